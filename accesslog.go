@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Formats of the access log, see ACCESS_LOG_FORMAT
+var accessLogFormats = []string{"text", "combined", "json"}
+
+// One line of the access log. Like the text format it has the route
+// pattern instead of the raw path, so IDs do not end up in the logs.
+type AccessEntry struct {
+	Time       time.Time     `json:"time"`
+	Method     string        `json:"method"`
+	Route      string        `json:"route"`
+	PathHash   string        `json:"path_hash,omitempty"` // With LOG_PATH_HASH
+	Proto      string        `json:"proto"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"-"`
+	DurationMS float64       `json:"duration_ms"`
+	RemoteAddr string        `json:"remote_addr"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+}
+
+// Where and how Logging writes the requests
+type AccessLog struct {
+	format string
+	out    io.Writer   // Nil for the application log
+	logger *log.Logger // Of the text format when out is set
+}
+
+// Text lines on the application log until main sets ACCESS_LOG up
+var accessLog = &AccessLog{format: "text"}
+
+// out nil writes on the application log, which LOG_LEVEL silences below info
+func NewAccessLog(format string, out io.Writer) *AccessLog {
+	accessLog := &AccessLog{format: format, out: out}
+	if out != nil {
+		accessLog.logger = log.New(out, "", log.LstdFlags)
+	}
+	return accessLog
+}
+
+func (accessLog *AccessLog) Write(entry AccessEntry) {
+	if accessLog.out == nil && !logEnabled(LevelInfo) {
+		return
+	}
+
+	switch accessLog.format {
+	case "combined":
+		accessLog.writeLine(entry.combined())
+	case "json":
+		line, err := json.Marshal(entry)
+		if err != nil {
+			errorf("access log: %v", err)
+			return
+		}
+		accessLog.writeLine(string(line))
+	default:
+		fields := []interface{}{entry.Method, entry.Route, entry.Duration}
+		if entry.PathHash != "" {
+			fields = append(fields, "path="+entry.PathHash)
+		}
+		if accessLog.logger != nil {
+			accessLog.logger.Println(fields...)
+			return
+		}
+		log.Println(fields...)
+	}
+}
+
+// Lines of the formats that carry their own time
+func (accessLog *AccessLog) writeLine(line string) {
+	out := accessLog.out
+	if out == nil {
+		out = log.Writer()
+	}
+	io.WriteString(out, line+"\n")
+}
+
+// Apache combined: host ident user [time] "request" status bytes "referer" "user agent"
+func (entry AccessEntry) combined() string {
+	host, _, err := net.SplitHostPort(entry.RemoteAddr)
+	if err != nil {
+		host = entry.RemoteAddr
+	}
+
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = strconv.FormatInt(entry.Bytes, 10)
+	}
+
+	return fmt.Sprintf("%s - - [%s] %q %d %s %q %q",
+		host, entry.Time.Format("02/Jan/2006:15:04:05 -0700"), entry.Method+" "+entry.Route+" "+entry.Proto,
+		entry.Status, bytes, orDash(entry.Referer), orDash(entry.UserAgent))
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// Remembers the status and size of the response for the access log
+type accessLogResponse struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	bytes       int64
+}
+
+func (response *accessLogResponse) Unwrap() http.ResponseWriter {
+	return response.ResponseWriter
+}
+
+func (response *accessLogResponse) Flush() {
+	http.NewResponseController(response.ResponseWriter).Flush()
+}
+
+func (response *accessLogResponse) WriteHeader(status int) {
+	if !response.wroteHeader {
+		response.wroteHeader, response.status = true, status
+	}
+	response.ResponseWriter.WriteHeader(status)
+}
+
+func (response *accessLogResponse) Write(data []byte) (int, error) {
+	response.wroteHeader = true
+	written, err := response.ResponseWriter.Write(data)
+	response.bytes += int64(written)
+	return written, err
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// A user as the admins see it, with its lock
+type AdminUser struct {
+	User
+	Lock *UserLock `json:"lock,omitempty"`
+}
+
+func adminUser(user User) AdminUser {
+	view := AdminUser{User: publicUser(user)}
+	if user.Locked() {
+		lock := *user.Lock
+		lock.By = publicID("users", lock.By)
+		view.Lock = &lock
+	}
+	return view
+}
+
+// GET /admin/users, deleted users included
+func (app *App) AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Locked  bool `query:"locked"`  // Only the locked users
+		Deleted bool `query:"deleted"` // Only the deleted users
+		Limit   int  `query:"limit" validate:"min=1,max=1000"`
+		Offset  int  `query:"offset" validate:"min=0"`
+	}
+	if err := Bind(r, &params); err != nil {
+		Error(w, err)
+		return
+	}
+
+	users := make([]AdminUser, 0)
+	index := 0
+	err := eachUser(app.Store, func(user User) error {
+		if (params.Locked && !user.Locked()) || (params.Deleted && !user.Deleted()) {
+			return nil
+		}
+		if index++; index <= params.Offset {
+			return nil
+		}
+		if params.Limit > 0 && len(users) == params.Limit {
+			return errPageFull
+		}
+		users = append(users, adminUser(user))
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPageFull) {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, users)
+}
+
+type LockUserRequest struct {
+	Reason string `json:"reason" validate:"max=200"`
+}
+
+// POST /admin/users/{id}/lock ends the sessions of the user and refuses its
+// logins and API keys. Locking twice keeps the first lock.
+func (app *App) LockUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	var request LockUserRequest
+	if r.ContentLength != 0 {
+		if err := DecodeJSON(r, &request); err != nil {
+			Error(w, err)
+			return
+		}
+	}
+	if err := validateStruct(request); err != nil {
+		Error(w, ErrValidation(err))
+		return
+	}
+
+	admin, _ := currentUser(r)
+	if admin.ID == id {
+		Error(w, ErrUnprocessable("admins can not lock themselves"))
+		return
+	}
+
+	app.setLock(w, id, &UserLock{At: app.Clock.Now().UTC(), By: admin.ID, Reason: request.Reason})
+}
+
+// DELETE /admin/users/{id}/lock
+func (app *App) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	app.setLock(w, id, &UserLock{})
+}
+
+func (app *App) setLock(w http.ResponseWriter, id ID, lock *UserLock) {
+	user, err := app.Store.Get(id)
+	if err == nil && user.Deleted() {
+		err = ErrNotFound("user")
+	}
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	// Nothing to change, e.g. locked twice
+	if locking := !lock.At.IsZero(); user.Locked() == locking {
+		JSON(w, http.StatusOK, adminUser(user))
+		return
+	}
+
+	user.Lock = lock
+	if user, err = app.Store.Update(user); err != nil {
+		Error(w, err)
+		return
+	}
+	if user.Locked() {
+		app.alert("alert.lockout", publicUser(user), fmt.Sprintf("locked by admin %s: %s", publicID("users", lock.By), orDash(lock.Reason)))
+	}
+
+	JSON(w, http.StatusOK, adminUser(user))
+}
+
+// GET /admin/audit, the changes made to the users since the start, newest first
+func (app *App) AdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		UserID ID  `query:"user_id"` // Only the changes of this user
+		Limit  int `query:"limit" validate:"min=1,max=1000"`
+		Offset int `query:"offset" validate:"min=0"`
+	}
+	if err := Bind(r, &params); err != nil {
+		Error(w, err)
+		return
+	}
+
+	entries := app.Audit.Entries()
+	page := make([]AuditEntry, 0)
+	index := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if params.UserID != "" && entry.UserID != params.UserID {
+			continue
+		}
+		if index++; index <= params.Offset {
+			continue
+		}
+		if params.Limit > 0 && len(page) == params.Limit {
+			break
+		}
+
+		entry.UserID = publicID("users", entry.UserID)
+		if entry.User != nil {
+			user := publicUser(*entry.User)
+			entry.User = &user
+		}
+		page = append(page, entry)
+	}
+
+	JSON(w, http.StatusOK, page)
+}
+
+func GetMaintenance(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, currentMaintenance())
+}
+
+// PUT /admin/maintenance {"enabled": true, "message": "..."}
+func PutMaintenance(w http.ResponseWriter, r *http.Request) {
+	var mode MaintenanceMode
+	if err := DecodeJSON(r, &mode); err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, setMaintenance(mode))
+}
+
+type LogLevelRequest struct {
+	Level    string    `json:"level"`              // debug, info, warn or error
+	Duration string    `json:"duration,omitempty"` // e.g. "15m", then back to the level set without one
+	Until    time.Time `json:"until,omitzero"`     // Set in responses while the level is temporary
+}
+
+func GetLogLevel(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, LogLevelRequest{Level: currentLogLevel().String(), Until: currentLogLevelEnds()})
+}
+
+// PUT /admin/loglevel {"level": "debug", "duration": "15m"}, until the next
+// change or restart without a duration
+func PutLogLevel(w http.ResponseWriter, r *http.Request) {
+	var request LogLevelRequest
+	if err := DecodeJSON(r, &request); err != nil {
+		Error(w, err)
+		return
+	}
+
+	level, err := ParseLogLevel(request.Level)
+	if err != nil {
+		Error(w, &AppError{Status: http.StatusUnprocessableEntity, Message: err.Error(), Field: "level"})
+		return
+	}
+
+	if request.Duration == "" {
+		setLogLevel(level)
+		log.Printf("log level set to %s", level)
+		JSON(w, http.StatusOK, LogLevelRequest{Level: level.String()})
+		return
+	}
+
+	duration, err := time.ParseDuration(request.Duration)
+	if err != nil || duration <= 0 || duration > maxTemporaryLogLevel {
+		Error(w, &AppError{Status: http.StatusUnprocessableEntity, Message: fmt.Sprintf("duration must be positive and at most %s, e.g. \"15m\"", maxTemporaryLogLevel), Field: "duration"})
+		return
+	}
+	until := setLogLevelFor(level, duration)
+	log.Printf("log level set to %s until %s", level, until.Format(time.RFC3339))
+
+	JSON(w, http.StatusOK, LogLevelRequest{Level: level.String(), Duration: duration.String(), Until: until})
+}
+
+func GetChaos(w http.ResponseWriter, r *http.Request) {
+	settings, _ := currentChaos()
+	JSON(w, http.StatusOK, settings)
+}
+
+// PUT /admin/chaos {"error_percent": 10}, zero percentages turn it off
+func PutChaos(w http.ResponseWriter, r *http.Request) {
+	var settings ChaosSettings
+	if err := DecodeJSON(r, &settings); err != nil {
+		Error(w, err)
+		return
+	}
+
+	settings, err := setChaos(settings)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, settings)
+}
+
+// GET /admin/recordings, the last exchanges, newest first, or ?format=har
+// for an HTTP Archive to open in the browser devtools
+func (app *App) AdminRecordings(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Format string `query:"format" validate:"oneof=json har"`
+	}
+	if err := Bind(r, &params); err != nil {
+		Error(w, err)
+		return
+	}
+	if app.Recorder == nil {
+		Error(w, &AppError{Status: http.StatusNotFound, Message: "recording is off, set RECORD_REQUESTS to turn it on"})
+		return
+	}
+
+	exchanges := app.Recorder.Exchanges()
+	if params.Format == "har" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="recordings.har"`)
+		json.NewEncoder(w).Encode(harOf(exchanges))
+		return
+	}
+
+	slices.Reverse(exchanges)
+	JSON(w, http.StatusOK, exchanges)
+}
+
+// DELETE /admin/recordings
+func (app *App) ClearRecordings(w http.ResponseWriter, r *http.Request) {
+	if app.Recorder != nil {
+		app.Recorder.Clear()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Limits applied to the clients and how close they are to them
+type LimitsState struct {
+	Connections    *ConnStats          `json:"connections"` // Null when the listener has no limits
+	OutboundBudget OutboundBudgetState `json:"outbound_budget"`
+}
+
+type OutboundBudgetState struct {
+	MaxCalls    int    `json:"max_calls"`    // Per request, 0 means no limit
+	MaxDuration string `json:"max_duration"` // Per request
+	Exceeded    int64  `json:"exceeded"`     // Requests that ran out of it, since the start
+}
+
+// GET /admin/limits
+func AdminLimits(server *Server, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := LimitsState{
+			OutboundBudget: OutboundBudgetState{
+				MaxCalls:    config.OutboundMaxCalls,
+				MaxDuration: config.OutboundMaxDuration.String(),
+				Exceeded:    budgetExceeded.Value(),
+			},
+		}
+		if stats, ok := server.ConnStats(); ok {
+			state.Connections = &stats
+		}
+
+		JSON(w, http.StatusOK, state)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const apiKeyKey contextKey = "api_key"
+
+const (
+	apiKeyPrefix      = "ak_"
+	apiKeyPrefixShown = len(apiKeyPrefix) + 8 // Characters kept to tell the keys apart
+	apiKeyTouchEvery  = time.Minute           // LastUsedAt is only written this often
+)
+
+// Long lived credential of a user, sent in the X-API-Key header.
+// Only the hash of the secret is stored.
+type APIKey struct {
+	ID         ID        `json:"id"`
+	UserID     ID        `json:"user_id"`
+	Name       string    `json:"name"`
+	Prefix     string    `json:"prefix"`
+	Hash       string    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitzero"`
+	RevokedAt  time.Time `json:"revoked_at,omitzero"`
+}
+
+func (key APIKey) Revoked() bool {
+	return !key.RevokedAt.IsZero()
+}
+
+// How the stores persist a key, the hash stays out of the API JSON
+type apiKeyRecord struct {
+	APIKey
+	Hash string `json:"hash"`
+}
+
+func newAPIKeyRecord(key APIKey) apiKeyRecord {
+	return apiKeyRecord{APIKey: key, Hash: key.Hash}
+}
+
+func (record apiKeyRecord) key() APIKey {
+	key := record.APIKey
+	key.Hash = record.Hash
+	return key
+}
+
+// Implemented by the user stores next to UserStore
+type APIKeyStore interface {
+	CreateAPIKey(key APIKey) (APIKey, error)
+	ListAPIKeys(userID ID) ([]APIKey, error)
+	GetAPIKeyByHash(hash string) (APIKey, error)
+	RevokeAPIKey(userID ID, id ID) (APIKey, error)
+	TouchAPIKey(id ID, at time.Time) error
+	// Requests of the key on a day, 2006-01-02 in UTC, see APIKeyMeter
+	AddAPIKeyUsage(id ID, day string, requests int64) error
+	APIKeyUsage(id ID, since string) ([]APIKeyDay, error)
+}
+
+type CreateAPIKeyRequest struct {
+	Name string `json:"name"`
+}
+
+// The only response with the secret, it can not be read again
+type CreatedAPIKey struct {
+	APIKey
+	Secret string `json:"secret"`
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKeySecret() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+func ErrAPIKeyNotFound() *AppError {
+	return ErrNotFound("api key")
+}
+
+// Authenticates requests carrying an X-API-Key header as the owner of the key.
+// Requests without it go on untouched, RequireAuth then asks for a token.
+func (app *App) APIKeyAuth() Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			secret := r.Header.Get("X-API-Key")
+			if secret == "" {
+				nextMiddleware(w, r)
+				return
+			}
+
+			now := app.Clock.Now()
+			key, user, err := app.checkAPIKey(secret, now)
+			if err != nil {
+				Error(w, err)
+				return
+			}
+			usage, err := app.Meter.Use(key.ID, now)
+			writeQuotaHeaders(w, usage, err, now)
+			if err != nil {
+				Error(w, err)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), currentUserKey, user)
+			ctx = context.WithValue(ctx, apiKeyKey, key)
+			reportUser(w, user.ID)
+			nextMiddleware(w, r.WithContext(ctx))
+		}
+	}
+}
+
+func (app *App) checkAPIKey(secret string, now time.Time) (APIKey, User, error) {
+	invalid := ErrUnauthorized("invalid api key")
+
+	key, err := app.APIKeys.GetAPIKeyByHash(hashAPIKey(secret))
+	if err != nil || key.Revoked() {
+		return key, User{}, invalid
+	}
+
+	user, err := app.Store.Get(key.UserID)
+	if err != nil || user.Deleted() || user.Locked() {
+		return key, User{}, invalid
+	}
+
+	if now.Sub(key.LastUsedAt) >= apiKeyTouchEvery {
+		if err := app.APIKeys.TouchAPIKey(key.ID, now.UTC()); err != nil {
+			warnf("api key last used: %v", err)
+		}
+	}
+
+	return key, user, nil
+}
+
+func (app *App) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	var request CreateAPIKeyRequest
+	if err := DecodeJSON(r, &request); err != nil {
+		Error(w, err)
+		return
+	}
+
+	if strings.TrimSpace(request.Name) == "" {
+		Error(w, &AppError{Status: http.StatusUnprocessableEntity, Message: "is required", Field: "name"})
+		return
+	}
+
+	secret, err := newAPIKeySecret()
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	key, err := app.APIKeys.CreateAPIKey(APIKey{
+		UserID: userID,
+		Name:   request.Name,
+		Prefix: secret[:apiKeyPrefixShown],
+		Hash:   hashAPIKey(secret),
+	})
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusCreated, CreatedAPIKey{APIKey: publicAPIKey(key), Secret: secret})
+}
+
+// Keys of the authenticated user, revoked ones included
+func (app *App) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	keys, err := app.APIKeys.ListAPIKeys(userID)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	for i := range keys {
+		keys[i] = publicAPIKey(keys[i])
+	}
+
+	JSON(w, http.StatusOK, keys)
+}
+
+// Revoked keys stay listed so their use can still be audited
+func (app *App) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	key, err := app.APIKeys.RevokeAPIKey(userID, ID(PathParam(r, "id")))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, publicAPIKey(key))
+}
+
+func publicAPIKey(key APIKey) APIKey {
+	key.UserID = publicID("users", key.UserID)
+	return key
+}
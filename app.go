@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// What the handlers, middleware and background tasks share. main builds one
+// from the config, tests build as many as they need. Settings of the wire
+// format, like the ID strategy or the token secret, stay package-wide.
+type App struct {
+	Config *Config
+	Clock  Clock
+
+	Store    UserStore // Publishes the events, encrypts with ENCRYPTION_KEYS
+	APIKeys  APIKeyStore
+	Webhooks WebhookStore
+	Blobs    BlobStore
+
+	Bus        *EventBus
+	Events     *EventBroker // The user events of the streams
+	Queue      TaskQueue
+	Jobs       *JobRunner
+	Dispatcher *WebhookDispatcher
+	Scheduler  *Scheduler
+	Audit      *AuditLog
+	Recorder   *RequestRecorder // Nil unless RECORD_REQUESTS is set
+	Meter      *APIKeyMeter
+	Mailer     Mailer
+
+	notifiers          map[string]Notifier // From NOTIFY_CHANNELS and NOTIFY_ROUTES
+	notificationRoutes []NotificationRoute
+
+	alertsMutex sync.Mutex
+	alertsSent  map[string]time.Time // Event and message -> last sent
+
+	oauthMutex  sync.Mutex
+	oauthStates map[string]oauthState // Logins waiting for the callback of their provider
+}
+
+// Builds the stores, queue and subscribers the config asks for. base is the
+// store of the users, API keys and webhooks, e.g. from newStore.
+func NewApp(config *Config, base UserStore, clock Clock) (*App, error) {
+	app := &App{
+		Config:      config,
+		Clock:       clock,
+		Events:      NewEventBroker(),
+		Scheduler:   NewScheduler(),
+		alertsSent:  make(map[string]time.Time),
+		oauthStates: make(map[string]oauthState),
+	}
+
+	// Emails and phones are encrypted under the events, handlers see them plain
+	users, err := encryptStore(base, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every write is published as a domain event, the side effects subscribe
+	app.Bus = NewEventBus()
+	app.Store = NewPublishingStore(users, app.Bus)
+
+	var ok bool
+	if app.APIKeys, ok = base.(APIKeyStore); !ok {
+		return nil, fmt.Errorf("the %s store can not keep api keys", config.Store)
+	}
+	app.Meter = NewAPIKeyMeter(app.APIKeys, config.APIKeyDailyQuota, config.APIKeyMonthlyQuota)
+	if app.Webhooks, ok = base.(WebhookStore); !ok {
+		return nil, fmt.Errorf("the %s store can not keep webhooks", config.Store)
+	}
+
+	app.Mailer = LogMailer{}
+	if config.SMTPURL != "" {
+		if app.Mailer, err = NewSMTPMailer(config.SMTPURL, config.MailFrom, clock); err != nil {
+			return nil, err
+		}
+	}
+	if err := app.setupNotifications(config); err != nil {
+		return nil, err
+	}
+
+	if app.Blobs, err = NewDiskBlobStore(config.AvatarDir); err != nil {
+		return nil, err
+	}
+	if config.RecordRequests > 0 {
+		app.Recorder = NewRequestRecorder(config.RecordRequests, config.RecordBodyLimit)
+	}
+
+	// Background work of the webhooks, notifications and jobs
+	app.Queue = NewMemoryQueue(config.QueueWorkers)
+	app.Queue.Handle("notification", app.deliverNotification, notificationOptions)
+	app.Queue.Handle("email", app.deliverEmail, emailOptions)
+	app.Dispatcher = NewWebhookDispatcher(app.Queue, app.Webhooks, clock, config.WebhookMaxAttempts, config.WebhookRetryDelay)
+	app.Jobs = NewJobRunner(app.Queue, NewMemoryJobStore(), config.JobWorkers)
+
+	// Keeps the history of every change for ?as_of= reads
+	app.Audit = NewAuditLog()
+	app.Bus.Subscribe("audit", app.Audit.Record)
+	// Pushed to the clients of GET /api/events, the WebSocket and gRPC
+	app.Bus.Subscribe("streams", app.streamUserEvent, "user.created", "user.updated", "user.deleted", "user.restored")
+	app.Bus.Subscribe("webhooks", app.Dispatcher.OnEvent, "user.created", "user.updated", "user.deleted", "user.restored")
+	app.Bus.Subscribe("notifications", app.notifyUserEvent, "user.signup", "user.created", "user.updated", "user.deleted", "user.restored")
+	app.Bus.Subscribe("welcome_email", app.sendWelcomeEmail, "user.signup")
+
+	return app, nil
+}
+
+// Stops the background work within ctx, what produces work first. The store
+// is left to its owner.
+func (app *App) Close(ctx context.Context) error {
+	var firstErr error
+	for _, stop := range []func(ctx context.Context) error{app.Scheduler.Stop, app.Bus.Close, app.Queue.Drain, app.Jobs.Close} {
+		if err := stop(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	app.Events.Close()
+	return firstErr
+}
+
+// Applies the middleware of every route to server, in the order main serves
+// them, and returns their names
+func (app *App) Middleware(server *Server) ([]string, error) {
+	config := app.Config
+	var middleware []string
+
+	// Any origin by default, CORS_ORIGINS lists the allowed ones
+	if len(config.CORSOrigins) > 0 {
+		err := server.EnableCORS(CORSOptions{
+			AllowedOrigins:   config.CORSOrigins,
+			AllowCredentials: config.CORSCredentials,
+			MaxAge:           600,
+		})
+		if err != nil {
+			return nil, err
+		}
+		middleware = append(middleware, "cors")
+	}
+
+	server.Use(OutboundBudget(config.OutboundMaxCalls, config.OutboundMaxDuration))
+	middleware = append(middleware, "outbound_budget")
+
+	if config.ShadowURL != "" {
+		server.Use(Shadow(ShadowOptions{
+			Target:      config.ShadowURL,
+			Percent:     config.ShadowPercent,
+			Timeout:     config.ShadowTimeout,
+			Concurrency: config.ShadowConcurrency,
+		}))
+		middleware = append(middleware, "shadow")
+	}
+
+	// Toggled from /admin/maintenance, the admin routes keep working
+	server.Use(Maintenance())
+	middleware = append(middleware, "maintenance")
+
+	// Fault injection, see setChaos
+	server.Use(Chaos())
+	middleware = append(middleware, "chaos")
+
+	server.Use(NegotiateContent())
+	middleware = append(middleware, "content_negotiation")
+
+	// Logs in requests with an X-API-Key header, before RequireAuth runs
+	server.Use(app.APIKeyAuth())
+	middleware = append(middleware, "api_key_auth")
+
+	// /api/v1/... and Accept-Version: 1 get the old shapes
+	server.VersionedPaths("/api")
+	server.Use(APIVersioning())
+	middleware = append(middleware, "api_versioning")
+
+	// Every request gets an X-Request-ID, the 5xx and panics go to errorReporter
+	server.Use(app.RecoverPanic())
+	server.Use(ReportErrors())
+	middleware = append(middleware, "recover_panic", "report_errors")
+
+	// Outermost, records what the clients sent and got
+	if app.Recorder != nil {
+		server.Use(app.Recorder.Middleware())
+		middleware = append(middleware, "recorder")
+	}
+
+	return middleware, nil
+}
+
+// Registers the routes of the API, the admin and the docs on server
+func (app *App) Routes(server *Server) error {
+	if app.Config.SPA {
+		files, _ := fs.Sub(webAssets, "web")
+		spa, err := NewSPA(files)
+		if err != nil {
+			return err
+		}
+		// The paths of the app are only known to it, every unknown one gets index.html
+		server.Handle("GET", "/", spa.ServeHTTP)
+		server.Handle("HEAD", "/", spa.ServeHTTP)
+		server.Fallback(server.AddMiddleware(spa.ServeHTTP, Logging()))
+	} else {
+		server.Handle("GET", "/", HandlerRoot)
+	}
+	server.Handle("GET", "/api", server.AddMiddleware(HandlerHome, app.RequireAuth(), Logging()))
+	server.Handle("POST", "/api", server.AddMiddleware(HandlerHome, app.RequireAuth(), Logging()))
+	server.Handle("GET", "/user", server.AddMiddleware(app.UserGetRequest, RequirePermission(PermReadUsers), app.RequireAuth(), TranslateResponse())).
+		Named("list_users", "List every user").
+		Schemas(nil, []User{}).
+		WithExample(Example{Name: "users", Status: http.StatusOK, Response: APIResponse{Success: true, Data: []User{exampleUser}}})
+	server.Handle("POST", "/user", server.AddMiddleware(Wrap(app.CreateUser), RequirePermission(PermWriteUsers), app.RequireAuth(), TranslateResponse())).
+		Named("create_user", "Create a user").
+		Schemas(User{}, User{}).
+		WithExample(Example{Name: "created", Request: exampleNewUser, Status: http.StatusOK, Response: APIResponse{Success: true, Data: exampleUser}}).
+		WithExample(exampleError(http.StatusBadRequest, "field 'email' expects a string at offset 31")).
+		WithExample(exampleError(http.StatusUnprocessableEntity, "email: is required"))
+
+	// Operational endpoints for the admins
+	admin := server.Group("/admin", RequirePermission(PermAdmin), app.RequireAuth(), TranslateResponse(), Logging())
+	admin.Handle("GET", "/users", app.AdminListUsers).
+		Named("admin_list_users", "Every user with its lock, ?locked=true and ?deleted=true filter them").
+		Schemas(nil, []AdminUser{})
+	admin.Handle("POST", "/users/{id}/lock", app.LockUser).
+		Named("lock_user", "Lock a user out, its sessions end and its logins and API keys are refused").
+		Schemas(LockUserRequest{}, AdminUser{})
+	admin.Handle("DELETE", "/users/{id}/lock", app.UnlockUser).
+		Named("unlock_user", "Let a locked user log in again").
+		Schemas(nil, AdminUser{})
+	admin.Handle("GET", "/audit", app.AdminAuditLog).
+		Named("audit_log", "The changes made to the users since the start, newest first").
+		Schemas(nil, []AuditEntry{})
+	admin.Handle("GET", "/maintenance", GetMaintenance).
+		Named("get_maintenance", "Whether maintenance mode is on").
+		Schemas(nil, MaintenanceMode{})
+	admin.Handle("PUT", "/maintenance", PutMaintenance).
+		Named("set_maintenance", "Turn maintenance mode on or off, the API answers 503 outside /admin while on").
+		Schemas(MaintenanceMode{}, MaintenanceMode{})
+	admin.Handle("GET", "/loglevel", GetLogLevel).
+		Named("get_log_level", "The current log level").
+		Schemas(nil, LogLevelRequest{})
+	admin.Handle("PUT", "/loglevel", PutLogLevel).
+		Named("set_log_level", "Change the log level until the next change or restart").
+		Schemas(LogLevelRequest{}, LogLevelRequest{})
+	admin.Handle("GET", "/chaos", GetChaos).
+		Named("get_chaos", "The faults injected into the requests").
+		Schemas(nil, ChaosSettings{})
+	admin.Handle("PUT", "/chaos", PutChaos).
+		Named("set_chaos", "Inject latency, errors or dropped connections into a share of the requests, for tests").
+		Schemas(ChaosSettings{}, ChaosSettings{})
+	admin.Handle("GET", "/recordings", app.AdminRecordings).
+		Named("admin_recordings", "The last requests and responses with the secrets redacted, ?format=har for an HTTP Archive").
+		Schemas(nil, []RecordedExchange{})
+	admin.Handle("DELETE", "/recordings", app.ClearRecordings).
+		Named("clear_recordings", "Forget the recorded requests")
+	admin.Handle("GET", "/limits", AdminLimits(server, app.Config)).
+		Named("admin_limits", "The connection limits and outbound budget, with the current usage").
+		Schemas(nil, LimitsState{})
+
+	server.AddHealthCheck("store", HealthCheckFunc(app.storeHealthCheck))
+
+	server.Handle("GET", "/health", HealthHandler(server.health))
+	server.Handle("GET", "/healthz", LivenessHandler)
+	server.Handle("GET", "/readyz", ReadinessHandler(server.health))
+
+	server.Handle("POST", "/api/auth/signup", server.AddMiddleware(app.Signup, TranslateResponse(), Logging())).
+		Named("signup", "Create an account, the new user is a member").
+		Schemas(SignupRequest{}, User{}).
+		WithExample(exampleError(http.StatusUnprocessableEntity, "password: must have at least 8 characters"))
+	server.Handle("POST", "/api/auth/login", server.AddMiddleware(app.Login, TranslateResponse(), Logging())).
+		Named("login", "Trade an email and password for a bearer token").
+		Schemas(LoginRequest{}, LoginResponse{}).
+		WithExample(exampleAppError(ErrUnauthorized("invalid email or password").WithCode(CodeInvalidCredentials)))
+	server.Handle("GET", "/api/auth/{provider}/login", server.AddMiddleware(app.OAuthLogin, TranslateResponse(), Logging())).
+		Named("oauth_login", "Redirect to the google or github login page")
+	server.Handle("GET", "/api/auth/{provider}/callback", server.AddMiddleware(app.OAuthCallback, TranslateResponse(), Logging())).
+		Named("oauth_callback", "Where the provider sends the user back, logs in or signs up by email").
+		Schemas(nil, LoginResponse{})
+	server.Handle("POST", "/api/auth/login/verify", server.AddMiddleware(app.LoginVerify, TranslateResponse(), Logging())).
+		Named("login_verify", "Second login step for users with two-factor authentication").
+		Schemas(LoginVerifyRequest{}, LoginResponse{}).
+		WithExample(exampleAppError(ErrInvalidCode()))
+	server.Handle("POST", "/api/me/2fa", server.AddMiddleware(app.EnrollTwoFactor, app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("enroll_2fa", "Start the two-factor enrollment, returns the TOTP secret").
+		Schemas(nil, TwoFactorEnrollment{})
+	server.Handle("POST", "/api/me/2fa/confirm", server.AddMiddleware(app.ConfirmTwoFactor, app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("confirm_2fa", "Enable two-factor with a first code, returns the backup codes").
+		Schemas(TwoFactorCodeRequest{}, BackupCodes{})
+	server.Handle("POST", "/api/me/2fa/backup-codes", server.AddMiddleware(app.RegenerateBackupCodes, app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("regenerate_backup_codes", "Replace the backup codes").
+		Schemas(TwoFactorCodeRequest{}, BackupCodes{})
+	server.Handle("DELETE", "/api/me/2fa", server.AddMiddleware(app.DisableTwoFactor, app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("disable_2fa", "Turn two-factor authentication off").
+		Schemas(TwoFactorCodeRequest{}, nil)
+	server.Handle("GET", "/api/me", server.AddMiddleware(HandlerE(app.GetMe).ServeHTTP, app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("get_me", "Get the authenticated user").
+		Schemas(nil, User{}).
+		WithExample(Example{Name: "found", Status: http.StatusOK, Response: APIResponse{Success: true, Data: exampleUser}})
+	server.Handle("PUT", "/api/me", server.AddMiddleware(Wrap(app.UpdateUser), RequirePermission(PermWriteSelf), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("update_me", "Replace every field of the authenticated user").
+		Schemas(User{}, User{}).
+		WithExample(Example{Name: "updated", Request: exampleNewUser, Status: http.StatusOK, Response: APIResponse{Success: true, Data: exampleUser}})
+	server.Handle("POST", "/api/me/password", server.AddMiddleware(app.ChangePassword, app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("change_password", "Change the password of the authenticated user, older tokens stop working").
+		Schemas(ChangePasswordRequest{}, LoginResponse{}).
+		WithExample(Example{Name: "weak", Request: ChangePasswordRequest{CurrentPassword: "old password 1", NewPassword: "short"}, Status: http.StatusUnprocessableEntity, Response: APIResponse{Error: &APIError{Code: CodeValidationFailed, Message: "must have at least 8 characters", Field: "new_password"}}})
+	server.Handle("POST", "/api/keys", server.AddMiddleware(app.CreateAPIKey, app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("create_api_key", "Create an API key, the secret is only returned here").
+		Schemas(CreateAPIKeyRequest{}, CreatedAPIKey{})
+	server.Handle("GET", "/api/keys", server.AddMiddleware(app.ListAPIKeys, app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("list_api_keys", "List the API keys of the authenticated user").
+		Schemas(nil, []APIKey{})
+	server.Handle("GET", "/api/keys/{id}/usage", server.AddMiddleware(Wrap(app.GetAPIKeyUsage), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("api_key_usage", "Requests made with an API key today, this month and on the last ?days=30 days, against its quotas").
+		Schemas(nil, APIKeyUsage{})
+	server.Handle("DELETE", "/api/keys/{id}", server.AddMiddleware(app.RevokeAPIKey, app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("revoke_api_key", "Revoke an API key").
+		Schemas(nil, APIKey{})
+	server.Handle("POST", "/api/webhooks", server.AddMiddleware(WrapStatus(http.StatusCreated, app.CreateWebhook), RequirePermission(PermManageWebhooks), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("create_webhook", "Register a URL for user events, the signing secret is only returned here").
+		Schemas(CreateWebhookRequest{}, CreatedWebhook{})
+	server.Handle("GET", "/api/webhooks", server.AddMiddleware(app.ListWebhooks, RequirePermission(PermManageWebhooks), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("list_webhooks", "List the registered webhooks").
+		Schemas(nil, []Webhook{})
+	server.Handle("GET", "/api/webhooks/{id}", server.AddMiddleware(app.GetWebhook, RequirePermission(PermManageWebhooks), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("get_webhook", "Get a webhook").
+		Schemas(nil, Webhook{})
+	server.Handle("DELETE", "/api/webhooks/{id}", server.AddMiddleware(app.DeleteWebhook, RequirePermission(PermManageWebhooks), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("delete_webhook", "Stop sending events to a webhook")
+	server.Handle("GET", "/api/webhooks/{id}/deliveries", server.AddMiddleware(app.ListWebhookDeliveries, RequirePermission(PermManageWebhooks), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("list_webhook_deliveries", "The last delivery attempts of a webhook, newest first").
+		Schemas(nil, []WebhookDelivery{})
+	server.Handle("GET", "/api/users", server.AddMiddleware(app.UserGetRequest, Coalesce(), RequirePermission(PermReadUsers), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("list_api_users", "List every user").
+		Schemas(nil, []User{})
+	server.Handle("POST", "/api/users", server.AddMiddleware(Wrap(app.CreateUser), RequirePermission(PermWriteUsers), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("create_api_user", "Create a user, for admins. Others sign up").
+		Schemas(User{}, User{})
+	server.Handle("POST", "/api/users/bulk", server.AddMiddleware(app.UserBulkCreate, RequirePermission(PermBulkUsers), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("bulk_create_users", "Create many users, with a result per user").
+		Schemas([]User{}, []BulkResult{}).
+		WithExample(Example{Name: "mixed", Request: []User{exampleNewUser, {Name: "No Email"}}, Status: http.StatusMultiStatus, Response: APIResponse{Success: true, Data: exampleBulkResults}})
+	server.Handle("DELETE", "/api/users/bulk", server.AddMiddleware(app.UserBulkDelete, RequirePermission(PermBulkUsers), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("bulk_delete_users", "Delete many users by ID or filter, dry_run only lists them").
+		Schemas(BulkDeleteRequest{}, BulkDeleteResponse{}).
+		WithExample(Example{Name: "dry run", Request: BulkDeleteRequest{Filter: &UserFilter{EmailSuffix: "@example.com"}, DryRun: true}, Status: http.StatusMultiStatus, Response: APIResponse{Success: true, Data: BulkDeleteResponse{DryRun: true, Results: []BulkResult{{Index: 0, Status: http.StatusOK, User: &exampleUser}}}}})
+	server.Handle("GET", "/api/users/export", server.AddMiddleware(app.ExportUsers, RequirePermission(PermBulkUsers), app.RequireAuth(), Logging())).
+		Named("export_users", "Download every user as CSV or JSON Lines")
+	server.Handle("POST", "/api/users/import", server.AddMiddleware(app.ImportUsers, RequirePermission(PermBulkUsers), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("import_users", "Create users from a CSV or JSON upload, upsert=true updates the ones with the same email").
+		Schemas(nil, ImportReport{})
+	server.Handle("GET", "/api/jobs/{id}", server.AddMiddleware(app.GetJob, app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("get_job", "Status and progress of an import or export sent with Prefer: respond-async").
+		Schemas(nil, Job{})
+	server.Handle("GET", "/api/jobs/{id}/result", server.AddMiddleware(app.GetJobResult, app.RequireAuth(), Logging())).
+		Named("get_job_result", "The file of a finished export job")
+	server.Handle("GET", "/api/users/{id}", server.AddMiddleware(app.GetUser, Coalesce(), RequirePermission(PermReadUsers), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("get_user", "Get a user").
+		Schemas(nil, User{}).
+		WithExample(Example{Name: "found", Status: http.StatusOK, Response: APIResponse{Success: true, Data: exampleUser}}).
+		WithExample(exampleError(http.StatusNotFound, "user not found"))
+	server.Handle("PUT", "/api/users/{id}", server.AddMiddleware(Wrap(app.UpdateUser), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("update_user", "Replace every field of a user").
+		Schemas(User{}, User{}).
+		WithExample(Example{Name: "updated", Request: exampleNewUser, Status: http.StatusOK, Response: APIResponse{Success: true, Data: exampleUser}}).
+		WithExample(exampleError(http.StatusPreconditionFailed, ErrPreconditionFailed().Message))
+	server.Handle("PATCH", "/api/users/{id}", server.AddMiddleware(app.PatchUser, app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("patch_user", "Change some fields of a user with JSON Merge Patch").
+		Schemas(User{}, User{}).
+		WithExample(Example{Name: "new phone", Request: map[string]string{"phone": "+1 555 0199"}, Status: http.StatusOK, Response: APIResponse{Success: true, Data: examplePatchedUser}})
+	server.Handle("DELETE", "/api/users/{id}", server.AddMiddleware(app.DeleteUser, RequirePermission(PermDeleteUsers), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("delete_user", "Delete a user, it can be restored later")
+	server.Handle("POST", "/api/users/{id}/restore", server.AddMiddleware(app.RestoreUser, RequirePermission(PermDeleteUsers), app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("restore_user", "Restore a deleted user").
+		Schemas(nil, User{}).
+		WithExample(Example{Name: "restored", Status: http.StatusOK, Response: APIResponse{Success: true, Data: exampleRestoredUser}}).
+		WithExample(exampleAppError(ErrNotDeleted()))
+	server.Handle("POST", "/api/users/{id}/avatar", server.AddMiddleware(app.UploadAvatar, app.RequireAuth(), TranslateResponse(), Logging())).
+		Named("upload_avatar", "Replace the avatar with a multipart \"file\" image").
+		Schemas(nil, AvatarResponse{}).
+		WithExample(exampleError(http.StatusUnsupportedMediaType, "upload a PNG, JPEG, GIF or WebP image"))
+	server.Handle("GET", "/api/users/{id}/avatar", server.AddMiddleware(app.GetAvatar, Logging())).
+		Named("get_avatar", "The avatar image, cacheable")
+	server.Handle("GET", "/api/events", server.AddMiddleware(app.UserEvents, RequirePermission(PermReadUsers), app.RequireAuth(), Logging())).
+		Named("user_events", "Server-Sent Events of every user created, updated, deleted or restored")
+	server.WebSocket("/api/ws", app.UserEventsSocket, RequirePermission(PermReadUsers), app.RequireAuth(), Logging()).
+		Named("user_events_socket", "The user events of /api/events over a WebSocket")
+
+	// Gateway to internal services, with the auth of the API
+	for _, entry := range app.Config.ProxyRoutes {
+		prefix, target, _ := parseProxyRoute(entry)
+		options := ProxyOptions{Target: target, StripPrefix: prefix, Timeout: app.Config.ProxyTimeout, Retries: app.Config.ProxyRetries}
+		if err := server.Proxy(prefix, options, app.RequireAuth(), Logging()); err != nil {
+			return err
+		}
+	}
+
+	server.Handle("GET", "/docs", DocsUI)
+	server.Handle("GET", "/docs/assets/{file}", DocsAsset)
+	server.Handle("GET", "/docs/openapi.json", server.OpenAPIHandler)
+	server.Handle("GET", "/docs/examples/{route}", server.ExamplesHandler)
+
+	return nil
+}
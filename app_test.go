@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// An App on a memory store with the default settings, settings replaces some
+// of them by env name. Its background work stops with the test.
+func newTestApp(t *testing.T, settings map[string]string) *App {
+	t.Helper()
+
+	values := map[string]string{"AVATAR_DIR": t.TempDir()}
+	for key, value := range settings {
+		values[key] = value
+	}
+	config, err := loadConfig("", "", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setupTokens("test secret of the access tokens", config.TokenTTL); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := NewFakeClock(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	app, err := NewApp(config, NewMemoryStore(clock), clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		app.Close(ctx)
+	})
+
+	return app
+}
+
+// A server with the middleware and routes of app, as main registers them
+func newTestServer(t *testing.T, app *App) *Server {
+	t.Helper()
+
+	server := NewServer(":0", app.Config)
+	if _, err := app.Middleware(server); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Routes(server); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// One change made to a user, User is nil for deletes
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	UserID ID        `json:"user_id"`
+	User   *User     `json:"user,omitempty"`
+}
+
+// AuditLog records every user write published on the event bus, so the
+// state of a user at a past time can be rebuilt. The history is kept in
+// memory and starts when the process starts.
+type AuditLog struct {
+	mutex   sync.RWMutex
+	entries []AuditEntry
+}
+
+func NewAuditLog() *AuditLog {
+	return &AuditLog{}
+}
+
+// Subscriber of the user events. Purged users are forgotten, so ?as_of=
+// reads can not bring them back.
+func (audit *AuditLog) Record(ctx context.Context, event Event) error {
+	entry := AuditEntry{Time: event.At}
+
+	switch data := event.Data.(type) {
+	case UserCreated:
+		entry.Action, entry.UserID, entry.User = "create", data.User.ID, &data.User
+	case UserUpdated:
+		entry.Action, entry.UserID, entry.User = "update", data.User.ID, &data.User
+	case UserDeleted:
+		entry.Action, entry.UserID = "delete", data.UserID
+	case UserRestored:
+		entry.Action, entry.UserID, entry.User = "restore", data.User.ID, &data.User
+	case UsersPurged:
+		audit.forget(data.UserIDs)
+		return nil
+	default:
+		return nil
+	}
+
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	audit.entries = append(audit.entries, entry)
+	return nil
+}
+
+func (audit *AuditLog) forget(ids []ID) {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	audit.entries = slices.DeleteFunc(audit.entries, func(entry AuditEntry) bool {
+		return slices.Contains(ids, entry.UserID)
+	})
+}
+
+// Rebuilds the user as it was at the given time
+func (audit *AuditLog) GetAsOf(id ID, at time.Time) (User, error) {
+	audit.mutex.RLock()
+	defer audit.mutex.RUnlock()
+
+	var state *User
+	for _, entry := range audit.entries {
+		if entry.Time.After(at) {
+			break
+		}
+		if entry.UserID == id {
+			state = entry.User
+		}
+	}
+
+	if state == nil {
+		return User{}, ErrNotFound("user")
+	}
+
+	return *state, nil
+}
+
+// Every change in order
+func (audit *AuditLog) Entries() []AuditEntry {
+	audit.mutex.RLock()
+	defer audit.mutex.RUnlock()
+
+	return append([]AuditEntry(nil), audit.entries...)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	claimsKey      contextKey = "claims"
+	currentUserKey contextKey = "current_user"
+)
+
+// Only HS256 is issued and accepted
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+var (
+	tokenSecret []byte
+	tokenTTL    time.Duration
+)
+
+// Compared against when the email is unknown, so both failures take as long
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password 1"), bcrypt.DefaultCost)
+
+// JWT payload of the access tokens
+type Claims struct {
+	Subject        string `json:"sub"` // Public ID of the user, an ID would reject obfuscated ones
+	IssuedAt       int64  `json:"iat"`
+	ExpiresAt      int64  `json:"exp"`
+	SessionVersion int64  `json:"sv"` // User.SessionVersion when the token was issued
+
+	// Empty for access tokens, "mfa" for the tokens that only allow the second login step
+	Purpose string `json:"purpose,omitempty"`
+}
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// Users with two-factor authentication get an mfa_token instead of the access
+// token, to send with a code to POST /api/auth/login/verify
+type LoginResponse struct {
+	AccessToken string `json:"access_token,omitempty"`
+	TokenType   string `json:"token_type,omitempty"`
+	MFARequired bool   `json:"mfa_required,omitempty"`
+	MFAToken    string `json:"mfa_token,omitempty"`
+	ExpiresIn   int64  `json:"expires_in"` // Seconds
+}
+
+// Without a secret a random one is used, tokens then stop working on restart
+func setupTokens(secret string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("TOKEN_TTL must be positive")
+	}
+	tokenTTL = ttl
+
+	if secret != "" {
+		tokenSecret = []byte(secret)
+		return nil
+	}
+
+	tokenSecret = make([]byte, 32)
+	if _, err := rand.Read(tokenSecret); err != nil {
+		return err
+	}
+	warnf("JWT_SECRET is not set, using a random one, tokens will not survive a restart")
+
+	return nil
+}
+
+func issueToken(user User, now time.Time) (string, Claims, error) {
+	return signClaims(Claims{
+		Subject:        string(publicID("users", user.ID)),
+		IssuedAt:       now.Unix(),
+		ExpiresAt:      now.Add(tokenTTL).Unix(),
+		SessionVersion: user.SessionVersion,
+	})
+}
+
+func signClaims(claims Claims) (string, Claims, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", claims, err
+	}
+
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + signToken(unsigned), claims, nil
+}
+
+func signToken(unsigned string) string {
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the signature and the expiry, the header must be the one issueToken writes
+func verifyToken(token string, now time.Time) (Claims, error) {
+	var claims Claims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return claims, errors.New("malformed token")
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(signToken(parts[0]+"."+parts[1]))) {
+		return claims, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.New("malformed token")
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.New("malformed token")
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, errors.New("token expired")
+	}
+
+	return claims, nil
+}
+
+// Rejects requests without a valid "Authorization: Bearer <token>" header or
+// API key, and tokens of deleted users or issued before a password change.
+// The claims of the token are available with AuthClaims.
+func (app *App) RequireAuth() Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// Already authenticated by APIKeyAuth
+			if _, ok := currentUser(r); ok {
+				nextMiddleware(w, r)
+				return
+			}
+
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" || token == r.Header.Get("Authorization") {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				Error(w, ErrUnauthorized("a bearer token is required"))
+				return
+			}
+
+			claims, err := verifyToken(token, app.Clock.Now())
+			if err == nil && claims.Purpose != "" {
+				err = errors.New("not an access token")
+			}
+			var user User
+			if err == nil {
+				user, err = app.checkSession(claims)
+			}
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				Error(w, ErrUnauthorized(err.Error()))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), claimsKey, claims)
+			ctx = context.WithValue(ctx, currentUserKey, user)
+			reportUser(w, user.ID)
+			nextMiddleware(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// Returns the user of the token as stored now
+func (app *App) checkSession(claims Claims) (User, error) {
+	id, ok := internalID("users", claims.Subject)
+	if !ok {
+		return User{}, errors.New("invalid token subject")
+	}
+
+	user, err := app.Store.Get(id)
+	if err != nil || user.Deleted() || user.Locked() || user.SessionVersion != claims.SessionVersion {
+		return User{}, errors.New("token revoked")
+	}
+
+	return user, nil
+}
+
+// Claims of the authenticated request, false outside RequireAuth
+func AuthClaims(r *http.Request) (Claims, bool) {
+	claims, ok := r.Context().Value(claimsKey).(Claims)
+	return claims, ok
+}
+
+// The authenticated user, loaded by RequireAuth
+func currentUser(r *http.Request) (User, bool) {
+	return contextUser(r.Context())
+}
+
+// Same for gRPC calls, loaded by the auth interceptors
+func contextUser(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(currentUserKey).(User)
+	return user, ok
+}
+
+// Internal ID of the authenticated user
+func currentUserID(r *http.Request) (ID, error) {
+	user, ok := currentUser(r)
+	if !ok {
+		return "", ErrUnauthorized("a bearer token is required")
+	}
+
+	return user.ID, nil
+}
+
+// Trades an email and password for an access token. Unknown emails, deleted
+// users and wrong passwords get the same answer.
+func (app *App) Login(w http.ResponseWriter, r *http.Request) {
+	var request LoginRequest
+	if err := DecodeJSON(r, &request); err != nil {
+		Error(w, err)
+		return
+	}
+
+	user, err := app.Store.GetByEmail(request.Email)
+	if errors.Is(err, ErrStatusNotFound) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(request.Password))
+		Error(w, ErrUnauthorized("invalid email or password").WithCode(CodeInvalidCredentials))
+		return
+	}
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	if !user.CheckPassword(request.Password) || user.Deleted() {
+		Error(w, ErrUnauthorized("invalid email or password").WithCode(CodeInvalidCredentials))
+		return
+	}
+
+	app.completeLogin(w, user)
+}
+
+// Answers a successful first login step, with the access token or, for users
+// with two-factor authentication, the mfa_token
+func (app *App) completeLogin(w http.ResponseWriter, user User) {
+	if user.Locked() {
+		Error(w, ErrForbidden("the account is locked, ask an admin").WithCode(CodeAccountLocked))
+		return
+	}
+
+	if user.TwoFactor.Active() {
+		token, claims, err := issueMFAToken(user, app.Clock.Now())
+		if err != nil {
+			Error(w, err)
+			return
+		}
+
+		JSON(w, http.StatusOK, LoginResponse{MFARequired: true, MFAToken: token, ExpiresIn: claims.ExpiresAt - claims.IssuedAt})
+		return
+	}
+
+	token, claims, err := issueToken(user, app.Clock.Now())
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, newLoginResponse(token, claims))
+}
+
+func newLoginResponse(token string, claims Claims) LoginResponse {
+	return LoginResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   claims.ExpiresAt - claims.IssuedAt,
+	}
+}
+
+// go run *.go token admin@example.com, token 42 or token --role admin prints
+// an access token of the user, for scripts and CI. --ttl 1h replaces TOKEN_TTL.
+// The token only works on servers with the same JWT_SECRET and store, a
+// memory store gets the SEED_FILE users as serve does.
+func runTokenCommand(config *Config, args []string) error {
+	set := flag.NewFlagSet("token", flag.ContinueOnError)
+	role := set.String("role", "", "the first active user with this role")
+	ttl := set.Duration("ttl", config.TokenTTL, "how long the token is valid")
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	if set.NArg() > 1 || (*role == "") == (set.NArg() == 0) {
+		return fmt.Errorf("usage: token [--ttl 1h] <email|id> or token [--ttl 1h] --role <role>")
+	}
+	if *ttl <= 0 {
+		return fmt.Errorf("--ttl must be positive")
+	}
+	if config.JWTSecret == "" {
+		return fmt.Errorf("JWT_SECRET is not set, the server would not accept a token signed with a random secret")
+	}
+
+	base, err := newStore(config, systemClock{})
+	if err != nil {
+		return err
+	}
+	// The file store would write its snapshot on Close, over the server's
+	if boltStore, ok := base.(*BoltStore); ok {
+		defer boltStore.Close()
+	}
+	users, err := encryptStore(base, config)
+	if err != nil {
+		return err
+	}
+	if config.Store == "memory" && config.SeedFile != "" {
+		if _, err := seedUsers(users, config.SeedFile); err != nil {
+			return err
+		}
+	}
+
+	user, err := tokenUser(users, set.Arg(0), Role(*role))
+	if err != nil {
+		return err
+	}
+
+	tokenTTL = *ttl
+	token, claims, err := issueToken(user, time.Now())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("token of %s (%s), expires at %s", user.Email, user.Role, time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	fmt.Println(token)
+	return nil
+}
+
+func tokenUser(userStore UserStore, value string, role Role) (User, error) {
+	var user User
+	var err error
+	switch {
+	case role != "":
+		err = eachUser(userStore, func(candidate User) error {
+			if candidate.Role != role || candidate.Deleted() || candidate.Locked() {
+				return nil
+			}
+			user = candidate
+			return errPageFull
+		})
+		if errors.Is(err, errPageFull) {
+			return user, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("no active user has the role %s", role)
+		}
+		return user, err
+	case strings.Contains(value, "@"):
+		user, err = userStore.GetByEmail(value)
+	default:
+		var id ID
+		if id, err = parseUserID(value); err == nil {
+			user, err = userStore.Get(id)
+		}
+	}
+	if err == nil && (user.Deleted() || user.Locked()) {
+		err = fmt.Errorf("%s is deleted or locked", value)
+	}
+	return user, err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Formats http.DetectContentType recognizes, the type is sniffed on upload and download
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+type AvatarResponse struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+func avatarKey(id ID) string {
+	return "avatars/" + string(id)
+}
+
+// Replaces the avatar with the multipart "file" upload, a PNG, JPEG, GIF or WebP image
+func (app *App) UploadAvatar(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	if err := canWriteUser(r.Context(), id); err != nil {
+		Error(w, err)
+		return
+	}
+
+	user, err := app.Store.Get(id)
+	if err == nil && user.Deleted() {
+		err = ErrNotFound("user")
+	}
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	// Room for the multipart headers around the file
+	r.Body = http.MaxBytesReader(w, r.Body, int64(app.Config.AvatarMaxSize)+64<<10)
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		Error(w, ErrBadRequest(fmt.Sprintf("a multipart file field is required: %v", err)))
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, int64(app.Config.AvatarMaxSize)+1))
+	if err != nil {
+		Error(w, ErrBadRequest(fmt.Sprintf("invalid file: %v", err)))
+		return
+	}
+
+	if len(data) > app.Config.AvatarMaxSize {
+		Error(w, &AppError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("avatars may have at most %d bytes", app.Config.AvatarMaxSize)})
+		return
+	}
+
+	// The declared type is not trusted
+	contentType := http.DetectContentType(data)
+	if !avatarTypes[contentType] {
+		Error(w, &AppError{Status: http.StatusUnsupportedMediaType, Message: "upload a PNG, JPEG, GIF or WebP image"})
+		return
+	}
+
+	if err := app.Blobs.Put(avatarKey(id), bytes.NewReader(data)); err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, AvatarResponse{
+		URL:         "/api/users/" + string(publicID("users", id)) + "/avatar",
+		ContentType: contentType,
+		Size:        int64(len(data)),
+	})
+}
+
+// Serves the avatar with Last-Modified and ETag, conditional requests get a 304
+// and byte ranges a 206
+func (app *App) GetAvatar(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	user, err := app.Store.Get(id)
+	if err == nil && user.Deleted() {
+		err = ErrNotFound("user")
+	}
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	blob, err := app.Blobs.Get(avatarKey(id))
+	if errors.Is(err, ErrBlobNotFound) {
+		Error(w, ErrNotFound("avatar"))
+		return
+	}
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	defer blob.Content.Close()
+
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+
+	// No name, the content type is sniffed
+	SendFile(w, r, blob.Content, FileInfo{
+		ModTime: blob.ModTime,
+		ETag:    `"` + strconv.FormatInt(blob.ModTime.UnixNano(), 36) + "-" + strconv.FormatInt(blob.Size, 36) + `"`,
+	})
+}
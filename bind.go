@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Converters of the parameter types that need more than strconv. IDs are
+// user IDs, `path:"id,raw"` takes the others, e.g. API key IDs, as they come.
+var paramParsers = map[reflect.Type]func(name string, value string) (interface{}, error){
+	reflect.TypeOf(ID("")): func(name string, value string) (interface{}, error) {
+		return parseUserID(value)
+	},
+	reflect.TypeOf(time.Time{}): func(name string, value string) (interface{}, error) {
+		parsed, err := parseTimestamp(value)
+		if err != nil {
+			return nil, ErrBadRequest(name + ": " + err.Error())
+		}
+		return parsed, nil
+	},
+}
+
+// Fills the fields of the struct v tagged `path:"id"`, `query:"include_deleted"`
+// or `header:"If-Match"` and checks their validate tags. The raw option skips the conversion of
+// paramParsers, e.g. `path:"id,raw"` is not decoded as a user ID. Missing parameters leave the zero value,
+// repeated query parameters fill slices. A value that does not convert is a 400.
+//
+//	var params struct {
+//		ID    ID        `path:"id"`
+//		AsOf  time.Time `query:"as_of"`
+//		Limit int       `query:"limit" validate:"min=1,max=100"`
+//	}
+//	if err := Bind(r, &params); err != nil {
+func Bind(r *http.Request, v interface{}) error {
+	if err := bindParams(r, v); err != nil {
+		return err
+	}
+
+	if err := validateStruct(v); err != nil {
+		return ErrValidation(err)
+	}
+
+	return nil
+}
+
+// The binding of Bind without the validation, Wrap validates once the body is in
+func bindParams(r *http.Request, v interface{}) error {
+	target := reflect.ValueOf(v).Elem()
+	query := r.URL.Query()
+
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Type().Field(i)
+
+		var values []string
+		if tag, ok := field.Tag.Lookup("path"); ok {
+			value := PathParam(r, paramName(field))
+			if _, option, _ := strings.Cut(tag, ","); option == "raw" {
+				target.Field(i).SetString(value)
+				continue
+			}
+			// Routes without the parameter, e.g. /api/me sharing the request of /api/users/{id}
+			if value != "" {
+				values = []string{value}
+			}
+		} else if name, ok := field.Tag.Lookup("query"); ok {
+			values = query[name]
+		} else if name, ok := field.Tag.Lookup("header"); ok {
+			values = r.Header.Values(name)
+		} else {
+			continue
+		}
+
+		if err := setParam(target.Field(i), paramName(field), values); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setParam(field reflect.Value, name string, values []string) error {
+	if len(values) == 0 || values[0] == "" && field.Kind() != reflect.String {
+		return nil
+	}
+
+	if field.Kind() == reflect.Slice && field.Type() != reflect.TypeOf([]byte(nil)) {
+		items := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setParam(items.Index(i), name, []string{value}); err != nil {
+				return err
+			}
+		}
+		field.Set(items)
+		return nil
+	}
+
+	value := values[0]
+
+	if parse, ok := paramParsers[field.Type()]; ok {
+		parsed, err := parse(name, value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(parsed))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return ErrBadRequest(name + " must be true or false")
+		}
+		field.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return ErrBadRequest(name + " must be an integer")
+		}
+		field.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return ErrBadRequest(name + " must be a positive integer")
+		}
+		field.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return ErrBadRequest(name + " must be a number")
+		}
+		field.SetFloat(parsed)
+	default:
+		panic(fmt.Sprintf("parameter %s has unsupported type %s", name, field.Type()))
+	}
+
+	return nil
+}
+
+// Name of the parameter in the path or query
+func paramName(field reflect.StructField) string {
+	if tag, ok := field.Tag.Lookup("path"); ok {
+		name, _, _ := strings.Cut(tag, ",")
+		return name
+	}
+	if name, ok := field.Tag.Lookup("header"); ok {
+		return name
+	}
+	return field.Tag.Get("query")
+}
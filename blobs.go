@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// Stores files by key, e.g. avatars/1. Keys use / whatever the backend.
+type BlobStore interface {
+	Put(key string, content io.Reader) error
+	Get(key string) (Blob, error) // ErrBlobNotFound when missing, the caller closes the content
+	Delete(key string) error
+}
+
+type Blob struct {
+	Content io.ReadSeekCloser
+	Size    int64
+	ModTime time.Time
+}
+
+// Keeps the blobs as files under a directory
+type DiskBlobStore struct {
+	dir string
+}
+
+func NewDiskBlobStore(dir string) (*DiskBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskBlobStore{dir: dir}, nil
+}
+
+func (blobs *DiskBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if key == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.New("invalid blob key " + key)
+	}
+	return filepath.Join(blobs.dir, clean), nil
+}
+
+// Writes to a temporary file first so readers never see half a blob
+func (blobs *DiskBlobStore) Put(key string, content io.Reader) error {
+	path, err := blobs.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func (blobs *DiskBlobStore) Get(key string) (Blob, error) {
+	path, err := blobs.path(key)
+	if err != nil {
+		return Blob{}, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return Blob{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return Blob{}, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return Blob{}, err
+	}
+
+	return Blob{Content: file, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (blobs *DiskBlobStore) Delete(key string) error {
+	path, err := blobs.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
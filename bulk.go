@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests with more users are rejected, split bigger imports in batches
+const maxBulkUsers = 1000
+
+// Outcome of one item of a bulk request, in the same order as the request
+type BulkResult struct {
+	Index  int       `json:"index"`
+	Status int       `json:"status"`
+	User   *User     `json:"user,omitempty"`
+	Error  *APIError `json:"error,omitempty"`
+}
+
+// Creates every user of the array independently, one failing does not stop
+// the others. Always answers 207 Multi-Status with a result per item.
+func (app *App) UserBulkCreate(w http.ResponseWriter, r *http.Request) {
+	var users []User
+	if err := DecodeBody(r, &users); err != nil {
+		Error(w, err)
+		return
+	}
+
+	if len(users) == 0 {
+		Error(w, ErrBadRequest("no users to create"))
+		return
+	}
+
+	if len(users) > maxBulkUsers {
+		Error(w, &AppError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("at most %d users per request", maxBulkUsers)})
+		return
+	}
+
+	results := make([]BulkResult, len(users))
+	for i, user := range users {
+		results[i] = app.bulkCreate(r, i, user)
+	}
+
+	JSON(w, http.StatusMultiStatus, results)
+}
+
+func (app *App) bulkCreate(r *http.Request, index int, user User) BulkResult {
+	if err := user.Validate(); err != nil {
+		recordValidationFailure(r, err)
+		return bulkFailure(index, ErrValidation(err))
+	}
+
+	user, err := app.Store.Create(user)
+	if err != nil {
+		return bulkFailure(index, err)
+	}
+
+	user = publicUser(user)
+	return BulkResult{Index: index, Status: http.StatusCreated, User: &user}
+}
+
+// Body of DELETE /api/users/bulk, either ids or filter must be set
+type BulkDeleteRequest struct {
+	IDs    []json.RawMessage `json:"ids,omitempty"` // Numbers or strings, like the IDs in the responses
+	Filter *UserFilter       `json:"filter,omitempty"`
+	DryRun bool              `json:"dry_run"`
+}
+
+// Users matching every set field are selected
+type UserFilter struct {
+	EmailSuffix   string `json:"email_suffix,omitempty"`
+	NameContains  string `json:"name_contains,omitempty"`
+	CreatedBefore string `json:"created_before,omitempty"` // RFC 3339
+}
+
+type BulkDeleteResponse struct {
+	DryRun  bool         `json:"dry_run"`
+	Results []BulkResult `json:"results"`
+}
+
+// Deletes the listed users, or the ones matching the filter. With dry_run
+// nothing is deleted and the results list what would be.
+func (app *App) UserBulkDelete(w http.ResponseWriter, r *http.Request) {
+	var request BulkDeleteRequest
+	if err := DecodeJSON(r, &request); err != nil {
+		Error(w, err)
+		return
+	}
+
+	if (len(request.IDs) == 0) == (request.Filter == nil) {
+		Error(w, ErrBadRequest("send either ids or filter"))
+		return
+	}
+
+	if len(request.IDs) > maxBulkUsers {
+		Error(w, &AppError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("at most %d users per request", maxBulkUsers)})
+		return
+	}
+
+	results := []BulkResult{}
+	if request.Filter != nil {
+		matches, err := app.filterUsers(*request.Filter)
+		if err != nil {
+			Error(w, err)
+			return
+		}
+
+		for i, user := range matches {
+			results = append(results, app.bulkDelete(i, user, request.DryRun))
+		}
+	} else {
+		for i, raw := range request.IDs {
+			results = append(results, app.bulkDeleteID(i, raw, request.DryRun))
+		}
+	}
+
+	JSON(w, http.StatusMultiStatus, BulkDeleteResponse{DryRun: request.DryRun, Results: results})
+}
+
+func (app *App) bulkDeleteID(index int, raw json.RawMessage, dryRun bool) BulkResult {
+	value := string(raw)
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+
+	id, err := parseUserID(value)
+	if err != nil {
+		return bulkFailure(index, err)
+	}
+
+	user, err := app.Store.Get(id)
+	if err == nil && user.Deleted() {
+		err = ErrNotFound("user")
+	}
+	if err != nil {
+		return bulkFailure(index, err)
+	}
+
+	return app.bulkDelete(index, user, dryRun)
+}
+
+// Deletes the version that was read, a concurrent write makes it fail with 412
+func (app *App) bulkDelete(index int, user User, dryRun bool) BulkResult {
+	if !dryRun {
+		if err := app.Store.Delete(user.ID, user.Version); err != nil {
+			return bulkFailure(index, err)
+		}
+	}
+
+	user = publicUser(user)
+	return BulkResult{Index: index, Status: http.StatusOK, User: &user}
+}
+
+func (app *App) filterUsers(filter UserFilter) ([]User, error) {
+	if filter == (UserFilter{}) {
+		return nil, ErrBadRequest("the filter needs at least one field")
+	}
+
+	var before time.Time
+	if filter.CreatedBefore != "" {
+		var err error
+		if before, err = parseTimestamp(filter.CreatedBefore); err != nil {
+			return nil, ErrBadRequest("created_before: " + err.Error())
+		}
+	}
+
+	users, err := app.Store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []User
+	for _, user := range users {
+		if user.Deleted() {
+			continue
+		}
+		if filter.EmailSuffix != "" && !strings.HasSuffix(emailKey(user.Email), strings.ToLower(filter.EmailSuffix)) {
+			continue
+		}
+		if filter.NameContains != "" && !strings.Contains(strings.ToLower(user.Name), strings.ToLower(filter.NameContains)) {
+			continue
+		}
+		if !before.IsZero() && !user.CreatedAt.Before(before) {
+			continue
+		}
+		matches = append(matches, user)
+	}
+
+	return matches, nil
+}
+
+// Same mapping as Error, unknown errors are hidden behind a 500
+func bulkFailure(index int, err error) BulkResult {
+	appErr, ok := asAppError(err)
+	if !ok {
+		appErr = &AppError{Status: http.StatusInternalServerError, Message: "internal server error"}
+	}
+
+	return BulkResult{Index: index, Status: appErr.Status, Error: appErr.apiError()}
+}
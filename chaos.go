@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths chaos never touches, so it can still be turned off and checked
+var chaosExempt = []string{"/admin", "/health", "/healthz", "/readyz", "/debug", "/docs"}
+
+// Statuses of the injected errors, one picked at random
+var chaosStatuses = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// Faults injected into the requests to check how clients cope, e.g. their
+// retries. Set from the CHAOS_* variables, changed with PUT /admin/chaos.
+// Every percentage applies on its own, a request may be delayed then fail.
+type ChaosSettings struct {
+	Latency        string `json:"latency,omitempty"` // Longest delay added, e.g. "2s", each request waits a random part of it
+	LatencyPercent int    `json:"latency_percent" validate:"min=0,max=100"`
+	ErrorPercent   int    `json:"error_percent" validate:"min=0,max=100"` // Answered with a random 5xx
+	DropPercent    int    `json:"drop_percent" validate:"min=0,max=100"`  // Connection closed without an answer
+}
+
+func (settings ChaosSettings) enabled() bool {
+	return settings.LatencyPercent > 0 || settings.ErrorPercent > 0 || settings.DropPercent > 0
+}
+
+var (
+	chaosMutex   sync.RWMutex
+	chaos        ChaosSettings
+	chaosLatency time.Duration // Parsed chaos.Latency
+)
+
+func currentChaos() (ChaosSettings, time.Duration) {
+	chaosMutex.RLock()
+	defer chaosMutex.RUnlock()
+
+	return chaos, chaosLatency
+}
+
+func setChaos(settings ChaosSettings) (ChaosSettings, error) {
+	settings, latency, err := checkChaos(settings)
+	if err != nil {
+		return settings, err
+	}
+
+	chaosMutex.Lock()
+	defer chaosMutex.Unlock()
+
+	chaos, chaosLatency = settings, latency
+	return settings, nil
+}
+
+// Validates the settings and parses their latency
+func checkChaos(settings ChaosSettings) (ChaosSettings, time.Duration, error) {
+	if err := validateStruct(settings); err != nil {
+		return settings, 0, ErrValidation(err)
+	}
+
+	var latency time.Duration
+	if settings.Latency != "" {
+		var err error
+		if latency, err = time.ParseDuration(settings.Latency); err != nil || latency < 0 {
+			return settings, 0, &AppError{Status: http.StatusUnprocessableEntity, Message: fmt.Sprintf("latency %q is not a duration", settings.Latency), Field: "latency"}
+		}
+		settings.Latency = latency.String()
+	}
+	if settings.LatencyPercent > 0 && latency == 0 {
+		return settings, 0, &AppError{Status: http.StatusUnprocessableEntity, Message: "latency_percent needs a latency", Field: "latency"}
+	}
+
+	return settings, latency, nil
+}
+
+// Injects the faults of the ChaosSettings, except on chaosExempt. Meant for
+// development and test environments. The X-Chaos response header names the
+// faults a request got.
+func Chaos() Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			settings, latency := currentChaos()
+			if !settings.enabled() || underPath(r.URL.Path, chaosExempt) {
+				nextMiddleware(w, r)
+				return
+			}
+
+			var faults []string
+			if chance(settings.LatencyPercent) {
+				faults = append(faults, "latency")
+				select {
+				case <-time.After(rand.N(latency + 1)):
+				case <-r.Context().Done():
+					return
+				}
+			}
+
+			if chance(settings.DropPercent) {
+				// Ends the connection without a response, net/http does not log it
+				panic(http.ErrAbortHandler)
+			}
+
+			if chance(settings.ErrorPercent) {
+				faults = append(faults, "error")
+				w.Header().Set("X-Chaos", strings.Join(faults, ", "))
+				status := chaosStatuses[rand.IntN(len(chaosStatuses))]
+				Error(w, &AppError{Status: status, Message: "failure injected by chaos testing"})
+				return
+			}
+
+			if len(faults) > 0 {
+				w.Header().Set("X-Chaos", strings.Join(faults, ", "))
+			}
+			nextMiddleware(w, r)
+		}
+	}
+}
+
+// True for percent out of 100 calls
+func chance(percent int) bool {
+	return percent > 0 && rand.IntN(100) < percent
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Largest response handed to the requests that waited for it. Bigger ones,
+// e.g. a long user list, only go to the request that made them and the
+// others run the handler themselves.
+const coalesceMaxBody = 1 << 20
+
+// Request headers the responses depend on, on top of the path and query
+var coalesceVary = []string{"Accept", "Accept-Version", "If-None-Match"}
+
+var coalescedRequests = expvar.NewInt("coalesced_requests")
+
+var coalesceGroup singleflight.Group
+
+// What the first of the identical requests answered
+type sharedResponse struct {
+	status   int
+	header   http.Header // Only what the handler set, not the outer middleware
+	body     bytes.Buffer
+	complete bool // False once the body outgrew coalesceMaxBody
+}
+
+// Lets identical GET requests that arrive while one of them is being handled
+// wait for it and get a copy of its response, so N clients asking for the same
+// user make one store read. Requests are identical when the method, path,
+// query, coalesceVary headers and authenticated user are. Goes right around
+// the handler, the middleware of every request still runs.
+func Coalesce() Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				nextMiddleware(w, r)
+				return
+			}
+
+			handled := false
+			result, _, _ := coalesceGroup.Do(coalesceKey(r), func() (interface{}, error) {
+				handled = true
+				response := &sharedResponse{status: http.StatusOK, header: http.Header{}, complete: true}
+				nextMiddleware(&coalescingResponse{ResponseWriter: w, shared: response, before: w.Header().Clone()}, r)
+				return response, nil
+			})
+			if handled {
+				return
+			}
+
+			response := result.(*sharedResponse)
+			if !response.complete {
+				nextMiddleware(w, r)
+				return
+			}
+
+			coalescedRequests.Add(1)
+			for name, values := range response.header {
+				w.Header()[name] = slices.Clone(values)
+			}
+			w.WriteHeader(response.status)
+			if r.Method != http.MethodHead {
+				w.Write(response.body.Bytes())
+			}
+		}
+	}
+}
+
+func coalesceKey(r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(r.Method + " " + r.URL.Path + "?" + r.URL.Query().Encode())
+	for _, name := range coalesceVary {
+		key.WriteString("\n" + name + ": " + strings.Join(r.Header.Values(name), ", "))
+	}
+	if user, ok := currentUser(r); ok {
+		key.WriteString("\nuser: " + string(user.ID))
+	}
+	return key.String()
+}
+
+// Sends the response of the first request on as usual and keeps a copy of it
+// for the requests that waited
+type coalescingResponse struct {
+	http.ResponseWriter
+	shared      *sharedResponse
+	before      http.Header // Headers set before the handler ran
+	wroteHeader bool
+}
+
+func (response *coalescingResponse) Unwrap() http.ResponseWriter {
+	return response.ResponseWriter
+}
+
+func (response *coalescingResponse) Flush() {
+	http.NewResponseController(response.ResponseWriter).Flush()
+}
+
+func (response *coalescingResponse) WriteHeader(status int) {
+	if response.wroteHeader {
+		return
+	}
+	response.wroteHeader = true
+
+	response.shared.status = status
+	for name, values := range response.Header() {
+		if !slices.Equal(response.before[name], values) {
+			response.shared.header[name] = slices.Clone(values)
+		}
+	}
+
+	response.ResponseWriter.WriteHeader(status)
+}
+
+func (response *coalescingResponse) Write(data []byte) (int, error) {
+	response.WriteHeader(http.StatusOK)
+
+	shared := response.shared
+	if shared.complete {
+		if shared.body.Len()+len(data) > coalesceMaxBody {
+			shared.complete = false
+			shared.body = bytes.Buffer{}
+		} else {
+			shared.body.Write(data)
+		}
+	}
+
+	return response.ResponseWriter.Write(data)
+}
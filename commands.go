@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// What the binary does, serve when no command is given
+var commands = []string{"serve", "config", "migrate", "seed", "routes", "token", "encrypt", "version"}
+
+// Rejects unknown commands before anything is set up
+func checkCommand(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	switch command := args[0]; {
+	case !slices.Contains(commands, command):
+		return fmt.Errorf("unknown command %q, use one of %s", command, strings.Join(commands, ", "))
+	case command == "config" && (len(args) != 2 || (args[1] != "print" && args[1] != "check")):
+		return fmt.Errorf("usage: config print|check")
+	case (command == "serve" || command == "routes" || command == "encrypt" || command == "version") && len(args) > 1:
+		return fmt.Errorf("%s takes no arguments", command)
+	}
+	return nil
+}
+
+// go run *.go routes, the route table of each server
+func printRoutes(out io.Writer, servers map[string]*Server) {
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SERVER\tMETHOD\tPATH\tNAME\tSUMMARY")
+
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	printed := make(map[*Server]bool)
+	for _, name := range names {
+		server := servers[name]
+		// The ops routes are on the API unless OPS_PORT is set
+		if printed[server] {
+			continue
+		}
+		printed[server] = true
+
+		for _, route := range server.routes {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", name, route.Method, route.Path, orDash(route.Name), orDash(route.Summary))
+		}
+	}
+
+	table.Flush()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Version served when the client does not ask for one
+const currentAPIVersion = 2
+
+// Describes one change between an older API version and the current one
+type TranslationRule struct {
+	Unwrap  string            // Envelope field whose value replaces the whole body
+	Renames map[string]string // Current field name -> old field name
+}
+
+// Rules that turn a current response into the shape of an older version.
+// Version 1 returned resources and errors without the envelope.
+var legacyTranslations = map[int][]TranslationRule{
+	1: {
+		{Unwrap: "data"},
+		{Unwrap: "error"},
+	},
+}
+
+// Reads the version asked by the client from the Accept-Version header or the version query param
+func negotiateVersion(r *http.Request) int {
+	requested := r.Header.Get("Accept-Version")
+	if requested == "" {
+		requested = r.URL.Query().Get("version")
+	}
+
+	version, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(requested), "v"))
+	if err != nil {
+		return currentAPIVersion
+	}
+
+	if _, known := legacyTranslations[version]; !known {
+		return currentAPIVersion
+	}
+
+	return version
+}
+
+// Rewrites JSON responses for clients that negotiated an old version
+func TranslateResponse() Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			version := requestVersion(r)
+			if version == currentAPIVersion {
+				nextMiddleware(w, r)
+				return
+			}
+
+			recorder := &bufferedResponse{writer: w, header: w.Header(), status: http.StatusOK}
+			nextMiddleware(recorder, r)
+
+			body := recorder.body.Bytes()
+			if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+				body = translate(body, legacyTranslations[version])
+			}
+
+			w.Header().Del("Content-Length")
+			w.WriteHeader(recorder.status)
+			w.Write(body)
+		}
+	}
+}
+
+func translate(body []byte, rules []TranslationRule) []byte {
+	var document interface{}
+	if err := decodeNumbers(body, &document); err != nil {
+		return body
+	}
+
+	for _, rule := range rules {
+		if rule.Unwrap != "" {
+			if object, ok := document.(map[string]interface{}); ok {
+				if value, exists := object[rule.Unwrap]; exists {
+					document = value
+				}
+			}
+		}
+
+		if len(rule.Renames) > 0 {
+			document = renameFields(document, rule.Renames)
+		}
+	}
+
+	translated, err := json.Marshal(document)
+	if err != nil {
+		return body
+	}
+
+	return translated
+}
+
+// Applies the renames to every object, nested ones included
+func renameFields(document interface{}, renames map[string]string) interface{} {
+	switch value := document.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(value))
+		for key, field := range value {
+			if oldName, ok := renames[key]; ok {
+				key = oldName
+			}
+			renamed[key] = renameFields(field, renames)
+		}
+		return renamed
+	case []interface{}:
+		for i := range value {
+			value[i] = renameFields(value[i], renames)
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+// Keeps the handler output in memory so it can be rewritten
+type bufferedResponse struct {
+	writer http.ResponseWriter // The one the body ends up in
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (response *bufferedResponse) Unwrap() http.ResponseWriter {
+	return response.writer
+}
+
+// Nothing to flush, the body is sent once translated
+func (response *bufferedResponse) Flush() {}
+
+func (response *bufferedResponse) Header() http.Header {
+	return response.header
+}
+
+func (response *bufferedResponse) WriteHeader(status int) {
+	response.status = status
+}
+
+func (response *bufferedResponse) Write(data []byte) (int, error) {
+	return response.body.Write(data)
+}
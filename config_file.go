@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Reads a flat YAML, JSON or TOML file whose keys are the env names in any
+// case, e.g. port: ":8080" or cors_origins: [a, b]. Returns the raw values
+// by env name, lists joined with the field separator by loadConfig.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	document := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &document)
+	case ".json":
+		err = json.Unmarshal(data, &document)
+	case ".toml":
+		err = toml.Unmarshal(data, &document)
+	default:
+		return nil, fmt.Errorf("%s: config files must be .yaml, .yml, .json or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	values := make(map[string]interface{}, len(document))
+	for key, value := range document {
+		values[strings.ToUpper(key)] = value
+	}
+
+	return values, nil
+}
+
+// Turns a file value into the string an env variable would hold
+func configFileValue(value interface{}, separator string) (string, error) {
+	switch value := value.(type) {
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			text, err := configFileValue(item, separator)
+			if err != nil {
+				return "", err
+			}
+			items[i] = text
+		}
+		return strings.Join(items, separator), nil
+	case map[string]interface{}:
+		return "", fmt.Errorf("nested values are not supported")
+	case nil:
+		return "", nil
+	case float64:
+		// JSON numbers, 2097152 and not 2.097152e+06
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	default:
+		return fmt.Sprint(value), nil
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Listener level protections against clients that hog connections
+type ConnLimits struct {
+	MaxPerIP int           // Open connections allowed per client IP, 0 means no limit
+	MinRate  int           // Bytes per second a client must send its request headers at, 0 disables it
+	Grace    time.Duration // Time before MinRate is enforced
+}
+
+var (
+	connectionsRejected   = expvar.NewInt("connections_rejected")
+	connectionsSlowClosed = expvar.NewInt("connections_slow_closed")
+)
+
+const connKey contextKey = "conn"
+
+type limitListener struct {
+	net.Listener
+	limits ConnLimits
+	mutex  sync.Mutex
+	perIP  map[string]int
+	conns  map[*trackedConn]struct{}
+	done   chan struct{}
+}
+
+func newLimitListener(listener net.Listener, limits ConnLimits) *limitListener {
+	limited := &limitListener{
+		Listener: listener,
+		limits:   limits,
+		perIP:    make(map[string]int),
+		conns:    make(map[*trackedConn]struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if limits.MinRate > 0 {
+		go limited.watch()
+	}
+
+	return limited
+}
+
+// Closes the connections over the per IP limit as soon as they are accepted
+func (limited *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := limited.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+		limited.mutex.Lock()
+		if limited.limits.MaxPerIP > 0 && limited.perIP[ip] >= limited.limits.MaxPerIP {
+			limited.mutex.Unlock()
+			conn.Close()
+			connectionsRejected.Add(1)
+			continue
+		}
+
+		tracked := &trackedConn{Conn: conn, listener: limited, ip: ip}
+		limited.perIP[ip]++
+		limited.conns[tracked] = struct{}{}
+		limited.mutex.Unlock()
+
+		return tracked, nil
+	}
+}
+
+func (limited *limitListener) Close() error {
+	select {
+	case <-limited.done:
+	default:
+		close(limited.done)
+	}
+
+	return limited.Listener.Close()
+}
+
+func (limited *limitListener) release(tracked *trackedConn) {
+	limited.mutex.Lock()
+	defer limited.mutex.Unlock()
+
+	delete(limited.conns, tracked)
+	limited.perIP[tracked.ip]--
+	if limited.perIP[tracked.ip] <= 0 {
+		delete(limited.perIP, tracked.ip)
+	}
+}
+
+// Every second closes the connections sending their request headers slower than MinRate.
+// Bodies are not checked here, READ_TIMEOUT bounds them.
+func (limited *limitListener) watch() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-limited.done:
+			return
+		case now := <-ticker.C:
+			limited.mutex.Lock()
+			slow := []*trackedConn{}
+			for tracked := range limited.conns {
+				if tracked.tooSlow(now, limited.limits) {
+					slow = append(slow, tracked)
+				}
+			}
+			limited.mutex.Unlock()
+
+			for _, tracked := range slow {
+				connectionsSlowClosed.Add(1)
+				tracked.Close()
+			}
+		}
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	listener *limitListener
+	ip       string
+	bytes    int64 // Read since the connection was opened
+	once     sync.Once
+
+	mutex          sync.Mutex
+	inRequest      bool // Between the first byte of a request and the connection going idle
+	readingHeaders bool // Between the first byte of a request and the handler start
+	requestStart   time.Time
+	bytesAtStart   int64
+}
+
+func (tracked *trackedConn) Read(data []byte) (int, error) {
+	n, err := tracked.Conn.Read(data)
+	total := atomic.AddInt64(&tracked.bytes, int64(n))
+
+	if n > 0 {
+		tracked.mutex.Lock()
+		if !tracked.inRequest {
+			tracked.inRequest = true
+			tracked.readingHeaders = true
+			tracked.requestStart = time.Now()
+			tracked.bytesAtStart = total - int64(n)
+		}
+		tracked.mutex.Unlock()
+	}
+
+	return n, err
+}
+
+func (tracked *trackedConn) Close() error {
+	tracked.once.Do(func() { tracked.listener.release(tracked) })
+	return tracked.Conn.Close()
+}
+
+// Called when the headers are in and the handler starts
+func (tracked *trackedConn) headersRead() {
+	tracked.mutex.Lock()
+	defer tracked.mutex.Unlock()
+
+	tracked.readingHeaders = false
+}
+
+// Called when the response is done, the next byte starts a new request
+func (tracked *trackedConn) idle() {
+	tracked.mutex.Lock()
+	defer tracked.mutex.Unlock()
+
+	tracked.inRequest = false
+	tracked.readingHeaders = false
+}
+
+func (tracked *trackedConn) tooSlow(now time.Time, limits ConnLimits) bool {
+	tracked.mutex.Lock()
+	defer tracked.mutex.Unlock()
+
+	elapsed := now.Sub(tracked.requestStart)
+	if !tracked.readingHeaders || elapsed < limits.Grace {
+		return false
+	}
+
+	received := atomic.LoadInt64(&tracked.bytes) - tracked.bytesAtStart
+	return float64(received)/elapsed.Seconds() < float64(limits.MinRate)
+}
+
+// The tracked connection under conn, which ServeTLS wraps in a *tls.Conn
+func asTrackedConn(conn net.Conn) (*trackedConn, bool) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tracked, ok := conn.(*trackedConn)
+	return tracked, ok
+}
+
+// Tells the connection its headers were read, the router calls it before running the handler
+func markHandlerStarted(r *http.Request) {
+	conn, _ := r.Context().Value(connKey).(net.Conn)
+	if tracked, ok := asTrackedConn(conn); ok {
+		tracked.headersRead()
+	}
+}
+
+// Wraps the listener of the server with the limits
+func (server *Server) LimitConnections(limits ConnLimits) {
+	server.connLimits = &limits
+
+	server.httpServer.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		return context.WithValue(ctx, connKey, conn)
+	}
+
+	server.httpServer.ConnState = func(conn net.Conn, state http.ConnState) {
+		tracked, ok := asTrackedConn(conn)
+		if !ok {
+			return
+		}
+
+		switch state {
+		case http.StateIdle, http.StateHijacked, http.StateClosed:
+			tracked.idle()
+		}
+	}
+}
+
+// What the connection limits see, for GET /admin/limits
+type ConnStats struct {
+	MaxPerIP   int            `json:"max_per_ip"`  // 0 means no limit
+	MinRate    int            `json:"min_rate"`    // Bytes per second, 0 means disabled
+	Grace      string         `json:"grace"`       // Before MinRate is enforced
+	Open       int            `json:"open"`        // Connections open now
+	PerIP      map[string]int `json:"per_ip"`      // Open connections of every client IP
+	Rejected   int64          `json:"rejected"`    // Over MaxPerIP, since the start
+	SlowClosed int64          `json:"slow_closed"` // Under MinRate, since the start
+}
+
+// False before Bind or without limits
+func (server *Server) ConnStats() (ConnStats, bool) {
+	limited, ok := server.listener.(*limitListener)
+	if !ok {
+		return ConnStats{}, false
+	}
+
+	limited.mutex.Lock()
+	defer limited.mutex.Unlock()
+
+	stats := ConnStats{
+		MaxPerIP:   limited.limits.MaxPerIP,
+		MinRate:    limited.limits.MinRate,
+		Grace:      limited.limits.Grace.String(),
+		Open:       len(limited.conns),
+		PerIP:      make(map[string]int, len(limited.perIP)),
+		Rejected:   connectionsRejected.Value(),
+		SlowClosed: connectionsSlowClosed.Value(),
+	}
+	for ip, count := range limited.perIP {
+		stats.PerIP[ip] = count
+	}
+
+	return stats, true
+}
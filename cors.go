@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Cross origin rules. "*" allows any origin, but browsers reject it together with
+// credentials, so with AllowCredentials the allowed origins are echoed one by one.
+type CORSOptions struct {
+	AllowedOrigins   []string
+	AllowCredentials bool
+	AllowedHeaders   []string
+	MaxAge           int // Seconds browsers may cache a preflight
+}
+
+func (options *CORSOptions) Validate() error {
+	if !options.AllowCredentials {
+		return nil
+	}
+
+	for _, origin := range options.AllowedOrigins {
+		if origin == "*" {
+			return fmt.Errorf("CORS credentials need explicit origins, \"*\" is not allowed")
+		}
+	}
+
+	return nil
+}
+
+func (options *CORSOptions) allowOrigin(origin string) bool {
+	for _, allowed := range options.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sets the CORS headers of a response, returns false if the origin is not allowed
+func (options *CORSOptions) apply(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+
+	if origin == "" || !options.allowOrigin(origin) {
+		return false
+	}
+
+	if options.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	} else if len(options.AllowedOrigins) == 1 && options.AllowedOrigins[0] == "*" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+
+	return true
+}
+
+// Answers an OPTIONS preflight with the methods registered on the path
+func (options *CORSOptions) preflight(w http.ResponseWriter, r *http.Request, methods map[string]http.HandlerFunc) {
+	if options.apply(w, r) {
+		allowed := make([]string, 0, len(methods))
+		for method := range methods {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowed, ", "))
+
+		headers := r.Header.Get("Access-Control-Request-Headers")
+		if len(options.AllowedHeaders) > 0 {
+			headers = strings.Join(options.AllowedHeaders, ", ")
+		}
+		if headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+
+		if options.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(options.MaxAge))
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Default CORS rules for every route
+func (server *Server) EnableCORS(options CORSOptions) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	server.router.cors = &options
+	return nil
+}
+
+// CORS rules for a single path, e.g. cookie based routes that need credentials
+func (server *Server) RouteCORS(path string, options CORSOptions) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	server.router.corsRoutes[path] = &options
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const openAPITitle = "GoLang RESTful API"
+
+// GET /docs/examples/{route}, examples of the route with that name
+func (server *Server) ExamplesHandler(w http.ResponseWriter, r *http.Request) {
+	name := PathParam(r, "route")
+
+	for _, route := range server.routes {
+		if route.Name == name {
+			JSON(w, http.StatusOK, route.Examples)
+			return
+		}
+	}
+
+	Error(w, ErrNotFound("route"))
+}
+
+// GET /docs/openapi.json, OpenAPI 3 document built from the named routes
+func (server *Server) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(server.OpenAPI())
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (server *Server) OpenAPI() map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+
+	for _, route := range server.routes {
+		// Routes without a name are internal and stay out of the docs
+		if route.Name == "" {
+			continue
+		}
+
+		if paths[route.Path] == nil {
+			paths[route.Path] = make(map[string]interface{})
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = route.operation()
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   openAPITitle,
+			"version": strconv.Itoa(currentAPIVersion),
+		},
+		"paths": paths,
+		// Lets the docs UI send a token, routes that need none ignore it
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"apiKey": []string{}},
+		},
+	}
+}
+
+func (route *Route) operation() map[string]interface{} {
+	operation := map[string]interface{}{
+		"operationId": route.Name,
+		"summary":     route.Summary,
+	}
+
+	parameters := []interface{}{}
+	for _, part := range strings.Split(route.Path, "/") {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			parameters = append(parameters, map[string]interface{}{
+				"name":     strings.TrimSuffix(part[1:len(part)-1], "..."),
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+
+	if route.RequestSchema != nil {
+		requestExamples := make(map[string]interface{})
+		for _, example := range route.Examples {
+			if example.Request != nil {
+				requestExamples[example.Name] = map[string]interface{}{"value": example.Request}
+			}
+		}
+
+		operation["requestBody"] = map[string]interface{}{
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema":   schemaOf(reflect.TypeOf(route.RequestSchema)),
+					"examples": requestExamples,
+				},
+			},
+		}
+	}
+
+	responses := make(map[string]interface{})
+	for _, example := range route.Examples {
+		status := strconv.Itoa(example.Status)
+		response, exists := responses[status].(map[string]interface{})
+
+		if !exists {
+			response = map[string]interface{}{
+				"description": http.StatusText(example.Status),
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema":   envelopeSchema(route.ResponseSchema, example.Status),
+						"examples": map[string]interface{}{},
+					},
+				},
+			}
+			responses[status] = response
+		}
+
+		content := response["content"].(map[string]interface{})["application/json"].(map[string]interface{})
+		content["examples"].(map[string]interface{})[example.Name] = map[string]interface{}{"value": example.Response}
+	}
+	if len(responses) == 0 {
+		responses["200"] = map[string]interface{}{"description": "OK"}
+	}
+	operation["responses"] = responses
+
+	return operation
+}
+
+func envelopeSchema(data interface{}, status int) map[string]interface{} {
+	properties := map[string]interface{}{
+		"success": map[string]interface{}{"type": "boolean"},
+	}
+
+	if status >= 400 || data == nil {
+		properties["error"] = schemaOf(reflect.TypeOf(APIError{}))
+	} else {
+		properties["data"] = schemaOf(reflect.TypeOf(data))
+		properties["links"] = schemaOf(reflect.TypeOf(Links{}))
+	}
+
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// JSON schema of a Go type, following the json struct tags
+func schemaOf(t reflect.Type) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{}
+	}
+
+	if t == reflect.TypeOf(ID("")) {
+		switch {
+		case idStrategy == "uuid":
+			return map[string]interface{}{"type": "string", "format": "uuid"}
+		case idStrategy == "ulid" || stringIDs || obfuscatedResources["users"]:
+			return map[string]interface{}{"type": "string"}
+		default:
+			return map[string]interface{}{"type": "integer", "format": "int64"}
+		}
+	}
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if field.PkgPath != "" || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaOf(field.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": properties}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// Checks every example against the route schemas, so published examples can not drift from the code
+func (server *Server) ValidateExamples() error {
+	for _, route := range server.routes {
+		for _, example := range route.Examples {
+			if err := route.validateExample(example); err != nil {
+				return fmt.Errorf("route %s example %q: %v", route.Name, example.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (route *Route) validateExample(example Example) error {
+	if example.Request != nil {
+		if route.RequestSchema == nil {
+			return fmt.Errorf("request example on a route without body")
+		}
+
+		target := reflect.New(reflect.TypeOf(route.RequestSchema)).Interface()
+		if err := strictRoundTrip(example.Request, target); err != nil {
+			return fmt.Errorf("request: %v", err)
+		}
+	}
+
+	var response APIResponse
+	if example.Status < 400 && route.ResponseSchema != nil {
+		response.Data = reflect.New(reflect.TypeOf(route.ResponseSchema)).Interface()
+	}
+
+	if err := strictRoundTrip(example.Response, &response); err != nil {
+		return fmt.Errorf("response: %v", err)
+	}
+
+	if example.Status >= 400 && response.Error == nil {
+		return fmt.Errorf("error response without error")
+	}
+
+	return nil
+}
+
+// Encodes the value and decodes it back into target rejecting unknown fields
+func strictRoundTrip(value interface{}, target interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(target)
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestRouteExamplesMatchTheirSchemas(t *testing.T) {
+	server := newTestServer(t, newTestApp(t, nil))
+
+	var examples int
+	for _, route := range server.routes {
+		examples += len(route.Examples)
+	}
+	if examples == 0 {
+		t.Fatal("no route has examples")
+	}
+
+	if err := server.ValidateExamples(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io"
+	"net/http"
+)
+
+// Swagger UI release in swagger-ui/, also the ETag of its files
+const swaggerUIVersion = "4.15.5"
+
+//go:embed swagger-ui
+var swaggerUIAssets embed.FS
+
+//go:embed templates/docs.html
+var docsTemplateSource string
+
+var docsTemplate = template.Must(template.New("docs").Parse(docsTemplateSource))
+
+// GET /docs, Swagger UI on top of /docs/openapi.json, try it out included
+func DocsUI(w http.ResponseWriter, r *http.Request) {
+	var page bytes.Buffer
+	err := docsTemplate.Execute(&page, map[string]string{
+		"Title":   openAPITitle,
+		"Assets":  "/docs/assets",
+		"SpecURL": "/docs/openapi.json",
+	})
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page.Bytes())
+}
+
+// GET /docs/assets/{file}, the Swagger UI scripts and styles
+func DocsAsset(w http.ResponseWriter, r *http.Request) {
+	name := PathParam(r, "file")
+
+	file, err := swaggerUIAssets.Open("swagger-ui/" + name)
+	if err != nil {
+		Error(w, ErrNotFound("file"))
+		return
+	}
+	defer file.Close()
+
+	// Embedded files can seek, see embed.FS
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		Error(w, ErrNotFound("file"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	SendFile(w, r, content, FileInfo{Name: name, ETag: `"swagger-ui-` + swaggerUIVersion + `"`})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// What a download tells the client about the file
+type FileInfo struct {
+	Name        string    // Suggested file name, the type is guessed from its extension
+	ContentType string    // Sniffed from the name or the content when empty
+	ModTime     time.Time // Last-Modified, left out when zero
+	ETag        string    // Quoted, checked by If-None-Match and If-Range
+}
+
+// Serves content to be shown by the client, see serveFile
+func SendFile(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, file FileInfo) {
+	serveFile(w, r, content, file, "inline")
+}
+
+// Serves content to be saved by the client under file.Name, see serveFile
+func Attachment(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, file FileInfo) {
+	serveFile(w, r, content, file, "attachment")
+}
+
+// Answers byte Range requests with a 206, or a 200 with the whole file when
+// If-Range no longer matches the ETag or Last-Modified. Conditional GETs get a
+// 304. Only the requested ranges are read from content.
+func serveFile(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, file FileInfo, disposition string) {
+	header := w.Header()
+
+	params := map[string]string{}
+	if file.Name != "" {
+		params["filename"] = file.Name // Encoded as filename*= when not plain ASCII
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+
+	if file.ContentType != "" {
+		header.Set("Content-Type", file.ContentType)
+	}
+	if file.ETag != "" {
+		header.Set("ETag", file.ETag)
+	}
+	header.Set("X-Content-Type-Options", "nosniff")
+
+	http.ServeContent(w, r, file.Name, file.ModTime, content)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Media types the envelope can be written in
+const (
+	mediaJSON    = "application/json"
+	mediaXML     = "application/xml"
+	mediaMsgpack = "application/msgpack"
+	mediaCBOR    = "application/cbor"
+	mediaBare    = "application/vnd.golang-api.bare+json" // JSON without the envelope, see envelope.go
+)
+
+// Writes the envelope in one media type, into a pooled buffer that is only
+// sent once the whole response is encoded
+type ResponseEncoder struct {
+	ContentType string // Sent as the Content-Type header
+	Encode      func(buffer *bytes.Buffer, response APIResponse) error
+	Indent      func(buffer *bytes.Buffer, response APIResponse) error // Readable Encode for ?pretty=true, optional
+}
+
+// Set from PRETTY_JSON in main, ?pretty=false still turns it off
+var prettyResponses bool
+
+var encoders = struct {
+	sync.RWMutex
+	byType  map[string]ResponseEncoder
+	aliases map[string]string // Other names clients use -> registered media type
+}{
+	byType: map[string]ResponseEncoder{
+		mediaJSON:    {ContentType: mediaJSON, Encode: encodeJSON, Indent: indentJSON},
+		mediaXML:     {ContentType: mediaXML + "; charset=utf-8", Encode: encodeXML, Indent: indentXML},
+		mediaMsgpack: {ContentType: mediaMsgpack, Encode: encodeMsgpack},
+		mediaCBOR:    {ContentType: mediaCBOR, Encode: encodeCBOR},
+		mediaBare:    {ContentType: mediaBare, Encode: encodeBare, Indent: indentBare},
+	},
+	aliases: map[string]string{
+		"*/*":                     mediaJSON,
+		"application/*":           mediaJSON,
+		"text/xml":                mediaXML,
+		"application/x-msgpack":   mediaMsgpack,
+		"application/vnd.msgpack": mediaMsgpack,
+	},
+}
+
+// Makes mediaType and its aliases negotiable with Accept, replacing the encoder it had
+func RegisterEncoder(mediaType string, encoder ResponseEncoder, aliases ...string) {
+	encoders.Lock()
+	defer encoders.Unlock()
+
+	encoders.byType[mediaType] = encoder
+	for _, alias := range aliases {
+		encoders.aliases[alias] = mediaType
+	}
+}
+
+// The registered media type behind mediaType or one of its aliases
+func registeredMediaType(mediaType string) (string, bool) {
+	encoders.RLock()
+	defer encoders.RUnlock()
+
+	if registered, ok := encoders.aliases[mediaType]; ok {
+		mediaType = registered
+	}
+	_, ok := encoders.byType[mediaType]
+	return mediaType, ok
+}
+
+// Encoder of a media type returned by negotiateFormat
+func responseEncoder(mediaType string) ResponseEncoder {
+	encoders.RLock()
+	defer encoders.RUnlock()
+
+	return encoders.byType[mediaType]
+}
+
+// Remembers what the client negotiated, see negotiation
+type negotiatedResponse struct {
+	http.ResponseWriter
+	format string
+	pretty bool
+}
+
+func (response *negotiatedResponse) Unwrap() http.ResponseWriter {
+	return response.ResponseWriter
+}
+
+// Answers in the registered media type the client prefers in Accept,
+// JSON when it accepts none of them. ?pretty=true indents the output.
+func NegotiateContent() Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept")
+
+			format := negotiateFormat(r.Header.Get("Accept"))
+			if format == mediaJSON && bareResponses {
+				format = mediaBare
+			}
+
+			nextMiddleware(&negotiatedResponse{
+				ResponseWriter: w,
+				format:         format,
+				pretty:         wantsPretty(r),
+			}, r)
+		}
+	}
+}
+
+// ?pretty and ?pretty=true turn indenting on, ?pretty=false off
+func wantsPretty(r *http.Request) bool {
+	query := r.URL.Query()
+	if !query.Has("pretty") {
+		return prettyResponses
+	}
+
+	raw := query.Get("pretty")
+	if raw == "" {
+		return true
+	}
+
+	pretty, err := strconv.ParseBool(raw)
+	if err != nil {
+		return prettyResponses
+	}
+	return pretty
+}
+
+// The media type with the highest q value, JSON on ties and when nothing matches
+func negotiateFormat(accept string) string {
+	best, bestQuality := mediaJSON, 0.0
+
+	for _, option := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(option)
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = parsed
+			}
+		}
+
+		mediaType, ok := registeredMediaType(mediaType)
+		if !ok {
+			continue
+		}
+
+		if quality > bestQuality || quality == bestQuality && mediaType == mediaJSON {
+			best, bestQuality = mediaType, quality
+		}
+	}
+
+	return best
+}
+
+// What was negotiated for w, looking through the writers that wrap it.
+// Without NegotiateContent, e.g. on the ops server, it is JSON or bare JSON.
+func negotiation(w http.ResponseWriter) negotiatedResponse {
+	if negotiated := negotiatedWriter(w); negotiated != nil {
+		return *negotiated
+	}
+
+	format := mediaJSON
+	if bareResponses {
+		format = mediaBare
+	}
+	return negotiatedResponse{format: format, pretty: prettyResponses}
+}
+
+// The writer NegotiateContent wrapped w in, nil without it
+func negotiatedWriter(w http.ResponseWriter) *negotiatedResponse {
+	for {
+		switch writer := w.(type) {
+		case *negotiatedResponse:
+			return writer
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+func encodeJSON(buffer *bytes.Buffer, response APIResponse) error {
+	if err := writeJSON(buffer, response, ""); err != nil {
+		return err
+	}
+	buffer.Truncate(buffer.Len() - 1) // The newline of the encoder
+	return nil
+}
+
+// With a final newline, so the shell prompt does not end up after the body
+func indentJSON(buffer *bytes.Buffer, response APIResponse) error {
+	return writeJSON(buffer, response, "  ")
+}
+
+// Like json.Marshal but leaves <, > and & alone, links keep their query readable
+func marshalJSON(value interface{}, indent string) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := writeJSON(&buffer, value, indent)
+	return buffer.Bytes(), err
+}
+
+// Appends value and a newline to buffer, see marshalJSON
+func writeJSON(buffer *bytes.Buffer, value interface{}, indent string) error {
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+	return encoder.Encode(value)
+}
+
+// Same document as the JSON one, field names, IDs and omitted fields included
+func encodeMsgpack(buffer *bytes.Buffer, response APIResponse) error {
+	document, err := jsonDocument(response)
+	if err != nil {
+		return err
+	}
+
+	encoder := msgpack.NewEncoder(buffer)
+	encoder.SetSortMapKeys(true)
+	encoder.UseCompactInts(true)
+	return encoder.Encode(document)
+}
+
+func encodeCBOR(buffer *bytes.Buffer, response APIResponse) error {
+	document, err := jsonDocument(response)
+	if err != nil {
+		return err
+	}
+	return cborEncoding.NewEncoder(buffer).Encode(document)
+}
+
+// Deterministic, sorted keys and the smallest integers
+var cborEncoding, _ = cbor.CanonicalEncOptions().EncMode()
+
+// The value as encoding/json sees it, with whole numbers as int64 so binary
+// encoders write them as integers
+func jsonDocument(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var document interface{}
+	if err := decodeNumbers(data, &document); err != nil {
+		return nil, err
+	}
+
+	return convertNumbers(document), nil
+}
+
+func convertNumbers(document interface{}) interface{} {
+	switch value := document.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			value[key] = convertNumbers(field)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = convertNumbers(item)
+		}
+	case json.Number:
+		if integer, err := value.Int64(); err == nil {
+			return integer
+		}
+		float, _ := value.Float64()
+		return float
+	}
+	return document
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// Encrypted values look like enc:<key id>:<hex of nonce and ciphertext>.
+// Values without the prefix were stored before encryption was turned on.
+const encryptedPrefix = "enc:"
+
+// Where the encryption keys come from. ENCRYPTION_KEYS is read by
+// staticKeys, a KMS or secret manager client can implement it as well.
+type KeyProvider interface {
+	// The AES-256 keys by ID and the ID of the one new values use
+	Keys() (current string, keys map[string][]byte, err error)
+}
+
+type staticKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (provider staticKeys) Keys() (string, map[string][]byte, error) {
+	return provider.current, provider.keys, nil
+}
+
+// Parses ENCRYPTION_KEYS, id:base64 key entries, the first one is current
+func parseEncryptionKeys(specs []string) (KeyProvider, error) {
+	provider := staticKeys{keys: make(map[string][]byte)}
+	for _, spec := range specs {
+		id, encoded, found := strings.Cut(spec, ":")
+		if !found || id == "" || strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-") != "" {
+			return nil, fmt.Errorf("%q is not id:base64 key, ids are letters, digits, _ and -", redactedKey(spec))
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes in base64, e.g. openssl rand -base64 32", id)
+		}
+		if _, taken := provider.keys[id]; taken {
+			return nil, fmt.Errorf("key %s is listed twice", id)
+		}
+		if provider.current == "" {
+			provider.current = id
+		}
+		provider.keys[id] = key
+	}
+	return provider, nil
+}
+
+// The id of a key spec, never the key itself
+func redactedKey(spec string) string {
+	id, _, _ := strings.Cut(spec, ":")
+	return id + ":..."
+}
+
+// Encrypts and decrypts field values with AES-GCM, the key ID is
+// authenticated with them so a value can not be moved to another key
+type fieldCipher struct {
+	current   string
+	aeads     map[string]cipher.AEAD
+	nonceKeys map[string][]byte // Derive the nonces of deterministic values
+}
+
+func newFieldCipher(provider KeyProvider) (*fieldCipher, error) {
+	current, keys, err := provider.Keys()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("the current key %q is not among the keys", current)
+	}
+
+	fields := &fieldCipher{current: current, aeads: make(map[string]cipher.AEAD), nonceKeys: make(map[string][]byte)}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+		if fields.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("field nonce"))
+		fields.nonceKeys[id] = mac.Sum(nil)
+	}
+	return fields, nil
+}
+
+// Deterministic values get the same ciphertext for the same value and key,
+// so they can still be looked up, at the cost of showing which are equal
+func (fields *fieldCipher) encrypt(value string, keyID string, deterministic bool) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	aead := fields.aeads[keyID]
+	nonce := make([]byte, aead.NonceSize())
+	if deterministic {
+		mac := hmac.New(sha256.New, fields.nonceKeys[keyID])
+		mac.Write([]byte(value))
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(keyID))
+	return encryptedPrefix + keyID + ":" + hex.EncodeToString(sealed), nil
+}
+
+func (fields *fieldCipher) decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	keyID, encoded, _ := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	aead, ok := fields.aeads[keyID]
+	if !ok {
+		return "", fmt.Errorf("encrypted with the unknown key %q", keyID)
+	}
+	sealed, err := hex.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return "", errors.New("encrypted value does not authenticate")
+	}
+	return string(plain), nil
+}
+
+// Whether the value is encrypted with the current key, or empty
+func (fields *fieldCipher) isCurrent(value string) bool {
+	return value == "" || strings.HasPrefix(value, encryptedPrefix+fields.current+":")
+}
+
+// Encrypts the email and phone of the users before they reach the wrapped
+// store and decrypts them on the way back, the handlers only see plain
+// values. Emails are normalized by emailKey and encrypted deterministically,
+// so logins and the unique check keep working. New values use the current
+// key, the older keys are kept to read what they encrypted until Reencrypt ran.
+type EncryptingStore struct {
+	UserStore
+	fields *fieldCipher
+}
+
+func NewEncryptingStore(base UserStore, provider KeyProvider) (*EncryptingStore, error) {
+	fields, err := newFieldCipher(provider)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptingStore{UserStore: base, fields: fields}, nil
+}
+
+// Wraps base in an EncryptingStore when ENCRYPTION_KEYS is set
+func encryptStore(base UserStore, config *Config) (UserStore, error) {
+	if len(config.EncryptionKeys) == 0 {
+		return base, nil
+	}
+	provider, err := parseEncryptionKeys(config.EncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptingStore(base, provider)
+}
+
+func (encrypted *EncryptingStore) seal(user User) (User, error) {
+	var err error
+	if user.Email, err = encrypted.fields.encrypt(emailKey(user.Email), encrypted.fields.current, true); err != nil {
+		return User{}, err
+	}
+	if user.Phone, err = encrypted.fields.encrypt(user.Phone, encrypted.fields.current, false); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (encrypted *EncryptingStore) open(user User) (User, error) {
+	var err error
+	if user.Email, err = encrypted.fields.decrypt(user.Email); err != nil {
+		return User{}, fmt.Errorf("user %s: email %v", user.ID, err)
+	}
+	if user.Phone, err = encrypted.fields.decrypt(user.Phone); err != nil {
+		return User{}, fmt.Errorf("user %s: phone %v", user.ID, err)
+	}
+	return user, nil
+}
+
+func (encrypted *EncryptingStore) openResult(user User, err error) (User, error) {
+	if err != nil {
+		return User{}, err
+	}
+	return encrypted.open(user)
+}
+
+// Fails when a user other than id has the email, also under the older keys
+// the wrapped store can not compare with the current one
+func (encrypted *EncryptingStore) checkEmail(email string, id ID) error {
+	user, err := encrypted.GetByEmail(email)
+	if errors.Is(err, ErrStatusNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.ID != id {
+		return ErrEmailTaken()
+	}
+	return nil
+}
+
+func (encrypted *EncryptingStore) Create(user User) (User, error) {
+	if err := encrypted.checkEmail(user.Email, ""); err != nil {
+		return User{}, err
+	}
+	sealed, err := encrypted.seal(user)
+	if err != nil {
+		return User{}, err
+	}
+	return encrypted.openResult(encrypted.UserStore.Create(sealed))
+}
+
+func (encrypted *EncryptingStore) List() ([]User, error) {
+	users, err := encrypted.UserStore.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		if users[i], err = encrypted.open(users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+func (encrypted *EncryptingStore) Get(id ID) (User, error) {
+	return encrypted.openResult(encrypted.UserStore.Get(id))
+}
+
+// Looks the email up under the current key, then the older ones, then as
+// stored before encryption
+func (encrypted *EncryptingStore) GetByEmail(email string) (User, error) {
+	email = emailKey(email)
+	candidates := []string{encrypted.fields.current}
+	for id := range encrypted.fields.aeads {
+		if id != encrypted.fields.current {
+			candidates = append(candidates, id)
+		}
+	}
+
+	for _, keyID := range candidates {
+		sealed, err := encrypted.fields.encrypt(email, keyID, true)
+		if err != nil {
+			return User{}, err
+		}
+		user, err := encrypted.UserStore.GetByEmail(sealed)
+		if !errors.Is(err, ErrStatusNotFound) {
+			return encrypted.openResult(user, err)
+		}
+	}
+	return encrypted.openResult(encrypted.UserStore.GetByEmail(email))
+}
+
+func (encrypted *EncryptingStore) Update(user User) (User, error) {
+	if err := encrypted.checkEmail(user.Email, user.ID); err != nil {
+		return User{}, err
+	}
+	sealed, err := encrypted.seal(user)
+	if err != nil {
+		return User{}, err
+	}
+	return encrypted.openResult(encrypted.UserStore.Update(sealed))
+}
+
+func (encrypted *EncryptingStore) Restore(id ID, version int64) (User, error) {
+	return encrypted.openResult(encrypted.UserStore.Restore(id, version))
+}
+
+func (encrypted *EncryptingStore) Each(fn func(User) error) error {
+	return eachUser(encrypted.UserStore, func(user User) error {
+		user, err := encrypted.open(user)
+		if err != nil {
+			return err
+		}
+		return fn(user)
+	})
+}
+
+func (encrypted *EncryptingStore) PurgeDeleted(before time.Time) ([]ID, error) {
+	purger, ok := encrypted.UserStore.(DeletedPurger)
+	if !ok {
+		return nil, fmt.Errorf("the store can not purge deleted users")
+	}
+	return purger.PurgeDeleted(before)
+}
+
+func (encrypted *EncryptingStore) Close() error {
+	if closer, ok := encrypted.UserStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (encrypted *EncryptingStore) Ping() error {
+	if pinger, ok := encrypted.UserStore.(Pinger); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
+
+// Encrypts with the current key the users stored under an older key or
+// before encryption, returns how many were rewritten. Each gets a new
+// version, except the deleted users, which can not be updated and are
+// rewritten as they are through the ContactRewriter of the store.
+func (encrypted *EncryptingStore) Reencrypt() (int, error) {
+	var stale []ID
+	err := eachUser(encrypted.UserStore, func(user User) error {
+		if !encrypted.fields.isCurrent(user.Email) || !encrypted.fields.isCurrent(user.Phone) {
+			stale = append(stale, user.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	rewriter, _ := encrypted.UserStore.(ContactRewriter)
+
+	// Written after the walk, the stores lock while they iterate
+	rewritten := 0
+	for _, id := range stale {
+		user, err := encrypted.Get(id)
+		if err != nil {
+			return rewritten, err
+		}
+		sealed, err := encrypted.seal(user)
+		if err != nil {
+			return rewritten, err
+		}
+
+		switch {
+		case !user.Deleted():
+			_, err = encrypted.UserStore.Update(sealed)
+		case rewriter != nil:
+			err = rewriter.RewriteContact(id, sealed.Email, sealed.Phone)
+		default:
+			err = errors.New("deleted, the store can not rewrite deleted users")
+		}
+		if err != nil {
+			return rewritten, fmt.Errorf("user %s: %w", id, err)
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+// go run *.go encrypt, rewrites the users under the current key once it
+// was put first in ENCRYPTION_KEYS, the old key can be dropped after
+func runEncryptCommand(config *Config) error {
+	if len(config.EncryptionKeys) == 0 {
+		return fmt.Errorf("ENCRYPTION_KEYS is not set")
+	}
+	if config.Store == "memory" {
+		return fmt.Errorf("the memory store is not kept, there is nothing to encrypt")
+	}
+
+	provider, err := parseEncryptionKeys(config.EncryptionKeys)
+	if err != nil {
+		return err
+	}
+	base, err := newStore(config, systemClock{})
+	if err != nil {
+		return err
+	}
+	encrypted, err := NewEncryptingStore(base, provider)
+	if err != nil {
+		return err
+	}
+
+	rewritten, err := encrypted.Reencrypt()
+	// File and bolt stores flush on Close
+	if closer, ok := base.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("encrypted %d users of the %s store with key %s", rewritten, config.Store, encrypted.fields.current)
+	return nil
+}
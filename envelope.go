@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Set from RESPONSE_ENVELOPE=false in main, JSON clients then get the bare
+// resources. Clients opt in on their own with Accept: application/vnd.golang-api.bare+json.
+var bareResponses bool
+
+// Bare JSON for the successes, [{...}] instead of {"success":true,"data":[{...}]}.
+// Errors keep the envelope so clients can still tell the code and the details.
+func encodeBare(buffer *bytes.Buffer, response APIResponse) error {
+	if response.Error != nil {
+		return encodeJSON(buffer, response)
+	}
+
+	if err := writeJSON(buffer, response.Data, ""); err != nil {
+		return err
+	}
+	buffer.Truncate(buffer.Len() - 1)
+	return nil
+}
+
+func indentBare(buffer *bytes.Buffer, response APIResponse) error {
+	if response.Error != nil {
+		return indentJSON(buffer, response)
+	}
+	return writeJSON(buffer, response.Data, "  ")
+}
+
+// Answers the routes it wraps without the envelope when the client negotiated JSON
+func WithoutEnvelope() Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if negotiated := negotiatedWriter(w); negotiated != nil && negotiated.format == mediaJSON {
+				negotiated.format = mediaBare
+			}
+			nextMiddleware(w, r)
+		}
+	}
+}
+
+// Bare responses have no room for links, they go in the Link header instead,
+// e.g. </api/users?offset=20>; rel="next"
+func linkHeader(links Links) string {
+	relations := make([]string, 0, len(links))
+	for relation := range links {
+		relations = append(relations, relation)
+	}
+	sort.Strings(relations)
+
+	values := make([]string, len(relations))
+	for i, relation := range relations {
+		values[i] = "<" + links[relation] + `>; rel="` + relation + `"`
+	}
+	return strings.Join(values, ", ")
+}
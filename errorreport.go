@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A server error with what is known of the request that got it
+type ErrorReport struct {
+	Err       error
+	Time      time.Time
+	Status    int
+	Method    string
+	Route     string // Pattern, like the access log
+	RequestID string
+	UserID    string // Public ID, empty for anonymous requests
+	Stack     []byte // Of the panic, nil for errors that were answered
+}
+
+// Where the 5xx responses and panics go besides the log, e.g. an error
+// tracker. Report is called on the request goroutine so it should not block.
+type ErrorReporter interface {
+	Report(report ErrorReport)
+}
+
+type noopReporter struct{}
+
+func (noopReporter) Report(ErrorReport) {}
+
+// Set up in main, SENTRY_DSN sends the reports to Sentry
+var errorReporter ErrorReporter = noopReporter{}
+
+// Longer or unprintable X-Request-ID headers are replaced
+const maxRequestID = 128
+
+// Reports the 5xx responses to errorReporter. Requests are given an
+// X-Request-ID, the one the client sent when it sent one, so clients can
+// quote it and reports can be found from it.
+func ReportErrors() Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get("X-Request-ID")
+			if !validRequestID(requestID) {
+				requestID = string(newUUID())
+				r.Header.Set("X-Request-ID", requestID)
+			}
+			w.Header().Set("X-Request-ID", requestID)
+
+			response := &reportingResponse{ResponseWriter: w, status: http.StatusOK}
+			nextMiddleware(response, r)
+			if response.status < 500 {
+				return
+			}
+
+			report := ErrorReport{
+				Err:       response.err,
+				Time:      time.Now().UTC(),
+				Status:    response.status,
+				Method:    r.Method,
+				Route:     RoutePattern(r),
+				RequestID: requestID,
+			}
+			if report.Route == "" {
+				report.Route = "unmatched"
+			}
+			if response.userID != "" {
+				report.UserID = string(publicID("users", response.userID))
+			}
+			var panicked *panicError
+			if errors.As(report.Err, &panicked) {
+				report.Stack = panicked.stack
+			}
+			if report.Err == nil {
+				report.Err = errors.New(http.StatusText(response.status))
+			}
+
+			errorReporter.Report(report)
+		}
+	}
+}
+
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestID {
+		return false
+	}
+	for _, char := range requestID {
+		if char < '!' || char > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Answers 500 instead of dropping the connection when a handler panics. The
+// panic, with its stack, is logged and reported by ReportErrors. Chaos drops
+// and other http.ErrAbortHandler panics still abort the response.
+func (app *App) RecoverPanic() Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+
+				err := &panicError{value: recovered, stack: debug.Stack()}
+				errorf("panic in %s %s: %v\n%s", r.Method, RoutePattern(r), recovered, err.stack)
+				app.alert("alert.panic", User{}, fmt.Sprintf("panic in %s %s: %v", r.Method, RoutePattern(r), recovered))
+				Error(w, &AppError{Status: http.StatusInternalServerError, Message: "internal server error", Err: err})
+			}()
+
+			nextMiddleware(w, r)
+		}
+	}
+}
+
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (err *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", err.value)
+}
+
+// Remembers the status, the error Error answered and the user RequireAuth
+// loaded, which ReportErrors can not see on its own request
+type reportingResponse struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	err         error
+	userID      ID
+}
+
+func (response *reportingResponse) Unwrap() http.ResponseWriter {
+	return response.ResponseWriter
+}
+
+func (response *reportingResponse) Flush() {
+	http.NewResponseController(response.ResponseWriter).Flush()
+}
+
+func (response *reportingResponse) WriteHeader(status int) {
+	if !response.wroteHeader {
+		response.wroteHeader, response.status = true, status
+	}
+	response.ResponseWriter.WriteHeader(status)
+}
+
+func (response *reportingResponse) Write(data []byte) (int, error) {
+	response.wroteHeader = true
+	return response.ResponseWriter.Write(data)
+}
+
+// The writer ReportErrors wrapped w in, nil without it
+func reportingWriter(w http.ResponseWriter) *reportingResponse {
+	for {
+		switch writer := w.(type) {
+		case *reportingResponse:
+			return writer
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// Called by Error with what it answers
+func reportError(w http.ResponseWriter, err error) {
+	if response := reportingWriter(w); response != nil {
+		response.err = err
+	}
+}
+
+// Called by the authentication middleware with the user they loaded
+func reportUser(w http.ResponseWriter, id ID) {
+	if response := reportingWriter(w); response != nil {
+		response.userID = id
+	}
+}
+
+// Sends the reports to Sentry as events, through its store endpoint so no
+// SDK is needed. The events are sent in the background, one at a time, and
+// dropped when too many are waiting.
+type SentryReporter struct {
+	endpoint    string
+	auth        string
+	environment string
+	events      chan map[string]interface{}
+	mutex       sync.Mutex // Guards closed, sending on the closed events would panic
+	closed      bool
+	sent        chan struct{} // Closed once the events left before Close are sent
+}
+
+// Reports waiting to be sent, more are dropped
+const sentryQueue = 100
+
+// dsn as Sentry shows it, https://<key>@<host>/<project id>
+func NewSentryReporter(dsn string, environment string) (*SentryReporter, error) {
+	reporter, err := parseSentryDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	reporter.environment = environment
+	reporter.events = make(chan map[string]interface{}, sentryQueue)
+	reporter.sent = make(chan struct{})
+
+	go reporter.send()
+	return reporter, nil
+}
+
+// The endpoint and credentials of a DSN
+func parseSentryDSN(dsn string) (*SentryReporter, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.User == nil || parsed.User.Username() == "" {
+		return nil, errors.New("not a Sentry DSN, expected https://<key>@<host>/<project id>")
+	}
+	// The project is the last segment, Sentry may be behind a path prefix
+	index := strings.LastIndex(parsed.Path, "/")
+	if index < 0 || index == len(parsed.Path)-1 {
+		return nil, errors.New("the Sentry DSN has no project id")
+	}
+	path, project := parsed.Path[:index], parsed.Path[index+1:]
+
+	reporter := &SentryReporter{
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/store/", parsed.Scheme, parsed.Host, path, project),
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=golang-api/%s, sentry_key=%s", version, parsed.User.Username()),
+	}
+	if secret, ok := parsed.User.Password(); ok {
+		reporter.auth += ", sentry_secret=" + secret
+	}
+	return reporter, nil
+}
+
+func (reporter *SentryReporter) Report(report ErrorReport) {
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+	if reporter.closed {
+		return
+	}
+
+	select {
+	case reporter.events <- reporter.event(report):
+	default:
+		warnf("sentry: too many reports waiting, dropped the one of request %s", report.RequestID)
+	}
+}
+
+// https://develop.sentry.dev/sdk/event-payloads/
+func (reporter *SentryReporter) event(report ErrorReport) map[string]interface{} {
+	eventID := make([]byte, 16)
+	rand.Read(eventID)
+
+	exception := map[string]interface{}{
+		"type":  fmt.Sprintf("%T", report.Err),
+		"value": report.Err.Error(),
+	}
+	if appErr, ok := asAppError(report.Err); ok {
+		exception["type"] = appErr.apiError().Code
+	}
+	if report.Stack != nil {
+		exception["type"] = "panic"
+	}
+
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(eventID),
+		"timestamp":   report.Time.Format(time.RFC3339),
+		"level":       "error",
+		"platform":    "go",
+		"logger":      "http",
+		"release":     version,
+		"transaction": report.Method + " " + report.Route,
+		"exception":   map[string]interface{}{"values": []interface{}{exception}},
+		"tags": map[string]string{
+			"route":      report.Route,
+			"method":     report.Method,
+			"status":     fmt.Sprint(report.Status),
+			"request_id": report.RequestID,
+		},
+	}
+	if reporter.environment != "" {
+		event["environment"] = reporter.environment
+	}
+	if report.UserID != "" {
+		event["user"] = map[string]string{"id": report.UserID}
+	}
+	if report.Stack != nil {
+		event["extra"] = map[string]string{"stack": string(report.Stack)}
+	}
+	return event
+}
+
+// Sends the reports still waiting, later ones are dropped
+func (reporter *SentryReporter) Close(ctx context.Context) error {
+	reporter.mutex.Lock()
+	if !reporter.closed {
+		reporter.closed = true
+		close(reporter.events)
+	}
+	reporter.mutex.Unlock()
+
+	select {
+	case <-reporter.sent:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("sentry: %d reports not sent: %w", len(reporter.events), ctx.Err())
+	}
+}
+
+func (reporter *SentryReporter) send() {
+	defer close(reporter.sent)
+	for event := range reporter.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			errorf("sentry: %v", err)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, reporter.endpoint, bytes.NewReader(body))
+		if err != nil {
+			cancel()
+			errorf("sentry: %v", err)
+			continue
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-Sentry-Auth", reporter.auth)
+
+		response, err := httpClient.Do(request)
+		cancel()
+		if err != nil {
+			warnf("sentry: %v", err)
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			warnf("sentry: answered %d to event %s", response.StatusCode, event["event_id"])
+		}
+	}
+}
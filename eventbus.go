@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Something that happened in the domain, e.g. UserCreated
+type DomainEvent interface {
+	EventName() string
+}
+
+type UserCreated struct{ User User }
+type UserUpdated struct{ User User }
+type UserDeleted struct{ UserID ID }
+type UserRestored struct{ User User }
+type UserSignedUp struct{ User User } // After UserCreated, for signups only
+type UsersPurged struct{ UserIDs []ID }
+
+func (UserCreated) EventName() string  { return "user.created" }
+func (UserUpdated) EventName() string  { return "user.updated" }
+func (UserDeleted) EventName() string  { return "user.deleted" }
+func (UserRestored) EventName() string { return "user.restored" }
+func (UserSignedUp) EventName() string { return "user.signup" }
+func (UsersPurged) EventName() string  { return "users.purged" }
+
+// A published domain event, numbered in publishing order
+type Event struct {
+	ID   uint64
+	At   time.Time
+	Data DomainEvent
+}
+
+// Handles the events of a subscriber, errors are logged
+type EventHandler func(ctx context.Context, event Event) error
+
+// Hands the domain events to the subscribers in the background, so the side
+// effects of a write (webhooks, event streams, audit history) do not hold the
+// request. Each subscriber gets the events in order, one at a time, and a
+// slow one does not hold the others. Events are kept in memory until handled.
+type EventBus struct {
+	mutex       sync.Mutex
+	nextID      uint64
+	subscribers []*eventSubscriber
+	closed      bool
+
+	ctx     context.Context // Of the handlers, cancelled when Close gives up waiting
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+type eventSubscriber struct {
+	name    string
+	events  []string // Names of the events it gets, every event when empty
+	handler EventHandler
+
+	mutex   sync.Mutex
+	pending []Event
+	closing bool
+	wake    chan struct{}
+}
+
+func NewEventBus() *EventBus {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &EventBus{ctx: ctx, cancel: cancel}
+}
+
+// Registers a subscriber for the named events, or every event when none is named
+func (bus *EventBus) Subscribe(name string, handler EventHandler, events ...string) {
+	subscriber := &eventSubscriber{name: name, events: events, handler: handler, wake: make(chan struct{}, 1)}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.subscribers = append(bus.subscribers, subscriber)
+	bus.running.Add(1)
+	go func() {
+		defer bus.running.Done()
+		subscriber.run(bus.ctx)
+	}()
+}
+
+// Numbers the event and queues it for its subscribers without waiting.
+// Events published once the bus is closed are dropped.
+func (bus *EventBus) Publish(data DomainEvent) Event {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.nextID++
+	event := Event{ID: bus.nextID, At: time.Now().UTC(), Data: data}
+
+	if bus.closed {
+		warnf("event bus: %s %d dropped, the bus is closed", data.EventName(), event.ID)
+		return event
+	}
+
+	debugf("event bus: %s %d published", data.EventName(), event.ID)
+	for _, subscriber := range bus.subscribers {
+		if len(subscriber.events) == 0 || slices.Contains(subscriber.events, data.EventName()) {
+			subscriber.push(event)
+		}
+	}
+
+	return event
+}
+
+func (subscriber *eventSubscriber) push(event Event) {
+	subscriber.mutex.Lock()
+	subscriber.pending = append(subscriber.pending, event)
+	subscriber.mutex.Unlock()
+
+	subscriber.signal()
+}
+
+func (subscriber *eventSubscriber) signal() {
+	select {
+	case subscriber.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Handles the pending events until the bus closes and none is left
+func (subscriber *eventSubscriber) run(ctx context.Context) {
+	for {
+		subscriber.mutex.Lock()
+		events, closing := subscriber.pending, subscriber.closing
+		subscriber.pending = nil
+		subscriber.mutex.Unlock()
+
+		if len(events) == 0 {
+			if closing {
+				return
+			}
+			<-subscriber.wake
+			continue
+		}
+
+		for _, event := range events {
+			if err := subscriber.handle(ctx, event); err != nil {
+				warnf("event bus: %s on %s %d: %v", subscriber.name, event.Data.EventName(), event.ID, err)
+			}
+		}
+	}
+}
+
+// A panic fails the event instead of the process
+func (subscriber *eventSubscriber) handle(ctx context.Context, event Event) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return subscriber.handler(ctx, event)
+}
+
+// Takes no more events and lets the subscribers handle the pending ones
+// until ctx is done, then cancels them
+func (bus *EventBus) Close(ctx context.Context) error {
+	bus.mutex.Lock()
+	bus.closed = true
+	for _, subscriber := range bus.subscribers {
+		subscriber.mutex.Lock()
+		subscriber.closing = true
+		subscriber.mutex.Unlock()
+		subscriber.signal()
+	}
+	bus.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		bus.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		bus.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Publishes every write of the wrapped store as a domain event once it
+// succeeded, whoever made it: handlers, gRPC, imports or the seed.
+type PublishingStore struct {
+	UserStore
+	bus *EventBus
+}
+
+func NewPublishingStore(base UserStore, bus *EventBus) *PublishingStore {
+	return &PublishingStore{UserStore: base, bus: bus}
+}
+
+func (published *PublishingStore) Create(user User) (User, error) {
+	user, err := published.UserStore.Create(user)
+	if err == nil {
+		published.bus.Publish(UserCreated{User: user})
+	}
+	return user, err
+}
+
+func (published *PublishingStore) Update(user User) (User, error) {
+	user, err := published.UserStore.Update(user)
+	if err == nil {
+		published.bus.Publish(UserUpdated{User: user})
+	}
+	return user, err
+}
+
+func (published *PublishingStore) Delete(id ID, version int64) error {
+	err := published.UserStore.Delete(id, version)
+	if err == nil {
+		published.bus.Publish(UserDeleted{UserID: id})
+	}
+	return err
+}
+
+func (published *PublishingStore) Restore(id ID, version int64) (User, error) {
+	user, err := published.UserStore.Restore(id, version)
+	if err == nil {
+		published.bus.Publish(UserRestored{User: user})
+	}
+	return user, err
+}
+
+func (published *PublishingStore) PurgeDeleted(before time.Time) ([]ID, error) {
+	purger, ok := published.UserStore.(DeletedPurger)
+	if !ok {
+		return nil, fmt.Errorf("the store can not purge deleted users")
+	}
+
+	purged, err := purger.PurgeDeleted(before)
+	if len(purged) > 0 {
+		published.bus.Publish(UsersPurged{UserIDs: purged})
+	}
+	return purged, err
+}
+
+// Falls back to List when the wrapped store can not iterate
+func (published *PublishingStore) Each(fn func(User) error) error {
+	return eachUser(published.UserStore, fn)
+}
+
+// The wrapped store may hold files or connections
+func (published *PublishingStore) Close() error {
+	if closer, ok := published.UserStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (published *PublishingStore) Ping() error {
+	if pinger, ok := published.UserStore.(Pinger); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Events kept for clients that reconnect with Last-Event-ID
+const eventHistorySize = 256
+
+// Events a client may fall behind before it is disconnected, it can resume
+// with Last-Event-ID while the events are in the history
+const eventBufferSize = 64
+
+// A user write, sent by GET /api/events
+type UserEvent struct {
+	ID     uint64    `json:"id"`
+	Type   string    `json:"type"` // user.created, user.updated, user.deleted or user.restored
+	UserID ID        `json:"user_id"`
+	User   *User     `json:"user,omitempty"` // Public fields, nil for deletes
+	At     time.Time `json:"at"`
+}
+
+// Fans the user events out to the subscribed clients
+type EventBroker struct {
+	mutex       sync.Mutex
+	history     []UserEvent
+	subscribers map[chan UserEvent]bool
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: make(map[chan UserEvent]bool), closed: make(chan struct{})}
+}
+
+// The user event of a domain event, public IDs only. False for the
+// events streams do not carry, e.g. signups.
+func userEventOf(event Event) (UserEvent, bool) {
+	userEvent := UserEvent{ID: event.ID, Type: event.Data.EventName(), At: event.At}
+
+	var user *User
+	switch data := event.Data.(type) {
+	case UserCreated:
+		user = &data.User
+	case UserUpdated:
+		user = &data.User
+	case UserRestored:
+		user = &data.User
+	case UserDeleted:
+		userEvent.UserID = publicID("users", data.UserID)
+		return userEvent, true
+	default:
+		return UserEvent{}, false
+	}
+
+	public := publicUser(*user)
+	userEvent.UserID, userEvent.User = public.ID, &public
+	return userEvent, true
+}
+
+// Subscriber of the event bus, streams the user events to the clients of
+// GET /api/events, the WebSocket and gRPC WatchUsers
+func (app *App) streamUserEvent(ctx context.Context, event Event) error {
+	if userEvent, ok := userEventOf(event); ok {
+		app.Events.Publish(userEvent)
+	}
+	return nil
+}
+
+// Hands the event to every subscriber without waiting, subscribers with a
+// full buffer are dropped. The event keeps the ID the event bus gave it.
+func (broker *EventBroker) Publish(event UserEvent) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	broker.history = append(broker.history, event)
+	if len(broker.history) > eventHistorySize {
+		broker.history = broker.history[len(broker.history)-eventHistorySize:]
+	}
+
+	for events := range broker.subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(broker.subscribers, events)
+			close(events)
+		}
+	}
+
+}
+
+// Events from now on, plus the ones after lastID still in the history.
+// The channel is closed when the subscriber falls behind, call cancel when done.
+func (broker *EventBroker) Subscribe(lastID uint64) (events <-chan UserEvent, missed []UserEvent, cancel func()) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	if lastID > 0 {
+		for _, event := range broker.history {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	channel := make(chan UserEvent, eventBufferSize)
+	broker.subscribers[channel] = true
+
+	cancel = func() {
+		broker.mutex.Lock()
+		defer broker.mutex.Unlock()
+
+		if broker.subscribers[channel] {
+			delete(broker.subscribers, channel)
+			close(channel)
+		}
+	}
+
+	return channel, missed, cancel
+}
+
+// Ends every stream, called when the server starts shutting down so open
+// streams do not hold the shutdown until its timeout
+func (broker *EventBroker) Close() {
+	broker.closeOnce.Do(func() { close(broker.closed) })
+}
+
+// GET /api/events, the user writes as Server-Sent Events. Clients resume after
+// a reconnect with the Last-Event-ID header browsers send.
+func (app *App) UserEvents(w http.ResponseWriter, r *http.Request) {
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	events, missed, cancel := app.Events.Subscribe(lastID)
+	defer cancel()
+
+	// The headers are out already, nothing left to answer
+	stream, err := NewSSEStream(w)
+	if err != nil {
+		warnf("events: %v", err)
+		return
+	}
+
+	send := func(event UserEvent) error {
+		return stream.Send(strconv.FormatUint(event.ID, 10), event.Type, event)
+	}
+
+	for _, event := range missed {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return // Too slow, the client reconnects and catches up from the history
+			}
+			err = send(event)
+		case <-heartbeat.C:
+			err = stream.Heartbeat()
+		case <-r.Context().Done():
+			return
+		case <-app.Events.closed:
+			return
+		}
+
+		// The client is gone
+		if err != nil {
+			return
+		}
+	}
+}
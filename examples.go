@@ -0,0 +1,35 @@
+package main
+
+import "net/http"
+
+// Sample payloads published in the docs, see Route.WithExample
+
+var exampleNewUser = User{Name: "Jane Doe", Email: "jane@example.com", Phone: "+1 555 0100"}
+
+var exampleUser = User{ID: "1", Name: "Jane Doe", Email: "jane@example.com", Phone: "+1 555 0100", Role: RoleMember, Version: 1}
+
+var examplePatchedUser = User{ID: "1", Name: "Jane Doe", Email: "jane@example.com", Phone: "+1 555 0199", Role: RoleMember, Version: 2}
+
+var exampleRestoredUser = User{ID: "1", Name: "Jane Doe", Email: "jane@example.com", Phone: "+1 555 0100", Role: RoleMember, Version: 3}
+
+var exampleBulkResults = []BulkResult{
+	{Index: 0, Status: http.StatusCreated, User: &exampleUser},
+	{Index: 1, Status: http.StatusUnprocessableEntity, Error: &APIError{Code: CodeValidationFailed, Message: "email: is required"}},
+}
+
+// Example of an error built by the handlers, with its own code
+func exampleAppError(appErr *AppError) Example {
+	return Example{
+		Name:     http.StatusText(appErr.Status),
+		Status:   appErr.Status,
+		Response: APIResponse{Error: appErr.apiError()},
+	}
+}
+
+func exampleError(status int, message string) Example {
+	return Example{
+		Name:     http.StatusText(status),
+		Status:   status,
+		Response: APIResponse{Error: &APIError{Code: statusCode(status), Message: message}},
+	}
+}
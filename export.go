@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var exportColumns = []string{"id", "name", "email", "phone", "role", "attributes", "version", "created_at", "updated_at", "deleted_at"}
+
+// Every user as a download, ?format=csv (default) or ?format=jsonl.
+// Rows are written to a temporary file as the store yields them, so big exports
+// do not pile up in memory and interrupted downloads resume with Range. The
+// ETag is a hash of the content, If-Range only resumes an unchanged export.
+// With "Prefer: respond-async" a job writes the file, GET /api/jobs/{id}/result sends it.
+func (app *App) ExportUsers(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		IncludeDeleted bool   `query:"include_deleted"`
+		Format         string `query:"format"`
+	}
+	if err := Bind(r, &params); err != nil {
+		Error(w, err)
+		return
+	}
+
+	if params.Format == "" {
+		params.Format = "csv"
+	}
+	if params.Format != "csv" && params.Format != "jsonl" {
+		Error(w, ErrBadRequest("format must be csv or jsonl"))
+		return
+	}
+
+	if prefersAsync(r) {
+		app.acceptJob(w, r, "export_users", func(ctx context.Context, job *JobHandle) (interface{}, error) {
+			file, err := os.CreateTemp("", "export-*")
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+
+			info, err := app.exportUsers(ctx, file, params.Format, params.IncludeDeleted, job.Progress)
+			job.SetFile(file.Name(), info)
+			return nil, err
+		})
+		return
+	}
+
+	file, err := os.CreateTemp("", "export-*")
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	info, err := app.exportUsers(r.Context(), file, params.Format, params.IncludeDeleted, func(done, total int) {})
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	Attachment(w, r, file, info)
+}
+
+// Writes the users to file in the format, csv or jsonl, and describes the download
+func (app *App) exportUsers(ctx context.Context, file io.Writer, format string, includeDeleted bool, progress func(done, total int)) (FileInfo, error) {
+	hash := sha256.New()
+	out := bufio.NewWriter(io.MultiWriter(file, hash))
+
+	var write func(User) error
+	var flush func() error
+	var contentType string
+
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(out)
+		writer.Write(exportColumns)
+		write = func(user User) error { return writer.Write(csvRow(user)) }
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+		contentType = "text/csv; charset=utf-8"
+	case "jsonl":
+		encoder := json.NewEncoder(out)
+		write = func(user User) error { return encoder.Encode(user) }
+		flush = func() error { return nil }
+		contentType = "application/x-ndjson"
+	default:
+		return FileInfo{}, ErrBadRequest("format must be csv or jsonl")
+	}
+
+	done := 0
+	err := eachUser(app.Store, func(user User) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if user.Deleted() && !includeDeleted {
+			return nil
+		}
+		done++
+		progress(done, 0)
+		return write(publicUser(user))
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	progress(done, done)
+
+	return FileInfo{
+		Name:        "users." + format,
+		ContentType: contentType,
+		ETag:        `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`,
+	}, nil
+}
+
+func csvRow(user User) []string {
+	attributes := ""
+	if len(user.Attributes) > 0 {
+		data, _ := json.Marshal(user.Attributes)
+		attributes = string(data)
+	}
+
+	return []string{
+		string(user.ID),
+		user.Name,
+		user.Email,
+		user.Phone,
+		string(user.Role),
+		attributes,
+		strconv.FormatInt(user.Version, 10),
+		csvTime(user.CreatedAt),
+		csvTime(user.UpdatedAt),
+		csvTime(user.DeletedAt),
+	}
+}
+
+func csvTime(value time.Time) string {
+	if value.IsZero() {
+		return ""
+	}
+	return value.Format(time.RFC3339Nano)
+}
+
+// Uses the store iterator when there is one, List otherwise
+func eachUser(userStore UserStore, fn func(User) error) error {
+	if iterator, ok := userStore.(UserIterator); ok {
+		return iterator.Each(fn)
+	}
+
+	users, err := userStore.List()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// Sets of users built into the binary, seeded with SEED_FILE=fixture:<name>
+// or go run *.go seed fixture:<name>, e.g. fixture:demo
+//
+//go:embed fixtures/*.json
+var fixtureFiles embed.FS
+
+const fixturePrefix = "fixture:"
+
+// The content of fixtures/<name>.json
+func readFixture(source string) ([]byte, error) {
+	name := strings.TrimPrefix(source, fixturePrefix)
+	data, err := fixtureFiles.ReadFile(path.Join("fixtures", name+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: no such fixture, there are %s", source, strings.Join(fixtureNames(), ", "))
+	}
+	return data, nil
+}
+
+func fixtureNames() []string {
+	entries, _ := fixtureFiles.ReadDir("fixtures")
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = fixturePrefix + strings.TrimSuffix(entry.Name(), ".json")
+	}
+	return names
+}
+
+var (
+	generatedFirstNames = []string{"Ada", "Grace", "Alan", "Katherine", "Linus", "Margaret", "Dennis", "Barbara", "Ken", "Frances"}
+	generatedLastNames  = []string{"Lovelace", "Hopper", "Turing", "Johnson", "Torvalds", "Hamilton", "Ritchie", "Liskov", "Thompson", "Allen"}
+	generatedUsers      atomic.Int64
+)
+
+// Password of the users made by seed --generate
+const generatedUserPassword = "password123"
+
+// A valid member with a realistic name and a unique email, for seed --generate
+// and the tests
+func generateUser() User {
+	n := int(generatedUsers.Add(1))
+	first, last := generatedFirstNames[(n-1)%len(generatedFirstNames)], generatedLastNames[(n-1)/len(generatedFirstNames)%len(generatedLastNames)]
+
+	// The random part keeps the emails unique across runs on a persistent store
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+
+	return User{
+		Name:     first + " " + last,
+		Email:    fmt.Sprintf("%s.%s.%s@example.com", strings.ToLower(first), strings.ToLower(last), hex.EncodeToString(suffix)),
+		Phone:    fmt.Sprintf("+1 555 %04d", n%10000),
+		Role:     RoleMember,
+		Password: generatedUserPassword,
+	}
+}
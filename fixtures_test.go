@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+// A valid member with a realistic name and a unique email, changed by the
+// overrides, e.g. NewTestUser(func(user *User) { user.Role = RoleAdmin })
+func NewTestUser(overrides ...func(user *User)) User {
+	user := generateUser()
+	for _, override := range overrides {
+		override(&user)
+	}
+	return user
+}
+
+// Creates the users of fixtures/<name>.json in the store
+func seedFixture(t *testing.T, userStore UserStore, name string) {
+	t.Helper()
+
+	if _, err := seedUsers(userStore, fixturePrefix+name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Stores a NewTestUser, its password is generatedUserPassword
+func createTestUser(t *testing.T, userStore UserStore, overrides ...func(user *User)) User {
+	t.Helper()
+
+	user, err := userStore.Create(NewTestUser(overrides...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestNewTestUser(t *testing.T) {
+	emails := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		user := NewTestUser()
+		if err := user.Validate(); err != nil {
+			t.Fatalf("%+v: %v", user, err)
+		}
+		if user.Role != RoleMember {
+			t.Fatalf("role %q, want member", user.Role)
+		}
+		if emails[user.Email] {
+			t.Fatalf("email %s made twice", user.Email)
+		}
+		emails[user.Email] = true
+	}
+
+	admin := NewTestUser(func(user *User) { user.Role = RoleAdmin }, func(user *User) { user.Name = "Root" })
+	if admin.Role != RoleAdmin || admin.Name != "Root" {
+		t.Fatalf("overrides not applied: %+v", admin)
+	}
+}
+
+func TestSeedFixture(t *testing.T) {
+	userStore := NewMemoryStore(systemClock{})
+	seedFixture(t, userStore, "demo")
+
+	admin, err := userStore.GetByEmail("admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.Role != RoleAdmin || !admin.CheckPassword("admin12345") {
+		t.Fatalf("demo admin %+v", admin)
+	}
+
+	// Seeding again leaves the users alone
+	created, err := seedUsers(userStore, "fixture:demo")
+	if err != nil || created != 0 {
+		t.Fatalf("second seed created %d users: %v", created, err)
+	}
+
+	if _, err := readSeedFile("fixture:missing"); err == nil {
+		t.Fatal("a missing fixture was read")
+	}
+}
+
+func TestCreateTestUser(t *testing.T) {
+	userStore := NewMemoryStore(systemClock{})
+	user := createTestUser(t, userStore, func(user *User) { user.Role = RoleViewer })
+
+	stored, err := userStore.Get(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Role != RoleViewer || !stored.CheckPassword(generatedUserPassword) {
+		t.Fatalf("stored %+v", stored)
+	}
+}
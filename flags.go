@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Command line options, parsed before the command
+type Flags struct {
+	ConfigFile string
+	Values     map[string]string // Raw values by env name, they win over the environment
+	Args       []string          // The command and its arguments
+}
+
+// One flag per Config field, e.g. --read-timeout for READ_TIMEOUT
+type configFlag struct {
+	key     string
+	values  map[string]string
+	boolean bool
+}
+
+func (option *configFlag) String() string {
+	if option.values == nil {
+		return ""
+	}
+	return option.values[option.key]
+}
+
+func (option *configFlag) Set(value string) error {
+	option.values[option.key] = value
+	return nil
+}
+
+func (option *configFlag) IsBoolFlag() bool {
+	return option.boolean
+}
+
+func flagName(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+// Parses options like --port :8080 --store=bolt --config config.yaml, every
+// Config field has one. Returns flag.ErrHelp after printing the help for -h.
+func parseFlags(args []string, output io.Writer) (Flags, error) {
+	flags := Flags{Values: make(map[string]string)}
+
+	set := flag.NewFlagSet("golang-api", flag.ContinueOnError)
+	set.SetOutput(output)
+
+	// Value type of each flag for the help, empty for booleans
+	kinds := map[string]string{"config": "file"}
+	set.Usage = func() {
+		fmt.Fprintln(output, "Usage: golang-api [options] [command]")
+		fmt.Fprintln(output)
+		fmt.Fprintln(output, "Commands:")
+		fmt.Fprintln(output, "  serve            serve the API, the default")
+		fmt.Fprintln(output, "  config print     print the effective configuration")
+		fmt.Fprintln(output, "  config check     check the configuration and exit")
+		fmt.Fprintln(output, "  migrate up|down  run the SQL migrations")
+		fmt.Fprintln(output, "  seed <file>      create the users of a JSON or YAML file, a fixture:<name> or --generate <count>")
+		fmt.Fprintln(output, "  routes           print the route table")
+		fmt.Fprintln(output, "  token <email|id> print an access token of the user, or --role <role>, --ttl <duration>")
+		fmt.Fprintln(output, "  encrypt          encrypt the users with the current ENCRYPTION_KEYS key")
+		fmt.Fprintln(output, "  version          print the version, commit and build date")
+		fmt.Fprintln(output)
+		fmt.Fprintln(output, "Options, they win over the config file and the environment:")
+		set.VisitAll(func(option *flag.Flag) {
+			fmt.Fprintf(output, "  --%s\n    \t%s\n", strings.TrimSpace(option.Name+" "+kinds[option.Name]), option.Usage)
+		})
+	}
+
+	set.StringVar(&flags.ConfigFile, "config", "", "settings file, YAML, JSON or TOML, env CONFIG_FILE")
+
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		key := field.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+
+		option := &configFlag{key: key, values: flags.Values, boolean: field.Type.Kind() == reflect.Bool}
+		set.Var(option, flagName(key), flagUsage(field, key))
+		kinds[flagName(key)] = flagKind(field.Type)
+	}
+
+	if err := set.Parse(args); err != nil {
+		return flags, err
+	}
+
+	flags.Args = set.Args()
+	return flags, nil
+}
+
+func flagKind(fieldType reflect.Type) string {
+	switch fieldType {
+	case reflect.TypeOf(time.Duration(0)):
+		return "duration"
+	case reflect.TypeOf([]string{}):
+		return "list"
+	case reflect.TypeOf(0):
+		return "int"
+	case reflect.TypeOf(false):
+		return ""
+	default:
+		return "string"
+	}
+}
+
+// e.g. "env READ_TIMEOUT, default 30s"
+func flagUsage(field reflect.StructField, key string) string {
+	usage := "env " + key
+	if value := field.Tag.Get("default"); value != "" && value != "false" {
+		usage += ", default " + value
+	}
+	if field.Tag.Get("secret") == "true" {
+		usage += ", prefer the env or a file for secrets"
+	}
+
+	return usage
+}
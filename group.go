@@ -0,0 +1,21 @@
+package main
+
+import "net/http"
+
+// Routes that share a path prefix and middleware, e.g. the /admin routes
+type RouteGroup struct {
+	server      *Server
+	prefix      string
+	middlewares []Middleware
+}
+
+// The middleware runs around every route of the group, outside the route's own
+func (server *Server) Group(prefix string, middlewares ...Middleware) *RouteGroup {
+	return &RouteGroup{server: server, prefix: prefix, middlewares: middlewares}
+}
+
+// Registers the handler at the prefix followed by path
+func (group *RouteGroup) Handle(method string, path string, handler http.HandlerFunc, middlewares ...Middleware) *Route {
+	all := append(append([]Middleware{}, middlewares...), group.middlewares...)
+	return group.server.Handle(method, group.prefix+path, group.server.AddMiddleware(handler, all...))
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang-api-example/pb"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The UserService of pb/users.proto, on the same store, tokens, API keys
+// and roles as the HTTP routes
+type userService struct {
+	pb.UnimplementedUserServiceServer
+	app *App
+}
+
+// Served next to the API on GRPC_PORT, with the API certificate when it has one
+func (app *App) NewGRPCServer(config *Config) (*grpc.Server, error) {
+	options := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcRecover, app.grpcAuthUnary),
+		grpc.ChainStreamInterceptor(app.grpcAuthStream),
+	}
+
+	if config.TLSCertFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+
+	server := grpc.NewServer(options...)
+	pb.RegisterUserServiceServer(server, userService{app: app})
+	return server, nil
+}
+
+// Serves gRPC on address while the API is up. Stopping waits for the
+// active calls until ctx is done, open WatchUsers streams end with userEvents.
+func (server *Server) ServeGRPC(address string, grpcServer *grpc.Server) {
+	var listener net.Listener
+
+	server.OnStart(func() error {
+		var err error
+		if listener, err = net.Listen("tcp", address); err != nil {
+			return err
+		}
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				errorf("grpc: %v", err)
+			}
+		}()
+		log.Println("gRPC listening on", listener.Addr())
+		return nil
+	})
+
+	server.OnShutdown("grpc", func(ctx context.Context) error {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+			return nil
+		case <-ctx.Done():
+			grpcServer.Stop()
+			return ctx.Err()
+		}
+	})
+}
+
+// Every call needs "authorization: Bearer <token>" or "x-api-key: <key>"
+// metadata, checked like RequireAuth and APIKeyAuth do, and the users:read permission
+func (app *App) grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	var user User
+	if secret := first("x-api-key"); secret != "" {
+		key, owner, err := app.checkAPIKey(secret, app.Clock.Now())
+		if err != nil {
+			return ctx, grpcError(err)
+		}
+		if _, err := app.Meter.Use(key.ID, app.Clock.Now()); err != nil {
+			return ctx, grpcError(err)
+		}
+		user = owner
+		ctx = context.WithValue(ctx, apiKeyKey, key)
+	} else {
+		header := first("authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == "" || token == header {
+			return ctx, status.Error(codes.Unauthenticated, "a bearer token is required")
+		}
+
+		claims, err := verifyToken(token, app.Clock.Now())
+		if err == nil && claims.Purpose != "" {
+			err = errors.New("not an access token")
+		}
+		if err == nil {
+			user, err = app.checkSession(claims)
+		}
+		if err != nil {
+			return ctx, status.Error(codes.Unauthenticated, err.Error())
+		}
+		ctx = context.WithValue(ctx, claimsKey, claims)
+	}
+
+	if !user.Role.Can(PermReadUsers) {
+		return ctx, status.Error(codes.PermissionDenied, "your role can not do this")
+	}
+
+	return context.WithValue(ctx, currentUserKey, user), nil
+}
+
+func (app *App) grpcAuthUnary(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := app.grpcAuthenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, request)
+}
+
+func (app *App) grpcAuthStream(service interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := app.grpcAuthenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(service, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// A stream carrying the context of grpcAuthenticate
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *authenticatedStream) Context() context.Context {
+	return stream.ctx
+}
+
+// net/http survives a panicking handler, grpc does not
+func grpcRecover(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (response interface{}, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			errorf("panic in %s: %v", info.FullMethod, recovered)
+			err = status.Error(codes.Internal, "internal server error")
+		}
+	}()
+	return handler(ctx, request)
+}
+
+// gRPC codes of the HTTP statuses an AppError carries
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:           codes.InvalidArgument,
+	http.StatusUnauthorized:         codes.Unauthenticated,
+	http.StatusForbidden:            codes.PermissionDenied,
+	http.StatusNotFound:             codes.NotFound,
+	http.StatusConflict:             codes.AlreadyExists,
+	http.StatusGone:                 codes.NotFound,
+	http.StatusPreconditionFailed:   codes.Aborted,
+	http.StatusPreconditionRequired: codes.FailedPrecondition,
+	http.StatusUnprocessableEntity:  codes.InvalidArgument,
+	http.StatusTooManyRequests:      codes.ResourceExhausted,
+	http.StatusNotImplemented:       codes.Unimplemented,
+	http.StatusServiceUnavailable:   codes.Unavailable,
+}
+
+// The status of an error, AppErrors keep their message and invalid fields,
+// other errors are logged and hidden like Error does
+func grpcError(err error) error {
+	appErr, ok := asAppError(err)
+	if !ok {
+		errorf("grpc: %v", err)
+		return status.Error(codes.Internal, "internal server error")
+	}
+
+	code, ok := grpcCodes[appErr.Status]
+	if !ok {
+		code = codes.Unknown
+	}
+
+	st := status.New(code, appErr.Message)
+
+	var violations []*errdetails.BadRequest_FieldViolation
+	if appErr.Field != "" {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: appErr.Field, Description: appErr.Message})
+	}
+	for _, detail := range appErr.Details {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: detail.Field, Description: detail.Message, Reason: detail.Rule})
+	}
+
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: appErr.apiError().Code, Domain: "golang-api"}}
+	if len(violations) > 0 {
+		details = append(details, &errdetails.BadRequest{FieldViolations: violations})
+	}
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		st = withDetails
+	}
+
+	return st.Err()
+}
+
+func (service userService) GetUser(ctx context.Context, request *pb.GetUserRequest) (*pb.User, error) {
+	id, err := parseUserID(request.GetId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	user, err := service.app.Store.Get(id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	if user.Deleted() && !request.GetIncludeDeleted() {
+		return nil, grpcError(ErrNotFound("user"))
+	}
+
+	return grpcUser(user)
+}
+
+func (service userService) ListUsers(ctx context.Context, request *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	limit, offset := int(request.GetLimit()), int(request.GetOffset())
+	if limit < 0 || limit > 1000 {
+		return nil, grpcError(&AppError{Status: http.StatusBadRequest, Message: "must be between 0 and 1000", Field: "limit"})
+	}
+	if offset < 0 {
+		return nil, grpcError(&AppError{Status: http.StatusBadRequest, Message: "must not be negative", Field: "offset"})
+	}
+
+	response := &pb.ListUsersResponse{Users: make([]*pb.User, 0)}
+	index := 0
+	err := eachUser(service.app.Store, func(user User) error {
+		if user.Deleted() && !request.GetIncludeDeleted() {
+			return nil
+		}
+		if index++; index <= offset {
+			return nil
+		}
+		if limit > 0 && len(response.Users) == limit {
+			response.More = true
+			return errPageFull
+		}
+
+		message, err := userToProto(publicUser(user))
+		if err != nil {
+			return err
+		}
+		response.Users = append(response.Users, message)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPageFull) {
+		return nil, grpcError(err)
+	}
+
+	return response, nil
+}
+
+// Same rules as POST /api/user
+func (service userService) CreateUser(ctx context.Context, request *pb.CreateUserRequest) (*pb.User, error) {
+	user := userFromProto(request.GetUser())
+	user.ID, user.Version = "", 0
+
+	if err := user.Validate(); err != nil {
+		return nil, grpcError(ErrValidation(err))
+	}
+
+	current, _ := contextUser(ctx)
+	if user.Role != "" && user.Role != RoleMember && !current.Role.Can(PermManageRoles) {
+		return nil, grpcError(&AppError{Status: http.StatusForbidden, Code: CodeRoleChangeForbidden, Message: "only admins can change roles", Field: "role"})
+	}
+
+	user, err := service.app.Store.Create(user)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return grpcUser(user)
+}
+
+// Same rules as PUT /api/users/{id}, the version replaces If-Match
+func (service userService) UpdateUser(ctx context.Context, request *pb.UpdateUserRequest) (*pb.User, error) {
+	user := userFromProto(request.GetUser())
+
+	id, err := parseUserID(string(user.ID))
+	if err == nil {
+		err = canWriteUser(ctx, id)
+	}
+	if err == nil && user.Version == 0 {
+		err = &AppError{Status: http.StatusPreconditionRequired, Message: "the version is required", Field: "version"}
+	}
+	if err == nil && user.Password != "" {
+		err = &AppError{Status: http.StatusUnprocessableEntity, Message: "change the password with POST /api/me/password", Field: "password"}
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	user.ID = id
+
+	if err := user.Validate(); err != nil {
+		return nil, grpcError(ErrValidation(err))
+	}
+
+	if err := service.app.canSetRole(ctx, user); err != nil {
+		return nil, grpcError(err)
+	}
+
+	user, err = service.app.Store.Update(user)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return grpcUser(user)
+}
+
+func (service userService) DeleteUser(ctx context.Context, request *pb.DeleteUserRequest) (*emptypb.Empty, error) {
+	current, _ := contextUser(ctx)
+	if !current.Role.Can(PermDeleteUsers) {
+		return nil, status.Error(codes.PermissionDenied, "your role can not do this")
+	}
+
+	id, err := parseUserID(request.GetId())
+	if err == nil && request.GetVersion() == 0 {
+		err = &AppError{Status: http.StatusPreconditionRequired, Message: "the version is required", Field: "version"}
+	}
+	if err == nil {
+		err = service.app.Store.Delete(id, request.GetVersion())
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// The events of GET /api/events, from the call on
+func (service userService) WatchUsers(request *pb.WatchUsersRequest, stream grpc.ServerStreamingServer[pb.UserEvent]) error {
+	events, _, cancel := service.app.Events.Subscribe(0)
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-service.app.Events.closed:
+			return status.Error(codes.Unavailable, "the server is shutting down")
+		case event, ok := <-events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "too many events behind, watch again")
+			}
+
+			message := &pb.UserEvent{Id: event.ID, Type: event.Type, UserId: string(event.UserID), At: timestamppb.New(event.At)}
+			if event.User != nil {
+				user, err := userToProto(*event.User)
+				if err != nil {
+					return grpcError(err)
+				}
+				message.User = user
+			}
+
+			if err := stream.Send(message); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// The public fields of a stored user
+func grpcUser(user User) (*pb.User, error) {
+	message, err := userToProto(publicUser(user))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return message, nil
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Send responses to the user
@@ -16,22 +22,393 @@ func HandlerHome(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Welcome to GoLang RESTful API!")
 }
 
-func UserPostRequest(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
-	var user User
-	err := decoder.Decode(&user)
+// POST /user and /api/users, the user is validated by Wrap
+func (app *App) CreateUser(ctx context.Context, user User) (User, error) {
+	current, _ := contextUser(ctx)
+	if user.Role != "" && user.Role != RoleMember && !current.Role.Can(PermManageRoles) {
+		return User{}, &AppError{Status: http.StatusForbidden, Code: CodeRoleChangeForbidden, Message: "only admins can change roles", Field: "role"}
+	}
+
+	user, err := app.Store.Create(user)
+	if err != nil {
+		return User{}, err
+	}
+
+	return publicUser(user), nil
+}
+
+func (app *App) UserGetRequest(w http.ResponseWriter, r *http.Request) {
+	location, err := displayLocation(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	var params struct {
+		IncludeDeleted bool `query:"include_deleted"`
+		Limit          int  `query:"limit" validate:"min=1,max=1000"` // Every user when missing
+		Offset         int  `query:"offset" validate:"min=0"`
+	}
+	if err := Bind(r, &params); err != nil {
+		Error(w, err)
+		return
+	}
+
+	// Walks the users of the page, more tells whether a next page exists
+	var more bool
+	eachOfPage := func(fn func(User) error) error {
+		index, sent := 0, 0
+		err := eachUser(app.Store, func(user User) error {
+			if user.Deleted() && !params.IncludeDeleted {
+				return nil
+			}
+			if index++; index <= params.Offset {
+				return nil
+			}
+			if params.Limit > 0 && sent == params.Limit {
+				more = true
+				return errPageFull
+			}
+			sent++
+			return fn(publicUser(user.In(location)))
+		})
+		if errors.Is(err, errPageFull) {
+			return nil
+		}
+		return err
+	}
+
+	// Plain JSON is streamed, memory stays flat however many users there are
+	if canStream(w) {
+		stream := NewJSONStream(w, http.StatusOK)
+		err := eachOfPage(func(user User) error { return stream.Write(user) })
+		if err == nil {
+			err = stream.Close(pageLinks(r, params.Offset, params.Limit, more))
+		}
+		if err != nil {
+			stream.Fail(err)
+		}
+		return
+	}
+
+	page := make([]User, 0)
+	if err := eachOfPage(func(user User) error {
+		page = append(page, user)
+		return nil
+	}); err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSONWithLinks(w, http.StatusOK, page, pageLinks(r, params.Offset, params.Limit, more))
+}
+
+// Stops the store iteration once a page has its users
+var errPageFull = errors.New("page full")
+
+// Reads the {id} path param, handlers with more parameters use Bind
+func parseID(r *http.Request) (ID, error) {
+	var params struct {
+		ID ID `path:"id"`
+	}
+	err := Bind(r, &params)
+	return params.ID, err
+}
+
+// Accepts a positive integer that fits in 64 bits, a UUID or a ULID.
+// Integers come back in their canonical form, 007 and +7 are 7 as in bodies.
+// With ID obfuscation only the public tokens are accepted.
+func parseUserID(value string) (ID, error) {
+	if value == "" {
+		return "", ErrBadRequest("the id is required")
+	}
+
+	raw, ok := internalID("users", value)
+	if !ok {
+		return "", ErrBadRequest("invalid id")
+	}
+
+	if isUUID(string(raw)) || isULID(string(raw)) {
+		return raw, nil
+	}
+
+	if strings.Trim(string(raw), "+-0123456789") != "" {
+		return "", ErrBadRequest("invalid id")
+	}
+
+	number, err := strconv.ParseInt(string(raw), 10, 64)
+	if errors.Is(err, strconv.ErrRange) && raw[0] != '-' {
+		return "", ErrBadRequest("invalid id, it overflows a 64-bit integer")
+	}
+	if err != nil || number < 1 {
+		return "", ErrBadRequest("invalid id, it must be a positive integer")
+	}
+
+	return ID(strconv.FormatInt(number, 10)), nil
+}
+
+// Parameters of GET /user/{id}
+type GetUserParams struct {
+	ID             ID        `path:"id"`
+	IncludeDeleted bool      `query:"include_deleted"` // Deleted users are hidden otherwise
+	AsOf           time.Time `query:"as_of"`           // The user as it was at that time
+}
+
+func (app *App) GetUser(w http.ResponseWriter, r *http.Request) {
+	var params GetUserParams
+	if err := Bind(r, &params); err != nil {
+		Error(w, err)
+		return
+	}
 
+	location, err := displayLocation(r)
 	if err != nil {
-		fmt.Fprintf(w, "error: %v", err)
+		Error(w, err)
 		return
 	}
-	response, err := user.ToJson()
 
+	if !params.AsOf.IsZero() {
+		app.getUserAsOf(w, params.ID, params.AsOf, location)
+		return
+	}
+
+	user, err := app.Store.Get(params.ID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		Error(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(response)
+	if user.Deleted() && !params.IncludeDeleted {
+		Error(w, ErrNotFound("user"))
+		return
+	}
+
+	setETag(w, user)
+	JSON(w, http.StatusOK, publicUser(user.In(location)))
+}
+
+func (app *App) getUserAsOf(w http.ResponseWriter, id ID, at time.Time, location *time.Location) {
+	if app.Audit == nil {
+		Error(w, ErrBadRequest("history is not available"))
+		return
+	}
+
+	user, err := app.Audit.GetAsOf(id, at)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, publicUser(user.In(location)))
+}
+
+// Request of PUT /api/users/{id} and PUT /api/me, the body is the user
+type UpdateUserRequest struct {
+	User
+	ID      ID     `json:"-" path:"id"`
+	IfMatch string `json:"-" header:"If-Match"` // The version replaced, see ifMatchVersion
+}
+
+// /api/me has no id in the path, it changes the authenticated user
+func (request *UpdateUserRequest) Authorize(ctx context.Context) error {
+	if user, ok := contextUser(ctx); ok && request.ID == "" {
+		request.ID = user.ID
+	}
+	return canWriteUser(ctx, request.ID)
+}
+
+// The password has its own route, the checks of the user come after
+func (request *UpdateUserRequest) Validate() error {
+	if request.Password != "" {
+		return ErrPasswordChange()
+	}
+	return request.User.Validate()
+}
+
+// PUT replaces every field of the user, Authorize checked the caller can
+func (app *App) UpdateUser(ctx context.Context, request UpdateUserRequest) (User, error) {
+	version, err := app.ifMatchVersion(request.IfMatch, request.ID)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := request.User
+	user.ID = request.ID
+	user.Version = version
+
+	if err := app.canSetRole(ctx, user); err != nil {
+		return User{}, err
+	}
+
+	user, err = app.Store.Update(user)
+	if err != nil {
+		return User{}, err
+	}
+
+	return publicUser(user), nil
+}
+
+// PATCH changes only the fields sent, using JSON Merge Patch (RFC 7386)
+// or JSON Patch (RFC 6902) depending on the Content-Type
+func (app *App) PatchUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r)
+	if err == nil {
+		err = canWriteUser(r.Context(), id)
+	}
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	version, err := app.ifMatchVersion(r.Header.Get("If-Match"), id)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	applyPatch := mergePatchUser
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "application/merge-patch+json", "application/json":
+	case "application/json-patch+json":
+		applyPatch = jsonPatchUser
+	default:
+		Error(w, &AppError{Status: http.StatusUnsupportedMediaType, Message: "use application/merge-patch+json or application/json-patch+json"})
+		return
+	}
+
+	patch, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxJSONBodySize))
+	if err != nil {
+		Error(w, jsonDecodeError(err))
+		return
+	}
+
+	user, err := app.Store.Get(id)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	if user.Deleted() {
+		Error(w, ErrNotFound("user"))
+		return
+	}
+
+	user, err = applyPatch(user, patch)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	user.ID = id
+	user.Version = version
+
+	app.saveUser(w, r, user)
+}
+
+// Validates and stores an updated user
+func (app *App) saveUser(w http.ResponseWriter, r *http.Request, user User) {
+	if user.Password != "" {
+		Error(w, ErrPasswordChange())
+		return
+	}
+
+	if err := user.Validate(); err != nil {
+		recordValidationFailure(r, err)
+		Error(w, ErrValidation(err))
+		return
+	}
+
+	if err := app.canSetRole(r.Context(), user); err != nil {
+		Error(w, err)
+		return
+	}
+
+	user, err := app.Store.Update(user)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	setETag(w, user)
+	JSON(w, http.StatusOK, publicUser(user))
+}
+
+func (app *App) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	version, err := app.ifMatchVersion(r.Header.Get("If-Match"), id)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	if err := app.Store.Delete(id, version); err != nil {
+		Error(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Undoes a delete, If-Match must carry the version of the deleted user
+func (app *App) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	version, err := app.ifMatchVersion(r.Header.Get("If-Match"), id)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	user, err := app.Store.Restore(id, version)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	setETag(w, user)
+	JSON(w, http.StatusOK, publicUser(user))
+}
+
+// Passwords are changed with the current one, not by PUT or PATCH
+func ErrPasswordChange() *AppError {
+	return &AppError{Status: http.StatusUnprocessableEntity, Message: "change the password with POST /api/me/password", Field: "password"}
+}
+
+// The version as an HTTP entity tag, sent by Wrap for the User responses
+func (user User) ETag() string {
+	return strconv.Quote(strconv.FormatInt(user.Version, 10))
+}
+
+func setETag(w http.ResponseWriter, user User) {
+	w.Header().Set("ETag", user.ETag())
+}
+
+// Version the client expects from the If-Match header, writes without it are rejected.
+// "*" means any version, so the current one is used.
+func (app *App) ifMatchVersion(header string, id ID) (int64, error) {
+	if header == "" {
+		return 0, &AppError{Status: http.StatusPreconditionRequired, Message: "the If-Match header is required"}
+	}
+
+	if header == "*" {
+		user, err := app.Store.Get(id)
+		return user.Version, err
+	}
+
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(header, "W/"), `"`), 10, 64)
+	if err != nil {
+		return 0, ErrPreconditionFailed()
+	}
+
+	return version, nil
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseUserID(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  ID
+		err   string // Part of the message, "" when the ID is valid
+	}{
+		{"empty", "", "", "the id is required"},
+		{"negative", "-1", "", "it must be a positive integer"},
+		{"zero", "0", "", "it must be a positive integer"},
+		{"max int64", "9223372036854775807", "9223372036854775807", ""},
+		{"overflow", "9223372036854775808", "", "it overflows a 64-bit integer"},
+		{"negative overflow", "-9223372036854775809", "", "it must be a positive integer"},
+		{"letters", "abc", "", "invalid id"},
+		{"digits and letters", "12a", "", "invalid id"},
+		{"decimal", "1.5", "", "invalid id"},
+		{"spaces", " 7", "", "invalid id"},
+		{"canonical", "7", "7", ""},
+		{"leading zeros", "007", "7", ""},
+		{"plus sign", "+7", "7", ""},
+		{"uuid", "0b9e1a2c-3f4d-4e5f-8a6b-7c8d9e0f1a2b", "0b9e1a2c-3f4d-4e5f-8a6b-7c8d9e0f1a2b", ""},
+		{"ulid", "01ARZ3NDEKTSV4RRFFQ69G5FAV", "01ARZ3NDEKTSV4RRFFQ69G5FAV", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkParseUserID(t, test.value, test.want, test.err)
+		})
+	}
+}
+
+func TestParseUserIDObfuscated(t *testing.T) {
+	obfuscateUserIDs(t)
+	token := string(publicID("users", "42"))
+
+	tests := []struct {
+		name  string
+		value string
+		want  ID
+		err   string
+	}{
+		{"token", token, "42", ""},
+		{"plain id", "42", "", "invalid id"},
+		{"tampered token", "A" + token[1:], "", "invalid id"},
+		{"not base64", "!!!!", "", "invalid id"},
+		{"empty", "", "", "the id is required"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkParseUserID(t, test.value, test.want, test.err)
+		})
+	}
+}
+
+func checkParseUserID(t *testing.T, value string, want ID, wantErr string) {
+	t.Helper()
+
+	id, err := parseUserID(value)
+	if wantErr == "" {
+		if err != nil {
+			t.Fatalf("parseUserID(%q): %v", value, err)
+		}
+		if id != want {
+			t.Fatalf("parseUserID(%q) = %q, want %q", value, id, want)
+		}
+		return
+	}
+
+	if err == nil {
+		t.Fatalf("parseUserID(%q) = %q, want an error", value, id)
+	}
+	if appErr, ok := asAppError(err); !ok || appErr.Status != http.StatusBadRequest || !strings.Contains(appErr.Message, wantErr) {
+		t.Fatalf("parseUserID(%q): %v, want a 400 with %q", value, err, wantErr)
+	}
+}
+
+// Turns ID_OBFUSCATION=users on for the test
+func obfuscateUserIDs(t *testing.T) {
+	t.Helper()
+
+	previous := idCipher
+	if err := setupIDObfuscation([]string{"users"}, "test obfuscation key"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		idCipher = previous
+		delete(obfuscatedResources, "users")
+	})
+}
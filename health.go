@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Time a single check gets before it counts as failing
+const healthCheckTimeout = 2 * time.Second
+
+// Verdicts of a health report
+const (
+	HealthHealthy   = "healthy"
+	HealthDegraded  = "degraded"  // An optional check is failing
+	HealthUnhealthy = "unhealthy" // A required check is failing
+)
+
+// Something the API depends on, nil when it works
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// Lets plain functions be used as checkers, like http.HandlerFunc
+type HealthCheckFunc func(ctx context.Context) error
+
+func (check HealthCheckFunc) CheckHealth(ctx context.Context) error {
+	return check(ctx)
+}
+
+type registeredCheck struct {
+	name     string
+	checker  HealthChecker
+	required bool
+}
+
+// Named checks of a server, see Server.AddHealthCheck
+type HealthRegistry struct {
+	mutex  sync.RWMutex
+	checks []registeredCheck
+}
+
+type DependencyStatus struct {
+	Name     string  `json:"name"`
+	Healthy  bool    `json:"healthy"`
+	Required bool    `json:"required"`
+	Latency  float64 `json:"latency_ms"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status string             `json:"status"` // healthy, degraded or unhealthy
+	Checks []DependencyStatus `json:"checks"`
+}
+
+// A failing check makes the API unhealthy
+func (server *Server) AddHealthCheck(name string, checker HealthChecker) {
+	server.health.add(name, checker, true)
+}
+
+// A failing check only makes the API degraded, e.g. a cache
+func (server *Server) AddOptionalHealthCheck(name string, checker HealthChecker) {
+	server.health.add(name, checker, false)
+}
+
+func (registry *HealthRegistry) add(name string, checker HealthChecker, required bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.checks = append(registry.checks, registeredCheck{name: name, checker: checker, required: required})
+}
+
+// Runs every check at the same time
+func (registry *HealthRegistry) Run(ctx context.Context) HealthReport {
+	registry.mutex.RLock()
+	checks := append([]registeredCheck(nil), registry.checks...)
+	registry.mutex.RUnlock()
+
+	report := HealthReport{Status: HealthHealthy, Checks: make([]DependencyStatus, len(checks))}
+
+	var wait sync.WaitGroup
+	for i, check := range checks {
+		wait.Add(1)
+		go func(i int, check registeredCheck) {
+			defer wait.Done()
+			report.Checks[i] = runHealthCheck(ctx, check)
+		}(i, check)
+	}
+	wait.Wait()
+
+	for _, status := range report.Checks {
+		if status.Healthy {
+			continue
+		}
+		if status.Required {
+			report.Status = HealthUnhealthy
+		} else if report.Status == HealthHealthy {
+			report.Status = HealthDegraded
+		}
+	}
+
+	sort.SliceStable(report.Checks, func(i, j int) bool {
+		return report.Checks[i].Name < report.Checks[j].Name
+	})
+
+	return report
+}
+
+func runHealthCheck(ctx context.Context, check registeredCheck) DependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.checker.CheckHealth(ctx)
+
+	status := DependencyStatus{
+		Name:     check.name,
+		Healthy:  err == nil,
+		Required: check.required,
+		Latency:  float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	return status
+}
+
+// Pings the stores that can tell whether they work
+func (app *App) storeHealthCheck(ctx context.Context) error {
+	if pinger, ok := app.Store.(Pinger); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
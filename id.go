@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Written as a JSON string instead of a number when STRING_IDS is on.
+// JavaScript numbers lose precision above 2^53, strings keep every digit.
+var stringIDs bool
+
+// How new IDs are made: int (sequential, the default), uuid (v4) or ulid.
+// Sequential IDs leak how many records exist and collide across instances.
+var idStrategy = "int"
+
+// Resource identifier. Sequential IDs are kept as their decimal string and
+// written as JSON numbers, UUIDs and ULIDs as strings.
+type ID string
+
+func (id ID) Int() (int64, bool) {
+	value, err := strconv.ParseInt(string(id), 10, 64)
+	return value, err == nil
+}
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	if _, numeric := id.Int(); numeric && !stringIDs {
+		return []byte(id), nil
+	}
+
+	return []byte(strconv.Quote(string(id))), nil
+}
+
+// Accepts both 123 and "123"
+func (id *ID) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	raw := string(data)
+	if unquoted, err := strconv.Unquote(raw); err == nil {
+		raw = unquoted
+	} else if _, err := strconv.ParseFloat(raw, 64); err != nil {
+		return fmt.Errorf("id %s is not a number or a string", raw)
+	}
+
+	if raw == "" {
+		*id = ""
+		return nil
+	}
+
+	// Numbers must fit in 64 bits, anything else must be a UUID or ULID
+	if strings.Trim(raw, "0123456789-+.eE") == "" {
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if errors.Is(err, strconv.ErrRange) {
+			return fmt.Errorf("id %s overflows a 64-bit integer", raw)
+		}
+		if err != nil {
+			return fmt.Errorf("id %s is not an integer", raw)
+		}
+		*id = ID(strconv.FormatInt(value, 10))
+		return nil
+	}
+
+	if !isUUID(raw) && !isULID(raw) {
+		return fmt.Errorf("id %q is not a valid id", raw)
+	}
+
+	*id = ID(raw)
+	return nil
+}
+
+// Sequential IDs sort by number, the others by their text
+func lessID(a ID, b ID) bool {
+	aInt, aNumeric := a.Int()
+	bInt, bNumeric := b.Int()
+
+	if aNumeric && bNumeric {
+		return aInt < bInt
+	}
+	if aNumeric != bNumeric {
+		return aNumeric
+	}
+
+	return a < b
+}
+
+// New random ID for the uuid and ulid strategies, false means use the store sequence.
+// ULIDs start with now.
+func newRandomID(now time.Time) (ID, bool) {
+	switch idStrategy {
+	case "uuid":
+		return newUUID(), true
+	case "ulid":
+		return newULID(now), true
+	default:
+		return "", false
+	}
+}
+
+func validIDStrategy(strategy string) bool {
+	return strategy == "int" || strategy == "uuid" || strategy == "ulid"
+}
+
+// Random UUID version 4
+func newUUID() ID {
+	var uuid [16]byte
+	rand.Read(uuid[:])
+	uuid[6] = (uuid[6] & 0x0f) | 0x40 // Version 4
+	uuid[8] = (uuid[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return ID(fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]))
+}
+
+func isUUID(value string) bool {
+	if len(value) != 36 {
+		return false
+	}
+
+	for i, char := range value {
+		switch i {
+		case 8, 13, 18, 23:
+			if char != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", char) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID: 48 bits of milliseconds and 80 random bits in Crockford base32, sorts by creation time
+func newULID(now time.Time) ID {
+	var data [16]byte
+	binary.BigEndian.PutUint64(data[:8], uint64(now.UnixNano()/int64(time.Millisecond))<<16)
+	rand.Read(data[6:])
+
+	// 128 bits written as 26 characters of 5 bits, the first one holds only 3 bits
+	var encoded [26]byte
+	high := binary.BigEndian.Uint64(data[:8])
+	low := binary.BigEndian.Uint64(data[8:])
+	for i := 25; i >= 0; i-- {
+		encoded[i] = crockford[low&0x1f]
+		low = (low >> 5) | (high << 59)
+		high >>= 5
+	}
+
+	return ID(encoded[:])
+}
+
+func isULID(value string) bool {
+	if len(value) != 26 || value[0] > '7' {
+		return false
+	}
+
+	for _, char := range strings.ToUpper(value) {
+		if !strings.ContainsRune(crockford, char) {
+			return false
+		}
+	}
+
+	return true
+}
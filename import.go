@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Uploads above it are rejected, bigger imports must be split
+const maxImportSize = 10 << 20
+
+// Outcome of an import, rows lists the ones that were not created
+type ImportReport struct {
+	Created int         `json:"created"`
+	Updated int         `json:"updated"`
+	Skipped int         `json:"skipped"`
+	Failed  int         `json:"failed"`
+	Rows    []ImportRow `json:"rows"`
+}
+
+type ImportRow struct {
+	Index  int    `json:"index"` // Position of the row in the file, the CSV header not counted
+	Status string `json:"status"`
+	ID     ID     `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Creates the users of a multipart "file" upload, a CSV with a header row
+// (same columns as the export) or a JSON array. Rows whose email is taken are
+// skipped, or update that user when the form has upsert=true.
+// With "Prefer: respond-async" the file is read and the rows are imported by a job.
+func (app *App) ImportUsers(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		Error(w, ErrBadRequest(fmt.Sprintf("a multipart file field is required: %v", err)))
+		return
+	}
+	defer file.Close()
+
+	upsert, err := strconv.ParseBool(r.FormValue("upsert"))
+	if err != nil && r.FormValue("upsert") != "" {
+		Error(w, ErrBadRequest("upsert must be true or false"))
+		return
+	}
+
+	var users []User
+	switch importFormat(header) {
+	case "csv":
+		users, err = readCSVUsers(file)
+	case "json":
+		err = json.NewDecoder(file).Decode(&users)
+	default:
+		Error(w, &AppError{Status: http.StatusUnsupportedMediaType, Message: "upload a .csv or .json file"})
+		return
+	}
+
+	if err != nil {
+		Error(w, ErrBadRequest(fmt.Sprintf("invalid file: %v", err)))
+		return
+	}
+
+	if prefersAsync(r) {
+		app.acceptJob(w, r, "import_users", func(ctx context.Context, job *JobHandle) (interface{}, error) {
+			return app.importUsers(ctx, r, users, upsert, job.Progress)
+		})
+		return
+	}
+
+	report, err := app.importUsers(r.Context(), r, users, upsert, func(done, total int) {})
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, report)
+}
+
+// Stops between rows once ctx is done, the rows imported so far stay
+func (app *App) importUsers(ctx context.Context, r *http.Request, users []User, upsert bool, progress func(done, total int)) (ImportReport, error) {
+	// Existing users by email, for the skip or upsert decision
+	existing := make(map[string]User)
+	current, err := app.Store.List()
+	if err != nil {
+		return ImportReport{}, err
+	}
+	for _, user := range current {
+		existing[emailKey(user.Email)] = user
+	}
+
+	report := ImportReport{Rows: []ImportRow{}}
+	for i, user := range users {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		row := app.importUser(r, user, existing, upsert)
+		row.Index = i
+		progress(i+1, len(users))
+
+		switch row.Status {
+		case "created":
+			report.Created++
+			continue
+		case "updated":
+			report.Updated++
+		case "skipped":
+			report.Skipped++
+		default:
+			report.Failed++
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	return report, nil
+}
+
+func (app *App) importUser(r *http.Request, user User, existing map[string]User, upsert bool) ImportRow {
+	if err := user.Validate(); err != nil {
+		recordValidationFailure(r, err)
+		return ImportRow{Status: "failed", Error: err.Error()}
+	}
+
+	stored, taken := existing[emailKey(user.Email)]
+	if !taken {
+		created, err := app.Store.Create(user)
+		if err != nil {
+			return ImportRow{Status: "failed", Error: importError(err)}
+		}
+		existing[emailKey(created.Email)] = created
+		return ImportRow{Status: "created", ID: publicID("users", created.ID)}
+	}
+
+	if !upsert {
+		return ImportRow{Status: "skipped", ID: publicID("users", stored.ID), Error: "email is already in use"}
+	}
+
+	if stored.Deleted() {
+		return ImportRow{Status: "skipped", ID: publicID("users", stored.ID), Error: "the user with this email is deleted"}
+	}
+
+	user.ID = stored.ID
+	user.Version = stored.Version
+	updated, err := app.Store.Update(user)
+	if err != nil {
+		return ImportRow{Status: "failed", ID: publicID("users", stored.ID), Error: importError(err)}
+	}
+	existing[emailKey(updated.Email)] = updated
+
+	return ImportRow{Status: "updated", ID: publicID("users", updated.ID)}
+}
+
+// Client errors are reported as is, the rest is hidden like in Error
+func importError(err error) string {
+	if appErr, ok := asAppError(err); ok {
+		return appErr.Message
+	}
+	return "internal server error"
+}
+
+// By the part Content-Type, or the file extension when the client sent a generic one
+func importFormat(header *multipart.FileHeader) string {
+	contentType := header.Header.Get("Content-Type")
+
+	switch {
+	case strings.HasPrefix(contentType, "text/csv"):
+		return "csv"
+	case strings.HasPrefix(contentType, "application/json"):
+		return "json"
+	}
+
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(header.Filename)), ".")
+}
+
+// Reads the columns by header name, unknown columns and the ones set by the
+// store (id, version, timestamps) are ignored so an export can be imported back
+func readCSVUsers(file io.Reader) ([]User, error) {
+	reader := csv.NewReader(file)
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return record[i]
+		}
+		return ""
+	}
+
+	var users []User
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return users, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		user := User{
+			Name:     column(record, "name"),
+			Email:    column(record, "email"),
+			Phone:    column(record, "phone"),
+			Role:     Role(column(record, "role")),
+			Password: column(record, "password"),
+		}
+
+		if raw := column(record, "attributes"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &user.Attributes); err != nil {
+				line, _ := reader.FieldPos(0)
+				return nil, fmt.Errorf("line %d: attributes: %v", line, err)
+			}
+		}
+
+		users = append(users, user)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobTTL           = time.Hour              // Finished jobs and their files are kept this long
+	jobProgressEvery = 500 * time.Millisecond // Progress is saved at most this often
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// A long running operation submitted with "Prefer: respond-async"
+type Job struct {
+	ID         ID          `json:"id"`
+	Type       string      `json:"type"` // import_users or export_users
+	Status     JobStatus   `json:"status"`
+	Progress   JobProgress `json:"progress"`
+	Result     interface{} `json:"result,omitempty"` // Once succeeded, e.g. the ImportReport
+	Error      *APIError   `json:"error,omitempty"`  // Once failed
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  time.Time   `json:"started_at,omitzero"`
+	FinishedAt time.Time   `json:"finished_at,omitzero"`
+
+	OwnerID ID       `json:"-"` // Only the user that submitted it sees it
+	File    FileInfo `json:"-"` // Download of the export jobs
+	Path    string   `json:"-"` // Where the download is kept
+}
+
+// Items handled so far, Total is 0 while unknown
+type JobProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+func (job Job) Finished() bool {
+	return job.Status == JobSucceeded || job.Status == JobFailed
+}
+
+func (job Job) Links() Links {
+	links := Links{}.add("self", linkTo("get_job", "id", string(job.ID)))
+	if job.Status == JobSucceeded && job.Path != "" {
+		links.add("result", linkTo("get_job_result", "id", string(job.ID)))
+	}
+	return links
+}
+
+// Keeps the jobs while they run and for jobTTL after
+type JobStore interface {
+	SaveJob(job Job) error
+	GetJob(id ID) (Job, error)
+	ListJobs() ([]Job, error)
+	DeleteJob(id ID) error
+}
+
+func ErrJobNotFound() *AppError {
+	return ErrNotFound("job")
+}
+
+// In-memory implementation, jobs are lost when the process stops
+type MemoryJobStore struct {
+	mutex sync.RWMutex
+	jobs  map[ID]Job
+}
+
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{jobs: make(map[ID]Job)}
+}
+
+func (jobStore *MemoryJobStore) SaveJob(job Job) error {
+	jobStore.mutex.Lock()
+	defer jobStore.mutex.Unlock()
+
+	jobStore.jobs[job.ID] = job
+	return nil
+}
+
+func (jobStore *MemoryJobStore) GetJob(id ID) (Job, error) {
+	jobStore.mutex.RLock()
+	defer jobStore.mutex.RUnlock()
+
+	job, exists := jobStore.jobs[id]
+	if !exists {
+		return Job{}, ErrJobNotFound()
+	}
+	return job, nil
+}
+
+// Job IDs are ULIDs, so this is submission order
+func (jobStore *MemoryJobStore) ListJobs() ([]Job, error) {
+	jobStore.mutex.RLock()
+	defer jobStore.mutex.RUnlock()
+
+	jobs := make([]Job, 0, len(jobStore.jobs))
+	for _, job := range jobStore.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+
+	return jobs, nil
+}
+
+func (jobStore *MemoryJobStore) DeleteJob(id ID) error {
+	jobStore.mutex.Lock()
+	defer jobStore.mutex.Unlock()
+
+	delete(jobStore.jobs, id)
+	return nil
+}
+
+// What a job does. It reports its progress through the handle and returns
+// the result, ctx is cancelled when the server can not wait for it any longer.
+type JobFunc func(ctx context.Context, job *JobHandle) (interface{}, error)
+
+// Lets a running job report its progress and leave a file for download
+type JobHandle struct {
+	runner *JobRunner
+	id     ID
+	file   FileInfo
+	path   string
+	saved  time.Time // Last progress save
+}
+
+// Saved at most every jobProgressEvery so big jobs do not hammer the store
+func (handle *JobHandle) Progress(done int, total int) {
+	if done != total && time.Since(handle.saved) < jobProgressEvery {
+		return
+	}
+	handle.saved = time.Now()
+
+	handle.runner.update(handle.id, func(job *Job) {
+		job.Progress = JobProgress{Done: done, Total: total}
+	})
+}
+
+// The file at path is the result of the job, removed when the job expires
+func (handle *JobHandle) SetFile(path string, info FileInfo) {
+	handle.path, handle.file = path, info
+}
+
+// Payload of the job tasks, the function stays in the runner
+type jobTask struct {
+	JobID ID `json:"job_id"`
+}
+
+// Runs the submitted jobs as tasks of the queue, at most concurrency at once.
+// The job functions are kept in memory, so jobs run in the process that took them.
+type JobRunner struct {
+	queue TaskQueue
+	jobs  JobStore
+	mutex sync.Mutex
+	funcs map[ID]JobFunc
+	stop  chan struct{}
+}
+
+func NewJobRunner(queue TaskQueue, jobs JobStore, concurrency int) *JobRunner {
+	runner := &JobRunner{
+		queue: queue,
+		jobs:  jobs,
+		funcs: make(map[ID]JobFunc),
+		stop:  make(chan struct{}),
+	}
+
+	queue.Handle("job", runner.run, TaskOptions{MaxAttempts: 1, Concurrency: concurrency})
+	go runner.expire()
+
+	return runner
+}
+
+// Queues the job, a full or closed queue is a 503
+func (runner *JobRunner) Submit(jobType string, ownerID ID, run JobFunc) (Job, error) {
+	now := time.Now().UTC()
+	job := Job{ID: newULID(now), Type: jobType, Status: JobQueued, OwnerID: ownerID, CreatedAt: now}
+
+	task, err := NewTask("job", jobTask{JobID: job.ID})
+	if err != nil {
+		return job, err
+	}
+
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+
+	if err := runner.jobs.SaveJob(job); err != nil {
+		return job, err
+	}
+	runner.funcs[job.ID] = run
+
+	if err := runner.queue.Enqueue(task); err != nil {
+		delete(runner.funcs, job.ID)
+		runner.jobs.DeleteJob(job.ID)
+		return job, err
+	}
+
+	return job, nil
+}
+
+// Failures end up in the job, they are not retried
+func (runner *JobRunner) run(ctx context.Context, task Task) error {
+	var payload jobTask
+	if err := task.Decode(&payload); err != nil {
+		return Permanent(err)
+	}
+
+	runner.mutex.Lock()
+	run, ok := runner.funcs[payload.JobID]
+	delete(runner.funcs, payload.JobID)
+	runner.mutex.Unlock()
+	if !ok {
+		return Permanent(fmt.Errorf("job %s is not known here", payload.JobID))
+	}
+
+	handle := &JobHandle{runner: runner, id: payload.JobID}
+	runner.update(payload.JobID, func(job *Job) {
+		job.Status = JobRunning
+		job.StartedAt = time.Now().UTC()
+	})
+
+	result, err := func() (result interface{}, err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				err = fmt.Errorf("panic: %v", recovered)
+			}
+		}()
+		return run(ctx, handle)
+	}()
+
+	runner.update(payload.JobID, func(job *Job) {
+		job.FinishedAt = time.Now().UTC()
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = jobError(err)
+			if handle.path != "" {
+				os.Remove(handle.path)
+			}
+			return
+		}
+		job.Status = JobSucceeded
+		job.Result = result
+		job.File, job.Path = handle.file, handle.path
+		if job.Progress.Total > 0 {
+			job.Progress.Done = job.Progress.Total
+		}
+	})
+
+	return nil
+}
+
+// Client errors are reported as is, the rest is logged and hidden like in Error
+func jobError(err error) *APIError {
+	if appErr, ok := asAppError(err); ok {
+		return appErr.apiError()
+	}
+	if errors.Is(err, context.Canceled) {
+		return &APIError{Code: statusCode(http.StatusServiceUnavailable), Message: "the server shut down while the job was running"}
+	}
+
+	errorf("job: %v", err)
+	return &APIError{Code: statusCode(http.StatusInternalServerError), Message: "internal server error"}
+}
+
+func (runner *JobRunner) update(id ID, change func(job *Job)) {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+
+	job, err := runner.jobs.GetJob(id)
+	if err != nil {
+		return
+	}
+	change(&job)
+	if err := runner.jobs.SaveJob(job); err != nil {
+		errorf("job %s: %v", id, err)
+	}
+}
+
+// Drops the jobs finished more than jobTTL ago and their files
+func (runner *JobRunner) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			runner.removeExpired(time.Now())
+		case <-runner.stop:
+			return
+		}
+	}
+}
+
+func (runner *JobRunner) removeExpired(now time.Time) {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+
+	jobs, err := runner.jobs.ListJobs()
+	if err != nil {
+		errorf("jobs: %v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		if !job.Finished() || now.Sub(job.FinishedAt) < jobTTL {
+			continue
+		}
+		if job.Path != "" {
+			os.Remove(job.Path)
+		}
+		runner.jobs.DeleteJob(job.ID)
+	}
+}
+
+// Stops expiring jobs and removes the files of the finished ones, after the queue drained
+func (runner *JobRunner) Close(ctx context.Context) error {
+	close(runner.stop)
+	runner.removeExpired(time.Now().Add(jobTTL))
+	return nil
+}
+
+// Asked with "Prefer: respond-async" (RFC 7240)
+func prefersAsync(r *http.Request) bool {
+	for _, value := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Submits the job and answers 202 with it and its URL in Location
+func (app *App) acceptJob(w http.ResponseWriter, r *http.Request, jobType string, run JobFunc) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	job, err := app.Jobs.Submit(jobType, userID, run)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	w.Header().Set("Preference-Applied", "respond-async")
+	w.Header().Set("Location", linkTo("get_job", "id", string(job.ID)))
+	JSON(w, http.StatusAccepted, job)
+}
+
+// Jobs of other users are not found
+func (app *App) ownJob(r *http.Request) (Job, error) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		return Job{}, err
+	}
+
+	job, err := app.Jobs.jobs.GetJob(ID(PathParam(r, "id")))
+	if err != nil || job.OwnerID != userID {
+		return Job{}, ErrJobNotFound()
+	}
+
+	return job, nil
+}
+
+// Status, progress and, once finished, the result or error of a job
+func (app *App) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, err := app.ownJob(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, job)
+}
+
+// The file of a finished export job
+func (app *App) GetJobResult(w http.ResponseWriter, r *http.Request) {
+	job, err := app.ownJob(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	if job.Status != JobSucceeded || job.Path == "" {
+		Error(w, &AppError{Status: http.StatusConflict, Message: "the job has no file to download, its status is " + string(job.Status)})
+		return
+	}
+
+	file, err := os.Open(job.Path)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	defer file.Close()
+
+	Attachment(w, r, file, job.File)
+}
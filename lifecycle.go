@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// How long a shutdown hook may still run once the shutdown deadline passed
+const shutdownGrace = 100 * time.Millisecond
+
+// Hooks run by Start and Shutdown, in registration order on start and in
+// reverse order on shutdown, so what starts first stops last
+type lifecycle struct {
+	onStart    []func() error
+	onReady    []func()
+	onShutdown []shutdownHook
+}
+
+type shutdownHook struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// Runs once the port is bound, before requests are served. An error stops Start.
+func (server *Server) OnStart(hook func() error) {
+	server.hooks.onStart = append(server.hooks.onStart, hook)
+}
+
+// Runs once the server is serving
+func (server *Server) OnReady(hook func()) {
+	server.hooks.onReady = append(server.hooks.onReady, hook)
+}
+
+// Runs after the active requests finished, e.g. to flush and close a store.
+// The name is logged with how long the hook took, or that it ran out of time.
+func (server *Server) OnShutdown(name string, hook func(ctx context.Context) error) {
+	server.hooks.onShutdown = append(server.hooks.onShutdown, shutdownHook{name: name, run: hook})
+}
+
+// Binds the port, runs the OnStart hooks, serves in the background and runs the OnReady hooks
+func (server *Server) Start() error {
+	if err := server.Bind(); err != nil {
+		return err
+	}
+
+	for _, hook := range server.hooks.onStart {
+		if err := hook(); err != nil {
+			server.listener.Close()
+			return fmt.Errorf("start hook: %v", err)
+		}
+	}
+
+	go func() {
+		if err := server.Serve(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	for _, hook := range server.hooks.onReady {
+		hook()
+	}
+
+	return nil
+}
+
+// Every hook runs even if one fails, the first error is returned. A hook
+// still running when ctx is done is left behind so the next ones get their
+// turn, e.g. the store still flushes when a worker is stuck.
+func (server *Server) runShutdownHooks(ctx context.Context) error {
+	var first error
+	for i := len(server.hooks.onShutdown) - 1; i >= 0; i-- {
+		hook := server.hooks.onShutdown[i]
+		if err := runShutdownHook(ctx, hook); err != nil {
+			errorf("shutdown %s: %v", hook.name, err)
+			if first == nil {
+				first = fmt.Errorf("%s: %w", hook.name, err)
+			}
+		}
+	}
+	return first
+}
+
+func runShutdownHook(ctx context.Context, hook shutdownHook) error {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- hook.run(ctx) }()
+
+	select {
+	case err := <-done:
+		debugf("shutdown %s: done in %s", hook.name, time.Since(start).Round(time.Millisecond))
+		return err
+	case <-ctx.Done():
+		// Hooks that ignore ctx get a moment once it is done, a quick close still beats none
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(shutdownGrace):
+			return fmt.Errorf("still running after %s: %w", time.Since(start).Round(time.Millisecond), ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Related URLs of a response by relation, e.g. self, next or avatar
+type Links map[string]string
+
+// Data that knows its URLs, JSON puts them in the envelope
+type linker interface {
+	Links() Links
+}
+
+// Path pattern of every named route, filled by Route.Named
+var routePaths = struct {
+	sync.RWMutex
+	byName map[string]string
+}{byName: make(map[string]string)}
+
+// Path of a named route with its {params} filled from name, value pairs,
+// empty when no route has that name
+func linkTo(name string, params ...string) string {
+	routePaths.RLock()
+	path, ok := routePaths.byName[name]
+	routePaths.RUnlock()
+	if !ok {
+		return ""
+	}
+
+	for i := 0; i+1 < len(params); i += 2 {
+		path = strings.ReplaceAll(path, "{"+params[i]+"}", url.PathEscape(params[i+1]))
+	}
+	return path
+}
+
+// Leaves out the relations whose route is not registered
+func (links Links) add(relation string, href string) Links {
+	if href != "" {
+		links[relation] = href
+	}
+	return links
+}
+
+func (user User) Links() Links {
+	id := string(publicID("users", user.ID))
+
+	return Links{}.
+		add("self", linkTo("get_user", "id", id)).
+		add("avatar", linkTo("get_avatar", "id", id)).
+		add("collection", linkTo("list_api_users"))
+}
+
+func linksOf(data interface{}) Links {
+	if linker, ok := data.(linker); ok {
+		return linker.Links()
+	}
+	return nil
+}
+
+// self, first, prev and next of a page, more tells whether items follow it.
+// The other query parameters are kept. Without a limit everything is one page.
+func pageLinks(r *http.Request, offset int, limit int, more bool) Links {
+	pageURL := func(offset int) string {
+		query := r.URL.Query()
+		query.Set("offset", strconv.Itoa(offset))
+		return r.URL.Path + "?" + query.Encode()
+	}
+
+	links := Links{"self": r.URL.RequestURI()}
+	if limit == 0 {
+		return links
+	}
+
+	links["first"] = pageURL(0)
+	if offset > 0 {
+		links["prev"] = pageURL(max(offset-limit, 0))
+	}
+	if more {
+		links["next"] = pageURL(offset + limit)
+	}
+
+	return links
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffix of the rotated log files, sorts in time order
+const logFileTimeFormat = "20060102-150405"
+
+// Log file that Rotate moves aside, e.g. app.log becomes
+// app.log.20261015-033000 and a new app.log is started. Only the newest
+// keep rotated files are kept. With SetMaxSize it also rotates once it
+// grows past a size.
+type LogFile struct {
+	path    string
+	keep    int
+	maxSize int64 // Bytes, 0 for no limit
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func OpenLogFile(path string, keep int) (*LogFile, error) {
+	logFile := &LogFile{path: path, keep: keep}
+	if err := logFile.open(); err != nil {
+		return nil, err
+	}
+	return logFile, nil
+}
+
+// Callers must hold the mutex
+func (logFile *LogFile) open() error {
+	file, err := os.OpenFile(logFile.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	logFile.file, logFile.size = file, info.Size()
+	return nil
+}
+
+// Rotates the file once it grows past bytes, 0 for no limit
+func (logFile *LogFile) SetMaxSize(bytes int64) {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+
+	logFile.maxSize = bytes
+}
+
+func (logFile *LogFile) Write(data []byte) (int, error) {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+
+	if logFile.maxSize > 0 && logFile.size > 0 && logFile.size+int64(len(data)) > logFile.maxSize {
+		// The line still goes to the current file when it can not rotate
+		logFile.rotate()
+	}
+
+	written, err := logFile.file.Write(data)
+	logFile.size += int64(written)
+	return written, err
+}
+
+// Moves the current file aside and starts a new one, meant for the scheduler
+func (logFile *LogFile) Rotate(ctx context.Context) error {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+
+	return logFile.rotate()
+}
+
+// Closes and opens the file again, e.g. once logrotate moved it away
+func (logFile *LogFile) Reopen() error {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+
+	if err := logFile.file.Close(); err != nil {
+		return err
+	}
+	return logFile.open()
+}
+
+// Callers must hold the mutex
+func (logFile *LogFile) rotate() error {
+	if logFile.size == 0 {
+		return nil
+	}
+
+	// Rotated names have a one second resolution, the file grows a bit more
+	// instead of overwriting the last rotated one
+	rotated := logFile.path + "." + time.Now().Format(logFileTimeFormat)
+	if _, err := os.Stat(rotated); err == nil {
+		return nil
+	}
+
+	if err := logFile.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(logFile.path, rotated); err != nil {
+		logFile.open()
+		return err
+	}
+	if err := logFile.open(); err != nil {
+		return err
+	}
+
+	return logFile.prune()
+}
+
+// Removes the oldest rotated files past keep. Callers must hold the mutex.
+func (logFile *LogFile) prune() error {
+	rotated, err := filepath.Glob(logFile.path + ".*")
+	if err != nil {
+		return err
+	}
+
+	// Only the names Rotate makes, other files next to the log are left alone
+	names := rotated[:0]
+	for _, name := range rotated {
+		if _, err := time.Parse(logFileTimeFormat, strings.TrimPrefix(name, logFile.path+".")); err == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for len(names) > logFile.keep {
+		if err := os.Remove(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+
+	return nil
+}
+
+func (logFile *LogFile) Close() error {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+
+	return logFile.file.Close()
+}
+
+// Reopens the files on reopenSignals, so they can be moved away by logrotate
+// and the like. Nil files are skipped.
+func ReopenOnSignal(files ...*LogFile) {
+	if len(reopenSignals) == 0 {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, reopenSignals...)
+	go func() {
+		for range signals {
+			for _, logFile := range files {
+				if logFile == nil {
+					continue
+				}
+				if err := logFile.Reopen(); err != nil {
+					errorf("reopen %s: %v", logFile.path, err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Make ReopenOnSignal reopen the log files, e.g. from logrotate
+var reopenSignals = []os.Signal{syscall.SIGUSR1}
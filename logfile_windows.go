@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// There is no SIGUSR1, the files are only rotated by the scheduler
+var reopenSignals []os.Signal
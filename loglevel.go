@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level LogLevel) String() string {
+	if level < LevelDebug || level > LevelError {
+		return fmt.Sprintf("level(%d)", int32(level))
+	}
+	return logLevelNames[level]
+}
+
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, known := range logLevelNames {
+		if strings.EqualFold(strings.TrimSpace(name), known) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, use %s", name, strings.Join(logLevelNames, ", "))
+}
+
+// Set from LOG_LEVEL in main, changed at runtime with PUT /admin/loglevel
+var logLevel atomic.Int32
+
+// Longest a temporary level may last
+const maxTemporaryLogLevel = 24 * time.Hour
+
+// The level a temporary one goes back to, see setLogLevelFor
+var (
+	logLevelMutex      sync.Mutex
+	baseLogLevel       = LevelInfo
+	temporaryLevelEnds time.Time
+	temporaryLevelID   int // Tells the expiry of the current temporary level from older ones
+)
+
+func init() {
+	logLevel.Store(int32(LevelInfo))
+}
+
+func currentLogLevel() LogLevel {
+	return LogLevel(logLevel.Load())
+}
+
+// Also when the current level is temporary, zero otherwise
+func currentLogLevelEnds() time.Time {
+	logLevelMutex.Lock()
+	defer logLevelMutex.Unlock()
+
+	return temporaryLevelEnds
+}
+
+// Until the next change, ends a temporary level
+func setLogLevel(level LogLevel) {
+	logLevelMutex.Lock()
+	defer logLevelMutex.Unlock()
+
+	temporaryLevelID++
+	baseLogLevel, temporaryLevelEnds = level, time.Time{}
+	logLevel.Store(int32(level))
+}
+
+// For a while, e.g. debug for 15 minutes in production, then back to the
+// level set without a duration. Returns when it ends.
+func setLogLevelFor(level LogLevel, duration time.Duration) time.Time {
+	logLevelMutex.Lock()
+	defer logLevelMutex.Unlock()
+
+	temporaryLevelID++
+	id := temporaryLevelID
+	temporaryLevelEnds = time.Now().Add(duration).UTC()
+	logLevel.Store(int32(level))
+
+	time.AfterFunc(duration, func() {
+		logLevelMutex.Lock()
+		defer logLevelMutex.Unlock()
+
+		if id != temporaryLevelID {
+			return
+		}
+		temporaryLevelEnds = time.Time{}
+		logLevel.Store(int32(baseLogLevel))
+		log.Printf("log level back to %s", baseLogLevel)
+	})
+
+	return temporaryLevelEnds
+}
+
+// Whether messages of the level are logged, e.g. the request log is info
+func logEnabled(level LogLevel) bool {
+	return level >= currentLogLevel()
+}
+
+// Logs at the level, with its name in front unless it is info. Plain
+// log.Printf is info.
+func logAt(level LogLevel, format string, args ...interface{}) {
+	if !logEnabled(level) {
+		return
+	}
+	if level != LevelInfo {
+		format = strings.ToUpper(level.String()) + " " + format
+	}
+	log.Printf(format, args...)
+}
+
+func debugf(format string, args ...interface{}) { logAt(LevelDebug, format, args...) }
+func warnf(format string, args ...interface{})  { logAt(LevelWarn, format, args...) }
+func errorf(format string, args ...interface{}) { logAt(LevelError, format, args...) }
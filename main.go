@@ -1,13 +1,383 @@
 package main
 
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
 // Init the process handler's registration in router
 // Handlers are in handlers.go
 // Paths registration go from main -> server -> router
 func main() {
-	server := NewServer(":3000")
-	server.Handle("GET", "/", HandlerRoot)
-	server.Handle("GET", "/api", server.AddMiddleware(HandlerHome, CheckAuth(), Loggin()))
-	server.Handle("POST", "/api", server.AddMiddleware(HandlerHome, CheckAuth(), Loggin()))
-	server.Handle("POST", "/user", UserPostRequest)
-	server.Listen()
+	flags, err := parseFlags(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	args := flags.Args
+	if err := checkCommand(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// go run *.go version, needs no configuration
+	if len(args) > 0 && args[0] == "version" {
+		printVersion()
+		return
+	}
+
+	configFile := flags.ConfigFile
+	if configFile == "" {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
+
+	config, err := loadConfig(os.Getenv("CONFIG_PREFIX"), configFile, flags.Values)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// go run *.go config print
+	if len(args) == 2 && args[0] == "config" && args[1] == "print" {
+		for _, line := range config.Dump() {
+			fmt.Println(line)
+		}
+		return
+	}
+
+	// go run *.go migrate up
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrateCommand(config, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var logFile *LogFile
+	if config.LogFile != "" {
+		if logFile, err = OpenLogFile(config.LogFile, config.LogFileKeep); err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(logFile)
+	}
+
+	var accessLogFile *LogFile
+	switch config.AccessLog {
+	case "":
+		accessLog = NewAccessLog(config.AccessLogFormat, nil)
+	case "stderr":
+		accessLog = NewAccessLog(config.AccessLogFormat, os.Stderr)
+	case "stdout":
+		accessLog = NewAccessLog(config.AccessLogFormat, os.Stdout)
+	default:
+		if accessLogFile, err = OpenLogFile(config.AccessLog, config.AccessLogKeep); err != nil {
+			log.Fatal(err)
+		}
+		accessLogFile.SetMaxSize(int64(config.AccessLogMaxSize))
+		accessLog = NewAccessLog(config.AccessLogFormat, accessLogFile)
+	}
+
+	// logrotate moves the files away, then sends SIGUSR1
+	ReopenOnSignal(logFile, accessLogFile)
+
+	level, _ := ParseLogLevel(config.LogLevel)
+	setLogLevel(level)
+
+	if logEnabled(LevelDebug) {
+		for _, line := range config.Dump() {
+			debugf("config %s", line)
+		}
+	}
+
+	stringIDs = config.StringIDs
+
+	idStrategy = config.IDStrategy
+
+	if err := setupIDObfuscation(config.IDObfuscation, config.IDObfuscationKey); err != nil {
+		log.Fatal(err)
+	}
+	logPathHash = config.LogPathHash
+	prettyResponses = config.PrettyJSON
+	bareResponses = !config.ResponseEnvelope
+
+	attributeSchema, err = parseAttributeSchema(config.UserAttributes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupTokens(config.JWTSecret, config.TokenTTL); err != nil {
+		log.Fatal(err)
+	}
+	totpIssuer = config.TOTPIssuer
+	setupOAuth(config)
+
+	// go run *.go config check, once every setting was loaded and parsed
+	if len(args) == 2 && args[0] == "config" && args[1] == "check" {
+		fmt.Println("the configuration is valid")
+		return
+	}
+
+	// go run *.go routes registers them as serve does, on a memory store
+	// so the data of a running server is left alone
+	listRoutes := len(args) > 0 && args[0] == "routes"
+	if listRoutes {
+		config.Store, config.SeedFile = "memory", ""
+	}
+
+	// go run *.go token admin@example.com, after the token settings
+	if len(args) > 0 && args[0] == "token" {
+		if err := runTokenCommand(config, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// go run *.go seed users.yaml, after the settings used to validate and create users
+	if len(args) > 0 && args[0] == "seed" {
+		if err := runSeedCommand(config, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// go run *.go encrypt, after ENCRYPTION_KEYS gained a new current key
+	if len(args) > 0 && args[0] == "encrypt" {
+		if err := runEncryptCommand(config); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// The records and tokens are stamped with the real time
+	base, err := newStore(config, systemClock{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	app, err := NewApp(config, base, systemClock{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if config.SeedFile != "" {
+		created, err := seedUsers(app.Store, config.SeedFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("seeded %d users from %s", created, config.SeedFile)
+	}
+
+	drainDelay = config.DrainDelay
+
+	server := NewServer(config.Port, config)
+	if config.TLSCertFile != "" {
+		if err := server.EnableTLS(config.TLSCertFile, config.TLSKeyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Fault injection for tests, off unless CHAOS_* or /admin/chaos turn it on
+	chaosSettings, err := setChaos(config.Chaos())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if chaosSettings.enabled() {
+		log.Printf("chaos testing is on: latency_percent=%d latency=%s error_percent=%d drop_percent=%d",
+			chaosSettings.LatencyPercent, chaosSettings.Latency, chaosSettings.ErrorPercent, chaosSettings.DropPercent)
+	}
+
+	// The deprecation schedule of /api/v1/... and Accept-Version: 1
+	versionSchedules[1] = VersionSchedule{Deprecated: config.APIV1Deprecated, Sunset: config.APIV1Sunset}
+
+	// 5xx responses and panics go to Sentry with SENTRY_DSN
+	if config.SentryDSN != "" {
+		reporter, err := NewSentryReporter(config.SentryDSN, config.SentryEnvironment)
+		if err != nil {
+			log.Fatal(err)
+		}
+		errorReporter = reporter
+	}
+
+	// Names of the middleware applied to every route, for the startup summary
+	middleware, err := app.Middleware(server)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := app.Routes(server); err != nil {
+		log.Fatal(err)
+	}
+
+	// Operational endpoints get their own listener when OPS_PORT is set
+	ops := server
+	if config.OpsPort != "" {
+		ops = NewServer(config.OpsPort, config)
+		// Reports the checks of the API server
+		ops.Handle("GET", "/health", HealthHandler(server.health))
+		ops.Handle("GET", "/healthz", LivenessHandler)
+		ops.Handle("GET", "/readyz", ReadinessHandler(server.health))
+	}
+	ops.Handle("GET", "/debug/vars", expvar.Handler().ServeHTTP)
+	if config.StatusPage {
+		ops.Handle("GET", "/status", StatusPage(server.health, config.StatusNotes))
+	}
+
+	// Published examples must match the real types
+	if err := server.ValidateExamples(); err != nil {
+		log.Fatal(err)
+	}
+
+	if config.Mock {
+		mocked, err := server.Mock(config.MockDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("mock mode: %d routes answer made up data from %s, their examples or their schemas", mocked, config.MockDir)
+	}
+
+	// Periodic upkeep, started with the server and stopped before the queue drains
+	schedule := func(name string, spec string, jitter time.Duration, run func(ctx context.Context) error) {
+		if err := app.Scheduler.Add(name, spec, jitter, run); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if fileStore, ok := base.(*FileStore); ok {
+		schedule("snapshot", "@every "+config.SnapshotInterval.String(), 0, func(ctx context.Context) error {
+			return fileStore.Snapshot()
+		})
+	}
+	schedule("flush_api_key_usage", "@every "+usageFlushEvery.String(), 0, app.Meter.Flush)
+	if _, ok := base.(DeletedPurger); ok && config.PurgeDeletedAfter > 0 {
+		schedule("purge_deleted_users", config.PurgeSchedule, time.Minute, app.purgeDeletedUsers(config.PurgeDeletedAfter))
+	}
+	if logFile != nil {
+		schedule("rotate_logs", config.LogRotateSchedule, 0, logFile.Rotate)
+	}
+	if accessLogFile != nil && config.AccessLogRotateSchedule != "" {
+		schedule("rotate_access_log", config.AccessLogRotateSchedule, 0, accessLogFile.Rotate)
+	}
+	if config.ValidationSummaryInterval > 0 {
+		schedule("validation_summary", "@every "+config.ValidationSummaryInterval.String(), 0, logValidationSummary(config.ValidationSummaryInterval))
+	}
+	server.OnStart(app.Scheduler.Start)
+
+	// Shutdown hooks run in reverse, each within what is left of the
+	// deadline: the ready file goes first, then what produces work (scheduler,
+	// event bus), what does it (queue, jobs), the reports, the API key usage
+	// and the store, which the others may still use. The log files close last.
+	server.OnShutdown("log_files", func(ctx context.Context) error {
+		// What is still logged goes to stderr
+		log.SetOutput(os.Stderr)
+		for _, file := range []*LogFile{accessLogFile, logFile} {
+			if file != nil {
+				file.Close()
+			}
+		}
+		return nil
+	})
+	server.OnShutdown("store", func(ctx context.Context) error {
+		// Stores that keep data on disk flush it here, the file store its snapshot
+		if closer, ok := app.Store.(io.Closer); ok {
+			return closer.Close()
+		}
+		return nil
+	})
+	server.OnShutdown("api_key_usage", app.Meter.Flush)
+	if reporter, ok := errorReporter.(*SentryReporter); ok {
+		server.OnShutdown("error_reports", reporter.Close)
+	}
+	server.OnShutdown("jobs", app.Jobs.Close)
+	server.OnShutdown("queue", app.Queue.Drain)
+	server.OnShutdown("event_bus", app.Bus.Close) // Its subscribers queue webhooks and notifications
+	server.OnShutdown("scheduler", app.Scheduler.Stop)
+
+	// Open event streams would hold the shutdown until its timeout
+	server.httpServer.RegisterOnShutdown(app.Events.Close)
+	if config.GRPCPort != "" {
+		grpcServer, err := app.NewGRPCServer(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.ServeGRPC(config.GRPCPort, grpcServer)
+	}
+
+	server.OnShutdown("ready_file", func(ctx context.Context) error {
+		removeReadyFile(config.ReadyFile)
+		return nil
+	})
+
+	servers := map[string]*Server{"api": server, "ops": ops}
+	if listRoutes {
+		printRoutes(os.Stdout, servers)
+		return
+	}
+
+	// Optional HTTP -> HTTPS redirect
+	var redirect *Server
+	if config.HTTPRedirectPort != "" {
+		redirect = NewRedirectServer(config.HTTPRedirectPort, server, config)
+		servers["redirect"] = redirect
+	}
+
+	// The API starts last, once every port is open the summary can report them
+	server.OnReady(func() {
+		summary := newStartupSummary(config, servers, middleware)
+		summary.Log()
+		if err := summary.SignalReady(config.ReadyFile, config.ReadyStdout); err != nil {
+			log.Fatal(err)
+		}
+	})
+
+	// The API starts last and stops last, its hooks close what the others share
+	order := []string{"api"}
+	if ops != server {
+		order = append([]string{"ops"}, order...)
+	}
+	if redirect != nil {
+		order = append([]string{"redirect"}, order...)
+	}
+
+	for _, name := range order {
+		if err := servers[name].Start(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Wait for Ctrl+C or a stop from the process manager
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+
+	// Active requests get 10 seconds once the drain delay is over
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainDelay+10*time.Second)
+	defer cancel()
+
+	for _, name := range order {
+		if err := servers[name].Shutdown(ctx); err != nil {
+			log.Printf("%s shutdown: %v", name, err)
+		}
+	}
+}
+
+// Picks the storage backend: memory (default), file or bolt. The records
+// are stamped with the time of clock.
+func newStore(config *Config, clock Clock) (UserStore, error) {
+	switch config.Store {
+	case "file":
+		return NewFileStore(config.DataFile, clock)
+	case "bolt":
+		return NewBoltStore(config.BoltFile, clock)
+	case "memory":
+		return NewMemoryStore(clock), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q", config.Store)
+	}
 }
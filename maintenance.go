@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths still served in maintenance mode: the admin routes, the logins the
+// admins need to reach them, the health checks and the docs
+var maintenanceExempt = []string{"/admin", "/api/auth", "/health", "/healthz", "/readyz", "/docs"}
+
+// Seconds clients are told to wait in maintenance mode
+const maintenanceRetryAfter = "120"
+
+// Toggled with PUT /admin/maintenance
+type MaintenanceMode struct {
+	Enabled bool      `json:"enabled"`
+	Message string    `json:"message,omitempty"` // Sent to the clients
+	Since   time.Time `json:"since,omitzero"`
+}
+
+var (
+	maintenanceMutex sync.RWMutex
+	maintenance      MaintenanceMode
+)
+
+func currentMaintenance() MaintenanceMode {
+	maintenanceMutex.RLock()
+	defer maintenanceMutex.RUnlock()
+
+	return maintenance
+}
+
+func setMaintenance(mode MaintenanceMode) MaintenanceMode {
+	maintenanceMutex.Lock()
+	defer maintenanceMutex.Unlock()
+
+	switch {
+	case !mode.Enabled:
+		mode = MaintenanceMode{}
+	case maintenance.Enabled:
+		mode.Since = maintenance.Since
+	default:
+		mode.Since = time.Now().UTC()
+	}
+	maintenance = mode
+
+	return mode
+}
+
+// Answers 503 MAINTENANCE with Retry-After while maintenance mode is on,
+// except on maintenanceExempt
+func Maintenance() Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mode := currentMaintenance()
+			if !mode.Enabled || underPath(r.URL.Path, maintenanceExempt) {
+				nextMiddleware(w, r)
+				return
+			}
+
+			message := mode.Message
+			if message == "" {
+				message = "the API is down for maintenance, try again later"
+			}
+			w.Header().Set("Retry-After", maintenanceRetryAfter)
+			Error(w, &AppError{Status: http.StatusServiceUnavailable, Code: CodeMaintenance, Message: message})
+		}
+	}
+}
+
+// Whether path is one of prefixes or below one of them
+func underPath(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
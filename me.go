@@ -0,0 +1,86 @@
+package main
+
+import "net/http"
+
+// The authenticated user, so clients do not need to know their own ID
+func (app *App) GetMe(w http.ResponseWriter, r *http.Request) error {
+	id, err := currentUserID(r)
+	if err != nil {
+		return err
+	}
+
+	location, err := displayLocation(r)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.Store.Get(id)
+	if err != nil {
+		return err
+	}
+	if user.Deleted() {
+		return ErrNotFound("user")
+	}
+
+	setETag(w, user)
+	JSON(w, http.StatusOK, publicUser(user.In(location)))
+	return nil
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// Needs the current password. Every token issued before is revoked, the
+// response carries a new one for the client making the change.
+func (app *App) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	id, err := currentUserID(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	var request ChangePasswordRequest
+	if err := DecodeJSON(r, &request); err != nil {
+		Error(w, err)
+		return
+	}
+
+	user, err := app.Store.Get(id)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	if !user.CheckPassword(request.CurrentPassword) {
+		Error(w, &AppError{Status: http.StatusUnprocessableEntity, Message: "is not the current password", Field: "current_password"})
+		return
+	}
+
+	if err := validatePassword(request.NewPassword); err != nil {
+		recordValidationFailure(r, err)
+		Error(w, &AppError{Status: http.StatusUnprocessableEntity, Message: err.(*ValidationError).Message, Field: "new_password"})
+		return
+	}
+
+	if request.NewPassword == request.CurrentPassword {
+		Error(w, &AppError{Status: http.StatusUnprocessableEntity, Message: "must differ from the current password", Field: "new_password"})
+		return
+	}
+
+	user.Password = request.NewPassword
+	user, err = app.Store.Update(user)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	token, claims, err := issueToken(user, app.Clock.Now())
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, newLoginResponse(token, claims))
+}
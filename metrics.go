@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Validation failures by "METHOD /route field", served on /debug/vars
+var validationFailures = expvar.NewMap("validation_failures")
+
+// Failures since the last summary log
+var (
+	pendingFailuresMutex sync.Mutex
+	pendingFailures      = make(map[string]int64)
+)
+
+// Counts every invalid field of err once
+func recordValidationFailure(r *http.Request, err error) {
+	fields := []string{"unknown"}
+	if errs := validationErrors(err); errs != nil {
+		fields = fields[:0]
+		for _, validationErr := range errs {
+			fields = append(fields, validationErr.Field)
+		}
+	}
+
+	pendingFailuresMutex.Lock()
+	defer pendingFailuresMutex.Unlock()
+
+	for _, field := range fields {
+		key := r.Method + " " + RoutePattern(r) + " " + field
+		validationFailures.Add(key, 1)
+		pendingFailures[key]++
+	}
+}
+
+// Logs the most common validation failures of every interval, so widespread
+// client mistakes stand out. Run by the scheduler.
+func logValidationSummary(interval time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		pendingFailuresMutex.Lock()
+		counts := pendingFailures
+		pendingFailures = make(map[string]int64)
+		pendingFailuresMutex.Unlock()
+
+		keys := make([]string, 0, len(counts))
+		for key := range counts {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return counts[keys[i]] > counts[keys[j]] })
+
+		for _, key := range keys {
+			log.Printf("validation failures in the last %s: %s x%d", interval, key, counts[key])
+		}
+		return nil
+	}
+}
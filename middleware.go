@@ -1,41 +1,52 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
 	"time"
 )
 
-func CheckAuth() Middleware {
-	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
-		return func(w http.ResponseWriter, request *http.Request) {
-
-			authenticated := true
-			fmt.Println("Checking authentication")
-
-			if authenticated {
-				nextMiddleware(w, request)
-			} else {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
-
-		}
-	}
-}
+// Adds a short hash of the raw path to the request log when LOG_PATH_HASH is on
+var logPathHash bool
 
-func Loggin() Middleware {
+// Logs the route pattern instead of the raw path, so IDs do not end up in the logs.
+// Lines go to the access log, the application log unless ACCESS_LOG is set.
+func Logging() Middleware {
 	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 
 			start := time.Now()
+			response := &accessLogResponse{ResponseWriter: w, status: http.StatusOK}
 			defer func() {
-				log.Println(r.URL.Path, time.Since(start))
+				route := RoutePattern(r)
+				if route == "" {
+					route = "unmatched"
+				}
+
+				duration := time.Since(start)
+				entry := AccessEntry{
+					Time:       start,
+					Method:     r.Method,
+					Route:      route,
+					Proto:      r.Proto,
+					Status:     response.status,
+					Bytes:      response.bytes,
+					Duration:   duration,
+					DurationMS: float64(duration.Microseconds()) / 1000,
+					RemoteAddr: r.RemoteAddr,
+					Referer:    r.Referer(),
+					UserAgent:  r.UserAgent(),
+				}
+				if logPathHash {
+					sum := sha256.Sum256([]byte(r.URL.Path))
+					entry.PathHash = hex.EncodeToString(sum[:6])
+				}
+
+				accessLog.Write(entry)
 			}()
 
-			nextMiddleware(w, r)
-
+			nextMiddleware(response, r)
 		}
 	}
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema changes for SQL stores. Files are named <version>_<name>.up.sql and <version>_<name>.down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Reads the embedded migrations sorted by version
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		parts := strings.SplitN(name, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+
+		content, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return nil, err
+		}
+
+		migration, exists := byVersion[version]
+		if !exists {
+			migration = &Migration{Version: version}
+			byVersion[version] = migration
+		}
+
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			migration.Name = strings.TrimSuffix(parts[1], ".up.sql")
+			migration.Up = string(content)
+		case strings.HasSuffix(name, ".down.sql"):
+			migration.Down = string(content)
+		default:
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up file", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Applies the pending migrations, each one in its own transaction
+func MigrateUp(db *sql.DB) error {
+	migrations, applied, err := migrationState(db)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if applied[migration.Version] {
+			continue
+		}
+
+		record := fmt.Sprintf("INSERT INTO schema_migrations (version) VALUES (%d)", migration.Version)
+		if err := runMigration(db, migration.Up, record); err != nil {
+			return fmt.Errorf("migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Reverts the last applied migrations, steps says how many
+func MigrateDown(db *sql.DB, steps int) error {
+	migrations, applied, err := migrationState(db)
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		migration := migrations[i]
+		if !applied[migration.Version] {
+			continue
+		}
+
+		if migration.Down == "" {
+			return fmt.Errorf("migration %d_%s can not be reverted", migration.Version, migration.Name)
+		}
+
+		record := fmt.Sprintf("DELETE FROM schema_migrations WHERE version = %d", migration.Version)
+		if err := runMigration(db, migration.Down, record); err != nil {
+			return fmt.Errorf("migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+		steps--
+	}
+
+	return nil
+}
+
+func migrationState(db *sql.DB) ([]Migration, map[int]bool, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, nil, err
+		}
+		applied[version] = true
+	}
+
+	return migrations, applied, rows.Err()
+}
+
+func runMigration(db *sql.DB, statements string, record string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(statements); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(record); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// go run *.go migrate up|down [steps]
+// The SQL driver named in DATABASE_DRIVER must be compiled in with a blank import
+func runMigrateCommand(config *Config, args []string) error {
+	if config.DatabaseURL == "" {
+		return fmt.Errorf("DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open(config.DatabaseDriver, config.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	direction := "up"
+	if len(args) > 0 {
+		direction = args[0]
+	}
+
+	switch direction {
+	case "up":
+		return MigrateUp(db)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil {
+				return fmt.Errorf("invalid steps %q", args[1])
+			}
+		}
+		return MigrateDown(db, steps)
+	default:
+		return fmt.Errorf("unknown migrate direction %q, use up or down", direction)
+	}
+}
@@ -0,0 +1,6 @@
+CREATE TABLE users (
+    id    INTEGER PRIMARY KEY,
+    name  VARCHAR(255) NOT NULL DEFAULT '',
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    phone VARCHAR(50)  NOT NULL DEFAULT ''
+);
@@ -0,0 +1,2 @@
+-- Serialized JSON object, TEXT keeps it portable across databases
+ALTER TABLE users ADD COLUMN attributes TEXT NOT NULL DEFAULT '{}';
@@ -0,0 +1,2 @@
+-- The API compares emails ignoring case, on case sensitive databases index lower(email) instead
+CREATE UNIQUE INDEX users_email_unique ON users (email);
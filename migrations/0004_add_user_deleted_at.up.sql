@@ -0,0 +1,2 @@
+-- NULL while the user is not deleted
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP NULL;
@@ -0,0 +1,2 @@
+-- bcrypt hash, NULL for users without a password
+ALTER TABLE users ADD COLUMN password_hash TEXT NULL;
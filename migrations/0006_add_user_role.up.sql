@@ -0,0 +1,2 @@
+-- admin, member or viewer
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'member';
@@ -0,0 +1,2 @@
+-- TOTP secret, backup code hashes and last used counter, as JSON
+ALTER TABLE users ADD COLUMN two_factor TEXT NULL;
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// What a mocked route answers when its mock file is missing
+type mockResponse struct {
+	status int
+	data   interface{}
+	links  Links
+}
+
+// Answers the named routes with made up data instead of running their
+// handlers, so frontends can be built before the API is. A route answers,
+// in order of preference:
+//   - the data in <dir>/<route name>.json, read on every request so it can be edited live
+//   - the data of its first successful example
+//   - a sample generated from its response schema
+//
+// Routes with none of them and the /admin routes keep their handler. Returns how many were mocked,
+// mock files that are not JSON or not named after a route are an error.
+func (server *Server) Mock(dir string) (int, error) {
+	if err := server.checkMocks(dir); err != nil {
+		return 0, err
+	}
+
+	mocked := 0
+	for _, route := range server.routes {
+		if route.Name == "" || underPath(route.Path, []string{"/admin"}) {
+			continue
+		}
+
+		file := filepath.Join(dir, route.Name+".json")
+		fallback, ok := route.mockResponse()
+		if _, err := os.Stat(file); err != nil && !ok {
+			continue
+		}
+
+		server.router.rules[route.Path][route.Method] = mockHandler(file, fallback)
+		mocked++
+	}
+	return mocked, nil
+}
+
+func (server *Server) checkMocks(dir string) error {
+	names := make(map[string]bool)
+	for _, route := range server.routes {
+		names[route.Name] = route.Name != ""
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		if !names[name] {
+			return fmt.Errorf("mock %s: no route is named %q", file, name)
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if !json.Valid(content) {
+			return fmt.Errorf("mock %s: not valid JSON", file)
+		}
+	}
+	return nil
+}
+
+func mockHandler(file string, fallback mockResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Mock", "true")
+
+		content, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			JSONWithLinks(w, fallback.status, fallback.data, fallback.links)
+			return
+		}
+
+		var data interface{}
+		if err == nil {
+			err = decodeNumbers(content, &data)
+		}
+		if err != nil {
+			Error(w, &AppError{Status: http.StatusInternalServerError, Message: fmt.Sprintf("mock %s: %v", filepath.Base(file), err)})
+			return
+		}
+
+		JSON(w, fallback.status, data)
+	}
+}
+
+// The first successful example or a sample of the response schema, false
+// when the route has neither. The status is the example's, 200 otherwise.
+func (route *Route) mockResponse() (mockResponse, bool) {
+	for _, example := range route.Examples {
+		if example.Status < 200 || example.Status >= 300 {
+			continue
+		}
+		if response, ok := example.Response.(APIResponse); ok {
+			return mockResponse{status: example.Status, data: response.Data, links: response.Links}, true
+		}
+		return mockResponse{status: example.Status, data: example.Response}, true
+	}
+
+	if route.ResponseSchema == nil {
+		return mockResponse{status: http.StatusOK}, false
+	}
+	return mockResponse{status: http.StatusOK, data: mockValue(schemaOf(reflect.TypeOf(route.ResponseSchema)))}, true
+}
+
+// A value matching an OpenAPI schema built by schemaOf, lists get one item
+func mockValue(schema map[string]interface{}) interface{} {
+	switch schema["type"] {
+	case "string":
+		switch schema["format"] {
+		case "date-time":
+			return time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC).Format(time.RFC3339)
+		case "uuid":
+			return "01234567-89ab-4def-8123-456789abcdef"
+		}
+		return "string"
+	case "integer":
+		return 1
+	case "number":
+		return 1.5
+	case "boolean":
+		return true
+	case "array":
+		items, _ := schema["items"].(map[string]interface{})
+		return []interface{}{mockValue(items)}
+	case "object":
+		object := make(map[string]interface{})
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, property := range properties {
+			object[name] = mockValue(property.(map[string]interface{}))
+		}
+		return object
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Time a notifier gets before it is given up
+const notifyTimeout = 10 * time.Second
+
+// The same alert is sent at most this often, a panicking route would flood the channels
+const alertEvery = time.Minute
+
+// Something that happened to a user, e.g. user.signup, or an alert for the
+// admins, e.g. alert.panic
+type Notification struct {
+	Event   string    `json:"event"`
+	User    User      `json:"user,omitzero"` // Public fields only, absent from alerts about no user
+	Message string    `json:"message,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// One line for people, e.g. user.signup: Jane Doe <jane@example.com>
+func (notification Notification) Text() string {
+	text := notification.Event + ":"
+	if notification.User.ID != "" {
+		text += fmt.Sprintf(" user %s", notification.User.ID)
+		if notification.User.Email != "" {
+			text += fmt.Sprintf(" %s <%s>", notification.User.Name, notification.User.Email)
+		}
+	}
+	if notification.Message != "" {
+		text += " " + notification.Message
+	}
+	return text
+}
+
+// Delivers notifications, e.g. a welcome email or a webhook call
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// The channels the notifications of an event go to. Pattern is an event,
+// a prefix ending in *, e.g. alert.*, or * for all of them.
+type NotificationRoute struct {
+	Pattern  string
+	Channels []string
+}
+
+func (route NotificationRoute) Matches(event string) bool {
+	if prefix, ok := strings.CutSuffix(route.Pattern, "*"); ok {
+		return strings.HasPrefix(event, prefix)
+	}
+	return route.Pattern == event
+}
+
+// A welcome email may wait a little but should not be lost to a blip
+var notificationOptions = TaskOptions{MaxAttempts: 3, RetryDelay: 5 * time.Second, Timeout: notifyTimeout}
+
+// Payload of the notification tasks
+type notificationTask struct {
+	Channel      string       `json:"channel"`
+	Notification Notification `json:"notification"`
+}
+
+// The channels of NOTIFY_CHANNELS, name=kind:target, and the log channel.
+// The email channels send with mailer.
+func parseNotifyChannels(specs []string, mailer Mailer) (map[string]Notifier, error) {
+	channels := map[string]Notifier{"log": LogNotifier{}}
+	for _, spec := range specs {
+		name, target, _ := strings.Cut(spec, "=")
+		kind, target, _ := strings.Cut(target, ":")
+		if name == "" || target == "" {
+			return nil, fmt.Errorf("%q is not name=kind:target", strings.SplitN(spec, ":", 2)[0])
+		}
+		if _, taken := channels[name]; taken {
+			return nil, fmt.Errorf("channel %s is defined twice", name)
+		}
+
+		switch kind {
+		case "webhook", "slack":
+			if parsed, err := url.Parse(target); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+				return nil, fmt.Errorf("channel %s: not an http or https URL", name)
+			}
+			if kind == "slack" {
+				channels[name] = SlackNotifier{URL: target}
+			} else {
+				channels[name] = WebhookNotifier{URL: target}
+			}
+		case "email":
+			if _, err := mail.ParseAddress(target); err != nil {
+				return nil, fmt.Errorf("channel %s: %v", name, err)
+			}
+			channels[name] = EmailNotifier{To: target, Mailer: mailer}
+		default:
+			return nil, fmt.Errorf("channel %s: unknown kind %q, use webhook, slack or email", name, kind)
+		}
+	}
+	return channels, nil
+}
+
+// The routes of NOTIFY_ROUTES, pattern=channel,channel, to known channels
+func parseNotifyRoutes(specs []string, channels map[string]Notifier) ([]NotificationRoute, error) {
+	routes := []NotificationRoute{}
+	for _, spec := range specs {
+		pattern, names, _ := strings.Cut(spec, "=")
+		if pattern == "" || names == "" || strings.Contains(strings.TrimSuffix(pattern, "*"), "*") {
+			return nil, fmt.Errorf("%q is not event=channel,channel", spec)
+		}
+
+		route := NotificationRoute{Pattern: pattern}
+		for _, name := range strings.Split(names, ",") {
+			if _, ok := channels[name]; !ok {
+				return nil, fmt.Errorf("route %s: unknown channel %q", pattern, name)
+			}
+			route.Channels = append(route.Channels, name)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// Sets up the channels and routes from config, SIGNUP_WEBHOOK_URL is a
+// webhook channel of the signups
+func (app *App) setupNotifications(config *Config) error {
+	channels, err := parseNotifyChannels(config.NotifyChannels, app.Mailer)
+	if err != nil {
+		return err
+	}
+	routes, err := parseNotifyRoutes(config.NotifyRoutes, channels)
+	if err != nil {
+		return err
+	}
+
+	if config.SignupWebhookURL != "" {
+		channels["signup_webhook"] = WebhookNotifier{URL: config.SignupWebhookURL}
+		routes = append(routes, NotificationRoute{Pattern: "user.signup", Channels: []string{"signup_webhook"}})
+	}
+
+	app.notifiers, app.notificationRoutes = channels, routes
+	return nil
+}
+
+// Subscriber of the event bus for the user events
+func (app *App) notifyUserEvent(ctx context.Context, event Event) error {
+	notification := Notification{Event: event.Data.EventName(), At: event.At}
+	switch data := event.Data.(type) {
+	case UserSignedUp:
+		notification.User = publicUser(data.User)
+	case UserCreated:
+		notification.User = publicUser(data.User)
+	case UserUpdated:
+		notification.User = publicUser(data.User)
+	case UserRestored:
+		notification.User = publicUser(data.User)
+	case UserDeleted:
+		notification.User = User{ID: publicID("users", data.UserID)}
+	default:
+		return nil
+	}
+
+	app.notify(notification)
+	return nil
+}
+
+// Tells the admins, e.g. alert("alert.panic", User{}, "panic in GET /api/users: ..."),
+// the same alert is only sent once per alertEvery. user, when set, is public.
+func (app *App) alert(event string, user User, message string) {
+	now := app.Clock.Now()
+	key := event + "\x00" + string(user.ID) + "\x00" + message
+
+	app.alertsMutex.Lock()
+	if sent, ok := app.alertsSent[key]; ok && now.Sub(sent) < alertEvery {
+		app.alertsMutex.Unlock()
+		return
+	}
+	for key, sent := range app.alertsSent {
+		if now.Sub(sent) >= alertEvery {
+			delete(app.alertsSent, key)
+		}
+	}
+	app.alertsSent[key] = now
+	app.alertsMutex.Unlock()
+
+	app.notify(Notification{Event: event, User: user, Message: message, At: now.UTC()})
+}
+
+// Delivers through the task queue to the channels of the routes the event
+// matches, each channel is retried on its own and its failures are only logged
+func (app *App) notify(notification Notification) {
+	var channels []string
+	for _, route := range app.notificationRoutes {
+		if !route.Matches(notification.Event) {
+			continue
+		}
+		for _, channel := range route.Channels {
+			if !slices.Contains(channels, channel) {
+				channels = append(channels, channel)
+			}
+		}
+	}
+
+	for _, channel := range channels {
+		task, err := NewTask("notification", notificationTask{Channel: channel, Notification: notification})
+		if err == nil {
+			err = app.Queue.Enqueue(task)
+		}
+		if err != nil {
+			warnf("notification channel %s on %s: %v", channel, notification.Event, err)
+		}
+	}
+}
+
+func (app *App) deliverNotification(ctx context.Context, task Task) error {
+	var payload notificationTask
+	if err := task.Decode(&payload); err != nil {
+		return Permanent(err)
+	}
+	notifier, ok := app.notifiers[payload.Channel]
+	if !ok {
+		return Permanent(fmt.Errorf("unknown notification channel %q", payload.Channel))
+	}
+
+	if err := notifier.Notify(ctx, payload.Notification); err != nil {
+		return fmt.Errorf("notification channel %s on %s: %w", payload.Channel, payload.Notification.Event, err)
+	}
+	return nil
+}
+
+// Writes the notifications to the log, the default channel
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, notification Notification) error {
+	log.Print(notification.Text())
+	return nil
+}
+
+// POSTs the notifications as JSON to a URL
+type WebhookNotifier struct {
+	URL string
+}
+
+func (notifier WebhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	return postNotification(ctx, notifier.URL, notification)
+}
+
+// POSTs the notifications to a Slack incoming webhook, or to anything that
+// takes its {"text": ...} payload, e.g. Mattermost
+type SlackNotifier struct {
+	URL string
+}
+
+func (notifier SlackNotifier) Notify(ctx context.Context, notification Notification) error {
+	return postNotification(ctx, notifier.URL, map[string]string{"text": slackEscaper.Replace(notification.Text())})
+}
+
+// Slack reads <...> as links and mentions
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Mails the notifications, e.g. to an admins list
+type EmailNotifier struct {
+	To     string
+	Mailer Mailer
+}
+
+func (notifier EmailNotifier) Notify(ctx context.Context, notification Notification) error {
+	return notifier.Mailer.Send(ctx, Email{
+		To:      notifier.To,
+		Subject: fmt.Sprintf("[%s] %s", openAPITitle, notification.Event),
+		Text:    notification.Text() + "\n\nAt " + notification.At.Format(time.RFC3339) + "\n",
+	})
+}
+
+func postNotification(ctx context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", response.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time a user has to come back from the provider
+const oauthStateTTL = 10 * time.Minute
+
+// OAuth2 authorization code flow with PKCE against an identity provider
+type OAuthProvider struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	Scopes       []string
+
+	// Fetches the user behind an access token
+	profile func(ctx context.Context, provider *OAuthProvider, accessToken string) (oauthProfile, error)
+}
+
+type oauthProfile struct {
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// A login started with the provider, waiting for its callback
+type oauthState struct {
+	provider  string
+	verifier  string
+	expiresAt time.Time
+}
+
+// Providers with a client ID, set in main
+var oauthProviders = map[string]*OAuthProvider{}
+
+// Base URL the providers redirect back to, set from OAUTH_BASE_URL in main
+var oauthBaseURL string
+
+// Registers the providers that have a client ID in the config
+func setupOAuth(config *Config) {
+	oauthBaseURL = strings.TrimSuffix(config.OAuthBaseURL, "/")
+
+	if config.GoogleClientID != "" {
+		oauthProviders["google"] = &OAuthProvider{
+			Name:         "google",
+			ClientID:     config.GoogleClientID,
+			ClientSecret: config.GoogleClientSecret,
+			AuthURL:      "https://accounts.google.com/o/oauth2/v2/auth",
+			TokenURL:     "https://oauth2.googleapis.com/token",
+			Scopes:       []string{"openid", "email", "profile"},
+			profile:      oidcProfile("https://openidconnect.googleapis.com/v1/userinfo"),
+		}
+	}
+
+	if config.GitHubClientID != "" {
+		oauthProviders["github"] = &OAuthProvider{
+			Name:         "github",
+			ClientID:     config.GitHubClientID,
+			ClientSecret: config.GitHubClientSecret,
+			AuthURL:      "https://github.com/login/oauth/authorize",
+			TokenURL:     "https://github.com/login/oauth/access_token",
+			Scopes:       []string{"read:user", "user:email"},
+			profile:      githubProfile,
+		}
+	}
+}
+
+func (provider *OAuthProvider) redirectURL() string {
+	return oauthBaseURL + "/api/auth/" + provider.Name + "/callback"
+}
+
+func oauthProvider(r *http.Request) (*OAuthProvider, error) {
+	provider, ok := oauthProviders[PathParam(r, "provider")]
+	if !ok {
+		return nil, ErrNotFound("auth provider")
+	}
+	return provider, nil
+}
+
+func randomToken() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// Keeps the state until the callback, expired ones are dropped on the way
+func (app *App) saveOAuthState(state string, pending oauthState) {
+	app.oauthMutex.Lock()
+	defer app.oauthMutex.Unlock()
+
+	now := app.Clock.Now()
+	for key, stored := range app.oauthStates {
+		if now.After(stored.expiresAt) {
+			delete(app.oauthStates, key)
+		}
+	}
+
+	app.oauthStates[state] = pending
+}
+
+// A state works once
+func (app *App) takeOAuthState(state string) (oauthState, bool) {
+	app.oauthMutex.Lock()
+	defer app.oauthMutex.Unlock()
+
+	pending, ok := app.oauthStates[state]
+	delete(app.oauthStates, state)
+
+	if !ok || app.Clock.Now().After(pending.expiresAt) {
+		return oauthState{}, false
+	}
+	return pending, true
+}
+
+// Redirects to the provider's consent page
+func (app *App) OAuthLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := oauthProvider(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	app.saveOAuthState(state, oauthState{
+		provider:  provider.Name,
+		verifier:  verifier,
+		expiresAt: app.Clock.Now().Add(oauthStateTTL),
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.ClientID},
+		"redirect_uri":          {provider.redirectURL()},
+		"scope":                 {strings.Join(provider.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	http.Redirect(w, r, provider.AuthURL+"?"+query.Encode(), http.StatusFound)
+}
+
+// Trades the code for the user's verified email and logs in the user with it,
+// creating a member the first time
+func (app *App) OAuthCallback(w http.ResponseWriter, r *http.Request) {
+	provider, err := oauthProvider(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		Error(w, ErrUnauthorized("login cancelled: "+reason))
+		return
+	}
+
+	pending, ok := app.takeOAuthState(query.Get("state"))
+	if !ok || pending.provider != provider.Name {
+		Error(w, ErrUnauthorized("invalid or expired state"))
+		return
+	}
+
+	accessToken, err := provider.exchange(r.Context(), query.Get("code"), pending.verifier)
+	if err != nil {
+		Error(w, ErrUnauthorized(err.Error()))
+		return
+	}
+
+	profile, err := provider.profile(r.Context(), provider, accessToken)
+	if err != nil {
+		Error(w, ErrUnauthorized(err.Error()))
+		return
+	}
+
+	if profile.Email == "" || !profile.EmailVerified {
+		Error(w, ErrUnauthorized(provider.Name+" did not return a verified email"))
+		return
+	}
+
+	user, err := app.provisionOAuthUser(profile)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	app.completeLogin(w, user)
+}
+
+// Users are linked by email, unknown ones are created without a password
+func (app *App) provisionOAuthUser(profile oauthProfile) (User, error) {
+	user, err := app.Store.GetByEmail(profile.Email)
+	if err == nil {
+		if user.Deleted() {
+			return User{}, ErrUnauthorized("user is deleted")
+		}
+		return user, nil
+	}
+	if !errors.Is(err, ErrStatusNotFound) {
+		return User{}, err
+	}
+
+	user = User{Name: profile.Name, Email: profile.Email, Role: RoleMember}
+	if strings.TrimSpace(user.Name) == "" {
+		user.Name = strings.Split(profile.Email, "@")[0]
+	}
+	if err := user.Validate(); err != nil {
+		return User{}, err
+	}
+
+	return app.Store.Create(user)
+}
+
+func (provider *OAuthProvider) exchange(ctx context.Context, code string, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("missing code")
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {provider.redirectURL()},
+		"client_id":     {provider.ClientID},
+		"client_secret": {provider.ClientSecret},
+		"code_verifier": {verifier},
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var response struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := fetchJSON(request, &response); err != nil {
+		return "", fmt.Errorf("%s token exchange: %v", provider.Name, err)
+	}
+
+	// GitHub answers errors with 200
+	if response.AccessToken == "" {
+		return "", fmt.Errorf("%s token exchange: %s", provider.Name, response.Error)
+	}
+
+	return response.AccessToken, nil
+}
+
+// OpenID Connect userinfo endpoint
+func oidcProfile(userInfoURL string) func(context.Context, *OAuthProvider, string) (oauthProfile, error) {
+	return func(ctx context.Context, provider *OAuthProvider, accessToken string) (oauthProfile, error) {
+		var info struct {
+			Email         string `json:"email"`
+			EmailVerified bool   `json:"email_verified"`
+			Name          string `json:"name"`
+		}
+		if err := getJSON(ctx, userInfoURL, accessToken, &info); err != nil {
+			return oauthProfile{}, fmt.Errorf("%s userinfo: %v", provider.Name, err)
+		}
+
+		return oauthProfile{Email: info.Email, EmailVerified: info.EmailVerified, Name: info.Name}, nil
+	}
+}
+
+// GitHub is OAuth2 only, the verified email comes from a separate endpoint
+func githubProfile(ctx context.Context, provider *OAuthProvider, accessToken string) (oauthProfile, error) {
+	var account struct {
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := getJSON(ctx, "https://api.github.com/user", accessToken, &account); err != nil {
+		return oauthProfile{}, fmt.Errorf("github user: %v", err)
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, "https://api.github.com/user/emails", accessToken, &emails); err != nil {
+		return oauthProfile{}, fmt.Errorf("github emails: %v", err)
+	}
+
+	profile := oauthProfile{Name: account.Name}
+	if profile.Name == "" {
+		profile.Name = account.Login
+	}
+	for _, email := range emails {
+		if email.Primary {
+			profile.Email, profile.EmailVerified = email.Email, email.Verified
+		}
+	}
+
+	return profile, nil
+}
+
+func getJSON(ctx context.Context, url string, accessToken string, target interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+
+	return fetchJSON(request, target)
+}
+
+// Sends the request with the shared client and decodes a JSON answer
+func fetchJSON(request *http.Request, target interface{}) error {
+	request.Header.Set("Accept", "application/json")
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	return json.NewDecoder(response.Body).Decode(target)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// Resources whose numeric IDs are shown as opaque tokens, from ID_OBFUSCATION=users,...
+// Sequential IDs let anyone guess every URL, tokens can not be enumerated.
+var obfuscatedResources = map[string]bool{}
+
+var idCipher cipher.Block
+
+func setupIDObfuscation(resources []string, key string) error {
+	if len(resources) == 0 {
+		return nil
+	}
+
+	if key == "" {
+		return fmt.Errorf("ID_OBFUSCATION_KEY is required when ID_OBFUSCATION is set")
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:16])
+	if err != nil {
+		return err
+	}
+
+	idCipher = block
+	for _, resource := range resources {
+		obfuscatedResources[resource] = true
+	}
+
+	return nil
+}
+
+// ID shown to clients. The number is encrypted as a single AES block padded with
+// zeros, so the token is stable for an ID and can not be forged without the key.
+func publicID(resource string, id ID) ID {
+	number, numeric := id.Int()
+	if !obfuscatedResources[resource] || !numeric {
+		return id
+	}
+
+	var block [16]byte
+	binary.BigEndian.PutUint64(block[:8], uint64(number))
+	idCipher.Encrypt(block[:], block[:])
+
+	return ID(base64.RawURLEncoding.EncodeToString(block[:]))
+}
+
+// Turns a public token back into the stored ID
+func internalID(resource string, raw string) (ID, bool) {
+	if !obfuscatedResources[resource] {
+		return ID(raw), true
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil || len(data) != 16 {
+		return "", false
+	}
+
+	idCipher.Decrypt(data, data)
+	for _, padding := range data[8:] {
+		if padding != 0 {
+			return "", false
+		}
+	}
+
+	return ID(fmt.Sprint(binary.BigEndian.Uint64(data[:8]))), true
+}
+
+// User as sent to clients
+func publicUser(user User) User {
+	user.ID = publicID("users", user.ID)
+	return user
+}
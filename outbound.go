@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Shared client for calls to other services. Build the requests with the
+// inbound request context so the OutboundBudget applies to them.
+var httpClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: &budgetTransport{next: http.DefaultTransport},
+}
+
+var ErrBudgetExceeded = errors.New("outbound request budget exceeded")
+
+var budgetExceeded = expvar.NewInt("outbound_budget_exceeded")
+
+const budgetKey contextKey = "outbound_budget"
+
+// Calls and time an inbound request may spend on outbound calls
+type outboundBudget struct {
+	mutex       sync.Mutex
+	maxCalls    int
+	maxDuration time.Duration
+	calls       int
+	spent       time.Duration
+	route       string
+	cancel      context.CancelFunc
+}
+
+// Caps the outbound calls made while serving a request. Over the budget the
+// call fails with ErrBudgetExceeded and the inbound request context is cancelled.
+func OutboundBudget(maxCalls int, maxDuration time.Duration) Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+
+			budget := &outboundBudget{
+				maxCalls:    maxCalls,
+				maxDuration: maxDuration,
+				route:       r.Method + " " + RoutePattern(r),
+				cancel:      cancel,
+			}
+
+			nextMiddleware(w, r.WithContext(context.WithValue(ctx, budgetKey, budget)))
+		}
+	}
+}
+
+// Reserves one call, fails when the budget is used up
+func (budget *outboundBudget) take() error {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	if budget.calls >= budget.maxCalls || budget.spent >= budget.maxDuration {
+		budgetExceeded.Add(1)
+		warnf("%s exceeded its outbound budget: %d calls in %s", budget.route, budget.calls, budget.spent)
+		budget.cancel()
+		return ErrBudgetExceeded
+	}
+
+	budget.calls++
+	return nil
+}
+
+func (budget *outboundBudget) spend(duration time.Duration) {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	budget.spent += duration
+}
+
+type budgetTransport struct {
+	next http.RoundTripper
+}
+
+func (transport *budgetTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	budget, ok := request.Context().Value(budgetKey).(*outboundBudget)
+	if ok {
+		if err := budget.take(); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	response, err := transport.next.RoundTrip(request)
+	elapsed := time.Since(start)
+	if ok {
+		budget.spend(elapsed)
+	}
+
+	if err != nil {
+		debugf("outbound %s %s: %v after %s", request.Method, request.URL.Host+request.URL.Path, err, elapsed)
+	} else {
+		debugf("outbound %s %s: %d in %s", request.Method, request.URL.Host+request.URL.Path, response.StatusCode, elapsed)
+	}
+	return response, err
+}
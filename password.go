@@ -0,0 +1,88 @@
+package main
+
+import (
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores the bytes after it
+)
+
+// How the stores persist a user, the hash is kept out of User's JSON so it
+// never reaches a response
+type userRecord struct {
+	User
+	PasswordHash   string     `json:"password_hash,omitempty"`
+	SessionVersion int64      `json:"session_version,omitempty"`
+	TwoFactor      *TwoFactor `json:"two_factor,omitempty"`
+	Lock           *UserLock  `json:"lock,omitempty"`
+}
+
+func newUserRecord(user User) userRecord {
+	return userRecord{
+		User:           user,
+		PasswordHash:   user.PasswordHash,
+		SessionVersion: user.SessionVersion,
+		TwoFactor:      user.TwoFactor,
+		Lock:           user.Lock,
+	}
+}
+
+func (record userRecord) user() User {
+	user := record.User
+	user.PasswordHash = record.PasswordHash
+	user.SessionVersion = record.SessionVersion
+	user.TwoFactor = record.TwoFactor
+	user.Lock = record.Lock
+	return user
+}
+
+// Replaces the plain password with its hash. Stores call it before taking
+// their locks, bcrypt is slow on purpose.
+func hashPassword(user User) (User, error) {
+	if user.Password == "" {
+		return user, nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return user, err
+	}
+
+	user.Password = ""
+	user.PasswordHash = string(hash)
+	return user, nil
+}
+
+func (user User) CheckPassword(password string) bool {
+	if user.PasswordHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
+}
+
+// At least 8 characters with a letter and a digit
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return &ValidationError{Field: "password", Rule: "min_length", Message: "must have at least 8 characters"}
+	}
+
+	if len(password) > maxPasswordLength {
+		return &ValidationError{Field: "password", Rule: "max_length", Message: "must have at most 72 bytes"}
+	}
+
+	var letter, digit bool
+	for _, char := range password {
+		letter = letter || unicode.IsLetter(char)
+		digit = digit || unicode.IsDigit(char)
+	}
+
+	if !letter || !digit {
+		return &ValidationError{Field: "password", Rule: "letter_and_digit", Message: "must have a letter and a digit"}
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Applies a JSON Merge Patch (RFC 7386): null removes a field, objects merge, anything else replaces
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+
+	return targetObject
+}
+
+// Merges the patch document into the user and returns the result
+func mergePatchUser(user User, patchDocument []byte) (User, error) {
+	current, err := json.Marshal(user)
+	if err != nil {
+		return User{}, err
+	}
+
+	var target, patch interface{}
+	if err := decodeNumbers(current, &target); err != nil {
+		return User{}, err
+	}
+
+	if err := decodeNumbers(patchDocument, &patch); err != nil {
+		return User{}, ErrBadRequest("invalid merge patch: " + err.Error())
+	}
+
+	merged, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return User{}, err
+	}
+
+	var patched User
+	if err := json.Unmarshal(merged, &patched); err != nil {
+		return User{}, ErrBadRequest("invalid merge patch: " + err.Error())
+	}
+
+	return patched, nil
+}
+
+// Decodes into interface{} keeping numbers as json.Number, so big IDs are not rounded
+func decodeNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// One operation of a JSON Patch (RFC 6902) document
+type JSONPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// Applies add, remove, replace and test operations to the user.
+// A failed test returns a 409, an operation that can not be applied a 422.
+func jsonPatchUser(user User, patchDocument []byte) (User, error) {
+	var operations []JSONPatchOperation
+	if err := decodeNumbers(patchDocument, &operations); err != nil {
+		return User{}, ErrBadRequest("invalid json patch: " + err.Error())
+	}
+
+	current, err := json.Marshal(user)
+	if err != nil {
+		return User{}, err
+	}
+
+	var document interface{}
+	if err := decodeNumbers(current, &document); err != nil {
+		return User{}, err
+	}
+
+	for i, operation := range operations {
+		tokens, err := parsePointer(operation.Path)
+		if err != nil {
+			return User{}, ErrUnprocessable(fmt.Sprintf("operation %d: %v", i, err))
+		}
+
+		switch operation.Op {
+		case "test":
+			value, err := pointerGet(document, tokens)
+			if err != nil {
+				return User{}, ErrUnprocessable(fmt.Sprintf("operation %d: %v", i, err))
+			}
+			if !reflect.DeepEqual(value, operation.Value) {
+				return User{}, &AppError{Status: http.StatusConflict, Message: fmt.Sprintf("operation %d: test failed for %s", i, operation.Path)}
+			}
+		case "add", "remove", "replace":
+			document, err = pointerApply(document, tokens, operation.Op, operation.Value)
+			if err != nil {
+				return User{}, ErrUnprocessable(fmt.Sprintf("operation %d: %v", i, err))
+			}
+		default:
+			return User{}, ErrUnprocessable(fmt.Sprintf("operation %d: unsupported op %q", i, operation.Op))
+		}
+	}
+
+	patched, err := json.Marshal(document)
+	if err != nil {
+		return User{}, err
+	}
+
+	var result User
+	if err := json.Unmarshal(patched, &result); err != nil {
+		return User{}, ErrUnprocessable("invalid json patch result: " + err.Error())
+	}
+
+	return result, nil
+}
+
+// Splits a JSON Pointer (RFC 6901) like /attributes/a~1b into its unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, fmt.Errorf("the whole document can not be patched")
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+
+	return tokens, nil
+}
+
+func pointerGet(node interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch container := node.(type) {
+		case map[string]interface{}:
+			value, exists := container[token]
+			if !exists {
+				return nil, fmt.Errorf("path %q does not exist", token)
+			}
+			node = value
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(container) {
+				return nil, fmt.Errorf("invalid index %q", token)
+			}
+			node = container[index]
+		default:
+			return nil, fmt.Errorf("path %q does not exist", token)
+		}
+	}
+
+	return node, nil
+}
+
+// Applies add, remove or replace at the pointer and returns the updated node
+func pointerApply(node interface{}, tokens []string, op string, value interface{}) (interface{}, error) {
+	token := tokens[0]
+	last := len(tokens) == 1
+
+	switch container := node.(type) {
+	case map[string]interface{}:
+		child, exists := container[token]
+
+		if !last {
+			if !exists {
+				return nil, fmt.Errorf("path %q does not exist", token)
+			}
+			updated, err := pointerApply(child, tokens[1:], op, value)
+			if err != nil {
+				return nil, err
+			}
+			container[token] = updated
+			return container, nil
+		}
+
+		if op != "add" && !exists {
+			return nil, fmt.Errorf("path %q does not exist", token)
+		}
+
+		if op == "remove" {
+			delete(container, token)
+		} else {
+			container[token] = value
+		}
+		return container, nil
+
+	case []interface{}:
+		if last && op == "add" && token == "-" {
+			return append(container, value), nil
+		}
+
+		index, err := strconv.Atoi(token)
+		limit := len(container)
+		if last && op == "add" {
+			limit++ // Adding may append right after the last element
+		}
+		if err != nil || index < 0 || index >= limit {
+			return nil, fmt.Errorf("invalid index %q", token)
+		}
+
+		if !last {
+			updated, err := pointerApply(container[index], tokens[1:], op, value)
+			if err != nil {
+				return nil, err
+			}
+			container[index] = updated
+			return container, nil
+		}
+
+		switch op {
+		case "add":
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+		case "remove":
+			container = append(container[:index], container[index+1:]...)
+		case "replace":
+			container[index] = value
+		}
+		return container, nil
+
+	default:
+		return nil, fmt.Errorf("path %q does not exist", token)
+	}
+}
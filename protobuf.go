@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang-api-example/pb"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Schema in pb/api.proto
+const mediaProtobuf = "application/x-protobuf"
+
+func init() {
+	RegisterEncoder(mediaProtobuf, ResponseEncoder{ContentType: mediaProtobuf, Encode: encodeProtobuf},
+		"application/protobuf", "application/vnd.google.protobuf")
+}
+
+// Users and lists of users have their own messages, any other data is sent
+// as a google.protobuf.Value holding its JSON document
+func encodeProtobuf(buffer *bytes.Buffer, response APIResponse) error {
+	message := &pb.Response{Success: response.Success, Links: response.Links}
+
+	switch data := response.Data.(type) {
+	case nil:
+	case User:
+		user, err := userToProto(data)
+		if err != nil {
+			return err
+		}
+		message.Data = &pb.Response_User{User: user}
+	case []User:
+		list := &pb.UserList{Users: make([]*pb.User, len(data))}
+		for i, user := range data {
+			converted, err := userToProto(user)
+			if err != nil {
+				return err
+			}
+			list.Users[i] = converted
+		}
+		message.Data = &pb.Response_Users{Users: list}
+	default:
+		document, err := jsonDocument(data)
+		if err != nil {
+			return err
+		}
+		value, err := structpb.NewValue(document)
+		if err != nil {
+			return err
+		}
+		message.Data = &pb.Response_Value{Value: value}
+	}
+
+	if response.Error != nil {
+		message.Error = &pb.Error{Code: response.Error.Code, Message: response.Error.Message, Field: response.Error.Field}
+		for _, detail := range response.Error.Details {
+			message.Error.Details = append(message.Error.Details, &pb.ErrorDetail{Field: detail.Field, Rule: detail.Rule, Message: detail.Message})
+		}
+	}
+
+	body, err := proto.MarshalOptions{}.MarshalAppend(buffer.AvailableBuffer(), message)
+	if err != nil {
+		return err
+	}
+	_, err = buffer.Write(body)
+	return err
+}
+
+func userToProto(user User) (*pb.User, error) {
+	message := &pb.User{
+		Id:       string(user.ID),
+		Name:     user.Name,
+		Email:    user.Email,
+		Phone:    user.Phone,
+		Role:     string(user.Role),
+		Password: user.Password,
+		Version:  user.Version,
+	}
+
+	optional := func(at time.Time) *timestamppb.Timestamp {
+		if at.IsZero() {
+			return nil
+		}
+		return timestamppb.New(at)
+	}
+	message.CreatedAt = optional(user.CreatedAt)
+	message.UpdatedAt = optional(user.UpdatedAt)
+	message.DeletedAt = optional(user.DeletedAt)
+
+	if len(user.Attributes) > 0 {
+		// Through JSON, attributes may hold json.Number that structpb does not know
+		document, err := jsonDocument(user.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		if message.Attributes, err = structpb.NewStruct(document.(map[string]interface{})); err != nil {
+			return nil, err
+		}
+	}
+
+	return message, nil
+}
+
+func userFromProto(message *pb.User) User {
+	user := User{
+		ID:       ID(message.GetId()),
+		Name:     message.GetName(),
+		Email:    message.GetEmail(),
+		Phone:    message.GetPhone(),
+		Role:     Role(message.GetRole()),
+		Password: message.GetPassword(),
+		Version:  message.GetVersion(),
+	}
+
+	if message.GetAttributes() != nil {
+		user.Attributes = message.GetAttributes().AsMap()
+	}
+
+	return user
+}
+
+// Decodes a User or UserList message into a User or []User, the body
+// content type decides between it and DecodeJSON
+func DecodeBody(r *http.Request, v interface{}) error {
+	mediaType, _ := registeredMediaType(requestMediaType(r))
+	if mediaType != mediaProtobuf {
+		return DecodeJSON(r, v)
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxJSONBodySize))
+	if err != nil {
+		return jsonDecodeError(err)
+	}
+
+	// The body of a PUT is the user
+	if request, ok := v.(*UpdateUserRequest); ok {
+		v = &request.User
+	}
+
+	switch target := v.(type) {
+	case *User:
+		var message pb.User
+		if err := proto.Unmarshal(data, &message); err != nil {
+			return ErrBadRequest(fmt.Sprintf("invalid api.v1.User message: %v", err))
+		}
+		*target = userFromProto(&message)
+	case *[]User:
+		var message pb.UserList
+		if err := proto.Unmarshal(data, &message); err != nil {
+			return ErrBadRequest(fmt.Sprintf("invalid api.v1.UserList message: %v", err))
+		}
+		*target = make([]User, len(message.GetUsers()))
+		for i, user := range message.GetUsers() {
+			(*target)[i] = userFromProto(user)
+		}
+	default:
+		return &AppError{Status: http.StatusUnsupportedMediaType, Message: "send the body as application/json"}
+	}
+
+	return nil
+}
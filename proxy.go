@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Methods Server.Proxy registers, the service answers the ones it does not support
+var proxyMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// Credentials of the API itself, not sent to the services unless forwarded by name
+var proxyCredentials = []string{"Authorization", "Cookie", "X-API-Key"}
+
+// Tell the services who called, set from the authenticated user only
+const (
+	proxyUserHeader = "X-User-ID"
+	proxyRoleHeader = "X-User-Role"
+)
+
+const (
+	defaultProxyTimeout    = 30 * time.Second
+	defaultProxyRetryDelay = 100 * time.Millisecond
+)
+
+// Where and how Proxy sends the requests
+type ProxyOptions struct {
+	Target         string                   // Base URL of the service, its path goes before the request path
+	StripPrefix    string                   // Removed from the request path first, e.g. /billing
+	Rewrite        func(path string) string // Changes the path after StripPrefix, optional
+	ForwardHeaders []string                 // Request headers sent on, every one but proxyCredentials when empty
+	Timeout        time.Duration            // Of the whole exchange, defaultProxyTimeout when zero
+	Retries        int                      // Extra attempts of GET, HEAD and OPTIONS on network errors, 502, 503 and 504
+	RetryDelay     time.Duration            // Between attempts, defaultProxyRetryDelay when zero
+}
+
+// Sends the requests on to another service and its responses back, as they
+// come. The calls go through the outbound budget like the other outbound calls.
+// A service that can not be reached is a 502, one that is too slow a 504.
+func Proxy(options ProxyOptions) (http.HandlerFunc, error) {
+	target, err := url.Parse(options.Target)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("proxy target %q: not an http(s) URL", options.Target)
+	}
+	if options.Timeout == 0 {
+		options.Timeout = defaultProxyTimeout
+	}
+	if options.RetryDelay == 0 {
+		options.RetryDelay = defaultProxyRetryDelay
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(proxied *httputil.ProxyRequest) {
+			path := strings.TrimPrefix(proxied.In.URL.Path, options.StripPrefix)
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+			if options.Rewrite != nil {
+				path = options.Rewrite(path)
+			}
+			proxied.Out.URL.Path, proxied.Out.URL.RawPath = path, ""
+			proxied.SetURL(target)
+			proxied.SetXForwarded()
+
+			header := proxied.Out.Header
+			if len(options.ForwardHeaders) > 0 {
+				forwarded := make(http.Header)
+				for _, name := range options.ForwardHeaders {
+					if values := header.Values(name); len(values) > 0 {
+						forwarded[http.CanonicalHeaderKey(name)] = values
+					}
+				}
+				for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+					if values, ok := header[name]; ok {
+						forwarded[name] = values
+					}
+				}
+				header = forwarded
+				proxied.Out.Header = header
+			} else {
+				for _, name := range proxyCredentials {
+					header.Del(name)
+				}
+			}
+
+			header.Del(proxyUserHeader)
+			header.Del(proxyRoleHeader)
+			if user, ok := currentUser(proxied.In); ok {
+				header.Set(proxyUserHeader, string(publicID("users", user.ID)))
+				header.Set(proxyRoleHeader, string(user.Role))
+			}
+		},
+		Transport: &retryTransport{next: httpClient.Transport, retries: options.Retries, delay: options.RetryDelay},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			warnf("proxy %s %s to %s: %v", r.Method, r.URL.Path, target.Host, err)
+
+			if errors.Is(err, context.DeadlineExceeded) {
+				Error(w, &AppError{Status: http.StatusGatewayTimeout, Message: "the service took too long to answer", Err: err})
+				return
+			}
+			Error(w, &AppError{Status: http.StatusBadGateway, Message: "the service could not be reached", Err: err})
+		},
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), options.Timeout)
+		defer cancel()
+
+		proxy.ServeHTTP(w, r.WithContext(ctx))
+	}, nil
+}
+
+// Sends every method under prefix to Proxy(options), e.g. /billing and
+// /billing/invoices/1. The middleware runs around it as for any route.
+func (server *Server) Proxy(prefix string, options ProxyOptions, middlewares ...Middleware) error {
+	handler, err := Proxy(options)
+	if err != nil {
+		return err
+	}
+
+	handler = server.AddMiddleware(handler, middlewares...)
+	prefix = strings.TrimSuffix(prefix, "/")
+	for _, method := range proxyMethods {
+		server.Handle(method, prefix, handler)
+		server.Handle(method, prefix+"/{path...}", handler)
+	}
+
+	return nil
+}
+
+// Tries the idempotent requests again when the service is down or overloaded
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	delay   time.Duration
+}
+
+func (transport *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if transport.retries == 0 || !slices.Contains([]string{"GET", "HEAD", "OPTIONS"}, request.Method) {
+		return transport.next.RoundTrip(request)
+	}
+
+	for attempt := 0; ; attempt++ {
+		response, err := transport.next.RoundTrip(request)
+		if attempt == transport.retries || errors.Is(err, ErrBudgetExceeded) || request.Context().Err() != nil {
+			return response, err
+		}
+		if err == nil {
+			switch response.StatusCode {
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				io.Copy(io.Discard, io.LimitReader(response.Body, 4<<10))
+				response.Body.Close()
+			default:
+				return response, nil
+			}
+		}
+
+		select {
+		case <-time.After(transport.delay):
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+	}
+}
+
+// PROXY_ROUTES entries look like /billing=http://billing.internal:8080
+func parseProxyRoute(entry string) (string, string, error) {
+	prefix, target, ok := strings.Cut(strings.TrimSpace(entry), "=")
+	if !ok || len(prefix) < 2 || !strings.HasPrefix(prefix, "/") || strings.Contains(prefix, "{") {
+		return "", "", fmt.Errorf("%q: use /prefix=http://service", entry)
+	}
+	if _, err := Proxy(ProxyOptions{Target: target}); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSuffix(prefix, "/"), target, nil
+}
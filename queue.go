@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tasks waiting in the memory queue, more are refused
+const maxPendingTasks = 10000
+
+var (
+	ErrQueueFull   = &AppError{Status: http.StatusServiceUnavailable, Message: "too much work queued, try again later"}
+	ErrQueueClosed = &AppError{Status: http.StatusServiceUnavailable, Message: "the server is shutting down"}
+)
+
+// A unit of background work. The payload is JSON so queues backed by
+// another service, e.g. Redis, can hand it to another process.
+type Task struct {
+	ID      ID              `json:"id"`
+	Kind    string          `json:"kind"` // Picks the handler, e.g. webhook.deliver
+	Payload json.RawMessage `json:"payload"`
+	Attempt int             `json:"attempt"` // 1 on the first run
+	RunAt   time.Time       `json:"run_at"`  // Not run before, zero means now
+}
+
+func NewTask(kind string, payload interface{}) (Task, error) {
+	data, err := json.Marshal(payload)
+	return Task{Kind: kind, Payload: data}, err
+}
+
+func (task Task) Decode(payload interface{}) error {
+	return json.Unmarshal(task.Payload, payload)
+}
+
+// Runs a task, errors are retried as the options of its kind say
+type TaskHandler func(ctx context.Context, task Task) error
+
+// How the tasks of a kind are run
+type TaskOptions struct {
+	MaxAttempts int           // Runs before giving up, 1 (or 0) means no retries
+	RetryDelay  time.Duration // Before the first retry, doubled for each next one
+	MaxDelay    time.Duration // Cap of the retry delay, none when 0
+	Timeout     time.Duration // Of each attempt, none when 0
+	Concurrency int           // Tasks of the kind running at once, only the workers limit it when 0
+}
+
+// Delay before the attempt that follows attempt
+func (options TaskOptions) Backoff(attempt int) time.Duration {
+	delay := options.RetryDelay
+	for i := 1; i < attempt && (options.MaxDelay == 0 || delay < options.MaxDelay); i++ {
+		delay *= 2
+	}
+	if options.MaxDelay > 0 && delay > options.MaxDelay {
+		delay = options.MaxDelay
+	}
+	return delay
+}
+
+// Whether a failed attempt is run again
+func (options TaskOptions) Retries(attempt int, err error) bool {
+	return attempt < options.MaxAttempts && !errors.Is(err, errPermanent)
+}
+
+var errPermanent = errors.New("permanent failure")
+
+// Marks err as not worth retrying, e.g. a task for something deleted since
+func Permanent(err error) error {
+	return fmt.Errorf("%w: %w", errPermanent, err)
+}
+
+// Background work for webhooks, notifications and jobs. MemoryQueue is the
+// only implementation for now, one backed by Redis would share it across instances.
+type TaskQueue interface {
+	// Registers the handler of a kind, before the first Enqueue of it
+	Handle(kind string, handler TaskHandler, options TaskOptions)
+	Enqueue(task Task) error
+
+	// Stops taking tasks and runs the due ones until ctx is done, then
+	// cancels the running ones. Retries scheduled for later are dropped.
+	Drain(ctx context.Context) error
+}
+
+type taskKind struct {
+	handler TaskHandler
+	options TaskOptions
+}
+
+// Keeps the tasks in memory and runs them on a fixed number of workers.
+// Tasks still queued when the process stops are lost.
+type MemoryQueue struct {
+	mutex   sync.Mutex
+	kinds   map[string]taskKind
+	pending []Task // By RunAt
+	running map[string]int
+	closed  bool
+
+	wake    chan struct{} // A task is due or a worker is free
+	closing chan struct{}
+	ctx     context.Context // Of the tasks, cancelled when Drain gives up
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+func NewMemoryQueue(workers int) *MemoryQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	queue := &MemoryQueue{
+		kinds:   make(map[string]taskKind),
+		running: make(map[string]int),
+		wake:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	for i := 0; i < workers; i++ {
+		queue.workers.Add(1)
+		go queue.work()
+	}
+
+	return queue
+}
+
+func (queue *MemoryQueue) Handle(kind string, handler TaskHandler, options TaskOptions) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.kinds[kind] = taskKind{handler: handler, options: options}
+}
+
+func (queue *MemoryQueue) Enqueue(task Task) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if _, ok := queue.kinds[task.Kind]; !ok {
+		return fmt.Errorf("no handler for %s tasks", task.Kind)
+	}
+	if queue.closed {
+		return ErrQueueClosed
+	}
+	if len(queue.pending) >= maxPendingTasks {
+		return ErrQueueFull
+	}
+
+	if task.ID == "" {
+		task.ID = newULID(time.Now())
+	}
+	if task.Attempt == 0 {
+		task.Attempt = 1
+	}
+	queue.push(task)
+
+	return nil
+}
+
+// Callers must hold the mutex
+func (queue *MemoryQueue) push(task Task) {
+	at := sort.Search(len(queue.pending), func(i int) bool { return queue.pending[i].RunAt.After(task.RunAt) })
+	queue.pending = append(queue.pending, Task{})
+	copy(queue.pending[at+1:], queue.pending[at:])
+	queue.pending[at] = task
+	queue.signal()
+}
+
+func (queue *MemoryQueue) signal() {
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (queue *MemoryQueue) work() {
+	defer queue.workers.Done()
+
+	// Wakes the worker once to see whether anything is left to drain
+	closing := queue.closing
+
+	for {
+		task, wait, ok := queue.next(time.Now())
+		if !ok {
+			return
+		}
+
+		if task == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-queue.wake:
+			case <-closing:
+				closing = nil
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+
+		queue.run(*task)
+	}
+}
+
+// The first due task whose kind may run one more, or how long to wait for
+// one. False once the queue is closed and no task is due.
+func (queue *MemoryQueue) next(now time.Time) (*Task, time.Duration, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	wait := time.Minute
+	for i, task := range queue.pending {
+		if task.RunAt.After(now) {
+			wait = min(wait, task.RunAt.Sub(now))
+			break
+		}
+
+		limit := queue.kinds[task.Kind].options.Concurrency
+		if limit > 0 && queue.running[task.Kind] >= limit {
+			continue
+		}
+
+		queue.pending = append(queue.pending[:i], queue.pending[i+1:]...)
+		queue.running[task.Kind]++
+		if len(queue.pending) > 0 {
+			queue.signal() // Another worker may take the next one
+		}
+		return &task, 0, true
+	}
+
+	if queue.closed && queue.dueCount(now) == 0 {
+		return nil, 0, false
+	}
+	return nil, wait, true
+}
+
+// Callers must hold the mutex
+func (queue *MemoryQueue) dueCount(now time.Time) int {
+	return sort.Search(len(queue.pending), func(i int) bool { return queue.pending[i].RunAt.After(now) })
+}
+
+func (queue *MemoryQueue) run(task Task) {
+	queue.mutex.Lock()
+	kind := queue.kinds[task.Kind]
+	queue.mutex.Unlock()
+
+	err := runTask(queue.ctx, kind, task)
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.running[task.Kind]--
+	queue.signal()
+
+	if err == nil {
+		return
+	}
+
+	if !kind.options.Retries(task.Attempt, err) {
+		errorf("task %s %s failed after %d attempts: %v", task.Kind, task.ID, task.Attempt, err)
+		return
+	}
+
+	if queue.closed {
+		warnf("task %s %s: retry dropped on shutdown: %v", task.Kind, task.ID, err)
+		return
+	}
+
+	task.RunAt = time.Now().Add(kind.options.Backoff(task.Attempt))
+	task.Attempt++
+	queue.push(task)
+}
+
+// A panic fails the attempt instead of the process
+func runTask(ctx context.Context, kind taskKind, task Task) (err error) {
+	if kind.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, kind.options.Timeout)
+		defer cancel()
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+
+	return kind.handler(ctx, task)
+}
+
+func (queue *MemoryQueue) Drain(ctx context.Context) error {
+	queue.mutex.Lock()
+	if !queue.closed {
+		queue.closed = true
+		close(queue.closing)
+		if later := len(queue.pending) - queue.dueCount(time.Now()); later > 0 {
+			warnf("queue: %d scheduled retries dropped", later)
+		}
+	}
+	queue.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		queue.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		queue.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
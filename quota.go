@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	usageDayFormat   = "2006-01-02" // Days and months are UTC
+	usageMonthFormat = "2006-01"
+	usageFlushEvery  = time.Minute // How often the counts are written to the store
+)
+
+// Requests made with an API key on a day
+type APIKeyDay struct {
+	Date     string `json:"date"`
+	Requests int64  `json:"requests"`
+}
+
+// Requests made with an API key in a day or month, against its quota
+type QuotaUsage struct {
+	Period    string    `json:"period"` // 2006-01-02 or 2006-01
+	Requests  int64     `json:"requests"`
+	Quota     int64     `json:"quota,omitempty"`     // Absent without a quota
+	Remaining *int64    `json:"remaining,omitempty"` // Absent without a quota
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+type APIKeyUsage struct {
+	KeyID ID          `json:"key_id"`
+	Day   QuotaUsage  `json:"day"`
+	Month QuotaUsage  `json:"month"`
+	Days  []APIKeyDay `json:"days"` // Days with requests, oldest first
+}
+
+// Counts the requests of each API key and holds them to the daily and
+// monthly quotas. Counts are kept in memory and added to the store every
+// usageFlushEvery, the quotas are per server.
+type APIKeyMeter struct {
+	keys         APIKeyStore // Where the counts are flushed
+	dailyQuota   int64       // 0 for no quota
+	monthlyQuota int64
+	mutex        sync.Mutex
+	counts       map[ID]*keyCounts
+	pending      map[ID]map[string]int64 // Requests of each day not in the store yet
+	flushing     map[ID]map[string]int64 // Pending ones being written by Flush
+}
+
+// Requests of a key in the current day and month, stored and pending
+type keyCounts struct {
+	day, month       string
+	today, thisMonth int64
+}
+
+func NewAPIKeyMeter(keys APIKeyStore, dailyQuota int, monthlyQuota int) *APIKeyMeter {
+	return &APIKeyMeter{
+		keys:         keys,
+		dailyQuota:   int64(dailyQuota),
+		monthlyQuota: int64(monthlyQuota),
+		counts:       make(map[ID]*keyCounts),
+		pending:      make(map[ID]map[string]int64),
+	}
+}
+
+func ErrQuotaExceeded(period string, quota int64) *AppError {
+	return &AppError{
+		Status:  http.StatusTooManyRequests,
+		Code:    CodeQuotaExceeded,
+		Message: fmt.Sprintf("the %s quota of %d requests of the api key is used up", period, quota),
+	}
+}
+
+// Counts a request of the key, unless it used up its quota of the day or
+// month. The usage is returned either way.
+func (meter *APIKeyMeter) Use(id ID, now time.Time) (APIKeyUsage, error) {
+	meter.mutex.Lock()
+	defer meter.mutex.Unlock()
+
+	counts, err := meter.load(id, now)
+	if err != nil {
+		return APIKeyUsage{}, err
+	}
+
+	switch {
+	case meter.dailyQuota > 0 && counts.today >= meter.dailyQuota:
+		err = ErrQuotaExceeded("daily", meter.dailyQuota)
+	case meter.monthlyQuota > 0 && counts.thisMonth >= meter.monthlyQuota:
+		err = ErrQuotaExceeded("monthly", meter.monthlyQuota)
+	default:
+		counts.today++
+		counts.thisMonth++
+		if meter.pending[id] == nil {
+			meter.pending[id] = make(map[string]int64)
+		}
+		meter.pending[id][counts.day]++
+	}
+
+	return meter.usage(id, counts, now), err
+}
+
+// The usage of the key with the requests of the last days, today included
+func (meter *APIKeyMeter) Usage(id ID, days int, now time.Time) (APIKeyUsage, error) {
+	since := now.UTC().AddDate(0, 0, 1-days).Format(usageDayFormat)
+	stored, err := meter.keys.APIKeyUsage(id, since)
+	if err != nil {
+		return APIKeyUsage{}, err
+	}
+
+	meter.mutex.Lock()
+	defer meter.mutex.Unlock()
+
+	counts, err := meter.load(id, now)
+	if err != nil {
+		return APIKeyUsage{}, err
+	}
+	usage := meter.usage(id, counts, now)
+
+	byDate := make(map[string]int64)
+	for _, day := range stored {
+		byDate[day.Date] = day.Requests
+	}
+	for _, unstored := range []map[string]int64{meter.pending[id], meter.flushing[id]} {
+		for date, requests := range unstored {
+			if date >= since {
+				byDate[date] += requests
+			}
+		}
+	}
+	usage.Days = []APIKeyDay{}
+	for date := now.UTC().AddDate(0, 0, 1-days); !date.After(now.UTC()); date = date.AddDate(0, 0, 1) {
+		if requests := byDate[date.Format(usageDayFormat)]; requests > 0 {
+			usage.Days = append(usage.Days, APIKeyDay{Date: date.Format(usageDayFormat), Requests: requests})
+		}
+	}
+
+	return usage, nil
+}
+
+// The counts of the key for the day of now, read from the store the first
+// time and moved on when the day or month changes. Called with the mutex.
+func (meter *APIKeyMeter) load(id ID, now time.Time) (*keyCounts, error) {
+	day, month := now.UTC().Format(usageDayFormat), now.UTC().Format(usageMonthFormat)
+
+	counts, ok := meter.counts[id]
+	if !ok {
+		stored, err := meter.keys.APIKeyUsage(id, month+"-01")
+		if err != nil {
+			return nil, err
+		}
+
+		counts = &keyCounts{day: day, month: month}
+		for _, stored := range stored {
+			counts.thisMonth += stored.Requests
+			if stored.Date == day {
+				counts.today += stored.Requests
+			}
+		}
+		for _, unstored := range []map[string]int64{meter.pending[id], meter.flushing[id]} {
+			for date, requests := range unstored {
+				if date[:len(month)] == month {
+					counts.thisMonth += requests
+				}
+				if date == day {
+					counts.today += requests
+				}
+			}
+		}
+		meter.counts[id] = counts
+	}
+
+	if counts.month != month {
+		counts.month, counts.thisMonth = month, 0
+	}
+	if counts.day != day {
+		counts.day, counts.today = day, 0
+	}
+	return counts, nil
+}
+
+func (meter *APIKeyMeter) usage(id ID, counts *keyCounts, now time.Time) APIKeyUsage {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+
+	return APIKeyUsage{
+		KeyID: id,
+		Day:   quotaUsage(counts.day, counts.today, meter.dailyQuota, midnight),
+		Month: quotaUsage(counts.month, counts.thisMonth, meter.monthlyQuota, nextMonth),
+	}
+}
+
+func quotaUsage(period string, requests int64, quota int64, resetsAt time.Time) QuotaUsage {
+	usage := QuotaUsage{Period: period, Requests: requests, Quota: quota, ResetsAt: resetsAt}
+	if quota > 0 {
+		remaining := max(quota-requests, 0)
+		usage.Remaining = &remaining
+	}
+	return usage
+}
+
+// Adds the pending counts to the store. Those that could not be written are
+// kept for the next time.
+func (meter *APIKeyMeter) Flush(ctx context.Context) error {
+	meter.mutex.Lock()
+	pending := meter.pending
+	meter.pending, meter.flushing = make(map[ID]map[string]int64), pending
+	meter.mutex.Unlock()
+	defer func() {
+		meter.mutex.Lock()
+		meter.flushing = nil
+		meter.mutex.Unlock()
+	}()
+
+	var firstErr error
+	for id, days := range pending {
+		for date, requests := range days {
+			err := meter.keys.AddAPIKeyUsage(id, date, requests)
+			if err == nil {
+				continue
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("api key usage: %w", err)
+			}
+
+			meter.mutex.Lock()
+			delete(meter.flushing[id], date)
+			if meter.pending[id] == nil {
+				meter.pending[id] = make(map[string]int64)
+			}
+			meter.pending[id][date] += requests
+			meter.mutex.Unlock()
+		}
+	}
+	return firstErr
+}
+
+// Tells the client what is left of its quotas, and when it may retry once
+// one is used up
+func writeQuotaHeaders(w http.ResponseWriter, usage APIKeyUsage, err error, now time.Time) {
+	for _, quota := range []struct {
+		header string
+		usage  QuotaUsage
+	}{{"X-Quota-Daily-Remaining", usage.Day}, {"X-Quota-Monthly-Remaining", usage.Month}} {
+		if quota.usage.Remaining != nil {
+			w.Header().Set(quota.header, strconv.FormatInt(*quota.usage.Remaining, 10))
+		}
+	}
+
+	if appErr, ok := asAppError(err); ok && appErr.Code == CodeQuotaExceeded {
+		resetsAt := usage.Day.ResetsAt
+		if usage.Month.Remaining != nil && *usage.Month.Remaining == 0 {
+			resetsAt = usage.Month.ResetsAt
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(resetsAt.Sub(now).Seconds())+1))
+	}
+}
+
+type APIKeyUsageRequest struct {
+	ID   ID  `path:"id,raw"`                         // A ULID, not obfuscated like the user IDs
+	Days int `query:"days" validate:"min=0,max=366"` // Of the history, 30 when absent
+}
+
+// GET /api/keys/{id}/usage, keys of other users are not found
+func (app *App) GetAPIKeyUsage(ctx context.Context, request APIKeyUsageRequest) (APIKeyUsage, error) {
+	user, ok := contextUser(ctx)
+	if !ok {
+		return APIKeyUsage{}, ErrUnauthorized("a bearer token is required")
+	}
+
+	keys, err := app.APIKeys.ListAPIKeys(user.ID)
+	if err != nil {
+		return APIKeyUsage{}, err
+	}
+	found := false
+	for _, key := range keys {
+		found = found || key.ID == request.ID
+	}
+	if !found {
+		return APIKeyUsage{}, ErrAPIKeyNotFound()
+	}
+
+	if request.Days == 0 {
+		request.Days = 30
+	}
+	return app.Meter.Usage(request.ID, request.Days, app.Clock.Now())
+}
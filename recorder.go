@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Never recorded, reading the recordings would fill them
+var recorderExempt = []string{"/admin", "/health", "/healthz", "/readyz", "/debug", "/docs"}
+
+// Headers whose value is replaced by redactedValue
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-API-Key"}
+
+// JSON fields and query params redacted in requests and responses, and the
+// ones only redacted in requests (a "code" in a response is an error code)
+var (
+	redactedFields        = []string{"password", "current_password", "new_password", "secret", "otpauth_uri", "token", "access_token", "refresh_token", "mfa_token", "backup_codes", "api_key"}
+	redactedRequestFields = []string{"code", "state"}
+)
+
+const redactedValue = "[REDACTED]"
+
+// One request and its response, as sent and received
+type RecordedExchange struct {
+	ID         uint64          `json:"id"`
+	StartedAt  time.Time       `json:"started_at"`
+	DurationMS float64         `json:"duration_ms"`
+	Request    RecordedMessage `json:"request"`
+	Response   RecordedMessage `json:"response"`
+	URL        string          `json:"-"` // Absolute, for HAR
+	Proto      string          `json:"-"`
+}
+
+// Either side of an exchange. Only the size of the bodies that can not be
+// redacted is kept, see recordedBody.
+type RecordedMessage struct {
+	Method   string      `json:"method,omitempty"`
+	URL      string      `json:"url,omitempty"` // Path and query, redacted
+	Status   int         `json:"status,omitempty"`
+	Header   http.Header `json:"headers"`
+	Body     string      `json:"body,omitempty"`
+	BodySize int         `json:"body_size"`
+	Omitted  bool        `json:"body_omitted,omitempty"` // The body could not be redacted
+}
+
+// Keeps the last exchanges in a ring, for troubleshooting integrations.
+// Secrets are redacted before they are stored.
+type RequestRecorder struct {
+	mutex     sync.Mutex
+	exchanges []RecordedExchange
+	next      int // Where the next exchange goes once the ring is full
+	count     uint64
+	bodyLimit int
+}
+
+func NewRequestRecorder(size int, bodyLimit int) *RequestRecorder {
+	return &RequestRecorder{exchanges: make([]RecordedExchange, 0, size), bodyLimit: bodyLimit}
+}
+
+// Records the exchanges that are not on recorderExempt
+func (recorder *RequestRecorder) Middleware() Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if underPath(r.URL.Path, recorderExempt) || r.Header.Get("Upgrade") != "" {
+				nextMiddleware(w, r)
+				return
+			}
+
+			start := time.Now()
+			limit := recorder.bodyLimit
+
+			requestBody, _ := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(requestBody), r.Body), r.Body}
+
+			// The router rewrites versioned paths, RequestURI is what the client sent
+			requestURI := redactURI(r.RequestURI)
+			exchange := RecordedExchange{
+				StartedAt: start.UTC(),
+				URL:       requestScheme(r) + "://" + r.Host + requestURI,
+				Proto:     r.Proto,
+				Request: RecordedMessage{
+					Method:   r.Method,
+					URL:      requestURI,
+					Header:   redactHeader(r.Header),
+					BodySize: max(int(r.ContentLength), len(requestBody)),
+				},
+			}
+			exchange.Request.Body, exchange.Request.Omitted = recordedBody(requestBody, r.Header.Get("Content-Type"), limit, true)
+
+			response := &recordingResponse{ResponseWriter: w, status: http.StatusOK, limit: limit}
+			nextMiddleware(response, r)
+
+			exchange.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+			exchange.Response = RecordedMessage{
+				Status:   response.status,
+				Header:   redactHeader(w.Header()),
+				BodySize: response.size,
+			}
+			exchange.Response.Body, exchange.Response.Omitted = recordedBody(response.body.Bytes(), w.Header().Get("Content-Type"), limit, false)
+
+			recorder.add(exchange)
+		}
+	}
+}
+
+func (recorder *RequestRecorder) add(exchange RecordedExchange) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.count++
+	exchange.ID = recorder.count
+
+	if len(recorder.exchanges) < cap(recorder.exchanges) {
+		recorder.exchanges = append(recorder.exchanges, exchange)
+		return
+	}
+	recorder.exchanges[recorder.next] = exchange
+	recorder.next = (recorder.next + 1) % len(recorder.exchanges)
+}
+
+// The recorded exchanges, oldest first
+func (recorder *RequestRecorder) Exchanges() []RecordedExchange {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	exchanges := make([]RecordedExchange, 0, len(recorder.exchanges))
+	exchanges = append(exchanges, recorder.exchanges[recorder.next:]...)
+	return append(exchanges, recorder.exchanges[:recorder.next]...)
+}
+
+func (recorder *RequestRecorder) Clear() {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.exchanges = recorder.exchanges[:0]
+	recorder.next = 0
+}
+
+// Tees the response body, up to the limit, while it is sent
+type recordingResponse struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	size        int
+	limit       int
+}
+
+func (response *recordingResponse) Unwrap() http.ResponseWriter {
+	return response.ResponseWriter
+}
+
+func (response *recordingResponse) Flush() {
+	http.NewResponseController(response.ResponseWriter).Flush()
+}
+
+func (response *recordingResponse) WriteHeader(status int) {
+	if !response.wroteHeader {
+		response.wroteHeader, response.status = true, status
+	}
+	response.ResponseWriter.WriteHeader(status)
+}
+
+func (response *recordingResponse) Write(data []byte) (int, error) {
+	response.wroteHeader = true
+	response.size += len(data)
+	// One byte over the limit tells recordedBody the body is too long
+	if room := response.limit + 1 - response.body.Len(); room > 0 {
+		response.body.Write(data[:min(room, len(data))])
+	}
+	return response.ResponseWriter.Write(data)
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func redactHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range redactedHeaders {
+		if len(redacted.Values(name)) > 0 {
+			redacted.Set(name, redactedValue)
+		}
+	}
+	return redacted
+}
+
+func redactURI(requestURI string) string {
+	path, rawQuery, found := strings.Cut(requestURI, "?")
+	if !found {
+		return requestURI
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return path + "?" + redactedValue
+	}
+	for name := range query {
+		if redactedField(name, true) {
+			query.Set(name, redactedValue)
+		}
+	}
+	return path + "?" + query.Encode()
+}
+
+func redactedField(name string, request bool) bool {
+	name = strings.ToLower(name)
+	return slices.Contains(redactedFields, name) || (request && slices.Contains(redactedRequestFields, name))
+}
+
+// The body as text with the secrets redacted, or whether it is left out. Only JSON and form bodies are kept, the others could not be
+// redacted. Bodies over the limit are left out for the same reason.
+func recordedBody(body []byte, contentType string, limit int, request bool) (string, bool) {
+	if len(body) == 0 {
+		return "", false
+	}
+	if len(body) > limit {
+		return "", true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var document interface{}
+		if err := decodeNumbers(body, &document); err != nil {
+			return "", true
+		}
+		redacted, err := json.Marshal(redactJSON(document, request))
+		if err != nil {
+			return "", true
+		}
+		return string(redacted), false
+	case mediaType == "application/x-www-form-urlencoded":
+		query, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "", true
+		}
+		for name := range query {
+			if redactedField(name, request) {
+				query.Set(name, redactedValue)
+			}
+		}
+		return query.Encode(), false
+	default:
+		return "", true
+	}
+}
+
+func redactJSON(document interface{}, request bool) interface{} {
+	switch value := document.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if redactedField(key, request) {
+				value[key] = redactedValue
+			} else {
+				value[key] = redactJSON(field, request)
+			}
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = redactJSON(value[i], request)
+		}
+	}
+	return document
+}
+
+// The exchanges as an HTTP Archive (HAR 1.2), for browser devtools and proxies
+func harOf(exchanges []RecordedExchange) map[string]interface{} {
+	entries := make([]interface{}, 0, len(exchanges))
+	for _, exchange := range exchanges {
+		request, response := exchange.Request, exchange.Response
+
+		query := []interface{}{}
+		if parsed, err := url.Parse(exchange.URL); err == nil {
+			for name, values := range parsed.Query() {
+				for _, value := range values {
+					query = append(query, map[string]interface{}{"name": name, "value": value})
+				}
+			}
+		}
+
+		harRequest := map[string]interface{}{
+			"method":      request.Method,
+			"url":         exchange.URL,
+			"httpVersion": exchange.Proto,
+			"cookies":     []interface{}{},
+			"headers":     harHeaders(request.Header),
+			"queryString": query,
+			"headersSize": -1,
+			"bodySize":    request.BodySize,
+		}
+		if request.BodySize > 0 {
+			harRequest["postData"] = map[string]interface{}{"mimeType": request.Header.Get("Content-Type"), "text": request.Body}
+		}
+
+		entries = append(entries, map[string]interface{}{
+			"startedDateTime": exchange.StartedAt.Format(time.RFC3339Nano),
+			"time":            exchange.DurationMS,
+			"request":         harRequest,
+			"response": map[string]interface{}{
+				"status":      response.Status,
+				"statusText":  http.StatusText(response.Status),
+				"httpVersion": exchange.Proto,
+				"cookies":     []interface{}{},
+				"headers":     harHeaders(response.Header),
+				"content": map[string]interface{}{
+					"size":     response.BodySize,
+					"mimeType": response.Header.Get("Content-Type"),
+					"text":     response.Body,
+				},
+				"redirectURL": response.Header.Get("Location"),
+				"headersSize": -1,
+				"bodySize":    response.BodySize,
+			},
+			"cache":   map[string]interface{}{},
+			"timings": map[string]interface{}{"send": 0, "wait": exchange.DurationMS, "receive": 0},
+			"comment": "exchange " + strconv.FormatUint(exchange.ID, 10),
+		})
+	}
+
+	return map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]interface{}{"name": openAPITitle, "version": version},
+			"entries": entries,
+		},
+	}
+}
+
+func harHeaders(header http.Header) []interface{} {
+	headers := []interface{}{}
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, map[string]interface{}{"name": name, "value": value})
+		}
+	}
+	return headers
+}
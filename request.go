@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Largest JSON body a handler reads, larger ones get a 413
+const maxJSONBodySize = 1 << 20
+
+// Decodes the JSON body into v. The body must be application/json (or a
+// +json type), hold a single value with known fields only and fit in
+// maxJSONBodySize. Mistakes come back as AppErrors pointing at the problem,
+// e.g. "field 'id' expects a number at offset 17".
+func DecodeJSON(r *http.Request, v interface{}) error {
+	mediaType := requestMediaType(r)
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return &AppError{Status: http.StatusUnsupportedMediaType, Message: "send the body as application/json"}
+	}
+
+	// No ResponseWriter, the handler answers the 413 itself
+	body := http.MaxBytesReader(nil, r.Body, maxJSONBodySize)
+
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return jsonDecodeError(err)
+	}
+
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return ErrBadRequest(fmt.Sprintf("the body must hold a single JSON value, more data at offset %d", decoder.InputOffset()))
+	}
+
+	return nil
+}
+
+// Content-Type of the body without its parameters
+func requestMediaType(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType
+}
+
+// Turns the errors of encoding/json into messages clients can act on
+func jsonDecodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var tooLarge *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &tooLarge):
+		return &AppError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("the body may have at most %d bytes", tooLarge.Limit)}
+	case errors.Is(err, io.EOF):
+		return ErrBadRequest("the body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrBadRequest("the body ends before the JSON value does")
+	case errors.As(err, &syntaxErr):
+		return ErrBadRequest(fmt.Sprintf("malformed JSON at offset %d: %s", syntaxErr.Offset, strings.TrimPrefix(syntaxErr.Error(), "json: ")))
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return ErrBadRequest(fmt.Sprintf("the body must be %s", jsonKind(typeErr.Type)))
+		}
+		return &AppError{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("field '%s' expects %s at offset %d", typeErr.Field, jsonKind(typeErr.Type), typeErr.Offset),
+			Field:   typeErr.Field,
+		}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// Not a typed error, the name is quoted at the end of the message
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return &AppError{Status: http.StatusBadRequest, Message: fmt.Sprintf("unknown field '%s'", field), Field: field}
+	}
+
+	return ErrBadRequest(fmt.Sprintf("invalid body: %v", err))
+}
+
+// How a Go type is written in JSON, e.g. "a number" for int64
+func jsonKind(t reflect.Type) string {
+	if t == reflect.TypeOf(time.Time{}) {
+		return "a string"
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonKind(t.Elem())
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+
+	return "a " + t.String()
+}
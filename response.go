@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Envelope used by every JSON response
+type APIResponse struct {
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   *APIError   `json:"error,omitempty"`
+	Links   Links       `json:"links,omitempty"` // Where to go next, built from named routes
+}
+
+type APIError struct {
+	Code    string `json:"code" xml:"code"` // Stable, clients branch on it instead of the message
+	Message string `json:"message" xml:"message"`
+	Field   string `json:"field,omitempty" xml:"field,omitempty"` // Request field that caused the error
+
+	Details []ErrorDetail `json:"details,omitempty" xml:"details>detail,omitempty"` // Every invalid field of a 422
+}
+
+// One invalid field, e.g. {"field":"/email","rule":"required","message":"is required"}
+type ErrorDetail struct {
+	Field   string `json:"field" xml:"field"` // JSON pointer into the request body
+	Rule    string `json:"rule" xml:"rule"`
+	Message string `json:"message" xml:"message"`
+}
+
+// Error carrying the HTTP status that should be sent to the client. It may be
+// wrapped with fmt.Errorf("...: %w", appErr), Error still finds it.
+type AppError struct {
+	Status  int
+	Code    string // Defaults to the code of the status, see statusCodes
+	Message string
+	Field   string
+	Err     error // Cause, logged but never sent to the client, see With
+	Details []ErrorDetail
+}
+
+// Match any AppError of their status with errors.Is, e.g.
+// errors.Is(err, ErrStatusNotFound) for ErrNotFound("user") wrapped or not
+var (
+	ErrStatusBadRequest    = &AppError{Status: http.StatusBadRequest}
+	ErrStatusUnauthorized  = &AppError{Status: http.StatusUnauthorized}
+	ErrStatusForbidden     = &AppError{Status: http.StatusForbidden}
+	ErrStatusNotFound      = &AppError{Status: http.StatusNotFound}
+	ErrStatusConflict      = &AppError{Status: http.StatusConflict}
+	ErrStatusUnprocessable = &AppError{Status: http.StatusUnprocessableEntity}
+)
+
+// Codes of the errors that need more than their status to be told apart
+const (
+	CodeValidationFailed      = "VALIDATION_FAILED"
+	CodeEmailTaken            = "EMAIL_TAKEN"
+	CodeUserNotDeleted        = "USER_NOT_DELETED"
+	CodeInvalidCredentials    = "INVALID_CREDENTIALS"
+	CodeInvalidCode           = "INVALID_CODE"
+	CodeRoleChangeForbidden   = "ROLE_CHANGE_FORBIDDEN"
+	CodeTwoFactorEnabled      = "TWO_FACTOR_ALREADY_ENABLED"
+	CodeTwoFactorNotEnabled   = "TWO_FACTOR_NOT_ENABLED"
+	CodeTwoFactorNotEnrolling = "TWO_FACTOR_NOT_ENROLLING"
+	CodeVersionSunset         = "VERSION_SUNSET"
+	CodeAccountLocked         = "ACCOUNT_LOCKED"
+	CodeMaintenance           = "MAINTENANCE"
+	CodeQuotaExceeded         = "QUOTA_EXCEEDED"
+)
+
+// Code of the errors that do not set one
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "BAD_REQUEST",
+	http.StatusUnauthorized:          "UNAUTHORIZED",
+	http.StatusForbidden:             "FORBIDDEN",
+	http.StatusNotFound:              "NOT_FOUND",
+	http.StatusMethodNotAllowed:      "METHOD_NOT_ALLOWED",
+	http.StatusConflict:              "CONFLICT",
+	http.StatusPreconditionFailed:    "PRECONDITION_FAILED",
+	http.StatusRequestEntityTooLarge: "PAYLOAD_TOO_LARGE",
+	http.StatusUnsupportedMediaType:  "UNSUPPORTED_MEDIA_TYPE",
+	http.StatusUnprocessableEntity:   CodeValidationFailed,
+	http.StatusUpgradeRequired:       "UPGRADE_REQUIRED",
+	http.StatusPreconditionRequired:  "PRECONDITION_REQUIRED",
+	http.StatusTooManyRequests:       "RATE_LIMITED",
+	http.StatusInternalServerError:   "INTERNAL_ERROR",
+	http.StatusBadGateway:            "BAD_GATEWAY",
+	http.StatusServiceUnavailable:    "UNAVAILABLE",
+	http.StatusGatewayTimeout:        "GATEWAY_TIMEOUT",
+}
+
+func (appErr *AppError) Error() string {
+	if appErr.Err != nil {
+		return appErr.Message + ": " + appErr.Err.Error()
+	}
+	return appErr.Message
+}
+
+func (appErr *AppError) Unwrap() error {
+	return appErr.Err
+}
+
+// Same status and, when the target has one, same code
+func (appErr *AppError) Is(target error) bool {
+	other, ok := target.(*AppError)
+	if !ok {
+		return false
+	}
+	return other.Status == appErr.Status && (other.Code == "" || other.Code == appErr.Code)
+}
+
+// Copy with the cause attached, e.g. ErrNotFound("user").With(sql.ErrNoRows)
+func (appErr *AppError) With(cause error) *AppError {
+	copied := *appErr
+	copied.Err = cause
+	return &copied
+}
+
+// The AppError in the chain of err, false for errors that are not meant for clients
+func asAppError(err error) (*AppError, bool) {
+	var appErr *AppError
+	ok := errors.As(err, &appErr)
+	return appErr, ok
+}
+
+// Sets the code, e.g. ErrConflict("email", "...").WithCode(CodeEmailTaken)
+func (appErr *AppError) WithCode(code string) *AppError {
+	appErr.Code = code
+	return appErr
+}
+
+// The error as clients see it
+func (appErr *AppError) apiError() *APIError {
+	code := appErr.Code
+	if code == "" {
+		code = statusCode(appErr.Status)
+	}
+
+	return &APIError{Code: code, Message: appErr.Message, Field: appErr.Field, Details: appErr.Details}
+}
+
+func statusCode(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	return "HTTP_" + strconv.Itoa(status)
+}
+
+func ErrBadRequest(message string) *AppError {
+	return &AppError{Status: http.StatusBadRequest, Message: message}
+}
+
+// The code names the resource, e.g. USER_NOT_FOUND
+func ErrNotFound(resource string) *AppError {
+	code := strings.ToUpper(strings.ReplaceAll(resource, " ", "_")) + "_NOT_FOUND"
+	return &AppError{Status: http.StatusNotFound, Code: code, Message: resource + " not found"}
+}
+
+func ErrUnauthorized(message string) *AppError {
+	return &AppError{Status: http.StatusUnauthorized, Message: message}
+}
+
+func ErrForbidden(message string) *AppError {
+	return &AppError{Status: http.StatusForbidden, Message: message}
+}
+
+func ErrUnprocessable(message string) *AppError {
+	return &AppError{Status: http.StatusUnprocessableEntity, Message: message}
+}
+
+// 422 listing every field of a ValidationError or ValidationErrors
+func ErrValidation(err error) *AppError {
+	errs := validationErrors(err)
+
+	details := make([]ErrorDetail, len(errs))
+	for i, validationErr := range errs {
+		details[i] = ErrorDetail{Field: validationErr.Pointer(), Rule: validationErr.Rule, Message: validationErr.Message}
+	}
+
+	return &AppError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    CodeValidationFailed,
+		Message: err.Error(),
+		Details: details,
+	}
+}
+
+func ErrPreconditionFailed() *AppError {
+	return &AppError{Status: http.StatusPreconditionFailed, Message: "the resource was modified, fetch it again"}
+}
+
+func ErrConflict(field string, message string) *AppError {
+	return &AppError{Status: http.StatusConflict, Message: message, Field: field}
+}
+
+// Writes data wrapped in the response envelope, with its links when it has them
+func JSON(w http.ResponseWriter, status int, data interface{}) {
+	JSONWithLinks(w, status, data, linksOf(data))
+}
+
+// For data that does not know its links, e.g. a page of a list
+func JSONWithLinks(w http.ResponseWriter, status int, data interface{}, links Links) {
+	writeEnvelope(w, status, APIResponse{Success: true, Data: data, Links: links})
+}
+
+// Writes an error response, validation errors become a 422 and unknown errors
+// are hidden behind a 500. The 5xx are reported with their cause, see ReportErrors.
+func Error(w http.ResponseWriter, err error) {
+	appErr, ok := asAppError(err)
+	if !ok && validationErrors(err) != nil {
+		appErr, ok = ErrValidation(err), true
+	}
+	if !ok {
+		appErr = &AppError{Status: http.StatusInternalServerError, Message: "internal server error"}
+	}
+	if appErr.Status >= 500 {
+		reportError(w, err)
+	}
+
+	writeEnvelope(w, appErr.Status, APIResponse{Error: appErr.apiError()})
+}
+
+// Sent when the response can not be encoded, written by hand so it can not fail too
+var encodingFailure = []byte(`{"success":false,"error":{"code":"INTERNAL_ERROR","message":"the response could not be encoded"}}`)
+
+// Buffers the responses are encoded into, reused across requests
+var responseBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// Bigger buffers go back to the garbage collector instead of the pool, one
+// large export should not pin its memory for good
+const maxPooledBuffer = 64 << 10
+
+// In the media type negotiated by NegotiateContent, JSON by default. The
+// whole response is encoded before anything is written, so a failing encoder
+// still gets a clean 500 with the right Content-Length.
+func writeEnvelope(w http.ResponseWriter, status int, response APIResponse) {
+	negotiated := negotiation(w)
+	encoder := responseEncoder(negotiated.format)
+
+	encode := encoder.Encode
+	if negotiated.pretty && encoder.Indent != nil {
+		encode = encoder.Indent
+	}
+
+	buffer := responseBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer func() {
+		if buffer.Cap() <= maxPooledBuffer {
+			responseBuffers.Put(buffer)
+		}
+	}()
+
+	if err := encode(buffer, response); err != nil {
+		errorf("encode %s response: %v", negotiated.format, err)
+		writeBody(w, http.StatusInternalServerError, mediaJSON, encodingFailure)
+		return
+	}
+
+	if negotiated.format == mediaBare && len(response.Links) > 0 {
+		w.Header().Set("Link", linkHeader(response.Links))
+	}
+
+	writeBody(w, status, encoder.ContentType, buffer.Bytes())
+}
+
+func writeBody(w http.ResponseWriter, status int, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type Role string
+
+const (
+	RoleAdmin  Role = "admin"
+	RoleMember Role = "member"
+	RoleViewer Role = "viewer"
+)
+
+type Permission string
+
+const (
+	PermReadUsers   Permission = "users:read"
+	PermWriteSelf   Permission = "users:write_self" // Change your own user
+	PermWriteUsers  Permission = "users:write"      // Change any user
+	PermDeleteUsers Permission = "users:delete"
+	PermBulkUsers   Permission = "users:bulk" // Bulk create and delete, import and export
+	PermManageRoles Permission = "roles:manage"
+
+	PermManageWebhooks Permission = "webhooks:manage"
+	PermAdmin          Permission = "admin:access" // The /admin routes
+)
+
+// What every role may do
+var rolePermissions = map[Role]map[Permission]bool{
+	RoleAdmin: {
+		PermReadUsers:   true,
+		PermWriteSelf:   true,
+		PermWriteUsers:  true,
+		PermDeleteUsers: true,
+		PermBulkUsers:   true,
+		PermManageRoles: true,
+
+		PermManageWebhooks: true,
+		PermAdmin:          true,
+	},
+	RoleMember: {
+		PermReadUsers: true,
+		PermWriteSelf: true,
+	},
+	RoleViewer: {
+		PermReadUsers: true,
+	},
+}
+
+func (role Role) Valid() bool {
+	_, exists := rolePermissions[role]
+	return exists
+}
+
+// Users stored before roles existed are members
+func (role Role) Can(permission Permission) bool {
+	if role == "" {
+		role = RoleMember
+	}
+	return rolePermissions[role][permission]
+}
+
+// Rejects users whose role lacks the permission, goes inside RequireAuth
+func RequirePermission(permission Permission) Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			user, ok := currentUser(r)
+			if !ok {
+				Error(w, ErrUnauthorized("a bearer token is required"))
+				return
+			}
+
+			if !user.Role.Can(permission) {
+				Error(w, ErrForbidden("your role can not do this"))
+				return
+			}
+
+			nextMiddleware(w, r)
+		}
+	}
+}
+
+// Changing yourself and changing others are separate permissions
+func canWriteUser(ctx context.Context, id ID) error {
+	user, ok := contextUser(ctx)
+	if !ok {
+		return ErrUnauthorized("a bearer token is required")
+	}
+
+	permission := PermWriteUsers
+	if user.ID == id {
+		permission = PermWriteSelf
+	}
+
+	if !user.Role.Can(permission) {
+		return ErrForbidden("your role can not change this user")
+	}
+
+	return nil
+}
+
+// Role changes are for admins, a PUT or PATCH leaving the role out keeps it
+func (app *App) canSetRole(ctx context.Context, user User) error {
+	if user.Role == "" {
+		return nil
+	}
+
+	stored, err := app.Store.Get(user.ID)
+	if err != nil {
+		return err
+	}
+
+	storedRole := stored.Role
+	if storedRole == "" {
+		storedRole = RoleMember
+	}
+
+	current, ok := contextUser(ctx)
+	if storedRole != user.Role && (!ok || !current.Role.Can(PermManageRoles)) {
+		return &AppError{Status: http.StatusForbidden, Code: CodeRoleChangeForbidden, Message: "only admins can change roles", Field: "role"}
+	}
+
+	return nil
+}
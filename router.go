@@ -1,40 +1,170 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"strings"
 )
 
 // The Router implementation requires ServeHTTP func
 type Router struct {
-	rules map[string]map[string]http.HandlerFunc // HTTP rules mapping
+	rules    map[string]map[string]http.HandlerFunc // HTTP rules mapping
+	patterns []string                               // Paths with {params}, tried when there is no exact match
+
+	cors       *CORSOptions            // Default CORS rules, nil disables CORS
+	corsRoutes map[string]*CORSOptions // Per path overrides
+
+	middlewares []Middleware // Run for every matched route and the fallback
+
+	fallback http.HandlerFunc // Answers the paths no route matches, see Server.Fallback
+
+	versionPrefix string // See VersionedPaths
 }
 
+type contextKey string
+
+const (
+	paramsKey contextKey = "params"
+	routeKey  contextKey = "route"
+)
+
 func newRouter() *Router {
 	return &Router{
-		rules: make(map[string]map[string]http.HandlerFunc),
+		rules:      make(map[string]map[string]http.HandlerFunc),
+		corsRoutes: make(map[string]*CORSOptions),
 	}
 }
 
 func (router *Router) FindHanlder(path string, method string) (http.HandlerFunc, bool, bool) {
-	_, exists := router.rules[path]
-	handler, methodExists := router.rules[path][method]
+	pattern, _, exists := router.match(path)
+	handler, methodExists := router.rules[pattern][method]
 	return handler, methodExists, exists
 }
 
+// Finds the registered path for a request path, exact paths win over patterns
+func (router *Router) match(path string) (string, map[string]string, bool) {
+	if _, exists := router.rules[path]; exists {
+		return path, nil, true
+	}
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, pattern := range router.patterns {
+		if params, ok := matchPattern(pattern, segments); ok {
+			return pattern, params, true
+		}
+	}
+
+	return "", nil, false
+}
+
+// Compares /api/users/{id} like patterns segment by segment. A last
+// {name...} segment takes the rest of the path, e.g. /billing/{path...}
+// matches /billing/invoices/1 with path "invoices/1".
+func matchPattern(pattern string, segments []string) (map[string]string, bool) {
+	parts := strings.Split(strings.Trim(pattern, "/"), "/")
+	params := make(map[string]string)
+
+	if last := parts[len(parts)-1]; strings.HasPrefix(last, "{") && strings.HasSuffix(last, "...}") {
+		if len(segments) < len(parts) {
+			return nil, false
+		}
+		rest := strings.Join(segments[len(parts)-1:], "/")
+		if rest == "" {
+			return nil, false
+		}
+		params[last[1:len(last)-4]] = rest
+		parts, segments = parts[:len(parts)-1], segments[:len(parts)-1]
+	}
+
+	if len(parts) != len(segments) {
+		return nil, false
+	}
+
+	for i, part := range parts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[part[1:len(part)-1]] = segments[i]
+		} else if part != segments[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+// Value of a {param} from the matched path
+func PathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey).(map[string]string)
+	return params[name]
+}
+
+// Registered path that matched the request, e.g. /api/users/{id}
+func RoutePattern(r *http.Request) string {
+	pattern, _ := r.Context().Value(routeKey).(string)
+	return pattern
+}
+
 func (router *Router) ServeHTTP(w http.ResponseWriter, request *http.Request) {
-	handler, methodExists, exists := router.FindHanlder(request.URL.Path, request.Method)
+	// Headers are in, slow client checks stop here
+	markHandlerStarted(request)
+
+	// /api/v1/users is /api/users for version 1
+	if path, version, ok := router.versionedPath(request.URL.Path); ok {
+		request = withVersion(request, version)
+		request.URL.Path, request.URL.RawPath = path, ""
+	}
 
-	// Route not found 404
+	pattern, params, exists := router.match(request.URL.Path)
+
+	// Route not found 404, unless the fallback serves it
 	if !exists {
-		w.WriteHeader(http.StatusNotFound)
+		if router.fallback == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		handler := router.fallback
+		for _, m := range router.middlewares {
+			handler = m(handler)
+		}
+		handler(w, request)
 		return
 	}
 
+	handler, methodExists := router.rules[pattern][request.Method]
+
+	cors := router.cors
+	if override, ok := router.corsRoutes[pattern]; ok {
+		cors = override
+	}
+
+	if cors != nil {
+		// Browser preflight, answered here so handlers do not need OPTIONS routes
+		if !methodExists && request.Method == http.MethodOptions && request.Header.Get("Access-Control-Request-Method") != "" {
+			cors.preflight(w, request, router.rules[pattern])
+			return
+		}
+
+		cors.apply(w, request)
+	}
+
 	if !methodExists {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
+	ctx := context.WithValue(request.Context(), routeKey, pattern)
+	if params != nil {
+		ctx = context.WithValue(ctx, paramsKey, params)
+	}
+	request = request.WithContext(ctx)
+
+	for _, m := range router.middlewares {
+		handler = m(handler)
+	}
+
 	// Call the handler (from handlers.go) to attend the request
 	handler(w, request)
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When a periodic task runs next
+type Schedule interface {
+	Next(after time.Time) time.Time // The first run strictly after the given time
+}
+
+// Parses a cron expression of 5 fields (minute, hour, day of month, month,
+// day of week) with *, lists, ranges and steps, e.g. "*/15 8-18 * * 1-5",
+// or one of @hourly, @daily, @weekly, @monthly and "@every <duration>".
+// Times are in the server's time zone.
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if every, ok := strings.CutPrefix(spec, "@every "); ok {
+		interval, err := time.ParseDuration(strings.TrimSpace(every))
+		if err != nil || interval < time.Second {
+			return nil, fmt.Errorf("schedule %q: @every needs a duration of 1s or more", spec)
+		}
+		return everySchedule(interval), nil
+	}
+
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: want 5 fields (minute hour day month weekday) or an @ shorthand", spec)
+	}
+
+	var schedule cronSchedule
+	bounds := []struct {
+		set      *uint64
+		min, max int
+	}{
+		{&schedule.minutes, 0, 59},
+		{&schedule.hours, 0, 23},
+		{&schedule.days, 1, 31},
+		{&schedule.months, 1, 12},
+		{&schedule.weekdays, 0, 7},
+	}
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i].min, bounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %v", spec, err)
+		}
+		*bounds[i].set = set
+	}
+
+	// Sunday is 0 or 7
+	if schedule.weekdays&(1<<7) != 0 {
+		schedule.weekdays |= 1
+	}
+	schedule.anyDay = fields[2] == "*"
+	schedule.anyWeekday = fields[4] == "*"
+
+	return schedule, nil
+}
+
+// One field of a cron expression as a bit set of the values it matches
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+
+			var err error
+			if low, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid range in %q", part)
+				}
+			} else if hasStep {
+				high = max // 5/15 is 5-max/15
+			}
+		}
+
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q is out of %d-%d", part, min, max)
+		}
+
+		for value := low; value <= high; value += step {
+			set |= 1 << value
+		}
+	}
+
+	return set, nil
+}
+
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+
+	// Like in cron, a day matches either field when both are restricted
+	anyDay, anyWeekday bool
+}
+
+// Skips whole months, days and hours that can not match, so even rare
+// schedules take a few hundred steps at most
+func (schedule cronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0) // e.g. February 30 never comes
+
+	for t.Before(limit) {
+		if schedule.months&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !schedule.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if schedule.hours&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if schedule.minutes&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (schedule cronSchedule) matchesDay(t time.Time) bool {
+	day := schedule.days&(1<<t.Day()) != 0
+	weekday := schedule.weekdays&(1<<int(t.Weekday())) != 0
+
+	if !schedule.anyDay && !schedule.anyWeekday {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// Runs at a fixed interval, counted from the end of the previous run
+type everySchedule time.Duration
+
+func (every everySchedule) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(every))
+}
+
+// A periodic task
+type ScheduledTask struct {
+	Name     string
+	Spec     string // As given to Add, e.g. "@daily"
+	Schedule Schedule
+	Jitter   time.Duration // Up to this much is added to every run, so instances do not run it at once
+	Run      func(ctx context.Context) error
+}
+
+// Runs periodic tasks, e.g. the purge of deleted users. A task never
+// overlaps itself: runs that come up while the previous one is still going
+// are skipped. Stop waits for the running tasks.
+type Scheduler struct {
+	mutex   sync.Mutex
+	tasks   []ScheduledTask
+	started bool
+
+	stop    chan struct{}
+	ctx     context.Context // Of the runs, cancelled when Stop gives up waiting
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+func NewScheduler() *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{stop: make(chan struct{}), ctx: ctx, cancel: cancel}
+}
+
+// Registers a task with a spec ParseSchedule understands, tasks added after Start run right away
+func (scheduler *Scheduler) Add(name string, spec string, jitter time.Duration, run func(ctx context.Context) error) error {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return fmt.Errorf("task %s: %w", name, err)
+	}
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	task := ScheduledTask{Name: name, Spec: spec, Schedule: schedule, Jitter: jitter, Run: run}
+	scheduler.tasks = append(scheduler.tasks, task)
+	if scheduler.started {
+		scheduler.loop(task)
+	}
+
+	return nil
+}
+
+// Starts running the tasks, meant for server.OnStart
+func (scheduler *Scheduler) Start() error {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.started = true
+	for _, task := range scheduler.tasks {
+		log.Printf("scheduler: %s runs %s", task.Name, task.Spec)
+		scheduler.loop(task)
+	}
+
+	return nil
+}
+
+// Callers must hold the mutex
+func (scheduler *Scheduler) loop(task ScheduledTask) {
+	scheduler.running.Add(1)
+
+	go func() {
+		defer scheduler.running.Done()
+
+		next := scheduler.nextRun(task, time.Now())
+		for !next.IsZero() {
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-timer.C:
+			case <-scheduler.stop:
+				timer.Stop()
+				return
+			}
+
+			scheduler.run(task)
+
+			// Runs missed while this one was going are skipped, not caught up
+			now := time.Now()
+			if skipped := task.Schedule.Next(next); !skipped.IsZero() && skipped.Before(now) {
+				warnf("scheduler: %s took until %s, the runs in the meantime were skipped", task.Name, now.Format(time.RFC3339))
+			}
+			next = scheduler.nextRun(task, now)
+		}
+
+		warnf("scheduler: %s has no next run", task.Name)
+	}()
+}
+
+// The jitter is at most half the time to the run after, so it never pushes a run past it
+func (scheduler *Scheduler) nextRun(task ScheduledTask, after time.Time) time.Time {
+	next := task.Schedule.Next(after)
+	if next.IsZero() || task.Jitter <= 0 {
+		return next
+	}
+
+	jitter := task.Jitter
+	if following := task.Schedule.Next(next); !following.IsZero() {
+		jitter = min(jitter, following.Sub(next)/2)
+	}
+	if jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+	return next
+}
+
+// A panic fails the run instead of the process
+func (scheduler *Scheduler) run(task ScheduledTask) {
+	start := time.Now()
+
+	err := func() (err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				err = fmt.Errorf("panic: %v", recovered)
+			}
+		}()
+		return task.Run(scheduler.ctx)
+	}()
+
+	if err != nil {
+		errorf("scheduler: %s failed after %s: %v", task.Name, time.Since(start).Round(time.Millisecond), err)
+	}
+}
+
+// Starts no more runs and waits for the running ones until ctx is done, then cancels them
+func (scheduler *Scheduler) Stop(ctx context.Context) error {
+	scheduler.mutex.Lock()
+	select {
+	case <-scheduler.stop:
+	default:
+		close(scheduler.stop)
+	}
+	scheduler.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		scheduler.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		scheduler.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Creates the users of a JSON or YAML file (a list of users, same fields as the
+// API) or of a fixture, see fixtureFiles. Users whose email is taken are left
+// alone, so seeding a persistent store twice is safe.
+func seedUsers(userStore UserStore, path string) (created int, err error) {
+	users, err := readSeedFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return createSeedUsers(userStore, path, users)
+}
+
+func createSeedUsers(userStore UserStore, path string, users []User) (created int, err error) {
+	for i, user := range users {
+		if err := user.Validate(); err != nil {
+			return created, fmt.Errorf("%s: user %d: %v", path, i, err)
+		}
+
+		_, err := userStore.Create(user)
+		if errors.Is(err, ErrEmailTaken()) {
+			continue
+		}
+		if err != nil {
+			return created, fmt.Errorf("%s: user %d: %v", path, i, err)
+		}
+		created++
+	}
+
+	return created, nil
+}
+
+func readSeedFile(path string) ([]User, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(path, fixturePrefix) {
+		data, err = readFixture(path)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// YAML goes through JSON so both formats use the json tags of User
+	switch extension := strings.ToLower(filepath.Ext(path)); {
+	case strings.HasPrefix(path, fixturePrefix):
+	case extension == ".yaml" || extension == ".yml":
+		var document interface{}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if data, err = json.Marshal(document); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	case extension == ".json":
+	default:
+		return nil, fmt.Errorf("%s: seed files must be .json, .yaml or .yml", path)
+	}
+
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return users, nil
+}
+
+// go run *.go seed users.yaml, seed fixture:demo or seed --generate 500 for
+// that many made up members, see generateUser
+func runSeedCommand(config *Config, args []string) error {
+	var generate int
+	if len(args) == 2 && args[0] == "--generate" {
+		number, err := strconv.Atoi(args[1])
+		if err != nil || number < 1 {
+			return fmt.Errorf("--generate takes a positive number of users")
+		}
+		generate = number
+	} else if len(args) != 1 {
+		return fmt.Errorf("usage: seed <file.json|file.yaml|fixture:name> or seed --generate <count>")
+	}
+
+	base, err := newStore(config, systemClock{})
+	if err != nil {
+		return err
+	}
+	users, err := encryptStore(base, config)
+	if err != nil {
+		return err
+	}
+
+	var created int
+	if generate > 0 {
+		generated := make([]User, generate)
+		for i := range generated {
+			generated[i] = generateUser()
+		}
+		created, err = createSeedUsers(users, "generated", generated)
+	} else {
+		created, err = seedUsers(users, args[0])
+	}
+
+	// File and bolt stores flush on Close
+	if closer, ok := base.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("seeded %d users into the %s store", created, config.Store)
+	return nil
+}
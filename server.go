@@ -1,46 +1,179 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
 
 // Struct properties
 type Server struct {
-	port   string
-	router *Router
+	port       string
+	router     *Router
+	httpServer *http.Server
+	routes     []*Route    // Metadata of every registered route, used by the docs
+	connLimits *ConnLimits // Optional listener limits, see LimitConnections
+	listener   net.Listener
+	hooks      lifecycle       // See OnStart, OnReady and OnShutdown
+	health     *HealthRegistry // See AddHealthCheck
+	websockets *WSManager      // Open WebSocket connections, see WebSocket
+	started    chan struct{}   // Closed when Serve starts, see Started
+	startOnce  sync.Once
 }
 
-// Server init
-func NewServer(port string) *Server {
+// Server init, the timeouts and connection limits come from the config.
+// A nil config keeps the net/http defaults.
+func NewServer(port string, config *Config) *Server {
 	// Exports the server instance, avoid creating more instances
-	return &Server{
+	router := newRouter() // Router instance to handle requests
+
+	server := &Server{
 		port:   port,
-		router: newRouter(), // Router instance to handle requests
+		router: router,
+		// The router attends every route
+		httpServer: &http.Server{
+			Addr:    port,
+			Handler: router,
+		},
+		health:  &HealthRegistry{},
+		started: make(chan struct{}),
+	}
+	server.websockets = newWSManager(server.checkWebSocketOrigin)
+
+	// Hijacked connections are not closed by http.Server.Shutdown, they get a
+	// close frame as soon as it starts and Shutdown waits for them
+	server.httpServer.RegisterOnShutdown(server.websockets.Close)
+
+	if config != nil {
+		server.Timeouts(config.ReadHeaderTimeout, config.ReadTimeout, config.WriteTimeout, config.IdleTimeout)
+		server.LimitConnections(ConnLimits{
+			MaxPerIP: config.MaxConnsPerIP,
+			MinRate:  config.MinHeaderRate,
+			Grace:    config.MinHeaderRateGrace,
+		})
 	}
+
+	return server
 }
 
-func (server *Server) Handle(method string, path string, handler http.HandlerFunc) {
+// Registers the handler and returns the route so docs metadata can be attached
+func (server *Server) Handle(method string, path string, handler http.HandlerFunc) *Route {
 	_, exists := server.router.rules[path]
 
 	if !exists {
 		server.router.rules[path] = make(map[string]http.HandlerFunc)
+
+		if strings.Contains(path, "{") {
+			server.router.patterns = append(server.router.patterns, path)
+		}
 	}
 
 	server.router.rules[path][method] = handler
+
+	route := &Route{Method: method, Path: path}
+	server.routes = append(server.routes, route)
+
+	return route
 }
 
-func (server *Server) Listen() error {
-	// Routes main endpoint registration
-	// Makes the router start attending routes
-	http.Handle("/", server.router)
-	// Init server listening
-	err := http.ListenAndServe(server.port, nil)
+// Answers the requests no route matches instead of a bare 404, e.g. a SPA.
+// The Use middleware runs around it, RoutePattern is empty.
+func (server *Server) Fallback(handler http.HandlerFunc) {
+	server.router.fallback = handler
+}
 
+// Limits for slow clients, zero values keep the net/http defaults (no limit)
+func (server *Server) Timeouts(readHeader, read, write, idle time.Duration) {
+	server.httpServer.ReadHeaderTimeout = readHeader
+	server.httpServer.ReadTimeout = read
+	server.httpServer.WriteTimeout = write
+	server.httpServer.IdleTimeout = idle
+}
+
+// Opens the port, connections wait in the backlog until Serve is called
+func (server *Server) Bind() error {
+	listener, err := net.Listen("tcp", server.port)
 	if err != nil {
 		return err
 	}
 
+	if server.connLimits != nil {
+		listener = newLimitListener(listener, *server.connLimits)
+	}
+
+	server.listener = listener
 	return nil
 }
 
+func (server *Server) Listen() error {
+	if err := server.Bind(); err != nil {
+		return err
+	}
+
+	return server.Serve()
+}
+
+// Bound address, with the real port when the config asked for :0.
+// Nil before Bind.
+func (server *Server) Addr() net.Addr {
+	if server.listener == nil {
+		return nil
+	}
+	return server.listener.Addr()
+}
+
+// Closed once the server accepts requests, so tests can wait for it
+func (server *Server) Started() <-chan struct{} {
+	return server.started
+}
+
+// Serves on the port opened by Bind, HTTPS after EnableTLS
+func (server *Server) Serve() error {
+	// Connections queue on the bound listener, they are served as soon as Serve runs
+	server.startOnce.Do(func() { close(server.started) })
+
+	// Init server listening
+	var err error
+	if server.TLS() {
+		err = server.httpServer.ServeTLS(server.listener, "", "")
+	} else {
+		err = server.httpServer.Serve(server.listener)
+	}
+
+	// Returned after Shutdown, not a failure
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// Fails /readyz for the drain delay, stops accepting connections, waits for
+// the active requests to finish and runs the OnShutdown hooks
+func (server *Server) Shutdown(ctx context.Context) error {
+	drain(ctx)
+
+	err := server.httpServer.Shutdown(ctx)
+
+	if wsErr := server.websockets.Wait(ctx); err == nil {
+		err = wsErr
+	}
+
+	if hooksErr := server.runShutdownHooks(ctx); err == nil {
+		err = hooksErr
+	}
+
+	return err
+}
+
+// Middlewares applied to every route, on top of the ones added with AddMiddleware
+func (server *Server) Use(middlewares ...Middleware) {
+	server.router.middlewares = append(server.router.middlewares, middlewares...)
+}
+
 // Creates the middleware chaining. With ... indicates that we do not know the number of middlewares
 func (server *Server) AddMiddleware(middleware http.HandlerFunc, middlewares ...Middleware) http.HandlerFunc {
 	// Pass parameters between middlewares
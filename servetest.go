@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+)
+
+// Runs the request through the middleware and the router in process, without
+// a listener, and returns what a client would have received, e.g.
+//
+//	response := server.Test(httptest.NewRequest("GET", "/api/users/1", nil))
+//
+// The request gets the RequestURI and RemoteAddr a listener would give it.
+// WebSocket upgrades can not be tested this way.
+func (server *Server) Test(r *http.Request) *http.Response {
+	if r.RequestURI == "" {
+		r.RequestURI = r.URL.RequestURI()
+	}
+	if r.RemoteAddr == "" {
+		r.RemoteAddr = "192.0.2.1:1234"
+	}
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+
+	recorder := httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(recorder, r)
+	return recorder.Result()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends a request through server.Test, body is encoded as JSON unless nil.
+// headers are name and value pairs.
+func testRequest(t *testing.T, server *Server, method string, path string, token string, body interface{}, headers ...string) *http.Response {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = strings.NewReader(string(data))
+	}
+
+	request := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+
+	return server.Test(request)
+}
+
+// Checks the status and decodes the data of the envelope into data, unless nil
+func decodeResponse(t *testing.T, response *http.Response, status int, data interface{}) {
+	t.Helper()
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != status {
+		t.Fatalf("status %d, want %d: %s", response.StatusCode, status, body)
+	}
+	if data == nil {
+		return
+	}
+
+	envelope := struct {
+		Data interface{} `json:"data"`
+	}{Data: data}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+}
+
+// The access token of POST /api/auth/login
+func loginToken(t *testing.T, server *Server, email string, password string) string {
+	t.Helper()
+
+	var login LoginResponse
+	response := testRequest(t, server, "POST", "/api/auth/login", "", LoginRequest{Email: email, Password: password})
+	decodeResponse(t, response, http.StatusOK, &login)
+	return login.AccessToken
+}
+
+func TestAuthRequired(t *testing.T) {
+	app := newTestApp(t, nil)
+	server := newTestServer(t, app)
+	seedFixture(t, app.Store, "demo")
+	viewer := createTestUser(t, app.Store, func(user *User) { user.Role = RoleViewer })
+	member := createTestUser(t, app.Store)
+
+	viewerToken := loginToken(t, server, viewer.Email, generatedUserPassword)
+	memberToken := loginToken(t, server, member.Email, generatedUserPassword)
+	adminToken := loginToken(t, server, "admin@example.com", "admin12345")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   interface{}
+		status int
+	}{
+		{"no token", "GET", "/api/users", "", nil, http.StatusUnauthorized},
+		{"bad token", "GET", "/api/users", "not.a.token", nil, http.StatusUnauthorized},
+		{"viewer reads", "GET", "/api/users", viewerToken, nil, http.StatusOK},
+		{"viewer creates", "POST", "/api/users", viewerToken, NewTestUser(), http.StatusForbidden},
+		{"member creates", "POST", "/api/users", memberToken, NewTestUser(), http.StatusForbidden},
+		{"member deletes", "DELETE", fmt.Sprintf("/api/users/%s", viewer.ID), memberToken, nil, http.StatusForbidden},
+		{"member replaces another", "PUT", fmt.Sprintf("/api/users/%s", viewer.ID), memberToken, User{Name: "Other", Email: viewer.Email}, http.StatusForbidden},
+		{"member replaces another with an invalid body", "PUT", fmt.Sprintf("/api/users/%s", viewer.ID), memberToken, User{Email: "not an email"}, http.StatusForbidden},
+		{"viewer replaces themselves", "PUT", "/api/me", viewerToken, User{Email: "not an email"}, http.StatusForbidden},
+		{"member on admin routes", "GET", "/admin/users", memberToken, nil, http.StatusForbidden},
+		{"admin on admin routes", "GET", "/admin/users", adminToken, nil, http.StatusOK},
+		{"wrong password", "POST", "/api/auth/login", "", LoginRequest{Email: "admin@example.com", Password: "wrong password"}, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := testRequest(t, server, test.method, test.path, test.token, test.body, "If-Match", "*")
+			decodeResponse(t, response, test.status, nil)
+
+			if test.status == http.StatusUnauthorized && test.path != "/api/auth/login" && response.Header.Get("WWW-Authenticate") == "" {
+				t.Fatal("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestUserRoundTrip(t *testing.T) {
+	app := newTestApp(t, nil)
+	server := newTestServer(t, app)
+	admin := createTestUser(t, app.Store, func(user *User) { user.Role = RoleAdmin })
+	token := loginToken(t, server, admin.Email, generatedUserPassword)
+
+	// Create
+	var created User
+	newUser := NewTestUser(func(user *User) { user.Password = "" })
+	response := testRequest(t, server, "POST", "/api/users", token, newUser)
+	if etag := response.Header.Get("ETag"); etag != `"1"` {
+		t.Fatalf("ETag %s after create, want \"1\"", etag)
+	}
+	decodeResponse(t, response, http.StatusOK, &created)
+	if created.ID == "" || created.Email != newUser.Email || created.Version != 1 {
+		t.Fatalf("created %+v", created)
+	}
+	path := "/api/users/" + string(created.ID)
+
+	// Read
+	var read User
+	decodeResponse(t, testRequest(t, server, "GET", path, token, nil), http.StatusOK, &read)
+	if read.Name != newUser.Name {
+		t.Fatalf("read %+v", read)
+	}
+
+	// Replace, If-Match is required and must be current
+	replacement := User{Name: "Renamed", Email: newUser.Email, Phone: newUser.Phone}
+	decodeResponse(t, testRequest(t, server, "PUT", path, token, replacement), http.StatusPreconditionRequired, nil)
+	var updated User
+	decodeResponse(t, testRequest(t, server, "PUT", path, token, replacement, "If-Match", `"1"`), http.StatusOK, &updated)
+	if updated.Name != "Renamed" || updated.Version != 2 {
+		t.Fatalf("updated %+v", updated)
+	}
+	decodeResponse(t, testRequest(t, server, "PUT", path, token, replacement, "If-Match", `"1"`), http.StatusPreconditionFailed, nil)
+
+	// Delete, then the user is gone until restored
+	decodeResponse(t, testRequest(t, server, "DELETE", path, token, nil, "If-Match", `"2"`), http.StatusNoContent, nil)
+	decodeResponse(t, testRequest(t, server, "GET", path, token, nil), http.StatusNotFound, nil)
+
+	var deleted User
+	decodeResponse(t, testRequest(t, server, "GET", path+"?include_deleted=true", token, nil), http.StatusOK, &deleted)
+	var restored User
+	decodeResponse(t, testRequest(t, server, "POST", path+"/restore", token, nil, "If-Match", fmt.Sprintf(`"%d"`, deleted.Version)), http.StatusOK, &restored)
+	if restored.Name != "Renamed" {
+		t.Fatalf("restored %+v", restored)
+	}
+	decodeResponse(t, testRequest(t, server, "GET", path, token, nil), http.StatusOK, nil)
+}
+
+func TestCreateIgnoresDeletedAt(t *testing.T) {
+	app := newTestApp(t, nil)
+	server := newTestServer(t, app)
+	admin := createTestUser(t, app.Store, func(user *User) { user.Role = RoleAdmin })
+	token := loginToken(t, server, admin.Email, generatedUserPassword)
+
+	var created User
+	body := map[string]string{"name": "Already Gone", "email": "gone@example.com", "deleted_at": "2020-01-01T00:00:00Z"}
+	decodeResponse(t, testRequest(t, server, "POST", "/api/users", token, body), http.StatusOK, &created)
+	if !created.DeletedAt.IsZero() {
+		t.Fatalf("created deleted at %s", created.DeletedAt)
+	}
+
+	var listed []User
+	decodeResponse(t, testRequest(t, server, "GET", "/api/users", token, nil), http.StatusOK, &listed)
+	for _, user := range listed {
+		if user.ID == created.ID {
+			return
+		}
+	}
+	t.Fatalf("user %s is not listed", created.ID)
+}
+
+// Goes through the middleware of newTestServer, the routes alone do not know
+// X-API-Key or /api/v1
+func TestAPIKeyAndVersionedRequests(t *testing.T) {
+	app := newTestApp(t, nil)
+	server := newTestServer(t, app)
+	member := createTestUser(t, app.Store)
+	token := loginToken(t, server, member.Email, generatedUserPassword)
+
+	var key CreatedAPIKey
+	decodeResponse(t, testRequest(t, server, "POST", "/api/keys", token, CreateAPIKeyRequest{Name: "ci"}), http.StatusCreated, &key)
+
+	decodeResponse(t, testRequest(t, server, "GET", "/api/users", "", nil, "X-API-Key", key.Secret), http.StatusOK, nil)
+	decodeResponse(t, testRequest(t, server, "GET", "/api/users", "", nil, "X-API-Key", "not a key"), http.StatusUnauthorized, nil)
+
+	response := testRequest(t, server, "GET", "/api/v1/users", token, nil)
+	if version := response.Header.Get("API-Version"); version != "1" {
+		t.Fatalf("API-Version %q on /api/v1, want 1", version)
+	}
+	decodeResponse(t, response, http.StatusOK, nil)
+}
+
+func TestTokenExpires(t *testing.T) {
+	app := newTestApp(t, nil)
+	server := newTestServer(t, app)
+	member := createTestUser(t, app.Store)
+	token := loginToken(t, server, member.Email, generatedUserPassword)
+	clock := app.Clock.(*FakeClock)
+
+	clock.Advance(app.Config.TokenTTL - time.Second)
+	decodeResponse(t, testRequest(t, server, "GET", "/api/users", token, nil), http.StatusOK, nil)
+
+	clock.Advance(time.Second)
+	decodeResponse(t, testRequest(t, server, "GET", "/api/users", token, nil), http.StatusUnauthorized, nil)
+}
+
+func TestUpdateMe(t *testing.T) {
+	app := newTestApp(t, nil)
+	server := newTestServer(t, app)
+	member := createTestUser(t, app.Store)
+	token := loginToken(t, server, member.Email, generatedUserPassword)
+
+	replacement := User{Name: "Renamed Me", Email: member.Email}
+	decodeResponse(t, testRequest(t, server, "PUT", "/api/me", token, replacement), http.StatusPreconditionRequired, nil)
+	decodeResponse(t, testRequest(t, server, "PUT", "/api/me", token, User{Email: member.Email}, "If-Match", `"1"`), http.StatusUnprocessableEntity, nil)
+	decodeResponse(t, testRequest(t, server, "PUT", "/api/me", token, User{Name: "Admin Me", Email: member.Email, Role: RoleAdmin}, "If-Match", `"1"`), http.StatusForbidden, nil)
+
+	var updated User
+	decodeResponse(t, testRequest(t, server, "PUT", "/api/me", token, replacement, "If-Match", `"1"`), http.StatusOK, &updated)
+	if updated.ID != member.ID || updated.Name != "Renamed Me" || updated.Version != 2 {
+		t.Fatalf("updated %+v", updated)
+	}
+}
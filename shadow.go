@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Bigger bodies are not mirrored, the request is only served
+const shadowMaxBody = 1 << 20
+
+// Never mirrored, they are about this instance
+var shadowExempt = []string{"/admin", "/health", "/healthz", "/readyz", "/debug", "/docs"}
+
+// Not sent on to the shadow, they are about the inbound connection
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// Mirrored requests by outcome: sent, dropped (too many in flight), failed
+// and mismatched (the shadow answered another status class), on /debug/vars
+var shadowRequests = expvar.NewMap("shadow_requests")
+
+// Where and how much of the traffic Shadow mirrors
+type ShadowOptions struct {
+	Target      string        // Base URL of the other deployment, the request URI is appended
+	Percent     int           // Of the requests mirrored
+	Timeout     time.Duration // Of a mirrored request
+	Concurrency int           // Mirrored requests in flight, more are dropped
+}
+
+// Sends a copy of a share of the requests, bodies included, to another
+// deployment, e.g. a new version to try on production traffic. The copy
+// leaves once the request was served and its answer is only compared with
+// the real one, so the clients never wait for the shadow or see its errors.
+// Copies carry X-Shadow: true for the shadow to skip its own side effects.
+func Shadow(options ShadowOptions) Middleware {
+	target := strings.TrimSuffix(options.Target, "/")
+	client := &http.Client{Timeout: options.Timeout}
+	slots := make(chan struct{}, options.Concurrency)
+
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !chance(options.Percent) || underPath(r.URL.Path, shadowExempt) || r.Header.Get("Upgrade") != "" || r.ContentLength > shadowMaxBody {
+				nextMiddleware(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(io.LimitReader(r.Body, shadowMaxBody+1))
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			if err != nil || len(body) > shadowMaxBody {
+				nextMiddleware(w, r)
+				return
+			}
+
+			// The router rewrites versioned paths, RequestURI is what the client sent
+			mirrored, err := http.NewRequest(r.Method, target+r.RequestURI, bytes.NewReader(body))
+			if err != nil {
+				nextMiddleware(w, r)
+				return
+			}
+			mirrored.Header = r.Header.Clone()
+			for _, name := range hopHeaders {
+				mirrored.Header.Del(name)
+			}
+			mirrored.Header.Set("X-Shadow", "true")
+
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			nextMiddleware(recorder, r)
+
+			select {
+			case slots <- struct{}{}:
+			default:
+				shadowRequests.Add("dropped", 1)
+				return
+			}
+
+			route := r.Method + " " + RoutePattern(r)
+			go func() {
+				defer func() { <-slots }()
+				sendShadow(client, mirrored, route, recorder.status)
+			}()
+		}
+	}
+}
+
+func sendShadow(client *http.Client, request *http.Request, route string, primaryStatus int) {
+	ctx, cancel := context.WithTimeout(context.Background(), client.Timeout)
+	defer cancel()
+
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		shadowRequests.Add("failed", 1)
+		warnf("shadow %s: %v", route, err)
+		return
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	shadowRequests.Add("sent", 1)
+	if response.StatusCode/100 != primaryStatus/100 {
+		shadowRequests.Add("mismatched", 1)
+		log.Printf("shadow %s: answered %d, the API %d", route, response.StatusCode, primaryStatus)
+	}
+}
+
+// The body already read followed by the rest, closed as the original
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Remembers the status the handler answered
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+func (recorder *statusRecorder) Flush() {
+	http.NewResponseController(recorder.ResponseWriter).Flush()
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if !recorder.wroteHeader {
+		recorder.wroteHeader, recorder.status = true, status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+)
+
+type SignupRequest struct {
+	Name     string `json:"name" validate:"required"`
+	Email    string `json:"email" validate:"required,email"`
+	Phone    string `json:"phone,omitempty" validate:"phone"`
+	Password string `json:"password" validate:"required,password"`
+}
+
+// Public registration, always creates a member with a password.
+// Admins create other users with POST /api/users.
+func (app *App) Signup(w http.ResponseWriter, r *http.Request) {
+	var request SignupRequest
+	if err := DecodeJSON(r, &request); err != nil {
+		Error(w, err)
+		return
+	}
+
+	if err := validateStruct(request); err != nil {
+		recordValidationFailure(r, err)
+		Error(w, ErrValidation(err))
+		return
+	}
+
+	user, err := app.Store.Create(User{
+		Name:     request.Name,
+		Email:    request.Email,
+		Phone:    request.Phone,
+		Password: request.Password,
+		Role:     RoleMember,
+	})
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	app.Bus.Publish(UserSignedUp{User: user})
+
+	setETag(w, user)
+	JSON(w, http.StatusCreated, publicUser(user))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// The built frontend, e.g. the dist/ of Vite, copied into web/ before go build
+//
+//go:embed all:web
+var webAssets embed.FS
+
+// Paths the SPA never answers, unknown ones stay a 404 for API clients
+var spaExcluded = []string{"/api", "/admin", "/docs"}
+
+// Serves a single page app: its files by path and index.html for the other
+// GET paths, which the app routes in the browser. Hashed assets are cached
+// for good, the rest is revalidated with its ETag.
+type SPA struct {
+	files fs.FS
+	etags map[string]string // File -> ETag, the files that exist
+}
+
+// files must have an index.html at its root, e.g. fs.Sub(webAssets, "web")
+func NewSPA(files fs.FS) (*SPA, error) {
+	spa := &SPA{files: files, etags: make(map[string]string)}
+	err := fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		spa.etags[name] = `"` + hex.EncodeToString(sum[:8]) + `"`
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := spa.etags["index.html"]; !ok {
+		return nil, fmt.Errorf("the frontend has no index.html")
+	}
+	return spa, nil
+}
+
+func (spa *SPA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || spaExcludes(r.URL.Path) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if _, ok := spa.etags[name]; !ok {
+		// A missing script or image, not a page of the app
+		if path.Ext(name) != "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		name = "index.html"
+	}
+
+	file, err := spa.files.Open(name)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	defer file.Close()
+	// Embedded files can seek, see embed.FS
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		Error(w, fmt.Errorf("%s can not seek", name))
+		return
+	}
+
+	if hashedAsset(name) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	SendFile(w, r, content, FileInfo{Name: path.Base(name), ETag: spa.etags[name]})
+}
+
+// app.3f9a2b1c.js, main.3f9a2b1c.chunk.js or index-D8f3kL2a.css, bundlers
+// put the content hash in the name: 8 or more letters and digits, a digit among them
+func hashedAsset(name string) bool {
+	base := path.Base(name)
+	parts := strings.FieldsFunc(strings.TrimSuffix(base, path.Ext(base)), func(char rune) bool {
+		return char == '.' || char == '-'
+	})
+	for _, part := range parts[min(1, len(parts)):] {
+		if len(part) >= 8 && strings.ContainsAny(part, "0123456789") && strings.Trim(part, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func spaExcludes(requestPath string) bool {
+	for _, prefix := range spaExcluded {
+		if requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Comment line sent when nothing happened for this long, so proxies keep
+// the connection open and dead clients are noticed
+const sseHeartbeatInterval = 15 * time.Second
+
+// Delay browsers wait before reconnecting, sent with the retry field
+const sseRetry = 3 * time.Second
+
+// Server-Sent Events response, text/event-stream flushed after every event
+type SSEStream struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+}
+
+// Sends the headers and lifts the write timeout, a stream lasts as long as
+// the client stays. Fails when the connection can not be flushed, the
+// headers are sent by then.
+func NewSSEStream(w http.ResponseWriter) (*SSEStream, error) {
+	stream := &SSEStream{w: w, controller: http.NewResponseController(w)}
+
+	// Unsupported deadlines only mean WRITE_TIMEOUT may cut the stream
+	stream.controller.SetWriteDeadline(time.Time{})
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no") // nginx would buffer the events otherwise
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds()); err != nil {
+		return nil, err
+	}
+	if err := stream.controller.Flush(); err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// Writes one event with data as JSON, id lets the client resume with Last-Event-ID
+func (stream *SSEStream) Send(id string, event string, data interface{}) error {
+	body, err := marshalJSON(data, "")
+	if err != nil {
+		return err
+	}
+
+	var message strings.Builder
+	if id != "" {
+		message.WriteString("id: " + id + "\n")
+	}
+	if event != "" {
+		message.WriteString("event: " + event + "\n")
+	}
+	message.WriteString("data: " + string(body) + "\n") // The encoder ends it with a newline
+
+	return stream.write(message.String())
+}
+
+func (stream *SSEStream) Heartbeat() error {
+	return stream.write(": heartbeat\n\n")
+}
+
+func (stream *SSEStream) write(message string) error {
+	if _, err := stream.w.Write([]byte(message)); err != nil {
+		return err
+	}
+	return stream.controller.Flush()
+}
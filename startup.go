@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Summary of the process once it accepts connections. Logged on startup and,
+// when enabled, written as JSON so scripts can wait for the API to be ready.
+type StartupSummary struct {
+	Event      string            `json:"event"` // Always "ready"
+	Version    string            `json:"version"`
+	Profile    string            `json:"profile"`
+	PID        int               `json:"pid"`
+	Addresses  map[string]string `json:"addresses"` // Listener name -> bound address
+	Routes     int               `json:"routes"`
+	Middleware []string          `json:"middleware"` // Applied to every route
+	Store      string            `json:"store"`
+}
+
+func newStartupSummary(config *Config, servers map[string]*Server, middleware []string) StartupSummary {
+	summary := StartupSummary{
+		Event:      "ready",
+		Version:    version,
+		Profile:    config.Profile,
+		PID:        os.Getpid(),
+		Addresses:  make(map[string]string),
+		Middleware: middleware,
+		Store:      config.Store,
+	}
+
+	counted := make(map[*Server]bool)
+	for name, server := range servers {
+		summary.Addresses[name] = server.Addr().String()
+
+		// The ops routes live in the API server when OPS_PORT is not set
+		if !counted[server] {
+			summary.Routes += len(server.routes)
+			counted[server] = true
+		}
+	}
+
+	return summary
+}
+
+func (summary StartupSummary) Log() {
+	addresses := make([]string, 0, len(summary.Addresses))
+	for _, name := range []string{"api", "ops", "redirect"} {
+		if addr, ok := summary.Addresses[name]; ok {
+			addresses = append(addresses, name+"="+addr)
+		}
+	}
+
+	log.Printf("started version=%s profile=%s pid=%d %s routes=%d store=%s middleware=%s",
+		summary.Version, summary.Profile, summary.PID, strings.Join(addresses, " "),
+		summary.Routes, summary.Store, strings.Join(summary.Middleware, ","))
+}
+
+// Prints the summary as one JSON line on stdout and/or writes it to path.
+// The file is written to a temp file and renamed, so readers never see half of it.
+func (summary StartupSummary) SignalReady(path string, stdout bool) error {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	if stdout {
+		fmt.Println(string(data))
+	}
+
+	if path == "" {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Called on shutdown, a stale ready file would tell scripts the API is still up
+func removeReadyFile(path string) {
+	if path == "" {
+		return
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		warnf("removing ready file: %v", err)
+	}
+}
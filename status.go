@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Set at build time, e.g. go build -ldflags "-X main.version=1.4.0
+// -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)".
+// Without them the commit and its time come from the VCS stamp of go build.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// What GET /health and the version command report about the binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Modified  bool   `json:"modified,omitempty"` // Built from a tree with uncommitted changes
+}
+
+func buildInfo() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+
+	stamp, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range stamp.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		case "vcs.time":
+			if info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		case "vcs.modified":
+			info.Modified = setting.Value == "true" && commit == ""
+		}
+	}
+	return info
+}
+
+var startedAt = time.Now()
+
+//go:embed templates/status.html
+var statusTemplateSource string
+
+var statusTemplate = template.Must(template.New("status").Parse(statusTemplateSource))
+
+// Set from DRAIN_DELAY in main
+var drainDelay time.Duration
+
+var (
+	draining   atomic.Bool
+	drainStart sync.Once
+)
+
+// Fails the readiness checks and waits DRAIN_DELAY so load balancers stop
+// sending requests before the listeners close. Only the first call waits.
+func drain(ctx context.Context) {
+	drainStart.Do(func() {
+		draining.Store(true)
+
+		select {
+		case <-time.After(drainDelay):
+		case <-ctx.Done():
+		}
+	})
+}
+
+// GET /healthz, liveness: the process is up and serving
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"version": version,
+		"uptime":  time.Since(startedAt).Round(time.Second).String(),
+	})
+}
+
+// GET /readyz, readiness: 503 while draining or when a required check fails
+func ReadinessHandler(health *HealthRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := health.Run(r.Context())
+		status := http.StatusOK
+		if report.Status == HealthUnhealthy || draining.Load() {
+			status = http.StatusServiceUnavailable
+		}
+
+		JSON(w, status, map[string]interface{}{
+			"status":   report.Status,
+			"draining": draining.Load(),
+			"checks":   report.Checks,
+		})
+	}
+}
+
+// GET /health, 503 when a required check fails, degraded still answers 200
+func HealthHandler(health *HealthRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := health.Run(r.Context())
+		status := http.StatusOK
+		if report.Status == HealthUnhealthy {
+			status = http.StatusServiceUnavailable
+		}
+
+		JSON(w, status, map[string]interface{}{
+			"status":  report.Status,
+			"version": version,
+			"build":   buildInfo(),
+			"uptime":  time.Since(startedAt).Round(time.Second).String(),
+			"checks":  report.Checks,
+		})
+	}
+}
+
+// GET /status, HTML summary for people that do not read JSON
+func StatusPage(health *HealthRegistry, notes []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := health.Run(r.Context())
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		statusTemplate.Execute(w, map[string]interface{}{
+			"Healthy": report.Status == HealthHealthy,
+			"Version": version,
+			"Uptime":  time.Since(startedAt).Round(time.Second).String(),
+			"Checks":  report.Checks,
+			"Notes":   notes,
+		})
+	}
+}
+
+// go run *.go version
+func printVersion() {
+	info := buildInfo()
+	fmt.Printf("version %s\n", info.Version)
+	if info.Commit != "" {
+		modified := ""
+		if info.Modified {
+			modified = " (modified)"
+		}
+		fmt.Printf("commit %s%s\n", info.Commit, modified)
+	}
+	if info.BuildDate != "" {
+		fmt.Printf("built %s\n", info.BuildDate)
+	}
+	fmt.Println(info.GoVersion)
+}
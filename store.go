@@ -0,0 +1,575 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage abstraction for users, handlers only talk to this interface.
+// Delete only marks the user as deleted, List and Get still return it
+// and the handlers decide whether to show it.
+type UserStore interface {
+	Create(user User) (User, error)
+	List() ([]User, error)
+	Get(id ID) (User, error)
+	GetByEmail(email string) (User, error)
+	Update(user User) (User, error)
+	Delete(id ID, version int64) error
+	Restore(id ID, version int64) (User, error)
+}
+
+// Stores that can walk the users without loading them all implement it,
+// used by the export. Iteration stops at the first error fn returns.
+type UserIterator interface {
+	Each(fn func(User) error) error
+}
+
+// Stores that can drop deleted users for good implement it, used by the
+// purge task. The API keys of the purged users go with them.
+type DeletedPurger interface {
+	PurgeDeleted(before time.Time) ([]ID, error) // Users deleted before the time, their IDs are returned
+}
+
+// Purges the users deleted more than retention ago, with their avatars.
+// Run by the scheduler.
+func (app *App) purgeDeletedUsers(retention time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		purger, ok := app.Store.(DeletedPurger)
+		if !ok {
+			return errors.New("the store can not purge deleted users")
+		}
+
+		purged, err := purger.PurgeDeleted(app.Clock.Now().Add(-retention))
+		if err != nil {
+			return err
+		}
+
+		for _, id := range purged {
+			if err := app.Blobs.Delete(avatarKey(id)); err != nil {
+				warnf("purge: avatar of user %s: %v", id, err)
+			}
+		}
+		if len(purged) > 0 {
+			log.Printf("purge: %d users deleted more than %s ago", len(purged), retention)
+		}
+
+		return nil
+	}
+}
+
+// Stores that can replace the email and phone of any user, deleted ones
+// included, without a new version implement it. Used by Reencrypt, deleted
+// users can not be updated.
+type ContactRewriter interface {
+	RewriteContact(id ID, email string, phone string) error
+}
+
+// Stores backed by something that can fail implement it for the health checks
+type Pinger interface {
+	Ping() error
+}
+
+// In-memory implementation, data is lost when the process stops
+type MemoryStore struct {
+	clock    Clock // Of the timestamps and ULIDs
+	mutex    sync.RWMutex
+	users    map[ID]User
+	emails   map[string]ID // Lowercased email -> owner, keeps emails unique
+	nextID   int64         // Next sequential ID, used by the int strategy
+	revision uint64        // Incremented on every write, used to detect changes
+
+	apiKeys      map[ID]APIKey
+	apiKeyHashes map[string]ID           // Secret hash -> key ID
+	apiKeyUsage  map[ID]map[string]int64 // Key ID -> day -> requests
+
+	webhooks map[ID]Webhook
+}
+
+func NewMemoryStore(clock Clock) *MemoryStore {
+	return &MemoryStore{
+		clock:  clock,
+		users:  make(map[ID]User),
+		emails: make(map[string]ID),
+		nextID: 1,
+
+		apiKeys:      make(map[ID]APIKey),
+		apiKeyHashes: make(map[string]ID),
+		apiKeyUsage:  make(map[ID]map[string]int64),
+
+		webhooks: make(map[ID]Webhook),
+	}
+}
+
+func (memStore *MemoryStore) Create(user User) (User, error) {
+	user, err := hashPassword(user)
+	if err != nil {
+		return User{}, err
+	}
+
+	memStore.mutex.Lock()
+	defer memStore.mutex.Unlock()
+
+	if _, taken := memStore.emails[emailKey(user.Email)]; taken {
+		return User{}, ErrEmailTaken()
+	}
+
+	if id, random := newRandomID(memStore.clock.Now()); random {
+		user.ID = id
+	} else {
+		user.ID = ID(strconv.FormatInt(memStore.nextID, 10))
+		memStore.nextID++
+	}
+	if user.Role == "" {
+		user.Role = RoleMember
+	}
+	user.Version = 1
+	user.CreatedAt = memStore.clock.Now().UTC()
+	user.UpdatedAt = user.CreatedAt
+	user.DeletedAt = time.Time{} // Users are deleted with Delete, not created deleted
+	memStore.users[user.ID] = user
+	memStore.indexEmail(user)
+	memStore.revision++
+
+	return user, nil
+}
+
+func (memStore *MemoryStore) Get(id ID) (User, error) {
+	memStore.mutex.RLock()
+	defer memStore.mutex.RUnlock()
+
+	user, exists := memStore.users[id]
+	if !exists {
+		return User{}, ErrNotFound("user")
+	}
+
+	return user, nil
+}
+
+// Emails are compared ignoring case
+func (memStore *MemoryStore) GetByEmail(email string) (User, error) {
+	memStore.mutex.RLock()
+	defer memStore.mutex.RUnlock()
+
+	id, exists := memStore.emails[emailKey(email)]
+	if !exists {
+		return User{}, ErrNotFound("user")
+	}
+
+	return memStore.users[id], nil
+}
+
+// Replaces the stored user with the same ID. user.Version must be the stored
+// version, so concurrent writers can not overwrite each other.
+// The password is kept when user has none.
+func (memStore *MemoryStore) Update(user User) (User, error) {
+	user, err := hashPassword(user)
+	if err != nil {
+		return User{}, err
+	}
+
+	memStore.mutex.Lock()
+	defer memStore.mutex.Unlock()
+
+	stored, exists := memStore.users[user.ID]
+	if !exists || stored.Deleted() {
+		return User{}, ErrNotFound("user")
+	}
+
+	if stored.Version != user.Version {
+		return User{}, ErrPreconditionFailed()
+	}
+
+	if owner, taken := memStore.emails[emailKey(user.Email)]; taken && owner != user.ID {
+		return User{}, ErrEmailTaken()
+	}
+
+	user = keepStoredFields(user, stored)
+	user.Version++
+	user.CreatedAt = stored.CreatedAt
+	user.UpdatedAt = memStore.clock.Now().UTC()
+	user.DeletedAt = time.Time{}
+	delete(memStore.emails, emailKey(stored.Email))
+	memStore.users[user.ID] = user
+	memStore.indexEmail(user)
+	memStore.revision++
+
+	return user, nil
+}
+
+func (memStore *MemoryStore) RewriteContact(id ID, email string, phone string) error {
+	memStore.mutex.Lock()
+	defer memStore.mutex.Unlock()
+
+	stored, exists := memStore.users[id]
+	if !exists {
+		return ErrNotFound("user")
+	}
+
+	if owner, taken := memStore.emails[emailKey(email)]; taken && owner != id {
+		return ErrEmailTaken()
+	}
+
+	delete(memStore.emails, emailKey(stored.Email))
+	stored.Email, stored.Phone = email, phone
+	memStore.users[id] = stored
+	memStore.indexEmail(stored)
+	memStore.revision++
+
+	return nil
+}
+
+// Marks the user as deleted. The email stays taken so the user can be restored.
+func (memStore *MemoryStore) Delete(id ID, version int64) error {
+	memStore.mutex.Lock()
+	defer memStore.mutex.Unlock()
+
+	stored, exists := memStore.users[id]
+	if !exists || stored.Deleted() {
+		return ErrNotFound("user")
+	}
+
+	if stored.Version != version {
+		return ErrPreconditionFailed()
+	}
+
+	memStore.users[id] = markDeleted(stored, memStore.clock.Now().UTC())
+	memStore.revision++
+
+	return nil
+}
+
+func (memStore *MemoryStore) Restore(id ID, version int64) (User, error) {
+	memStore.mutex.Lock()
+	defer memStore.mutex.Unlock()
+
+	stored, exists := memStore.users[id]
+	if !exists {
+		return User{}, ErrNotFound("user")
+	}
+
+	if stored.Version != version {
+		return User{}, ErrPreconditionFailed()
+	}
+
+	if !stored.Deleted() {
+		return User{}, ErrNotDeleted()
+	}
+
+	user := markRestored(stored, memStore.clock.Now().UTC())
+	memStore.users[id] = user
+	memStore.revision++
+
+	return user, nil
+}
+
+func (memStore *MemoryStore) PurgeDeleted(before time.Time) ([]ID, error) {
+	memStore.mutex.Lock()
+	defer memStore.mutex.Unlock()
+
+	purged := []ID{}
+	for id, user := range memStore.users {
+		if !user.Deleted() || !user.DeletedAt.Before(before) {
+			continue
+		}
+		delete(memStore.users, id)
+		delete(memStore.emails, emailKey(user.Email))
+		purged = append(purged, id)
+	}
+
+	for id, key := range memStore.apiKeys {
+		if slices.Contains(purged, key.UserID) {
+			delete(memStore.apiKeys, id)
+			delete(memStore.apiKeyHashes, key.Hash)
+			delete(memStore.apiKeyUsage, id)
+		}
+	}
+
+	if len(purged) > 0 {
+		memStore.revision++
+	}
+
+	return purged, nil
+}
+
+func (memStore *MemoryStore) List() ([]User, error) {
+	memStore.mutex.RLock()
+	defer memStore.mutex.RUnlock()
+
+	return memStore.sortedUsers(), nil
+}
+
+// The users are already in memory, the lock is only held while sorting them
+func (memStore *MemoryStore) Each(fn func(User) error) error {
+	users, _ := memStore.List()
+
+	for _, user := range users {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (memStore *MemoryStore) CreateAPIKey(key APIKey) (APIKey, error) {
+	memStore.mutex.Lock()
+	defer memStore.mutex.Unlock()
+
+	key.CreatedAt = memStore.clock.Now().UTC()
+	key.ID = newULID(key.CreatedAt)
+	memStore.apiKeys[key.ID] = key
+	memStore.apiKeyHashes[key.Hash] = key.ID
+	memStore.revision++
+
+	return key, nil
+}
+
+func (memStore *MemoryStore) ListAPIKeys(userID ID) ([]APIKey, error) {
+	memStore.mutex.RLock()
+	defer memStore.mutex.RUnlock()
+
+	keys := []APIKey{}
+	for _, key := range memStore.sortedAPIKeys() {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (memStore *MemoryStore) GetAPIKeyByHash(hash string) (APIKey, error) {
+	memStore.mutex.RLock()
+	defer memStore.mutex.RUnlock()
+
+	id, exists := memStore.apiKeyHashes[hash]
+	if !exists {
+		return APIKey{}, ErrAPIKeyNotFound()
+	}
+
+	return memStore.apiKeys[id], nil
+}
+
+// Keys of other users are not found. Revoking twice keeps the first time.
+func (memStore *MemoryStore) RevokeAPIKey(userID ID, id ID) (APIKey, error) {
+	memStore.mutex.Lock()
+	defer memStore.mutex.Unlock()
+
+	key, exists := memStore.apiKeys[id]
+	if !exists || key.UserID != userID {
+		return APIKey{}, ErrAPIKeyNotFound()
+	}
+
+	if !key.Revoked() {
+		key.RevokedAt = memStore.clock.Now().UTC()
+		memStore.apiKeys[id] = key
+		memStore.revision++
+	}
+
+	return key, nil
+}
+
+func (memStore *MemoryStore) TouchAPIKey(id ID, at time.Time) error {
+	memStore.mutex.Lock()
+	defer memStore.mutex.Unlock()
+
+	key, exists := memStore.apiKeys[id]
+	if !exists {
+		return ErrAPIKeyNotFound()
+	}
+
+	key.LastUsedAt = at
+	memStore.apiKeys[id] = key
+	memStore.revision++
+
+	return nil
+}
+
+func (memStore *MemoryStore) AddAPIKeyUsage(id ID, day string, requests int64) error {
+	memStore.mutex.Lock()
+	defer memStore.mutex.Unlock()
+
+	if _, exists := memStore.apiKeys[id]; !exists {
+		return ErrAPIKeyNotFound()
+	}
+
+	if memStore.apiKeyUsage[id] == nil {
+		memStore.apiKeyUsage[id] = make(map[string]int64)
+	}
+	memStore.apiKeyUsage[id][day] += requests
+	memStore.revision++
+
+	return nil
+}
+
+// Oldest day first
+func (memStore *MemoryStore) APIKeyUsage(id ID, since string) ([]APIKeyDay, error) {
+	memStore.mutex.RLock()
+	defer memStore.mutex.RUnlock()
+
+	days := []APIKeyDay{}
+	for day, requests := range memStore.apiKeyUsage[id] {
+		if day >= since {
+			days = append(days, APIKeyDay{Date: day, Requests: requests})
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+
+	return days, nil
+}
+
+func (memStore *MemoryStore) CreateWebhook(webhook Webhook) (Webhook, error) {
+	memStore.mutex.Lock()
+	defer memStore.mutex.Unlock()
+
+	webhook.CreatedAt = memStore.clock.Now().UTC()
+	webhook.ID = newULID(webhook.CreatedAt)
+	memStore.webhooks[webhook.ID] = webhook
+	memStore.revision++
+
+	return webhook, nil
+}
+
+func (memStore *MemoryStore) ListWebhooks() ([]Webhook, error) {
+	memStore.mutex.RLock()
+	defer memStore.mutex.RUnlock()
+
+	return memStore.sortedWebhooks(), nil
+}
+
+func (memStore *MemoryStore) GetWebhook(id ID) (Webhook, error) {
+	memStore.mutex.RLock()
+	defer memStore.mutex.RUnlock()
+
+	webhook, exists := memStore.webhooks[id]
+	if !exists {
+		return Webhook{}, ErrWebhookNotFound()
+	}
+
+	return webhook, nil
+}
+
+func (memStore *MemoryStore) DeleteWebhook(id ID) error {
+	memStore.mutex.Lock()
+	defer memStore.mutex.Unlock()
+
+	if _, exists := memStore.webhooks[id]; !exists {
+		return ErrWebhookNotFound()
+	}
+
+	delete(memStore.webhooks, id)
+	memStore.revision++
+
+	return nil
+}
+
+// Callers must hold the mutex. Webhook IDs are ULIDs, so this is creation order.
+func (memStore *MemoryStore) sortedWebhooks() []Webhook {
+	webhooks := make([]Webhook, 0, len(memStore.webhooks))
+	for _, webhook := range memStore.webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+
+	return webhooks
+}
+
+// Callers must hold the mutex. Key IDs are ULIDs, so this is creation order.
+func (memStore *MemoryStore) sortedAPIKeys() []APIKey {
+	keys := make([]APIKey, 0, len(memStore.apiKeys))
+	for _, key := range memStore.apiKeys {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	return keys
+}
+
+// Callers must hold the mutex
+func (memStore *MemoryStore) indexEmail(user User) {
+	if user.Email != "" {
+		memStore.emails[emailKey(user.Email)] = user.ID
+	}
+}
+
+// Callers must hold the mutex
+func (memStore *MemoryStore) sortedUsers() []User {
+	list := make([]User, 0, len(memStore.users))
+	for _, user := range memStore.users {
+		list = append(list, user)
+	}
+
+	// Maps have no order, keep responses stable
+	sort.Slice(list, func(i, j int) bool { return lessID(list[i].ID, list[j].ID) })
+
+	return list
+}
+
+// Carries over what an update may leave out: the fields the API never sends
+// back and an empty role. A new password ends the sessions opened with the previous one.
+func keepStoredFields(user User, stored User) User {
+	user.SessionVersion = stored.SessionVersion
+
+	if user.PasswordHash == "" {
+		user.PasswordHash = stored.PasswordHash
+	} else if user.PasswordHash != stored.PasswordHash {
+		user.SessionVersion++
+	}
+
+	if user.Role == "" {
+		user.Role = stored.Role
+	}
+
+	if user.TwoFactor == nil {
+		user.TwoFactor = stored.TwoFactor
+	}
+
+	// Locking ends the sessions of the user
+	if user.Lock == nil {
+		user.Lock = stored.Lock
+	} else if user.Locked() && !stored.Locked() {
+		user.SessionVersion++
+	}
+	if user.Lock != nil && !user.Locked() {
+		user.Lock = nil
+	}
+
+	return user
+}
+
+// Shared by the stores so deletes and restores bump the same fields
+func markDeleted(user User, now time.Time) User {
+	user.Version++
+	user.UpdatedAt = now
+	user.DeletedAt = now
+	return user
+}
+
+func markRestored(user User, now time.Time) User {
+	user.Version++
+	user.UpdatedAt = now
+	user.DeletedAt = time.Time{}
+	return user
+}
+
+// Emails are unique ignoring case
+func emailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func ErrEmailTaken() *AppError {
+	return ErrConflict("email", "email is already in use").WithCode(CodeEmailTaken)
+}
+
+func ErrNotDeleted() *AppError {
+	return ErrConflict("", "user is not deleted").WithCode(CodeUserNotDeleted)
+}
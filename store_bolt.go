@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	usersBucket  = []byte("users")
+	emailsBucket = []byte("emails") // Lowercased email -> user ID, keeps emails unique
+
+	apiKeysBucket      = []byte("api_keys")
+	apiKeyHashesBucket = []byte("api_key_hashes") // Secret hash -> key ID
+	apiKeyUsageBucket  = []byte("api_key_usage")  // <key ID>/<day> -> requests, big endian
+
+	webhooksBucket = []byte("webhooks")
+)
+
+// BoltStore keeps the users in an embedded bbolt database file.
+// Every write is a transaction, so the data survives crashes.
+type BoltStore struct {
+	db    *bolt.DB
+	clock Clock // Of the timestamps and ULIDs
+}
+
+func NewBoltStore(path string, clock Clock) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		users, err := tx.CreateBucketIfNotExists(usersBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range [][]byte{apiKeysBucket, apiKeyHashesBucket, apiKeyUsageBucket, webhooksBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		if tx.Bucket(emailsBucket) != nil {
+			return nil
+		}
+
+		// Databases created before the email index get it built here
+		emails, err := tx.CreateBucket(emailsBucket)
+		if err != nil {
+			return err
+		}
+
+		return users.ForEach(func(key, data []byte) error {
+			var user User
+			if err := json.Unmarshal(data, &user); err != nil {
+				return err
+			}
+			return boltIndexEmail(emails, user)
+		})
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db, clock: clock}, nil
+}
+
+func (boltStore *BoltStore) Create(user User) (User, error) {
+	user, err := hashPassword(user)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = boltStore.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		emails := tx.Bucket(emailsBucket)
+
+		if emails.Get([]byte(emailKey(user.Email))) != nil {
+			return ErrEmailTaken()
+		}
+
+		if id, random := newRandomID(boltStore.clock.Now()); random {
+			user.ID = id
+		} else {
+			id, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			user.ID = ID(strconv.FormatUint(id, 10))
+		}
+		if user.Role == "" {
+			user.Role = RoleMember
+		}
+		user.Version = 1
+		user.CreatedAt = boltStore.clock.Now().UTC()
+		user.UpdatedAt = user.CreatedAt
+		user.DeletedAt = time.Time{} // Users are deleted with Delete, not created deleted
+
+		if err := boltIndexEmail(emails, user); err != nil {
+			return err
+		}
+
+		return boltPut(bucket, user)
+	})
+
+	return user, err
+}
+
+func (boltStore *BoltStore) List() ([]User, error) {
+	users := []User{}
+
+	err := boltStore.Each(func(user User) error {
+		users = append(users, user)
+		return nil
+	})
+
+	return users, err
+}
+
+// Decodes one user at a time inside a read transaction
+func (boltStore *BoltStore) Each(fn func(User) error) error {
+	return boltStore.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(key, data []byte) error {
+			var record userRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			return fn(record.user())
+		})
+	})
+}
+
+func (boltStore *BoltStore) Get(id ID) (User, error) {
+	var user User
+
+	err := boltStore.db.View(func(tx *bolt.Tx) error {
+		var err error
+		user, err = boltGet(tx.Bucket(usersBucket), id)
+		return err
+	})
+
+	return user, err
+}
+
+// Emails are compared ignoring case
+func (boltStore *BoltStore) GetByEmail(email string) (User, error) {
+	var user User
+
+	err := boltStore.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(emailsBucket).Get([]byte(emailKey(email)))
+		if id == nil {
+			return ErrNotFound("user")
+		}
+
+		var err error
+		user, err = boltGet(tx.Bucket(usersBucket), ID(id))
+		return err
+	})
+
+	return user, err
+}
+
+// The password is kept when user has none
+func (boltStore *BoltStore) Update(user User) (User, error) {
+	user, err := hashPassword(user)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = boltStore.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		stored, err := boltGet(bucket, user.ID)
+		if err != nil {
+			return err
+		}
+
+		if stored.Deleted() {
+			return ErrNotFound("user")
+		}
+
+		if stored.Version != user.Version {
+			return ErrPreconditionFailed()
+		}
+
+		emails := tx.Bucket(emailsBucket)
+		if owner := emails.Get([]byte(emailKey(user.Email))); owner != nil && ID(owner) != user.ID {
+			return ErrEmailTaken()
+		}
+		user = keepStoredFields(user, stored)
+		user.Version++
+		user.CreatedAt = stored.CreatedAt
+		user.UpdatedAt = boltStore.clock.Now().UTC()
+		user.DeletedAt = time.Time{}
+
+		if err := emails.Delete([]byte(emailKey(stored.Email))); err != nil {
+			return err
+		}
+
+		if err := boltIndexEmail(emails, user); err != nil {
+			return err
+		}
+
+		return boltPut(bucket, user)
+	})
+
+	return user, err
+}
+
+func (boltStore *BoltStore) RewriteContact(id ID, email string, phone string) error {
+	return boltStore.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		stored, err := boltGet(bucket, id)
+		if err != nil {
+			return err
+		}
+
+		emails := tx.Bucket(emailsBucket)
+		if owner := emails.Get([]byte(emailKey(email))); owner != nil && ID(owner) != id {
+			return ErrEmailTaken()
+		}
+		if err := emails.Delete([]byte(emailKey(stored.Email))); err != nil {
+			return err
+		}
+
+		stored.Email, stored.Phone = email, phone
+		if err := boltIndexEmail(emails, stored); err != nil {
+			return err
+		}
+		return boltPut(bucket, stored)
+	})
+}
+
+// Marks the user as deleted. The email stays taken so the user can be restored.
+func (boltStore *BoltStore) Delete(id ID, version int64) error {
+	return boltStore.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		stored, err := boltGet(bucket, id)
+		if err != nil {
+			return err
+		}
+
+		if stored.Deleted() {
+			return ErrNotFound("user")
+		}
+
+		if stored.Version != version {
+			return ErrPreconditionFailed()
+		}
+
+		return boltPut(bucket, markDeleted(stored, boltStore.clock.Now().UTC()))
+	})
+}
+
+func (boltStore *BoltStore) Restore(id ID, version int64) (User, error) {
+	var user User
+
+	err := boltStore.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		stored, err := boltGet(bucket, id)
+		if err != nil {
+			return err
+		}
+
+		if stored.Version != version {
+			return ErrPreconditionFailed()
+		}
+
+		if !stored.Deleted() {
+			return ErrNotDeleted()
+		}
+
+		user = markRestored(stored, boltStore.clock.Now().UTC())
+		return boltPut(bucket, user)
+	})
+
+	return user, err
+}
+
+func (boltStore *BoltStore) PurgeDeleted(before time.Time) ([]ID, error) {
+	purged := []ID{}
+
+	err := boltStore.db.Update(func(tx *bolt.Tx) error {
+		users, emails := tx.Bucket(usersBucket), tx.Bucket(emailsBucket)
+
+		// Keys are collected first, bolt cursors do not like deletes while walking
+		var keys [][]byte
+		err := users.ForEach(func(key, data []byte) error {
+			var record userRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			user := record.user()
+			if user.Deleted() && user.DeletedAt.Before(before) {
+				keys = append(keys, key)
+				purged = append(purged, user.ID)
+				return emails.Delete([]byte(emailKey(user.Email)))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := users.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		apiKeys, hashes := tx.Bucket(apiKeysBucket), tx.Bucket(apiKeyHashesBucket)
+		var revoked []apiKeyRecord
+		err = apiKeys.ForEach(func(id, data []byte) error {
+			var record apiKeyRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if slices.Contains(purged, record.UserID) {
+				revoked = append(revoked, record)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, record := range revoked {
+			if err := apiKeys.Delete([]byte(record.ID)); err != nil {
+				return err
+			}
+			if err := hashes.Delete([]byte(record.Hash)); err != nil {
+				return err
+			}
+			if err := boltDeleteAPIKeyUsage(tx, record.ID); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+func (boltStore *BoltStore) CreateAPIKey(key APIKey) (APIKey, error) {
+	key.CreatedAt = boltStore.clock.Now().UTC()
+	key.ID = newULID(key.CreatedAt)
+
+	err := boltStore.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(apiKeyHashesBucket).Put([]byte(key.Hash), []byte(key.ID)); err != nil {
+			return err
+		}
+		return boltPutAPIKey(tx, key)
+	})
+
+	return key, err
+}
+
+// ULID keys, so the cursor walks them in creation order
+func (boltStore *BoltStore) ListAPIKeys(userID ID) ([]APIKey, error) {
+	keys := []APIKey{}
+
+	err := boltStore.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeysBucket).ForEach(func(id, data []byte) error {
+			var record apiKeyRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if record.UserID == userID {
+				keys = append(keys, record.key())
+			}
+			return nil
+		})
+	})
+
+	return keys, err
+}
+
+func (boltStore *BoltStore) GetAPIKeyByHash(hash string) (APIKey, error) {
+	var key APIKey
+
+	err := boltStore.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(apiKeyHashesBucket).Get([]byte(hash))
+		if id == nil {
+			return ErrAPIKeyNotFound()
+		}
+
+		var err error
+		key, err = boltGetAPIKey(tx, ID(id))
+		return err
+	})
+
+	return key, err
+}
+
+// Keys of other users are not found. Revoking twice keeps the first time.
+func (boltStore *BoltStore) RevokeAPIKey(userID ID, id ID) (APIKey, error) {
+	var key APIKey
+
+	err := boltStore.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		key, err = boltGetAPIKey(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if key.UserID != userID {
+			return ErrAPIKeyNotFound()
+		}
+
+		if key.Revoked() {
+			return nil
+		}
+
+		key.RevokedAt = boltStore.clock.Now().UTC()
+		return boltPutAPIKey(tx, key)
+	})
+
+	return key, err
+}
+
+func (boltStore *BoltStore) TouchAPIKey(id ID, at time.Time) error {
+	return boltStore.db.Update(func(tx *bolt.Tx) error {
+		key, err := boltGetAPIKey(tx, id)
+		if err != nil {
+			return err
+		}
+
+		key.LastUsedAt = at
+		return boltPutAPIKey(tx, key)
+	})
+}
+
+func (boltStore *BoltStore) AddAPIKeyUsage(id ID, day string, requests int64) error {
+	return boltStore.db.Update(func(tx *bolt.Tx) error {
+		if _, err := boltGetAPIKey(tx, id); err != nil {
+			return err
+		}
+
+		usage := tx.Bucket(apiKeyUsageBucket)
+		key := []byte(string(id) + "/" + day)
+		if data := usage.Get(key); len(data) == 8 {
+			requests += int64(binary.BigEndian.Uint64(data))
+		}
+
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(requests))
+		return usage.Put(key, data)
+	})
+}
+
+// The days sort after the key ID prefix, oldest first
+func (boltStore *BoltStore) APIKeyUsage(id ID, since string) ([]APIKeyDay, error) {
+	days := []APIKeyDay{}
+	prefix := []byte(string(id) + "/")
+
+	err := boltStore.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(apiKeyUsageBucket).Cursor()
+		for key, data := cursor.Seek([]byte(string(prefix) + since)); bytes.HasPrefix(key, prefix); key, data = cursor.Next() {
+			days = append(days, APIKeyDay{Date: string(key[len(prefix):]), Requests: int64(binary.BigEndian.Uint64(data))})
+		}
+		return nil
+	})
+
+	return days, err
+}
+
+func (boltStore *BoltStore) CreateWebhook(webhook Webhook) (Webhook, error) {
+	webhook.CreatedAt = boltStore.clock.Now().UTC()
+	webhook.ID = newULID(webhook.CreatedAt)
+
+	data, err := json.Marshal(newWebhookRecord(webhook))
+	if err != nil {
+		return webhook, err
+	}
+
+	err = boltStore.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).Put([]byte(webhook.ID), data)
+	})
+
+	return webhook, err
+}
+
+// ULID keys, so the cursor walks them in creation order
+func (boltStore *BoltStore) ListWebhooks() ([]Webhook, error) {
+	webhooks := []Webhook{}
+
+	err := boltStore.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).ForEach(func(id, data []byte) error {
+			var record webhookRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			webhooks = append(webhooks, record.webhook())
+			return nil
+		})
+	})
+
+	return webhooks, err
+}
+
+func (boltStore *BoltStore) GetWebhook(id ID) (Webhook, error) {
+	var record webhookRecord
+
+	err := boltStore.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(webhooksBucket).Get([]byte(id))
+		if data == nil {
+			return ErrWebhookNotFound()
+		}
+		return json.Unmarshal(data, &record)
+	})
+
+	return record.webhook(), err
+}
+
+func (boltStore *BoltStore) DeleteWebhook(id ID) error {
+	return boltStore.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(webhooksBucket)
+		if bucket.Get([]byte(id)) == nil {
+			return ErrWebhookNotFound()
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (boltStore *BoltStore) Ping() error {
+	return boltStore.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket) == nil {
+			return errors.New("users bucket is missing")
+		}
+		return nil
+	})
+}
+
+func (boltStore *BoltStore) Close() error {
+	return boltStore.db.Close()
+}
+
+// Sequential IDs are stored big endian so the cursor walks them in order
+func boltKey(id ID) []byte {
+	number, numeric := id.Int()
+	if !numeric {
+		return []byte(id)
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(number))
+	return key
+}
+
+func boltGet(bucket *bolt.Bucket, id ID) (User, error) {
+	var record userRecord
+
+	data := bucket.Get(boltKey(id))
+	if data == nil {
+		return User{}, ErrNotFound("user")
+	}
+
+	err := json.Unmarshal(data, &record)
+	return record.user(), err
+}
+
+func boltPut(bucket *bolt.Bucket, user User) error {
+	data, err := json.Marshal(newUserRecord(user))
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(boltKey(user.ID), data)
+}
+
+func boltGetAPIKey(tx *bolt.Tx, id ID) (APIKey, error) {
+	data := tx.Bucket(apiKeysBucket).Get([]byte(id))
+	if data == nil {
+		return APIKey{}, ErrAPIKeyNotFound()
+	}
+
+	var record apiKeyRecord
+	err := json.Unmarshal(data, &record)
+	return record.key(), err
+}
+
+func boltPutAPIKey(tx *bolt.Tx, key APIKey) error {
+	data, err := json.Marshal(newAPIKeyRecord(key))
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(apiKeysBucket).Put([]byte(key.ID), data)
+}
+
+func boltDeleteAPIKeyUsage(tx *bolt.Tx, id ID) error {
+	cursor := tx.Bucket(apiKeyUsageBucket).Cursor()
+	prefix := []byte(string(id) + "/")
+	for key, _ := cursor.Seek(prefix); bytes.HasPrefix(key, prefix); key, _ = cursor.Seek(prefix) {
+		if err := cursor.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boltIndexEmail(emails *bolt.Bucket, user User) error {
+	if user.Email == "" {
+		return nil
+	}
+
+	return emails.Put([]byte(emailKey(user.Email)), []byte(user.ID))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Snapshot format written to disk
+type fileSnapshot struct {
+	NextID   int64           `json:"next_id"`
+	Users    []userRecord    `json:"users"`
+	APIKeys  []apiKeyRecord  `json:"api_keys,omitempty"`
+	Webhooks []webhookRecord `json:"webhooks,omitempty"`
+
+	APIKeyUsage map[ID]map[string]int64 `json:"api_key_usage,omitempty"` // Key ID -> day -> requests
+}
+
+// FileStore keeps the users in memory and snapshots them to a JSON file on
+// Close and whenever the scheduler says so. The file is reloaded on startup.
+type FileStore struct {
+	*MemoryStore
+	path         string
+	saveMutex    sync.Mutex
+	lastRevision uint64
+	lastErr      error // Result of the last snapshot
+}
+
+func NewFileStore(path string, clock Clock) (*FileStore, error) {
+	fileStore := &FileStore{
+		MemoryStore: NewMemoryStore(clock),
+		path:        path,
+	}
+
+	if err := fileStore.load(); err != nil {
+		return nil, err
+	}
+
+	return fileStore, nil
+}
+
+func (fileStore *FileStore) load() error {
+	data, err := os.ReadFile(fileStore.path)
+
+	// First run, nothing to restore
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var snapshot fileSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	for _, record := range snapshot.Users {
+		user := record.user()
+		fileStore.users[user.ID] = user
+		fileStore.indexEmail(user)
+		if id, numeric := user.ID.Int(); numeric && id >= snapshot.NextID {
+			snapshot.NextID = id + 1
+		}
+	}
+
+	for _, record := range snapshot.APIKeys {
+		key := record.key()
+		fileStore.apiKeys[key.ID] = key
+		fileStore.apiKeyHashes[key.Hash] = key.ID
+	}
+	for id, days := range snapshot.APIKeyUsage {
+		fileStore.apiKeyUsage[id] = days
+	}
+
+	for _, record := range snapshot.Webhooks {
+		webhook := record.webhook()
+		fileStore.webhooks[webhook.ID] = webhook
+	}
+
+	if snapshot.NextID > fileStore.nextID {
+		fileStore.nextID = snapshot.NextID
+	}
+
+	return nil
+}
+
+// Writes the current state to disk if it changed since the last snapshot.
+// Writes into a temp file and renames it, so a crash never leaves a half written file.
+func (fileStore *FileStore) Snapshot() (err error) {
+	fileStore.saveMutex.Lock()
+	defer fileStore.saveMutex.Unlock()
+
+	defer func() { fileStore.lastErr = err }()
+
+	fileStore.mutex.RLock()
+	revision := fileStore.revision
+	if revision == fileStore.lastRevision {
+		fileStore.mutex.RUnlock()
+		return nil
+	}
+	snapshot := fileSnapshot{NextID: fileStore.nextID, Users: []userRecord{}}
+	for _, user := range fileStore.sortedUsers() {
+		snapshot.Users = append(snapshot.Users, newUserRecord(user))
+	}
+	for _, key := range fileStore.sortedAPIKeys() {
+		snapshot.APIKeys = append(snapshot.APIKeys, newAPIKeyRecord(key))
+	}
+	// Copied, the maps keep changing once the lock is released
+	snapshot.APIKeyUsage = make(map[ID]map[string]int64, len(fileStore.apiKeyUsage))
+	for id, days := range fileStore.apiKeyUsage {
+		snapshot.APIKeyUsage[id] = maps.Clone(days)
+	}
+	for _, webhook := range fileStore.sortedWebhooks() {
+		snapshot.Webhooks = append(snapshot.Webhooks, newWebhookRecord(webhook))
+	}
+	fileStore.mutex.RUnlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fileStore.path), filepath.Base(fileStore.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), fileStore.path); err != nil {
+		return err
+	}
+
+	fileStore.lastRevision = revision
+
+	return nil
+}
+
+// Unhealthy while snapshots are failing
+func (fileStore *FileStore) Ping() error {
+	fileStore.saveMutex.Lock()
+	defer fileStore.saveMutex.Unlock()
+
+	return fileStore.lastErr
+}
+
+// Writes a last snapshot, after the scheduler stopped
+func (fileStore *FileStore) Close() error {
+	return fileStore.Snapshot()
+}
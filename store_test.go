@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoresCreateUsersNotDeleted(t *testing.T) {
+	boltStore, err := NewBoltStore(filepath.Join(t.TempDir(), "users.db"), systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltStore.Close()
+
+	stores := map[string]UserStore{"memory": NewMemoryStore(systemClock{}), "bolt": boltStore}
+	for name, userStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			user, err := userStore.Create(NewTestUser(func(user *User) { user.DeletedAt = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) }))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := userStore.Get(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Deleted() || stored.Deleted() {
+				t.Fatalf("created deleted at %s, stored %s", user.DeletedAt, stored.DeletedAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Items written between flushes
+const streamFlushEvery = 100
+
+// Writes the envelope of a list item by item, {"success":true,"data":[...],"links":{...}},
+// so big lists never sit in memory. Nothing is sent before the first item, until
+// then a failure can still be answered with Error. After it errors can only be
+// logged and the body is cut short, which clients see as invalid JSON.
+type JSONStream struct {
+	w       http.ResponseWriter
+	status  int
+	items   int
+	started bool
+}
+
+// Only plain JSON is streamed, other formats and ?pretty build the list in memory
+func canStream(w http.ResponseWriter) bool {
+	negotiated := negotiation(w)
+	return negotiated.format == mediaJSON && !negotiated.pretty
+}
+
+func NewJSONStream(w http.ResponseWriter, status int) *JSONStream {
+	return &JSONStream{w: w, status: status}
+}
+
+func (stream *JSONStream) start() error {
+	if stream.started {
+		return nil
+	}
+	stream.started = true
+
+	stream.w.Header().Set("Content-Type", mediaJSON)
+	stream.w.WriteHeader(stream.status)
+	_, err := stream.w.Write([]byte(`{"success":true,"data":[`))
+	return err
+}
+
+func (stream *JSONStream) Write(item interface{}) error {
+	body, err := marshalJSON(item, "")
+	if err != nil {
+		return err
+	}
+
+	if err := stream.start(); err != nil {
+		return err
+	}
+
+	if stream.items > 0 {
+		body = append([]byte{','}, body...)
+	}
+	if _, err := stream.w.Write(body[:len(body)-1]); err != nil { // Without the newline of the encoder
+		return err
+	}
+	stream.items++
+
+	if stream.items%streamFlushEvery == 0 {
+		if err := http.NewResponseController(stream.w).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Ends the array and the envelope, the links go last as they may depend on the items
+func (stream *JSONStream) Close(links Links) error {
+	if err := stream.start(); err != nil {
+		return err
+	}
+
+	tail := []byte("]")
+	if len(links) > 0 {
+		encoded, err := marshalJSON(links, "")
+		if err != nil {
+			return err
+		}
+		tail = append(append([]byte(`],"links":`), encoded[:len(encoded)-1]...), '}')
+	} else {
+		tail = append(tail, '}')
+	}
+
+	_, err := stream.w.Write(tail)
+	return err
+}
+
+// Answers err when nothing was sent yet, logs it otherwise
+func (stream *JSONStream) Fail(err error) {
+	if !stream.started {
+		Error(stream.w, err)
+		return
+	}
+	warnf("stream: %v", err)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	_ "time/tzdata" // ?tz= works on hosts without a zoneinfo database
+)
+
+// Parses an RFC 3339 timestamp like 2024-01-02T15:04:05Z or 2024-01-02T10:04:05-05:00.
+// Values without a zone are rejected, they mean a different instant on every server.
+func parseTimestamp(value string) (time.Time, error) {
+	parsed, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(value))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not an RFC 3339 timestamp with a zone, e.g. 2024-01-02T15:04:05Z", value)
+	}
+
+	return parsed.UTC(), nil
+}
+
+// Time zone asked with ?tz=Europe/Madrid, UTC when missing
+func displayLocation(r *http.Request) (*time.Location, error) {
+	name := r.URL.Query().Get("tz")
+	if name == "" {
+		return time.UTC, nil
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, ErrBadRequest(fmt.Sprintf("unknown time zone %q", name))
+	}
+
+	return location, nil
+}
+
+// Converts the user timestamps to the display time zone, storage stays in UTC
+func (user User) In(location *time.Location) User {
+	if !user.CreatedAt.IsZero() {
+		user.CreatedAt = user.CreatedAt.In(location)
+	}
+	if !user.UpdatedAt.IsZero() {
+		user.UpdatedAt = user.UpdatedAt.In(location)
+	}
+	if !user.DeletedAt.IsZero() {
+		user.DeletedAt = user.DeletedAt.In(location)
+	}
+	return user
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// TLS 1.2 with forward secret AEAD ciphers only, TLS 1.3 picks its own suites
+func modernTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
+
+// Makes Serve answer HTTPS with the PEM certificate and key
+func (server *Server) EnableTLS(certFile, keyFile string) error {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	config := modernTLSConfig()
+	config.Certificates = []tls.Certificate{certificate}
+	server.httpServer.TLSConfig = config
+
+	return nil
+}
+
+func (server *Server) ListenTLS(certFile, keyFile string) error {
+	if err := server.EnableTLS(certFile, keyFile); err != nil {
+		return err
+	}
+
+	return server.Listen()
+}
+
+func (server *Server) TLS() bool {
+	return server.httpServer.TLSConfig != nil
+}
+
+// Plain HTTP server answering every request with a 301 to the same URL on the
+// HTTPS port, except the health checks which load balancers may still probe over HTTP
+func NewRedirectServer(port string, api *Server, config *Config) *Server {
+	redirect := NewServer(port, config)
+	redirect.Handle("GET", "/health", HealthHandler(api.health))
+	redirect.Handle("GET", "/healthz", LivenessHandler)
+	redirect.Handle("GET", "/readyz", ReadinessHandler(api.health))
+
+	router := redirect.router
+	redirect.httpServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := router.rules[r.URL.Path]; ok {
+			router.ServeHTTP(w, r)
+			return
+		}
+
+		markHandlerStarted(r)
+		// The bound address has the real port when PORT is :0
+		httpsPort := api.port
+		if addr := api.Addr(); addr != nil {
+			httpsPort = addr.String()
+		}
+
+		http.Redirect(w, r, httpsURL(r, httpsPort), http.StatusMovedPermanently)
+	})
+
+	return redirect
+}
+
+func httpsURL(r *http.Request, httpsPort string) string {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = hostname
+	}
+
+	if _, port, err := net.SplitHostPort(httpsPort); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	return "https://" + host + r.URL.RequestURI()
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RFC 6238 defaults (SHA-1, 6 digits), the ones every authenticator app supports
+const (
+	totpPeriod      = 30 * time.Second
+	totpSkew        = 1 // Periods accepted before and after the current one
+	mfaTokenTTL     = 5 * time.Minute
+	maxCodeFailures = 5 // Wrong codes at the second login step before the mfa tokens are revoked
+	backupCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Set from TOTP_ISSUER in main
+var totpIssuer string
+
+// Second factor settings of a user. The secret is pending until a first code
+// confirms it, backup codes are stored hashed and work once.
+type TwoFactor struct {
+	Secret      string   `json:"secret,omitempty"`
+	Enabled     bool     `json:"enabled,omitempty"`
+	BackupCodes []string `json:"backup_codes,omitempty"`
+	LastCounter int64    `json:"last_counter,omitempty"` // Used codes can not be replayed
+
+	// Wrong codes in a row at the second login step. The mfa tokens issued up
+	// to TokensAfter, a Unix time, are rejected after maxCodeFailures of them.
+	Failures    int   `json:"failures,omitempty"`
+	TokensAfter int64 `json:"tokens_after,omitempty"`
+}
+
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"` // For QR codes
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type BackupCodes struct {
+	Codes []string `json:"backup_codes"` // Only shown once
+}
+
+type LoginVerifyRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"` // TOTP or backup code
+}
+
+func (twoFactor *TwoFactor) Active() bool {
+	return twoFactor != nil && twoFactor.Enabled
+}
+
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// Returns the settings to store when the code is valid, the receiver is shared
+// with the store so it is never modified
+func (twoFactor TwoFactor) verifyTOTP(code string, now time.Time) (TwoFactor, bool) {
+	current := now.Unix() / int64(totpPeriod/time.Second)
+
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if counter <= twoFactor.LastCounter {
+			continue
+		}
+
+		expected, err := totpCode(twoFactor.Secret, counter)
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			twoFactor.LastCounter = counter
+			return twoFactor, true
+		}
+	}
+
+	return twoFactor, false
+}
+
+// TOTP codes or backup codes, a used backup code is removed
+func (twoFactor TwoFactor) verifyCode(code string, now time.Time) (TwoFactor, bool) {
+	code = strings.TrimSpace(code)
+
+	if updated, ok := twoFactor.verifyTOTP(code, now); ok {
+		return updated, true
+	}
+
+	hash := hashBackupCode(code)
+	for i, stored := range twoFactor.BackupCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			remaining := append([]string(nil), twoFactor.BackupCodes[:i]...)
+			twoFactor.BackupCodes = append(remaining, twoFactor.BackupCodes[i+1:]...)
+			return twoFactor, true
+		}
+	}
+
+	return twoFactor, false
+}
+
+func hashBackupCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the codes to show and their hashes to store
+func newBackupCodes() ([]string, []string, error) {
+	codes := make([]string, backupCodeCount)
+	hashes := make([]string, backupCodeCount)
+
+	for i := range codes {
+		random := make([]byte, 7)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(random))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashBackupCode(code)
+	}
+
+	return codes, hashes, nil
+}
+
+func issueMFAToken(user User, now time.Time) (string, Claims, error) {
+	return signClaims(Claims{
+		Subject:        string(publicID("users", user.ID)),
+		IssuedAt:       now.Unix(),
+		ExpiresAt:      now.Add(mfaTokenTTL).Unix(),
+		SessionVersion: user.SessionVersion,
+		Purpose:        "mfa",
+	})
+}
+
+func ErrInvalidCode() *AppError {
+	return &AppError{Status: http.StatusUnprocessableEntity, Code: CodeInvalidCode, Message: "invalid code", Field: "code"}
+}
+
+// Starts the enrollment, two-factor is enabled once a code is confirmed
+func (app *App) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := app.loadCurrentUser(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	if user.TwoFactor.Active() {
+		Error(w, ErrConflict("", "two-factor authentication is already enabled").WithCode(CodeTwoFactorEnabled))
+		return
+	}
+
+	random := make([]byte, 20)
+	if _, err := rand.Read(random); err != nil {
+		Error(w, err)
+		return
+	}
+	secret := totpEncoding.EncodeToString(random)
+
+	user.TwoFactor = &TwoFactor{Secret: secret}
+	if _, err := app.Store.Update(user); err != nil {
+		Error(w, err)
+		return
+	}
+
+	label := url.PathEscape(totpIssuer + ":" + user.Email)
+	query := url.Values{"secret": {secret}, "issuer": {totpIssuer}}
+
+	JSON(w, http.StatusOK, TwoFactorEnrollment{
+		Secret: secret,
+		URI:    "otpauth://totp/" + label + "?" + query.Encode(),
+	})
+}
+
+// Enables two-factor with a first valid code and returns the backup codes
+func (app *App) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, code, err := app.twoFactorRequest(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	if user.TwoFactor == nil || user.TwoFactor.Secret == "" || user.TwoFactor.Enabled {
+		Error(w, ErrConflict("", "start the enrollment with POST /api/me/2fa").WithCode(CodeTwoFactorNotEnrolling))
+		return
+	}
+
+	updated, ok := user.TwoFactor.verifyTOTP(code, app.Clock.Now())
+	if !ok {
+		Error(w, ErrInvalidCode())
+		return
+	}
+
+	updated.Enabled = true
+	app.saveBackupCodes(w, user, updated)
+}
+
+// Replaces the backup codes, needs a TOTP code
+func (app *App) RegenerateBackupCodes(w http.ResponseWriter, r *http.Request) {
+	user, code, err := app.twoFactorRequest(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	if !user.TwoFactor.Active() {
+		Error(w, ErrConflict("", "two-factor authentication is not enabled").WithCode(CodeTwoFactorNotEnabled))
+		return
+	}
+
+	updated, ok := user.TwoFactor.verifyTOTP(code, app.Clock.Now())
+	if !ok {
+		Error(w, ErrInvalidCode())
+		return
+	}
+
+	app.saveBackupCodes(w, user, updated)
+}
+
+func (app *App) saveBackupCodes(w http.ResponseWriter, user User, twoFactor TwoFactor) {
+	codes, hashes, err := newBackupCodes()
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	twoFactor.BackupCodes = hashes
+	user.TwoFactor = &twoFactor
+	if _, err := app.Store.Update(user); err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, BackupCodes{Codes: codes})
+}
+
+// Turns two-factor off, needs a TOTP or backup code
+func (app *App) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, code, err := app.twoFactorRequest(r)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	if !user.TwoFactor.Active() {
+		Error(w, ErrConflict("", "two-factor authentication is not enabled").WithCode(CodeTwoFactorNotEnabled))
+		return
+	}
+
+	if _, ok := user.TwoFactor.verifyCode(code, app.Clock.Now()); !ok {
+		Error(w, ErrInvalidCode())
+		return
+	}
+
+	// Not nil, nil would keep the stored settings
+	user.TwoFactor = &TwoFactor{}
+	if _, err := app.Store.Update(user); err != nil {
+		Error(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Held from reading the user to storing its failures, concurrent guesses
+// would otherwise all be counted as the first one
+var loginVerifyMutex sync.Mutex
+
+// Second login step, trades the mfa_token and a code for the access token.
+// After maxCodeFailures wrong codes the password has to be sent again.
+func (app *App) LoginVerify(w http.ResponseWriter, r *http.Request) {
+	var request LoginVerifyRequest
+	if err := DecodeJSON(r, &request); err != nil {
+		Error(w, err)
+		return
+	}
+
+	loginVerifyMutex.Lock()
+	defer loginVerifyMutex.Unlock()
+
+	now := app.Clock.Now()
+	claims, err := verifyToken(request.MFAToken, now)
+	if err == nil && claims.Purpose != "mfa" {
+		err = errors.New("not an mfa token")
+	}
+	var user User
+	if err == nil {
+		user, err = app.checkSession(claims)
+	}
+	if err != nil {
+		Error(w, ErrUnauthorized(err.Error()))
+		return
+	}
+
+	if !user.TwoFactor.Active() {
+		Error(w, ErrUnauthorized("two-factor authentication is not enabled"))
+		return
+	}
+	if claims.IssuedAt <= user.TwoFactor.TokensAfter {
+		Error(w, ErrUnauthorized("too many invalid codes, log in again"))
+		return
+	}
+
+	updated, ok := user.TwoFactor.verifyCode(request.Code, now)
+	if !ok {
+		updated.Failures++
+		if updated.Failures >= maxCodeFailures {
+			updated.Failures, updated.TokensAfter = 0, now.Unix()
+		}
+		user.TwoFactor = &updated
+		if _, err := app.Store.Update(user); err != nil {
+			Error(w, err)
+			return
+		}
+
+		if updated.Failures == 0 {
+			Error(w, ErrUnauthorized("too many invalid codes, log in again"))
+		} else {
+			Error(w, ErrInvalidCode())
+		}
+		return
+	}
+
+	// Stores the used counter or backup code so it can not be replayed
+	updated.Failures = 0
+	user.TwoFactor = &updated
+	if user, err = app.Store.Update(user); err != nil {
+		Error(w, err)
+		return
+	}
+
+	token, accessClaims, err := issueToken(user, app.Clock.Now())
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, newLoginResponse(token, accessClaims))
+}
+
+func (app *App) loadCurrentUser(r *http.Request) (User, error) {
+	id, err := currentUserID(r)
+	if err != nil {
+		return User{}, err
+	}
+
+	return app.Store.Get(id)
+}
+
+func (app *App) twoFactorRequest(r *http.Request) (User, string, error) {
+	var request TwoFactorCodeRequest
+	if err := DecodeJSON(r, &request); err != nil {
+		return User{}, "", err
+	}
+
+	user, err := app.loadCurrentUser(r)
+	return user, request.Code, err
+}
@@ -3,14 +3,70 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 )
 
 type Middleware func(http.HandlerFunc) http.HandlerFunc
 
+// Handler that returns its error instead of writing it, e.g.
+// return ErrNotFound("user"). Register it as HandlerE(handler).ServeHTTP.
+// Errors must be returned before the response is started.
+type HandlerE func(w http.ResponseWriter, r *http.Request) error
+
+// Answers a returned error with Error
+func (handler HandlerE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := handler(w, r); err != nil {
+		Error(w, err)
+	}
+}
+
 type User struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Phone string `json:"phone"`
+	ID    ID     `json:"id" xml:"id"`
+	Name  string `json:"name" xml:"name" validate:"required"`
+	Email string `json:"email" xml:"email" validate:"required,email"`
+	Phone string `json:"phone" xml:"phone" validate:"phone"`
+	Role  Role   `json:"role,omitempty" xml:"role,omitempty" validate:"role"` // member when not set on create
+
+	// Write only, the stores replace it with PasswordHash and never return it
+	Password     string `json:"password,omitempty" xml:"password,omitempty" validate:"password"`
+	PasswordHash string `json:"-" xml:"-"`
+
+	// Incremented when the password changes, tokens with an older one are rejected
+	SessionVersion int64 `json:"-" xml:"-"`
+
+	// Nil on updates keeps the stored settings
+	TwoFactor *TwoFactor `json:"-" xml:"-"`
+
+	// Set by admins, locked users can not log in. Nil on updates keeps the
+	// stored lock, an empty one unlocks.
+	Lock *UserLock `json:"-" xml:"-"`
+
+	// Incremented on every write, sent as the ETag and checked against If-Match
+	Version int64 `json:"version" xml:"version"`
+
+	// Set by the store, always UTC. Zero ones are left out of XML by MarshalXML.
+	CreatedAt time.Time `json:"created_at,omitzero" xml:"-"`
+	UpdatedAt time.Time `json:"updated_at,omitzero" xml:"-"`
+
+	// Set when the user is deleted, deleted users can be restored
+	DeletedAt time.Time `json:"deleted_at,omitzero" xml:"-"`
+
+	// Deployment specific fields, allowed keys come from USER_ATTRIBUTES
+	Attributes map[string]interface{} `json:"attributes,omitempty" xml:"-"`
+}
+
+func (user User) Deleted() bool {
+	return !user.DeletedAt.IsZero()
+}
+
+func (user User) Locked() bool {
+	return user.Lock != nil && !user.Lock.At.IsZero()
+}
+
+type UserLock struct {
+	At     time.Time `json:"at"`
+	By     ID        `json:"by"` // The admin that locked the user
+	Reason string    `json:"reason,omitempty"`
 }
 
 func (user *User) ToJson() ([]byte, error) {
@@ -18,3 +74,45 @@ func (user *User) ToJson() ([]byte, error) {
 }
 
 type MetaData interface{}
+
+// Route metadata used to build the API docs
+type Route struct {
+	Method         string
+	Path           string
+	Name           string
+	Summary        string
+	RequestSchema  interface{} // Zero value of the body type, nil when there is no body
+	ResponseSchema interface{} // Zero value of the type sent in the envelope data
+	Examples       []Example
+}
+
+// Sample request and response of a route, checked against the schemas on startup
+type Example struct {
+	Name     string      `json:"name"`
+	Request  interface{} `json:"request,omitempty"`
+	Status   int         `json:"status"`
+	Response interface{} `json:"response"`
+}
+
+// Names the route for the docs and for links, see linkTo
+func (route *Route) Named(name string, summary string) *Route {
+	route.Name = name
+	route.Summary = summary
+
+	routePaths.Lock()
+	routePaths.byName[name] = route.Path
+	routePaths.Unlock()
+
+	return route
+}
+
+func (route *Route) Schemas(request interface{}, response interface{}) *Route {
+	route.RequestSchema = request
+	route.ResponseSchema = response
+	return route
+}
+
+func (route *Route) WithExample(example Example) *Route {
+	route.Examples = append(route.Examples, example)
+	return route
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A field that did not pass validation
+type ValidationError struct {
+	Field   string // Dotted path, e.g. attributes.team
+	Rule    string // Check that failed, e.g. required or email
+	Message string
+}
+
+func (validationErr *ValidationError) Error() string {
+	return validationErr.Field + ": " + validationErr.Message
+}
+
+// JSON pointer of the field in the request body, e.g. /attributes/team
+func (validationErr *ValidationError) Pointer() string {
+	escaper := strings.NewReplacer("~", "~0", "/", "~1")
+
+	pointer := ""
+	for _, segment := range strings.Split(validationErr.Field, ".") {
+		pointer += "/" + escaper.Replace(segment)
+	}
+	return pointer
+}
+
+// Every problem of a request, not only the first one
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (errs *ValidationErrors) add(field string, rule string, message string) {
+	*errs = append(*errs, &ValidationError{Field: field, Rule: rule, Message: message})
+}
+
+// Nil without errors, a nil ValidationErrors in an error interface is not nil
+func (errs ValidationErrors) orNil() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// The field errors of err, a ValidationError or ValidationErrors possibly wrapped
+func validationErrors(err error) ValidationErrors {
+	var errs ValidationErrors
+	if errors.As(err, &errs) {
+		return errs
+	}
+
+	var single *ValidationError
+	if errors.As(err, &single) {
+		return ValidationErrors{single}
+	}
+
+	return nil
+}
+
+// Checks the validate tags of the user and its attributes, returns a
+// ValidationErrors with every problem found
+func (user *User) Validate() error {
+	var errs ValidationErrors
+	if err := validateStruct(user); err != nil {
+		errs = err.(ValidationErrors)
+	}
+
+	errs = append(errs, validateAttributes(user.Attributes)...)
+
+	return errs.orNil()
+}
+
+// Allowed user attribute, configured with USER_ATTRIBUTES=key:type[:max],...
+// type is string, number or bool, max is the longest string allowed.
+type AttributeRule struct {
+	Key     string
+	Type    string
+	MaxSize int
+}
+
+// Attributes accepted on users, empty means none
+var attributeSchema = map[string]AttributeRule{}
+
+func parseAttributeSchema(specs []string) (map[string]AttributeRule, error) {
+	schema := make(map[string]AttributeRule)
+
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid attribute %q, use key:type[:max]", spec)
+		}
+
+		rule := AttributeRule{Key: parts[0], Type: parts[1]}
+		if rule.Type != "string" && rule.Type != "number" && rule.Type != "bool" {
+			return nil, fmt.Errorf("attribute %s has unknown type %q", rule.Key, rule.Type)
+		}
+
+		if len(parts) == 3 {
+			max, err := strconv.Atoi(parts[2])
+			if err != nil || max <= 0 {
+				return nil, fmt.Errorf("attribute %s has invalid max %q", rule.Key, parts[2])
+			}
+			rule.MaxSize = max
+		}
+
+		schema[rule.Key] = rule
+	}
+
+	return schema, nil
+}
+
+func validateAttributes(attributes map[string]interface{}) ValidationErrors {
+	var errs ValidationErrors
+
+	// Sorted so the errors come in the same order every time
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := attributes[key]
+		field := "attributes." + key
+		rule, allowed := attributeSchema[key]
+		if !allowed {
+			errs.add(field, "allowed", "is not an allowed attribute")
+			continue
+		}
+
+		switch rule.Type {
+		case "string":
+			text, ok := value.(string)
+			if !ok {
+				errs.add(field, "type", "must be a string")
+			} else if rule.MaxSize > 0 && len(text) > rule.MaxSize {
+				errs.add(field, "max_length", fmt.Sprintf("must be at most %d characters", rule.MaxSize))
+			}
+		case "number":
+			switch value.(type) {
+			case float64, json.Number:
+			default:
+				errs.add(field, "type", "must be a number")
+			}
+		case "bool":
+			if _, ok := value.(bool); !ok {
+				errs.add(field, "type", "must be true or false")
+			}
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Checks a field against the parameter of its tag, e.g. "100" in max=100.
+// A *ValidationError keeps its rule and message, other errors only give the message.
+type ValidationRule func(value reflect.Value, param string) error
+
+// Rules usable in validate tags. Register custom ones with RegisterRule before serving.
+var validationRules = map[string]ValidationRule{
+	"email": validateEmail,
+	"phone": validatePhone,
+	"min":   validateMin,
+	"max":   validateMax,
+	"oneof": validateOneOf,
+}
+
+func RegisterRule(name string, rule ValidationRule) {
+	validationRules[name] = rule
+}
+
+func init() {
+	RegisterRule("role", func(value reflect.Value, param string) error {
+		if !Role(value.String()).Valid() {
+			return fmt.Errorf("must be admin, member or viewer")
+		}
+		return nil
+	})
+
+	RegisterRule("password", func(value reflect.Value, param string) error {
+		return validatePassword(value.String())
+	})
+}
+
+// Checks the validate tags of a struct, e.g. `validate:"required,email,max=100"`.
+// Empty fields only fail required, the other rules skip them.
+// Nested structs are checked too, their fields are reported as parent.child.
+func validateStruct(value interface{}) error {
+	var errs ValidationErrors
+	checkStruct(reflect.Indirect(reflect.ValueOf(value)), "", &errs)
+	return errs.orNil()
+}
+
+func checkStruct(value reflect.Value, prefix string, errs *ValidationErrors) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := prefix + jsonName(field)
+		fieldValue := reflect.Indirect(value.Field(i))
+
+		// Embedded structs without a JSON name are flattened, as encoding/json does
+		if field.Anonymous && fieldValue.Kind() == reflect.Struct && field.Tag.Get("json") == "" {
+			checkStruct(fieldValue, prefix, errs)
+			continue
+		}
+
+		if tag := field.Tag.Get("validate"); tag != "" {
+			checkField(fieldValue, name, tag, errs)
+		}
+
+		if fieldValue.Kind() == reflect.Struct {
+			checkStruct(fieldValue, name+".", errs)
+		}
+	}
+}
+
+// Rules run in order, the first failing one is reported
+func checkField(value reflect.Value, name string, tag string, errs *ValidationErrors) {
+	for _, rule := range strings.Split(tag, ",") {
+		rule, param, _ := strings.Cut(rule, "=")
+
+		if rule == "required" {
+			if isBlank(value) {
+				errs.add(name, "required", "is required")
+				return
+			}
+			continue
+		}
+
+		if isBlank(value) {
+			return
+		}
+
+		check, ok := validationRules[rule]
+		if !ok {
+			panic(fmt.Sprintf("validate tag of %s has unknown rule %q", name, rule))
+		}
+
+		if err := check(value, param); err != nil {
+			if validationErr, ok := err.(*ValidationError); ok {
+				errs.add(name, validationErr.Rule, validationErr.Message)
+			} else {
+				errs.add(name, rule, err.Error())
+			}
+			return
+		}
+	}
+}
+
+// Zero values and strings with only spaces
+func isBlank(value reflect.Value) bool {
+	if !value.IsValid() {
+		return true
+	}
+	if value.Kind() == reflect.String {
+		return strings.TrimSpace(value.String()) == ""
+	}
+	return value.IsZero()
+}
+
+// Name of the field in the request body, or of the parameter for Bind
+func jsonName(field reflect.StructField) string {
+	if name := paramName(field); name != "" {
+		return name
+	}
+
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+func validateEmail(value reflect.Value, param string) error {
+	if _, err := mail.ParseAddress(value.String()); err != nil {
+		return fmt.Errorf("is not a valid email")
+	}
+	return nil
+}
+
+func validatePhone(value reflect.Value, param string) error {
+	for _, char := range value.String() {
+		if !strings.ContainsRune("0123456789+-() ", char) {
+			return fmt.Errorf("may only contain digits, spaces and + - ( )")
+		}
+	}
+	return nil
+}
+
+// Characters of strings, items of slices and maps, value of numbers
+func validateMin(value reflect.Value, param string) error {
+	return compareTo(value, param, func(size float64, limit float64) bool { return size >= limit }, "at least")
+}
+
+func validateMax(value reflect.Value, param string) error {
+	return compareTo(value, param, func(size float64, limit float64) bool { return size <= limit }, "at most")
+}
+
+func compareTo(value reflect.Value, param string, within func(float64, float64) bool, bound string) error {
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		panic(fmt.Sprintf("invalid validate limit %q", param))
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		if !within(float64(utf8.RuneCountInString(value.String())), limit) {
+			return fmt.Errorf("must have %s %s characters", bound, param)
+		}
+	case reflect.Slice, reflect.Array, reflect.Map:
+		if !within(float64(value.Len()), limit) {
+			return fmt.Errorf("must have %s %s items", bound, param)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !within(float64(value.Int()), limit) {
+			return fmt.Errorf("must be %s %s", bound, param)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if !within(float64(value.Uint()), limit) {
+			return fmt.Errorf("must be %s %s", bound, param)
+		}
+	case reflect.Float32, reflect.Float64:
+		if !within(value.Float(), limit) {
+			return fmt.Errorf("must be %s %s", bound, param)
+		}
+	default:
+		panic(fmt.Sprintf("min and max do not apply to %s", value.Kind()))
+	}
+
+	return nil
+}
+
+// oneof=a b c
+func validateOneOf(value reflect.Value, param string) error {
+	options := strings.Fields(param)
+	for _, option := range options {
+		if fmt.Sprint(value.Interface()) == option {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(options, ", "))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const versionKey contextKey = "api_version"
+
+// Retirement plan of an old version, announced on each of its responses with
+// the Deprecation (RFC 9745) and Sunset (RFC 8594) headers
+type VersionSchedule struct {
+	Deprecated time.Time // Zero while the version is supported
+	Sunset     time.Time // Answered with a 410 from then on, zero when not planned
+}
+
+// Set in main from API_V1_DEPRECATED and API_V1_SUNSET
+var versionSchedules = map[int]VersionSchedule{}
+
+// Versions clients may ask for, the current one and those with translation rules
+func knownVersion(version int) bool {
+	_, legacy := legacyTranslations[version]
+	return version == currentAPIVersion || legacy
+}
+
+// Serves every path under prefix also as prefix/v1/..., prefix/v2/... for the
+// known versions, e.g. /api/v1/users/7 is /api/users/7 answered as version 1.
+// The version in the path wins over Accept-Version.
+func (server *Server) VersionedPaths(prefix string) {
+	server.router.versionPrefix = strings.TrimSuffix(prefix, "/")
+}
+
+// The unversioned path and the version of a prefix/v{n}/... path
+func (router *Router) versionedPath(path string) (string, int, bool) {
+	if router.versionPrefix == "" {
+		return "", 0, false
+	}
+
+	rest, ok := strings.CutPrefix(path, router.versionPrefix+"/v")
+	if !ok {
+		return "", 0, false
+	}
+
+	number, rest, _ := strings.Cut(rest, "/")
+	version, err := strconv.Atoi(number)
+	if err != nil || !knownVersion(version) {
+		return "", 0, false
+	}
+
+	return router.versionPrefix + "/" + rest, version, true
+}
+
+// Version of the request, from the path when VersionedPaths pinned one,
+// see negotiateVersion otherwise
+func requestVersion(r *http.Request) int {
+	if version, ok := r.Context().Value(versionKey).(int); ok {
+		return version
+	}
+	return negotiateVersion(r)
+}
+
+// Sends API-Version on every response and the schedule of deprecated versions,
+// and X-API-Version with the version of the build. Requests for a version past
+// its sunset get a 410.
+func APIVersioning() Middleware {
+	return func(nextMiddleware http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-API-Version", version)
+
+			version := requestVersion(r)
+			w.Header().Set("API-Version", strconv.Itoa(version))
+
+			schedule := versionSchedules[version]
+			if !schedule.Deprecated.IsZero() {
+				w.Header().Set("Deprecation", "@"+strconv.FormatInt(schedule.Deprecated.Unix(), 10))
+			}
+			if !schedule.Sunset.IsZero() {
+				w.Header().Set("Sunset", schedule.Sunset.UTC().Format(http.TimeFormat))
+
+				if !time.Now().Before(schedule.Sunset) {
+					Error(w, &AppError{Status: http.StatusGone, Code: CodeVersionSunset, Message: "API version " + strconv.Itoa(version) + " is no longer served, use version " + strconv.Itoa(currentAPIVersion)})
+					return
+				}
+			}
+
+			nextMiddleware(w, r)
+		}
+	}
+}
+
+func withVersion(r *http.Request, version int) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), versionKey, version))
+}
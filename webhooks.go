@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookSecretPrefix = "whsec_"
+	webhookLogSize      = 100 // Deliveries kept per webhook for GET /api/webhooks/{id}/deliveries
+)
+
+// The user events a webhook can subscribe to
+var webhookEvents = []string{"user.created", "user.updated", "user.deleted", "user.restored"}
+
+// URL POSTed the user events it subscribed to, signed with its secret
+type Webhook struct {
+	ID        ID        `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (webhook Webhook) Wants(event string) bool {
+	return slices.Contains(webhook.Events, event)
+}
+
+// How the stores persist a webhook, the secret stays out of the API JSON
+type webhookRecord struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+func newWebhookRecord(webhook Webhook) webhookRecord {
+	return webhookRecord{Webhook: webhook, Secret: webhook.Secret}
+}
+
+func (record webhookRecord) webhook() Webhook {
+	webhook := record.Webhook
+	webhook.Secret = record.Secret
+	return webhook
+}
+
+// Implemented by the user stores next to UserStore
+type WebhookStore interface {
+	CreateWebhook(webhook Webhook) (Webhook, error)
+	ListWebhooks() ([]Webhook, error)
+	GetWebhook(id ID) (Webhook, error)
+	DeleteWebhook(id ID) error
+}
+
+func ErrWebhookNotFound() *AppError {
+	return ErrNotFound("webhook")
+}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"` // Generated when empty
+}
+
+// The only response with the secret, it can not be read again
+type CreatedWebhook struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// One attempt to deliver an event, failed ones are retried as new attempts
+type WebhookDelivery struct {
+	ID         ID        `json:"id"`
+	WebhookID  ID        `json:"webhook_id"`
+	EventID    uint64    `json:"event_id"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	Status     int       `json:"status,omitempty"` // Status code answered, 0 when there was no answer
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	At         time.Time `json:"at"`
+	NextRetry  time.Time `json:"next_retry,omitzero"` // Zero once delivered or given up
+	Successful bool      `json:"successful"`
+}
+
+// Payload of the webhook.deliver tasks
+type webhookTask struct {
+	WebhookID ID        `json:"webhook_id"`
+	Event     UserEvent `json:"event"`
+}
+
+// Delivers the user events to the webhooks through the task queue, which
+// retries failed deliveries with exponential backoff. The log of the last
+// deliveries of every webhook is kept in memory.
+type WebhookDispatcher struct {
+	queue    TaskQueue
+	webhooks WebhookStore
+	clock    Clock
+	options  TaskOptions
+
+	mutex sync.Mutex
+	log   map[ID][]WebhookDelivery
+}
+
+// Handles the webhook.deliver tasks of the queue
+func NewWebhookDispatcher(queue TaskQueue, webhooks WebhookStore, clock Clock, maxAttempts int, retryDelay time.Duration) *WebhookDispatcher {
+	dispatcher := &WebhookDispatcher{
+		queue:    queue,
+		webhooks: webhooks,
+		clock:    clock,
+		options:  TaskOptions{MaxAttempts: maxAttempts, RetryDelay: retryDelay, Timeout: notifyTimeout},
+		log:      make(map[ID][]WebhookDelivery),
+	}
+
+	queue.Handle("webhook.deliver", dispatcher.deliver, dispatcher.options)
+
+	return dispatcher
+}
+
+// Subscriber of the event bus
+func (dispatcher *WebhookDispatcher) OnEvent(ctx context.Context, event Event) error {
+	if userEvent, ok := userEventOf(event); ok {
+		dispatcher.Dispatch(userEvent)
+	}
+	return nil
+}
+
+// Queues the event for every webhook subscribed to it
+func (dispatcher *WebhookDispatcher) Dispatch(event UserEvent) {
+	registered, err := dispatcher.webhooks.ListWebhooks()
+	if err != nil {
+		warnf("webhooks for %s: %v", event.Type, err)
+		return
+	}
+
+	for _, webhook := range registered {
+		if !webhook.Wants(event.Type) {
+			continue
+		}
+
+		task, err := NewTask("webhook.deliver", webhookTask{WebhookID: webhook.ID, Event: event})
+		if err == nil {
+			err = dispatcher.queue.Enqueue(task)
+		}
+		if err != nil {
+			warnf("webhook %s: %s event %d dropped: %v", webhook.ID, event.Type, event.ID, err)
+		}
+	}
+}
+
+// Webhooks deleted in the meantime are skipped
+func (dispatcher *WebhookDispatcher) deliver(ctx context.Context, task Task) error {
+	var payload webhookTask
+	if err := task.Decode(&payload); err != nil {
+		return Permanent(err)
+	}
+
+	webhook, err := dispatcher.webhooks.GetWebhook(payload.WebhookID)
+	if err != nil {
+		return nil
+	}
+
+	now := dispatcher.clock.Now()
+	delivery := WebhookDelivery{
+		ID:        newULID(now),
+		WebhookID: webhook.ID,
+		EventID:   payload.Event.ID,
+		Event:     payload.Event.Type,
+		Attempt:   task.Attempt,
+		At:        now.UTC(),
+	}
+
+	// The duration is measured, the clock may be a fake one
+	started := time.Now()
+	status, err := sendWebhook(ctx, webhook, delivery.ID, payload.Event, now)
+	delivery.DurationMS = time.Since(started).Milliseconds()
+	delivery.Status = status
+	delivery.Successful = err == nil
+	if err != nil {
+		delivery.Error = err.Error()
+		if dispatcher.options.Retries(task.Attempt, err) {
+			delivery.NextRetry = delivery.At.Add(dispatcher.options.Backoff(task.Attempt))
+		}
+	}
+
+	dispatcher.record(delivery)
+	return err
+}
+
+func (dispatcher *WebhookDispatcher) record(delivery WebhookDelivery) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	deliveries := append(dispatcher.log[delivery.WebhookID], delivery)
+	if len(deliveries) > webhookLogSize {
+		deliveries = deliveries[len(deliveries)-webhookLogSize:]
+	}
+	dispatcher.log[delivery.WebhookID] = deliveries
+}
+
+// Last deliveries of a webhook, newest first
+func (dispatcher *WebhookDispatcher) Deliveries(webhookID ID) []WebhookDelivery {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	deliveries := slices.Clone(dispatcher.log[webhookID])
+	slices.Reverse(deliveries)
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+	return deliveries
+}
+
+func (dispatcher *WebhookDispatcher) forget(webhookID ID) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	delete(dispatcher.log, webhookID)
+}
+
+// POSTs the event as JSON. The X-Webhook-Signature header is
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>" with the secret>",
+// receivers should reject old timestamps to stop replays.
+func sendWebhook(ctx context.Context, webhook Webhook, deliveryID ID, event UserEvent, now time.Time) (int, error) {
+	body, err := marshalJSON(event, "")
+	if err != nil {
+		return 0, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "golang-api-webhooks")
+	request.Header.Set("X-Webhook-ID", string(deliveryID))
+	request.Header.Set("X-Webhook-Event", event.Type)
+	request.Header.Set("X-Webhook-Signature", "t="+timestamp+",v1="+signWebhook(webhook.Secret, timestamp, body))
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("webhook answered %s", response.Status)
+	}
+
+	return response.StatusCode, nil
+}
+
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return webhookSecretPrefix + base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+func (request CreateWebhookRequest) Validate() error {
+	target, err := url.Parse(request.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return &AppError{Status: http.StatusUnprocessableEntity, Message: "must be an http or https URL", Field: "url"}
+	}
+
+	if len(request.Events) == 0 {
+		return &AppError{Status: http.StatusUnprocessableEntity, Message: "is required, one or more of " + strings.Join(webhookEvents, ", "), Field: "events"}
+	}
+	for _, event := range request.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return &AppError{Status: http.StatusUnprocessableEntity, Message: fmt.Sprintf("unknown event %q, use %s", event, strings.Join(webhookEvents, ", ")), Field: "events"}
+		}
+	}
+
+	if request.Secret != "" && len(request.Secret) < 16 {
+		return &AppError{Status: http.StatusUnprocessableEntity, Message: "must be 16 characters or more", Field: "secret"}
+	}
+
+	return nil
+}
+
+func (app *App) CreateWebhook(ctx context.Context, request CreateWebhookRequest) (CreatedWebhook, error) {
+	secret := request.Secret
+	if secret == "" {
+		var err error
+		if secret, err = newWebhookSecret(); err != nil {
+			return CreatedWebhook{}, err
+		}
+	}
+
+	slices.Sort(request.Events)
+	webhook, err := app.Webhooks.CreateWebhook(Webhook{
+		URL:    request.URL,
+		Events: slices.Compact(request.Events),
+		Secret: secret,
+	})
+	if err != nil {
+		return CreatedWebhook{}, err
+	}
+
+	return CreatedWebhook{Webhook: webhook, Secret: secret}, nil
+}
+
+func (app *App) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	registered, err := app.Webhooks.ListWebhooks()
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, registered)
+}
+
+func (app *App) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, err := app.Webhooks.GetWebhook(ID(PathParam(r, "id")))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, webhook)
+}
+
+// Pending retries of the webhook are skipped when they come up
+func (app *App) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := ID(PathParam(r, "id"))
+	if err := app.Webhooks.DeleteWebhook(id); err != nil {
+		Error(w, err)
+		return
+	}
+	app.Dispatcher.forget(id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Last deliveries of the webhook, newest first, kept in memory until a restart
+func (app *App) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := ID(PathParam(r, "id"))
+	if _, err := app.Webhooks.GetWebhook(id); err != nil {
+		Error(w, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, app.Dispatcher.Deliveries(id))
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait      = 10 * time.Second // Limit of a single write
+	wsPongWait       = 60 * time.Second // A client that answers no ping for this long is gone
+	wsPingInterval   = wsPongWait * 9 / 10
+	wsCloseGrace     = time.Second // Wait for the reply to a close frame
+	wsMaxMessageSize = 64 << 10
+	wsSendBuffer     = 64 // Messages a client may fall behind before it is dropped
+)
+
+var (
+	errWSClosed = errors.New("websocket: connection closed")
+	errWSSlow   = errors.New("websocket: client too slow")
+)
+
+// Runs once the connection is upgraded, the connection closes when it returns
+type WebSocketHandler func(conn *WSConn, r *http.Request)
+
+// An upgraded connection. A reader and a writer goroutine run per connection,
+// the writer sends the pings and the reader takes the pongs. Send and Close
+// may be called from any goroutine.
+type WSConn struct {
+	ws       *websocket.Conn
+	send     chan []byte
+	incoming chan []byte
+	closing  chan struct{} // Close was called, the writer sends the close frame
+	done     chan struct{} // The reader ended, the client is gone
+
+	closeOnce sync.Once
+	closeCode int
+	closeText string
+}
+
+// Keeps the open connections so Shutdown can close them, http.Server.Shutdown
+// does not see hijacked connections
+type WSManager struct {
+	upgrader websocket.Upgrader
+	mutex    sync.Mutex
+	conns    map[*WSConn]bool
+	closed   bool
+	active   sync.WaitGroup
+}
+
+func newWSManager(checkOrigin func(r *http.Request) bool) *WSManager {
+	return &WSManager{
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+			CheckOrigin:     checkOrigin,
+		},
+		conns: make(map[*WSConn]bool),
+	}
+}
+
+// Registers a GET route that upgrades to a WebSocket, the middlewares run
+// before the upgrade so they can still answer with an error
+func (server *Server) WebSocket(path string, handler WebSocketHandler, middlewares ...Middleware) *Route {
+	return server.Handle("GET", path, server.AddMiddleware(server.websockets.upgrade(handler), middlewares...))
+}
+
+// Same origin and origin-less clients are always allowed, others need the CORS rules
+func (server *Server) checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || server.router.cors != nil && server.router.cors.allowOrigin(origin) {
+		return true
+	}
+
+	for _, scheme := range []string{"http://", "https://"} {
+		if origin == scheme+r.Host {
+			return true
+		}
+	}
+	return false
+}
+
+func (manager *WSManager) upgrade(handler WebSocketHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !websocket.IsWebSocketUpgrade(r) {
+			w.Header().Set("Upgrade", "websocket")
+			Error(w, &AppError{Status: http.StatusUpgradeRequired, Message: "connect with a WebSocket client"})
+			return
+		}
+
+		// Refused before the upgrade, the server is going down
+		if manager.isClosed() {
+			Error(w, &AppError{Status: http.StatusServiceUnavailable, Message: "the server is shutting down"})
+			return
+		}
+
+		// The upgrader answers the handshake errors itself
+		ws, err := manager.upgrader.Upgrade(hijacker(w), r, nil)
+		if err != nil {
+			return
+		}
+
+		conn := &WSConn{
+			ws:       ws,
+			send:     make(chan []byte, wsSendBuffer),
+			incoming: make(chan []byte, wsSendBuffer),
+			closing:  make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+		if !manager.add(conn) {
+			ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(wsWriteWait))
+			ws.Close()
+			return
+		}
+
+		go conn.readPump()
+		go conn.writePump(manager)
+
+		handler(conn, r)
+		conn.Close()
+	}
+}
+
+// The writer that can be hijacked, looking through the ones that wrap it
+func hijacker(w http.ResponseWriter) http.ResponseWriter {
+	for {
+		if _, ok := w.(http.Hijacker); ok {
+			return w
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return w // The upgrader answers that it can not hijack
+		}
+		w = unwrapper.Unwrap()
+	}
+}
+
+func (manager *WSManager) add(conn *WSConn) bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if manager.closed {
+		return false
+	}
+	manager.conns[conn] = true
+	manager.active.Add(1)
+	return true
+}
+
+func (manager *WSManager) remove(conn *WSConn) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if manager.conns[conn] {
+		delete(manager.conns, conn)
+		manager.active.Done()
+	}
+}
+
+func (manager *WSManager) isClosed() bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return manager.closed
+}
+
+// Open connections
+func (manager *WSManager) Count() int {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return len(manager.conns)
+}
+
+// Refuses new connections and sends a going away close frame to the open ones
+func (manager *WSManager) Close() {
+	manager.mutex.Lock()
+	manager.closed = true
+	conns := make([]*WSConn, 0, len(manager.conns))
+	for conn := range manager.conns {
+		conns = append(conns, conn)
+	}
+	manager.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.close(websocket.CloseGoingAway, "server shutting down")
+	}
+}
+
+// Waits for the connections to end, the ones still open when ctx is done are cut
+func (manager *WSManager) Wait(ctx context.Context) error {
+	ended := make(chan struct{})
+	go func() {
+		manager.active.Wait()
+		close(ended)
+	}()
+
+	select {
+	case <-ended:
+		return nil
+	case <-ctx.Done():
+		manager.mutex.Lock()
+		for conn := range manager.conns {
+			conn.ws.Close()
+		}
+		manager.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Queues v as a JSON text message. A client whose queue is full is
+// disconnected instead of slowing the sender down.
+func (conn *WSConn) Send(v interface{}) error {
+	body, err := marshalJSON(v, "")
+	if err != nil {
+		return err
+	}
+	body = bytes.TrimSuffix(body, []byte("\n"))
+
+	select {
+	case <-conn.closing:
+		return errWSClosed
+	case <-conn.done:
+		return errWSClosed
+	default:
+	}
+
+	select {
+	case conn.send <- body:
+		return nil
+	default:
+		conn.close(websocket.ClosePolicyViolation, "too slow")
+		return errWSSlow
+	}
+}
+
+// Messages sent by the client
+func (conn *WSConn) Messages() <-chan []byte {
+	return conn.incoming
+}
+
+// Closed once the connection is gone
+func (conn *WSConn) Done() <-chan struct{} {
+	return conn.done
+}
+
+// Normal closure, the queued messages are sent first
+func (conn *WSConn) Close() {
+	conn.close(websocket.CloseNormalClosure, "")
+}
+
+func (conn *WSConn) close(code int, text string) {
+	conn.closeOnce.Do(func() {
+		conn.closeCode = code
+		conn.closeText = text
+		close(conn.closing)
+	})
+}
+
+// Takes the client messages and the pongs, ends on a close frame or when
+// no pong came in time
+func (conn *WSConn) readPump() {
+	defer close(conn.done)
+
+	conn.ws.SetReadLimit(wsMaxMessageSize)
+	conn.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.ws.SetPongHandler(func(string) error {
+		return conn.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, message, err := conn.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				warnf("websocket: %v", err)
+			}
+			return
+		}
+
+		// Left out when the handler does not read them, or once closing
+		select {
+		case conn.incoming <- message:
+		case <-conn.closing:
+		default:
+		}
+	}
+}
+
+// The only goroutine writing to the connection, besides the close replies
+// of the reader
+func (conn *WSConn) writePump(manager *WSManager) {
+	ping := time.NewTicker(wsPingInterval)
+	defer func() {
+		ping.Stop()
+		conn.ws.Close()
+		manager.remove(conn)
+	}()
+
+	for {
+		select {
+		case message := <-conn.send:
+			conn.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-conn.closing:
+			conn.flush()
+			conn.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(conn.closeCode, conn.closeText), time.Now().Add(wsWriteWait))
+
+			// The client answers with its own close frame, which ends the reader
+			select {
+			case <-conn.done:
+			case <-time.After(wsCloseGrace):
+			}
+			return
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+// Sends what is still queued, not for clients dropped as too slow
+func (conn *WSConn) flush() {
+	if conn.closeCode == websocket.ClosePolicyViolation {
+		return
+	}
+
+	for {
+		select {
+		case message := <-conn.send:
+			conn.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// GET /api/ws, the user events of GET /api/events over a WebSocket
+func (app *App) UserEventsSocket(conn *WSConn, r *http.Request) {
+	events, _, cancel := app.Events.Subscribe(0)
+	defer cancel()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := conn.Send(event); err != nil {
+				return
+			}
+		case <-conn.Messages():
+			// Nothing to answer, clients only listen
+		case <-conn.Done():
+			return
+		case <-app.Events.closed:
+			return
+		}
+	}
+}
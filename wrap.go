@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+)
+
+// Requests with their own checks besides the validate tags, e.g. User
+type validatable interface {
+	Validate() error
+}
+
+// Requests checking the caller can make them, before the body is decoded and
+// validated so that callers without the permission get a 403 whatever they sent
+type authorizer interface {
+	Authorize(ctx context.Context) error
+}
+
+// Adapts a handler of a typed request and response, see WrapStatus. Answers 200.
+func Wrap[Req, Resp any](handler func(ctx context.Context, request Req) (Resp, error)) http.HandlerFunc {
+	return WrapStatus(http.StatusOK, handler)
+}
+
+// Adapts a handler of a typed request and response:
+//   - the path, query and header fields of a struct Req are bound, see Bind
+//   - Req is authorized by its Authorize method, when it has one
+//   - the body, when there is one, is decoded into Req with DecodeBody
+//   - Req is validated by its validate tags and its Validate method
+//   - the response is sent in the envelope with status, errors with Error.
+//     Responses with an ETag method, e.g. User, send it as the ETag header.
+//
+// The user and the rest of the request context are in ctx, e.g. contextUser(ctx).
+func WrapStatus[Req, Resp any](status int, handler func(ctx context.Context, request Req) (Resp, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request Req
+		isStruct := reflect.TypeOf(request) != nil && reflect.TypeOf(request).Kind() == reflect.Struct
+		if isStruct {
+			if err := bindParams(r, &request); err != nil {
+				Error(w, err)
+				return
+			}
+		}
+		if request, ok := any(&request).(authorizer); ok {
+			if err := request.Authorize(r.Context()); err != nil {
+				Error(w, err)
+				return
+			}
+		}
+
+		if r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody {
+			if err := DecodeBody(r, &request); err != nil {
+				Error(w, err)
+				return
+			}
+		}
+
+		if isStruct {
+			if err := validateStruct(&request); err != nil {
+				Error(w, ErrValidation(err))
+				return
+			}
+		}
+		if request, ok := any(&request).(validatable); ok {
+			if err := request.Validate(); err != nil {
+				if validationErrors(err) != nil {
+					recordValidationFailure(r, err)
+				}
+				Error(w, err)
+				return
+			}
+		}
+
+		response, err := handler(r.Context(), request)
+		if err != nil {
+			Error(w, err)
+			return
+		}
+
+		if tagged, ok := any(response).(interface{ ETag() string }); ok {
+			w.Header().Set("ETag", tagged.ETag())
+		}
+		JSON(w, status, response)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// <response><success>true</success><data>...</data></response>, data can be
+// anything so it is written by xmlValue
+func (response APIResponse) MarshalXML(encoder *xml.Encoder, start xml.StartElement) error {
+	start.Name.Local = "response"
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+
+	if err := encoder.EncodeElement(response.Success, xmlElement("success")); err != nil {
+		return err
+	}
+
+	if response.Data != nil {
+		if err := encoder.EncodeElement(xmlValue{response.Data}, xmlElement("data")); err != nil {
+			return err
+		}
+	}
+
+	if response.Error != nil {
+		if err := encoder.EncodeElement(response.Error, xmlElement("error")); err != nil {
+			return err
+		}
+	}
+
+	if len(response.Links) > 0 {
+		if err := encoder.EncodeElement(response.Links, xmlElement("links")); err != nil {
+			return err
+		}
+	}
+
+	return encoder.EncodeToken(start.End())
+}
+
+// <links><link rel="self" href="/api/users/1"></link></links>, sorted by relation
+func (links Links) MarshalXML(encoder *xml.Encoder, start xml.StartElement) error {
+	relations := make([]string, 0, len(links))
+	for relation := range links {
+		relations = append(relations, relation)
+	}
+	sort.Strings(relations)
+
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, relation := range relations {
+		link := xmlElement("link")
+		link.Attr = []xml.Attr{{Name: xml.Name{Local: "rel"}, Value: relation}, {Name: xml.Name{Local: "href"}, Value: links[relation]}}
+		if err := encoder.EncodeToken(link); err != nil {
+			return err
+		}
+		if err := encoder.EncodeToken(link.End()); err != nil {
+			return err
+		}
+	}
+	return encoder.EncodeToken(start.End())
+}
+
+// XML has no omitzero, unset timestamps and empty attributes are left out here.
+// The shallower fields of the anonymous struct replace the ones of plainUser.
+func (user User) MarshalXML(encoder *xml.Encoder, start xml.StartElement) error {
+	type plainUser User // Without this method
+
+	// Items of a list are named after the type, <user> reads better
+	if start.Name.Local == "User" {
+		start.Name.Local = "user"
+	}
+
+	optional := func(at time.Time) *time.Time {
+		if at.IsZero() {
+			return nil
+		}
+		return &at
+	}
+
+	var attributes *xmlValue
+	if len(user.Attributes) > 0 {
+		attributes = &xmlValue{user.Attributes}
+	}
+
+	return encoder.EncodeElement(struct {
+		*plainUser
+		CreatedAt  *time.Time `xml:"created_at,omitempty"`
+		UpdatedAt  *time.Time `xml:"updated_at,omitempty"`
+		DeletedAt  *time.Time `xml:"deleted_at,omitempty"`
+		Attributes *xmlValue  `xml:"attributes,omitempty"`
+	}{(*plainUser)(&user), optional(user.CreatedAt), optional(user.UpdatedAt), optional(user.DeletedAt), attributes}, start)
+}
+
+// Writes values of types without xml tags with the names they have in JSON:
+// objects become elements per key and arrays an <item> per element
+type xmlValue struct {
+	value interface{}
+}
+
+func (wrapped xmlValue) MarshalXML(encoder *xml.Encoder, start xml.StartElement) error {
+	if hasXMLTags(reflect.TypeOf(wrapped.value)) {
+		return encoder.EncodeElement(wrapped.value, start)
+	}
+
+	// Lists of tagged types, e.g. []User, keep their element names
+	if items := reflect.ValueOf(wrapped.value); items.Kind() == reflect.Slice && hasXMLTags(items.Type().Elem()) {
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+		for i := 0; i < items.Len(); i++ {
+			if err := encoder.Encode(items.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return encoder.EncodeToken(start.End())
+	}
+
+	data, err := json.Marshal(wrapped.value)
+	if err != nil {
+		return err
+	}
+
+	var document interface{}
+	if err := decodeNumbers(data, &document); err != nil {
+		return err
+	}
+
+	return encodeXMLDocument(encoder, start, document)
+}
+
+func encodeXMLDocument(encoder *xml.Encoder, start xml.StartElement, document interface{}) error {
+	switch value := document.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := encodeXMLDocument(encoder, xmlElement(key), value[key]); err != nil {
+				return err
+			}
+		}
+		return encoder.EncodeToken(start.End())
+	case []interface{}:
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, item := range value {
+			if err := encodeXMLDocument(encoder, xmlElement("item"), item); err != nil {
+				return err
+			}
+		}
+		return encoder.EncodeToken(start.End())
+	default:
+		return encoder.EncodeElement(value, start)
+	}
+}
+
+// Types that know how to be written as XML
+func hasXMLTags(t reflect.Type) bool {
+	if t == nil {
+		return false
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Implements(reflect.TypeOf((*xml.Marshaler)(nil)).Elem()) {
+		return true
+	}
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	_, named := t.FieldByName("XMLName")
+	return named
+}
+
+func encodeXML(buffer *bytes.Buffer, response APIResponse) error {
+	buffer.WriteString(xml.Header)
+	return xml.NewEncoder(buffer).Encode(response)
+}
+
+func indentXML(buffer *bytes.Buffer, response APIResponse) error {
+	buffer.WriteString(xml.Header)
+	encoder := xml.NewEncoder(buffer)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(response); err != nil {
+		return err
+	}
+	return buffer.WriteByte('\n')
+}
+
+func xmlElement(name string) xml.StartElement {
+	return xml.StartElement{Name: xml.Name{Local: name}}
+}